@@ -1,49 +1,124 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/mempool"
+	"github.com/fkapsahili/mini-blockchain/internal/miner"
+	"github.com/fkapsahili/mini-blockchain/internal/p2p"
+	"github.com/fkapsahili/mini-blockchain/internal/rpc"
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
 	"github.com/fkapsahili/mini-blockchain/internal/types"
 )
 
 var (
-	dataDir string
-	port    uint
-	chain   *blockchain.Chain
+	dataDir     string
+	network     string
+	port        uint
+	rpcURL      string
+	rpcUser     string
+	rpcPassword string
+	jsonOutput  bool
 )
 
 func main() {
 	flag.StringVar(&dataDir, "datadir", "./data", "Data directory for blockchain")
-	flag.UintVar(&port, "port", 8333, "Port for P2P communication")
+	flag.StringVar(&network, "network", "mainnet", "Network to use (mainnet, testnet, regtest)")
+	flag.UintVar(&port, "port", 0, "Port for P2P communication (0 uses the network's default port)")
+	flag.StringVar(&rpcURL, "rpc", "", "JSON-RPC URL of a running node to send status, block, createblock, bans and estimatefee to instead of opening the data directory")
+	flag.StringVar(&rpcUser, "rpcuser", "", "User name of the JSON-RPC server, with --rpcpassword")
+	flag.StringVar(&rpcPassword, "rpcpassword", "", "Password of the JSON-RPC server (defaults to random credentials in the data directory's "+rpc.CookieFile+" file)")
+	flag.BoolVar(&jsonOutput, "json", false, "Print the output of status, block, createblock and estimatefee as JSON")
 
 	startCmd := flag.NewFlagSet("start", flag.ExitOnError)
 	createBlockCmd := flag.NewFlagSet("createBlock", flag.ExitOnError)
 	statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
 	blockCmd := flag.NewFlagSet("block", flag.ExitOnError)
+	bansCmd := flag.NewFlagSet("bans", flag.ExitOnError)
+	estimateFeeCmd := flag.NewFlagSet("estimatefee", flag.ExitOnError)
 
-	if len(os.Args) < 2 {
+	var start startOptions
+	startCmd.Var(&start.connect, "connect", "Peer address to keep connected to, may be repeated")
+	startCmd.Var(&start.seeds, "seed", "Peer address to learn other peers from, may be repeated")
+	startCmd.BoolVar(&start.mine, "mine", false, "Mine blocks on the tip of the chain")
+	startCmd.IntVar(&start.threads, "threads", 0, "Number of mining threads (0 uses all CPUs)")
+	startCmd.StringVar(&start.address, "address", "", "Hex address receiving block rewards when mining")
+	startCmd.IntVar(&start.banScore, "banscore", p2p.DefaultBanThreshold, "Misbehavior score at which a peer is banned")
+	startCmd.DurationVar(&start.banDuration, "banduration", p2p.DefaultBanDuration, "How long misbehaving peers stay banned")
+	startCmd.StringVar(&start.rpcListen, "rpclisten", "", "Address of the JSON-RPC server (defaults to the network's RPC port on localhost)")
+	startCmd.BoolVar(&start.noRPC, "norpc", false, "Disable the JSON-RPC server")
+	startCmd.IntVar(&start.maxMempool, "maxmempool", mempool.DefaultMaxSize>>20, "Size limit of the transaction pool in MB")
+	startCmd.DurationVar(&start.mempoolExpiry, "mempoolexpiry", mempool.DefaultExpiry, "How long unconfirmed transactions stay in the pool")
+	startCmd.BoolVar(&start.mempoolReplacement, "mempoolreplacement", false, "Let transactions paying higher fees replace pooled ones spending the same outputs")
+
+	threads := createBlockCmd.Int("threads", 0, "Number of mining threads (0 uses all CPUs)")
+	address := createBlockCmd.String("address", "", "Hex address receiving the block reward")
+
+	estimateMode := estimateFeeCmd.String("mode", mempool.EstimateConservative.String(), "Estimate mode (conservative, economical)")
+
+	flag.Usage = printUsage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "start":
-		startCmd.Parse(os.Args[2:])
-		handleStart()
+		startCmd.Parse(args[1:])
+		handleStart(start)
 	case "createblock":
-		createBlockCmd.Parse(os.Args[2:])
-		handleCreateBlock()
+		createBlockCmd.Parse(args[1:])
+		if rpcURL != "" {
+			handleRemoteCreateBlock(*address)
+		} else {
+			handleCreateBlock(*threads, *address)
+		}
 	case "status":
-		statusCmd.Parse(os.Args[2:])
-		handleStatus()
+		statusCmd.Parse(args[1:])
+		if rpcURL != "" {
+			handleRemoteStatus()
+		} else {
+			handleStatus()
+		}
 	case "block":
-		blockCmd.Parse(os.Args[2:])
-		handleBlock(blockCmd)
+		blockCmd.Parse(args[1:])
+		if rpcURL != "" {
+			handleRemoteBlock(blockCmd)
+		} else {
+			handleBlock(blockCmd)
+		}
+	case "bans":
+		bansCmd.Parse(args[1:])
+		if rpcURL != "" {
+			handleRemoteBans(bansCmd)
+		} else {
+			handleBans(bansCmd)
+		}
+	case "estimatefee":
+		estimateFeeCmd.Parse(args[1:])
+		if rpcURL != "" {
+			handleRemoteEstimateFee(estimateFeeCmd, *estimateMode)
+		} else {
+			handleEstimateFee(estimateFeeCmd, *estimateMode)
+		}
 	default:
 		printUsage()
 		os.Exit(1)
@@ -52,110 +127,580 @@ func main() {
 
 func printUsage() {
 	fmt.Println("Usage:")
-	fmt.Println("  node [--datadir <dir>] [--port <port>] <command>")
+	fmt.Println("  node [--datadir <dir>] [--network <name>] [--port <port>] [--rpc <url>] [--rpcuser <user> --rpcpassword <password>] [--json] <command>")
 	fmt.Println("\nCommands:")
-	fmt.Println("  start        Start the blockchain node")
+	fmt.Println("  start        Start the blockchain node [-connect <host:port>]... [-seed <host:port>]... [-mine] [-rpclisten <host:port>]")
 	fmt.Println("  createblock  Create a new block")
 	fmt.Println("  status       Show blockchain status")
-	fmt.Println("  block        Show block information")
+	fmt.Println("  block        Show block information by height or hash")
+	fmt.Println("  bans         List banned peers, or lift bans with: bans clear [host]")
+	fmt.Println("  estimatefee  Estimate the fee rate to confirm within a number of blocks [-mode conservative|economical] <blocks>")
 }
 
-func handleStart() {
-	var err error
-	chain, err := blockchain.NewChain(dataDir)
+// openChain opens the chain in the data directory or exits on failure.
+// Read-only commands share the datadir lock, writers need it exclusively.
+func openChain(readOnly bool) *blockchain.Chain {
+	chain, err := tryOpenChain(readOnly)
 	if err != nil {
-		fmt.Printf("Failed to initialize blockchain: %v\n", err)
+		fmt.Printf("Failed to open blockchain: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("Blockchain initialized at height %d\n", chain.GetHeight())
+	return chain
+}
 
-	fmt.Println("Node is running. Press Ctrl+C to stop.")
-	select {} // Keep running for now
+// tryOpenChain opens the chain in the data directory, it exits only for an
+// invalid network
+func tryOpenChain(readOnly bool) (*blockchain.Chain, error) {
+	params, err := chaincfg.ParamsForName(network)
+	if err != nil {
+		fmt.Printf("Invalid network: %v\n", err)
+		os.Exit(1)
+	}
+
+	return blockchain.OpenChain(dataDir, blockchain.Options{
+		ReadOnly: readOnly,
+		Params:   params,
+	})
+}
+
+// addrList collects the values of a repeatable flag
+type addrList []string
+
+func (l *addrList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *addrList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// startOptions holds the flags of the start command
+type startOptions struct {
+	connect     addrList
+	seeds       addrList
+	mine        bool
+	threads     int
+	address     string
+	banScore    int
+	banDuration time.Duration
+	rpcListen   string
+	noRPC       bool
+
+	maxMempool         int
+	mempoolExpiry      time.Duration
+	mempoolReplacement bool
 }
 
-func handleCreateBlock() {
-	if chain == nil {
-		fmt.Println("Blockchain not initialized. Please start the node first.")
+func handleStart(opts startOptions) {
+	var payTo []byte
+	if opts.mine {
+		payTo = parseAddress(opts.address)
+	}
+
+	chain := openChain(false)
+	defer chain.Close()
+
+	fmt.Printf("Blockchain initialized at height %d\n", chain.GetHeight())
+
+	if port > 65535 {
+		fmt.Printf("Invalid port: %d\n", port)
+		os.Exit(1)
+	}
+	listenPort := uint16(port)
+	if port == 0 {
+		listenPort = chain.Params().DefaultPort
+	}
+
+	addrs, err := p2p.OpenAddrManager(dataDir)
+	if err != nil {
+		fmt.Printf("Failed to open peer database: %v\n", err)
 		return
 	}
 
-	latestBlock, err := chain.GetLatestBlock()
+	bans, err := p2p.OpenBanList(dataDir)
 	if err != nil {
-		fmt.Printf("Failed to get latest block: %v\n", err)
+		fmt.Printf("Failed to open ban list: %v\n", err)
 		return
 	}
 
-	newBlock := &types.Block{
-		Header: types.BlockHeader{
-			Version:       1,
-			PrevBlockHash: latestBlock.Hash,
-			Timestamp:     time.Now(),
-			Difficulty:    1, // Simple difficulty for now
-			Nonce:         0, // Should be calculated with proper PoW
+	estimator, err := mempool.OpenFeeEstimator(dataDir, chain)
+	if err != nil {
+		fmt.Printf("Failed to open fee estimator: %v\n", err)
+		return
+	}
+	defer func() {
+		if err := estimator.Close(); err != nil {
+			fmt.Printf("Failed to save fee estimates: %v\n", err)
+		}
+	}()
+
+	// The RPC server is created before anything is started, so the pool
+	// can publish accepted transactions to it
+	var rpcServer *rpc.Server
+	pool, err := mempool.New(mempool.Config{
+		Chain:        chain,
+		MaxSize:      opts.maxMempool << 20,
+		Expiry:       opts.mempoolExpiry,
+		ReplaceByFee: opts.mempoolReplacement,
+		FeeEstimator: estimator,
+		OnAccept: func(tx *types.Transaction) {
+			if rpcServer != nil {
+				rpcServer.NotifyTransaction(tx)
+			}
 		},
-		Transactions: []types.Transaction{}, // Empty transactions for now
-		Height:       latestBlock.Height + 1,
+	})
+	if err != nil {
+		fmt.Printf("Failed to create transaction pool: %v\n", err)
+		return
 	}
+	defer pool.Close()
 
-	// TODO: Calculate proper hash
-	// For now, just use a dummy hash
-	newBlock.Hash = [32]byte{} // This should be properly calculated
+	// Transactions saved at the last shutdown are revalidated against the
+	// current tip, the pool is saved again once everything else stopped
+	restored, err := pool.Load(dataDir)
+	if err != nil {
+		fmt.Printf("Failed to restore unconfirmed transactions: %v\n", err)
+	} else if len(restored) > 0 {
+		fmt.Printf("Restored %d unconfirmed transactions\n", len(restored))
+	}
+	defer func() {
+		if err := pool.Save(dataDir); err != nil {
+			fmt.Printf("Failed to save unconfirmed transactions: %v\n", err)
+		}
+	}()
+
+	templates, err := miner.NewTemplateGenerator(miner.TemplateConfig{Chain: chain, TxSource: pool})
+	if err != nil {
+		fmt.Printf("Failed to create block template generator: %v\n", err)
+		return
+	}
 
-	if err := chain.AddBlock(newBlock); err != nil {
-		fmt.Printf("Failed to add block: %v\n", err)
+	server, err := p2p.NewServer(p2p.Config{
+		Params:       chain.Params(),
+		ListenAddr:   net.JoinHostPort("", strconv.Itoa(int(listenPort))),
+		Chain:        chain,
+		TxPool:       pool,
+		AddrManager:  addrs,
+		Seeds:        opts.seeds,
+		BanList:      bans,
+		BanThreshold: opts.banScore,
+		BanDuration:  opts.banDuration,
+	})
+	if err != nil {
+		fmt.Printf("Failed to create P2P server: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Created new block at height %d\n", newBlock.Height)
+	if !opts.noRPC {
+		rpcListen := opts.rpcListen
+		if rpcListen == "" {
+			rpcListen = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(chain.Params().DefaultRPCPort)))
+		}
+		// Without a configured password local clients read the credentials
+		// written for this run from the data directory
+		user, password := rpcUser, rpcPassword
+		if password == "" {
+			user, password, err = rpc.WriteCookie(dataDir)
+			if err != nil {
+				fmt.Printf("Failed to create RPC credentials: %v\n", err)
+				return
+			}
+			defer rpc.RemoveCookie(dataDir)
+		}
+		rpcServer, err = rpc.NewServer(rpc.Config{
+			ListenAddr:   rpcListen,
+			Username:     user,
+			Password:     password,
+			Chain:        chain,
+			TxPool:       pool,
+			Peers:        server,
+			FeeEstimator: estimator,
+			Templates:    templates,
+			Generate: func(ctx context.Context, payTo []byte) (*types.Block, error) {
+				block, _, err := generateBlock(ctx, chain, templates, opts.threads, payTo)
+				return block, err
+			},
+		})
+		if err != nil {
+			fmt.Printf("Failed to create RPC server: %v\n", err)
+			return
+		}
+	}
+
+	if err := server.Start(); err != nil {
+		fmt.Printf("Failed to start P2P server: %v\n", err)
+		return
+	}
+	defer server.Stop()
+
+	for _, addr := range opts.connect {
+		if err := server.Connect(addr); err != nil {
+			fmt.Printf("Failed to connect to %s: %v\n", addr, err)
+		}
+	}
+
+	fmt.Printf("Listening for peers on %s\n", server.Addr())
+
+	if rpcServer != nil {
+		if err := rpcServer.Start(); err != nil {
+			fmt.Printf("Failed to start RPC server: %v\n", err)
+			return
+		}
+		defer rpcServer.Stop()
+		fmt.Printf("Serving JSON-RPC on %s\n", rpcServer.Addr())
+	}
+
+	fmt.Println("Node is running. Press Ctrl+C to stop.")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var workers sync.WaitGroup
+	if len(restored) > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			announceRestored(ctx, server, restored)
+		}()
+	}
+	if opts.mine {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			mineLoop(ctx, chain, templates, opts.threads, payTo)
+		}()
+	}
+
+	<-ctx.Done()
+	fmt.Println("Shutting down")
+	workers.Wait()
+}
+
+// announceRestored announces the transactions restored from the saved pool
+// once the first peers completed the handshake, so they are relayed again
+// after a restart
+func announceRestored(ctx context.Context, server *p2p.Server, restored []*mempool.TxDesc) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for len(server.Peers()) == 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+	for _, desc := range restored {
+		server.AnnounceTransaction(desc.Tx.Hash)
+	}
+}
+
+// parseAddress decodes a hex address, an empty address leaves block
+// rewards unspendable
+func parseAddress(address string) []byte {
+	payTo, err := hex.DecodeString(address)
+	if err != nil || (address != "" && len(payTo) != crypto.AddressLen) {
+		fmt.Printf("Invalid address: expected %d hex characters\n", 2*crypto.AddressLen)
+		os.Exit(1)
+	}
+	if address == "" {
+		fmt.Fprintln(os.Stderr, "No --address given, the block reward will be unspendable")
+	}
+	return payTo
+}
+
+// mineLoop mines blocks on the tip of the chain until ctx is cancelled. The
+// current attempt is abandoned whenever the tip changes.
+func mineLoop(ctx context.Context, chain *blockchain.Chain, templates *miner.TemplateGenerator, threads int, payTo []byte) {
+	tipChanged := make(chan struct{}, 1)
+	sub := chain.Observe(blockchain.ObserverFuncs{OnTipChanged: func(*types.Block) {
+		select {
+		case tipChanged <- struct{}{}:
+		default:
+		}
+	}}, blockchain.SubscribeOptions{})
+	defer sub.Cancel()
+
+	m := miner.New(miner.Config{Threads: threads})
+	for ctx.Err() == nil {
+		// Drop tip changes from before this template
+		select {
+		case <-tipChanged:
+		default:
+		}
+
+		template, err := templates.NewBlockTemplate(payTo)
+		if err != nil {
+			fmt.Printf("Mining stopped: %v\n", err)
+			return
+		}
+		block := template.Block
+
+		attemptCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-tipChanged:
+				cancel()
+			case <-attemptCtx.Done():
+			}
+		}()
+		_, err = m.Solve(attemptCtx, block)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		if err := chain.AddBlock(block); err != nil {
+			fmt.Printf("Mined block rejected: %v\n", err)
+			continue
+		}
+		fmt.Printf("Mined block %x at height %d\n", block.Hash, block.Height)
+
+		// Without retargeting nothing else paces the miner
+		if chain.Params().RetargetMode == chaincfg.RetargetNone {
+			select {
+			case <-time.After(chain.Params().TargetBlockTime):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// generateBlock mines a template on the tip of the chain paying to payTo
+// and adds it to the chain
+func generateBlock(ctx context.Context, chain *blockchain.Chain, templates *miner.TemplateGenerator, threads int, payTo []byte) (*types.Block, *miner.Result, error) {
+	template, err := templates.NewBlockTemplate(payTo)
+	if err != nil {
+		return nil, nil, err
+	}
+	block := template.Block
+
+	result, err := miner.New(miner.Config{Threads: threads}).Solve(ctx, block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mining aborted: %w", err)
+	}
+
+	if err := chain.AddBlock(block); err != nil {
+		return nil, nil, fmt.Errorf("failed to add block: %w", err)
+	}
+	return block, result, nil
+}
+
+func handleCreateBlock(threads int, address string) {
+	payTo := parseAddress(address)
+
+	chain := openChain(false)
+	defer chain.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Without a running node there are no transactions to include
+	templates, err := miner.NewTemplateGenerator(miner.TemplateConfig{Chain: chain})
+	if err != nil {
+		fmt.Printf("Failed to create block: %v\n", err)
+		os.Exit(1)
+	}
+
+	block, result, err := generateBlock(ctx, chain, templates, threads, payTo)
+	if err != nil {
+		fmt.Printf("Failed to create block: %v\n", err)
+		os.Exit(1)
+	}
+
+	created := rpc.NewBlockResult(chain, block)
+	if jsonOutput {
+		printJSON(created)
+		return
+	}
+	printCreatedBlock(created)
+	fmt.Printf("Mined in %v (%d hashes, %.0f H/s)\n", result.Elapsed.Round(time.Millisecond), result.Hashes, result.HashRate())
 }
 
 func handleStatus() {
-	if chain == nil {
-		fmt.Println("Blockchain not initialized. Please start the node first.")
+	chain, err := tryOpenChain(true)
+	if errors.Is(err, storage.ErrLocked) {
+		// A running node holds the chain, it reports its progress instead
+		handleLocalNodeStatus()
 		return
 	}
+	if err != nil {
+		fmt.Printf("Failed to open blockchain: %v\n", err)
+		os.Exit(1)
+	}
+	defer chain.Close()
 
-	height := chain.GetHeight()
 	latestBlock, err := chain.GetLatestBlock()
 	if err != nil {
 		fmt.Printf("Failed to get latest block: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
-	fmt.Printf("Current Height: %d\n", height)
-	fmt.Printf("Latest Block Hash: %x\n", latestBlock.Hash)
-	fmt.Printf("Latest Block Time: %v\n", latestBlock.Header.Timestamp)
-	fmt.Printf("Number of Transactions: %d\n", len(latestBlock.Transactions))
+	printStatus(&statusResult{
+		Height:        chain.GetHeight(),
+		BestBlockHash: hex.EncodeToString(latestBlock.Hash[:]),
+		Time:          latestBlock.Header.Timestamp,
+		Transactions:  len(latestBlock.Transactions),
+	})
 }
 
 func handleBlock(cmd *flag.FlagSet) {
-	if chain == nil {
-		fmt.Println("Blockchain not initialized. Please start the node first.")
-		return
+	if cmd.NArg() < 1 {
+		fmt.Println("Please provide block height or hash")
+		os.Exit(1)
 	}
 
+	chain := openChain(true)
+	defer chain.Close()
+
+	var block *types.Block
+	var err error
+	if height, parseErr := strconv.ParseUint(cmd.Arg(0), 10, 64); parseErr == nil {
+		block, err = chain.GetBlock(height)
+	} else {
+		var hash []byte
+		hash, err = hex.DecodeString(cmd.Arg(0))
+		if err != nil || len(hash) != 32 {
+			fmt.Println("Invalid block: expected a height or a 64 character hash")
+			os.Exit(1)
+		}
+		block, err = chain.GetBlockByHash([32]byte(hash))
+	}
+	if err != nil {
+		fmt.Printf("Failed to get block: %v\n", err)
+		os.Exit(1)
+	}
+
+	printBlock(rpc.NewBlockResult(chain, block))
+}
+
+// parseConfirmTarget returns the block count argument of estimatefee or
+// exits
+func parseConfirmTarget(cmd *flag.FlagSet) int {
 	if cmd.NArg() < 1 {
-		fmt.Println("Please provide block height")
+		fmt.Println("Please provide the number of blocks to confirm within")
+		os.Exit(1)
+	}
+	target, err := strconv.Atoi(cmd.Arg(0))
+	if err != nil || target < 1 {
+		fmt.Printf("Invalid number of blocks: %s\n", cmd.Arg(0))
 		os.Exit(1)
 	}
+	return target
+}
 
-	height, err := strconv.ParseUint(cmd.Arg(0), 10, 64)
+// handleEstimateFee estimates from the statistics a stopped node saved
+func handleEstimateFee(cmd *flag.FlagSet, modeName string) {
+	target := parseConfirmTarget(cmd)
+	mode, err := mempool.ParseEstimateMode(modeName)
 	if err != nil {
-		fmt.Printf("Invalid height: %v\n", err)
-		return
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	block, err := chain.GetBlock(height)
+	chain, err := tryOpenChain(true)
+	if errors.Is(err, storage.ErrLocked) {
+		fmt.Println("A running node holds the data directory, ask it with --rpc")
+		os.Exit(1)
+	}
 	if err != nil {
-		fmt.Printf("Failed to get block: %v\n", err)
-		return
+		fmt.Printf("Failed to open blockchain: %v\n", err)
+		os.Exit(1)
 	}
+	defer chain.Close()
 
-	fmt.Printf("Block Height: %d\n", block.Height)
-	fmt.Printf("Block Hash: %x\n", block.Hash)
-	fmt.Printf("Previous Block Hash: %x\n", block.Header.PrevBlockHash)
-	fmt.Printf("Timestamp: %v\n", block.Header.Timestamp)
-	fmt.Printf("Difficulty: %d\n", block.Header.Difficulty)
-	fmt.Printf("Nonce: %d\n", block.Header.Nonce)
-	fmt.Printf("Number of Transactions: %d\n", len(block.Transactions))
+	// The estimator isn't closed, that would rewrite the statistics of a
+	// read-only command
+	estimator, err := mempool.OpenFeeEstimator(dataDir, chain)
+	if err != nil {
+		fmt.Printf("Failed to open fee estimator: %v\n", err)
+		os.Exit(1)
+	}
+	rate, err := estimator.EstimateFee(target, mode)
+	if err != nil {
+		fmt.Printf("Failed to estimate fee: %v\n", err)
+		os.Exit(1)
+	}
+	printFeeEstimate(&rpc.FeeEstimateResult{
+		FeeRate: uint64(rate),
+		Blocks:  min(target, mempool.MaxConfirmTarget),
+		Mode:    mode.String(),
+	})
+}
+
+// handleBans lists the banned peers, or with "clear" lifts the ban of a
+// host or all bans. The ban list is replaced atomically, so it can be
+// listed while a node runs, but a running node clears its bans over --rpc.
+func handleBans(cmd *flag.FlagSet) {
+	switch cmd.Arg(0) {
+	case "", "list":
+		bans, err := p2p.OpenBanList(dataDir)
+		if err != nil {
+			fmt.Printf("Failed to open ban list: %v\n", err)
+			os.Exit(1)
+		}
+		list := bans.List()
+		results := make([]rpc.BanResult, len(list))
+		for i, ban := range list {
+			results[i] = rpc.BanResult{
+				Address:     ban.Host,
+				Reason:      ban.Reason,
+				BanCreated:  ban.Created,
+				BannedUntil: ban.Until,
+			}
+		}
+		printBans(results)
+
+	case "clear":
+		lock, err := storage.LockDir(dataDir, true)
+		if errors.Is(err, storage.ErrLocked) {
+			fmt.Println("A running node holds the data directory, clear its bans with --rpc")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Printf("Failed to lock data directory: %v\n", err)
+			os.Exit(1)
+		}
+		defer lock.Unlock()
+
+		bans, err := p2p.OpenBanList(dataDir)
+		if err != nil {
+			fmt.Printf("Failed to open ban list: %v\n", err)
+			os.Exit(1)
+		}
+		if host := cmd.Arg(1); host != "" {
+			ok, err := bans.Unban(host)
+			if err != nil {
+				fmt.Printf("Failed to save ban list: %v\n", err)
+				os.Exit(1)
+			}
+			if !ok {
+				fmt.Printf("%s is not banned\n", host)
+				return
+			}
+			fmt.Printf("Unbanned %s\n", host)
+			return
+		}
+		if err := bans.Clear(); err != nil {
+			fmt.Printf("Failed to save ban list: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Cleared all bans")
+
+	default:
+		fmt.Printf("Unknown bans command %q, want list or clear\n", cmd.Arg(0))
+		os.Exit(1)
+	}
+}
+
+// printBans prints the banned hosts
+func printBans(bans []rpc.BanResult) {
+	if len(bans) == 0 {
+		fmt.Println("No banned peers")
+		return
+	}
+	for _, ban := range bans {
+		fmt.Printf("%s until %s: %s\n", ban.Address, ban.BannedUntil.Format(time.RFC3339), ban.Reason)
+	}
 }
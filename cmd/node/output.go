@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/mempool"
+	"github.com/fkapsahili/mini-blockchain/internal/p2p"
+	"github.com/fkapsahili/mini-blockchain/internal/rpc"
+)
+
+// statusResult is the output of the status command
+type statusResult struct {
+	Height        uint64            `json:"height"`
+	BestBlockHash string            `json:"bestblockhash"`
+	Time          time.Time         `json:"time"`
+	Transactions  int               `json:"transactions"`
+	Sync          *p2p.SyncProgress `json:"sync,omitempty"` // Only reported by a running node
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode output: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// printStatus prints the status of the chain
+func printStatus(status *statusResult) {
+	if jsonOutput {
+		printJSON(status)
+		return
+	}
+	fmt.Printf("Current Height: %d\n", status.Height)
+	fmt.Printf("Latest Block Hash: %s\n", status.BestBlockHash)
+	fmt.Printf("Latest Block Time: %v\n", status.Time)
+	fmt.Printf("Number of Transactions: %d\n", status.Transactions)
+	if status.Sync != nil {
+		printSync(status.Sync)
+	}
+}
+
+// printSync prints how far a running node is in syncing from peers
+func printSync(progress *p2p.SyncProgress) {
+	if !progress.Syncing {
+		fmt.Println("Sync: up to date with peers")
+		return
+	}
+	if progress.SyncPeer != "" {
+		fmt.Printf("Sync: downloading from %s (peer height %d)\n", progress.SyncPeer, progress.PeerHeight)
+	} else {
+		fmt.Println("Sync: downloading validated headers' blocks")
+	}
+	fmt.Printf("Headers: %d\n", progress.HeaderHeight)
+	fmt.Printf("Blocks in flight: %d\n", progress.InFlight)
+}
+
+// printBlock prints a block
+func printBlock(block *rpc.BlockResult) {
+	if jsonOutput {
+		printJSON(block)
+		return
+	}
+	fmt.Printf("Block Height: %d\n", block.Height)
+	fmt.Printf("Block Hash: %s\n", block.Hash)
+	fmt.Printf("Previous Block Hash: %s\n", block.PreviousBlockHash)
+	fmt.Printf("Timestamp: %v\n", block.Time)
+	fmt.Printf("Bits: %s\n", block.Bits)
+	fmt.Printf("Difficulty: %.4f\n", block.Difficulty)
+	fmt.Printf("Nonce: %d\n", block.Nonce)
+	fmt.Printf("Confirmations: %d\n", block.Confirmations)
+	fmt.Printf("Number of Transactions: %d\n", len(block.Tx))
+}
+
+// printCreatedBlock prints a block that was just mined, JSON output is
+// left to the caller
+func printCreatedBlock(block *rpc.BlockResult) {
+	fmt.Printf("Created new block at height %d\n", block.Height)
+	fmt.Printf("Block Hash: %s\n", block.Hash)
+	if len(block.Tx) > 0 && len(block.Tx[0].Outputs) > 0 {
+		reward := block.Tx[0].Outputs[0]
+		fmt.Printf("Reward: %d to %s\n", reward.Value, reward.Address)
+	}
+}
+
+// printFeeEstimate prints a fee rate estimate
+func printFeeEstimate(estimate *rpc.FeeEstimateResult) {
+	if jsonOutput {
+		printJSON(estimate)
+		return
+	}
+	fmt.Printf("Fee Rate: %s (%d per 1000 bytes)\n", mempool.FeeRate(estimate.FeeRate), estimate.FeeRate)
+	fmt.Printf("Confirmation Target: %d blocks (%s)\n", estimate.Blocks, estimate.Mode)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/p2p"
+	"github.com/fkapsahili/mini-blockchain/internal/rpc"
+)
+
+// remoteTimeout bounds the calls of commands that don't mine
+const remoteTimeout = 30 * time.Second
+
+// newRPCClient returns a client for the node at --rpc. It authenticates
+// with --rpcuser and --rpcpassword, or with the credentials the node wrote
+// to the data directory.
+func newRPCClient() *rpc.Client {
+	user, password := rpcUser, rpcPassword
+	if password == "" {
+		var err error
+		user, password, err = rpc.ReadCookie(dataDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v, pass --rpcuser and --rpcpassword or the --datadir of the node\n", err)
+			os.Exit(1)
+		}
+	}
+	return rpc.NewClient(rpcURL, user, password)
+}
+
+// remoteCall calls a method of the node at --rpc and exits on failure
+func remoteCall(ctx context.Context, result any, method string, params ...any) {
+	if err := newRPCClient().Call(ctx, result, method, params...); err != nil {
+		fmt.Fprintf(os.Stderr, "RPC %s failed: %v\n", method, err)
+		os.Exit(1)
+	}
+}
+
+func handleRemoteStatus() {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	status, err := remoteStatus(ctx, newRPCClient())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printStatus(status)
+}
+
+// handleLocalNodeStatus asks the node holding the data directory for its
+// status at the network's default RPC address, with the credentials it
+// wrote there. Nodes listening elsewhere need --rpc.
+func handleLocalNodeStatus() {
+	params, err := chaincfg.ParamsForName(network)
+	if err != nil {
+		fmt.Printf("Invalid network: %v\n", err)
+		os.Exit(1)
+	}
+
+	user, password := rpcUser, rpcPassword
+	if password == "" {
+		user, password, err = rpc.ReadCookie(dataDir)
+	}
+	if err == nil {
+		url := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(int(params.DefaultRPCPort)))
+		ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+		defer cancel()
+
+		var status *statusResult
+		status, err = remoteStatus(ctx, rpc.NewClient(url, user, password))
+		if err == nil {
+			printStatus(status)
+			return
+		}
+	}
+	fmt.Printf("A running node holds the data directory and couldn't be reached (%v), ask it with --rpc\n", err)
+	os.Exit(1)
+}
+
+// remoteStatus queries the tip and sync progress of a node
+func remoteStatus(ctx context.Context, client *rpc.Client) (*statusResult, error) {
+	var hash string
+	if err := client.Call(ctx, &hash, "getbestblockhash"); err != nil {
+		return nil, fmt.Errorf("RPC getbestblockhash failed: %w", err)
+	}
+	var tip rpc.BlockResult
+	if err := client.Call(ctx, &tip, "getblock", hash); err != nil {
+		return nil, fmt.Errorf("RPC getblock failed: %w", err)
+	}
+
+	status := &statusResult{
+		Height:        tip.Height,
+		BestBlockHash: tip.Hash,
+		Time:          tip.Time,
+		Transactions:  len(tip.Tx),
+	}
+	// Nodes started without networking don't report sync progress
+	var progress p2p.SyncProgress
+	if err := client.Call(ctx, &progress, "getsyncprogress"); err == nil {
+		status.Sync = &progress
+	}
+	return status, nil
+}
+
+func handleRemoteBlock(cmd *flag.FlagSet) {
+	if cmd.NArg() < 1 {
+		fmt.Println("Please provide block height or hash")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	// Heights are sent as numbers and hashes as strings
+	var id any = cmd.Arg(0)
+	if height, err := strconv.ParseUint(cmd.Arg(0), 10, 64); err == nil {
+		id = height
+	}
+
+	var block rpc.BlockResult
+	remoteCall(ctx, &block, "getblock", id)
+	printBlock(&block)
+}
+
+func handleRemoteCreateBlock(address string) {
+	payTo := parseAddress(address)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var block rpc.BlockResult
+	remoteCall(ctx, &block, "generate", fmt.Sprintf("%x", payTo))
+	if jsonOutput {
+		printJSON(&block)
+		return
+	}
+	printCreatedBlock(&block)
+}
+
+func handleRemoteEstimateFee(cmd *flag.FlagSet, mode string) {
+	target := parseConfirmTarget(cmd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	var estimate rpc.FeeEstimateResult
+	remoteCall(ctx, &estimate, "estimatefee", target, mode)
+	printFeeEstimate(&estimate)
+}
+
+func handleRemoteBans(cmd *flag.FlagSet) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	switch cmd.Arg(0) {
+	case "", "list":
+		var bans []rpc.BanResult
+		remoteCall(ctx, &bans, "listbanned")
+		printBans(bans)
+
+	case "clear":
+		if host := cmd.Arg(1); host != "" {
+			remoteCall(ctx, nil, "setban", host, "remove")
+			fmt.Printf("Unbanned %s\n", host)
+			return
+		}
+		remoteCall(ctx, nil, "clearbanned")
+		fmt.Println("Cleared all bans")
+
+	default:
+		fmt.Printf("Unknown bans command %q, want list or clear\n", cmd.Arg(0))
+		os.Exit(1)
+	}
+}
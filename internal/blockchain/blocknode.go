@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"math/big"
+
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// blockStatus tracks what is known about a block in the index
+type blockStatus uint8
+
+const (
+	// statusValid marks blocks that have been connected to the best chain
+	statusValid blockStatus = 1 << iota
+	// statusInvalid marks blocks that failed validation when connecting
+	statusInvalid
+)
+
+// blockNode is an entry in the block tree. Every stored block, on the best
+// chain or a side branch, has a node linked to its parent.
+type blockNode struct {
+	hash    [32]byte
+	parent  *blockNode
+	height  uint64
+	header  types.BlockHeader
+	workSum *big.Int // Total work of the chain up to and including this block
+	status  blockStatus
+}
+
+// newBlockNode creates a node for the block on top of parent
+func newBlockNode(block *types.Block, parent *blockNode) *blockNode {
+	node := &blockNode{
+		hash:    block.Hash,
+		parent:  parent,
+		height:  block.Height,
+		header:  block.Header,
+		workSum: crypto.CalcWork(block.Header.Difficulty),
+	}
+	if parent != nil {
+		node.workSum.Add(node.workSum, parent.workSum)
+	}
+	return node
+}
+
+// Ancestor returns the ancestor of the node at height, or nil if height is
+// above the node
+func (n *blockNode) Ancestor(height uint64) *blockNode {
+	if height > n.height {
+		return nil
+	}
+
+	node := n
+	for node != nil && node.height != height {
+		node = node.parent
+	}
+	return node
+}
+
+// ancestorHeader returns an ancestor lookup for blocks built on top of n
+func (n *blockNode) ancestorHeader(height uint64) (*types.BlockHeader, error) {
+	ancestor := n.Ancestor(height)
+	if ancestor == nil {
+		return nil, errUnknownAncestor
+	}
+	return &ancestor.header, nil
+}
+
+// isInvalid reports whether the node failed validation or was accepted on
+// top of a block that did
+func (n *blockNode) isInvalid() bool {
+	return n.status&statusInvalid != 0
+}
+
+// findFork returns the most recent common ancestor of two nodes
+func findFork(a, b *blockNode) *blockNode {
+	for a != nil && b != nil && a.height > b.height {
+		a = a.parent
+	}
+	for a != nil && b != nil && b.height > a.height {
+		b = b.parent
+	}
+	for a != b {
+		a, b = a.parent, b.parent
+	}
+	return a
+}
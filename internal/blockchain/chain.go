@@ -3,76 +3,538 @@ package blockchain
 import (
 	"errors"
 	"fmt"
+	"math/big"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
 	"github.com/fkapsahili/mini-blockchain/internal/crypto"
 	"github.com/fkapsahili/mini-blockchain/internal/storage"
 	"github.com/fkapsahili/mini-blockchain/internal/types"
+	"github.com/fkapsahili/mini-blockchain/internal/utxo"
 )
 
+var (
+	// ErrReadOnly is returned when modifying a chain opened read-only
+	ErrReadOnly = errors.New("blockchain is opened read-only")
+
+	// ErrDuplicateBlock is returned when adding a block that is already known
+	ErrDuplicateBlock = errors.New("block already known")
+
+	// ErrUnknownParent is returned when a block's previous block is not known
+	ErrUnknownParent = errors.New("previous block not found")
+
+	// ErrOrphanBlock is returned when a block is held in the orphan pool
+	// until its parent arrives
+	ErrOrphanBlock = errors.New("block is an orphan")
+
+	// errUnknownAncestor is returned when walking past the start of a branch
+	errUnknownAncestor = errors.New("ancestor block not found")
+)
+
+// utxoFlushInterval is how many blocks are connected or disconnected between
+// writes of the utxo set. After a crash the set is caught up from the
+// stored blocks and their undo data.
+const utxoFlushInterval = 100
+
 type Chain struct {
-	store         storage.ChainStore
-	currentHeight uint64
-	mu            sync.RWMutex
-	latestHash    [32]byte
+	params *chaincfg.Params
+	store  storage.ChainStore
+	mu     sync.RWMutex
+
+	// index holds every known block, bestChain the blocks of the chain with
+	// the most work ordered by height
+	index     map[[32]byte]*blockNode
+	bestChain []*blockNode
+
+	// orphans holds blocks that arrived before their parent
+	orphans *orphanPool
+
+	// utxos holds the unspent outputs as of the tip of the best chain,
+	// unflushed counts the blocks applied to it since it was last written
+	utxos     *utxo.Set
+	unflushed int
+
+	// pending holds events queued under the lock, deliverMu orders their
+	// delivery to subscribers
+	pending       []Event
+	deliverMu     sync.Mutex
+	subscribersMu sync.Mutex
+	subscribers   []*Subscription
+}
+
+// Options controls how a chain is opened
+type Options struct {
+	// ReadOnly opens the chain with a shared datadir lock and rejects writes
+	ReadOnly bool
+	// Params selects the network rules, defaults to the main network
+	Params *chaincfg.Params
 }
 
-// NewChain creates a new blockchain
+// NewChain creates a new blockchain, or opens an existing one, in read-write mode
 func NewChain(dataDir string) (*Chain, error) {
-	store, err := storage.NewFileStore(dataDir)
+	return OpenChain(dataDir, Options{})
+}
+
+// OpenChain opens the blockchain stored in dataDir. In read-write mode a
+// missing chain is initialized with a genesis block.
+func OpenChain(dataDir string, opts Options) (*Chain, error) {
+	if opts.Params == nil {
+		opts.Params = &chaincfg.MainNetParams
+	}
+
+	store, err := storage.OpenFileStore(dataDir, opts.ReadOnly)
 	if err != nil {
 		return nil, err
 	}
 
 	chain := &Chain{
-		store: store,
+		params:  opts.Params,
+		store:   store,
+		index:   make(map[[32]byte]*blockNode),
+		orphans: newOrphanPool(maxOrphanBlocks, maxOrphanBytes, orphanTTL),
 	}
 
-	if latest, err := store.GetLatestBlock(); err != nil {
-		// Create genesis
-		genesis := chain.CreateGenesisBlock()
-		if err := chain.AddBlock(genesis); err != nil {
-			return nil, err
-		}
-	} else {
-		// Restore from storage
-		chain.currentHeight = latest.Height
-		chain.latestHash = latest.Hash
+	if err := chain.loadBlockIndex(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if len(chain.bestChain) == 0 && opts.ReadOnly {
+		store.Close()
+		return nil, fmt.Errorf("no blockchain found in %s", dataDir)
+	}
+
+	chain.utxos, err = utxo.Open(dataDir)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if len(chain.bestChain) == 0 {
+		err = chain.addGenesisBlock()
+	} else if chain.utxos.BestHash() != chain.tip().hash {
+		// The set was not flushed for the current tip, catch it up
+		err = chain.catchUpUtxoSet()
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
 	}
 
 	return chain, nil
 }
 
-// AddBlock adds a new block to the chain
-func (c *Chain) AddBlock(block *types.Block) error {
+// loadBlockIndex rebuilds the block tree from the store and restores the
+// best chain from the recorded tip
+func (c *Chain) loadBlockIndex() error {
+	var blocks []*types.Block
+	err := c.store.ForEachBlock(func(block *types.Block) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load blocks: %w", err)
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	// Parents always have a lower height than their children
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Height < blocks[j].Height
+	})
+
+	for _, block := range blocks {
+		parent := c.index[block.Header.PrevBlockHash]
+		if parent == nil && block.Height != 0 {
+			continue
+		}
+		c.index[block.Hash] = newBlockNode(block, parent)
+	}
+
+	bestHash, err := c.store.GetBestBlock()
+	if err != nil {
+		return fmt.Errorf("failed to load best block: %w", err)
+	}
+	tip := c.index[bestHash]
+	if tip == nil {
+		return fmt.Errorf("best block %x not found in block index", bestHash)
+	}
+
+	c.bestChain = make([]*blockNode, tip.height+1)
+	for node := tip; node != nil; node = node.parent {
+		node.status |= statusValid
+		c.bestChain[node.height] = node
+	}
+
+	return nil
+}
+
+// addGenesisBlock stores the genesis block and makes it the tip
+func (c *Chain) addGenesisBlock() error {
+	genesis := c.CreateGenesisBlock()
+	if err := c.store.SaveBlock(genesis); err != nil {
+		return fmt.Errorf("failed to save genesis block: %w", err)
+	}
+
+	c.utxos.Reset()
+	if err := c.applyUtxos(genesis); err != nil {
+		return err
+	}
+	if err := c.flushUtxos(); err != nil {
+		return err
+	}
+
+	if err := c.store.SetBestBlock(genesis.Hash); err != nil {
+		return fmt.Errorf("failed to save best block: %w", err)
+	}
+
+	node := newBlockNode(genesis, nil)
+	node.status |= statusValid
+	c.index[node.hash] = node
+	c.bestChain = []*blockNode{node}
+
+	return nil
+}
+
+// catchUpUtxoSet brings a set flushed at an earlier block to the tip,
+// disconnecting the blocks of a branch the best chain left and connecting
+// the rest of the best chain. Sets of unknown blocks are rebuilt.
+func (c *Chain) catchUpUtxoSet() error {
+	node := c.index[c.utxos.BestHash()]
+	if node == nil {
+		return c.rebuildUtxoSet()
+	}
+
+	for !c.isMainChain(node) {
+		block, err := c.store.GetBlockByHash(node.hash)
+		if err != nil {
+			return err
+		}
+		undo, err := c.utxos.LoadUndo(node.hash)
+		if err != nil {
+			return c.rebuildUtxoSet()
+		}
+		if err := c.utxos.DisconnectBlock(block, undo); err != nil {
+			return fmt.Errorf("failed to disconnect block %x from utxo set: %w", node.hash, err)
+		}
+		c.unflushed++
+		node = node.parent
+	}
+	return c.replayUtxos(node.height + 1)
+}
+
+// rebuildUtxoSet recreates the unspent outputs by replaying the best chain
+func (c *Chain) rebuildUtxoSet() error {
+	c.utxos.Reset()
+	return c.replayUtxos(0)
+}
+
+// replayUtxos applies the blocks of the best chain from height on and
+// writes the set once at the end
+func (c *Chain) replayUtxos(height uint64) error {
+	for _, node := range c.bestChain[height:] {
+		block, err := c.store.GetBlockByHash(node.hash)
+		if err != nil {
+			return err
+		}
+		if err := c.applyUtxos(block); err != nil {
+			return fmt.Errorf("failed to rebuild utxo set at height %d: %w", node.height, err)
+		}
+	}
+	return c.flushUtxos()
+}
+
+// applyUtxos connects the block to the utxo set and persists the block's
+// undo data. The set itself is written by flushUtxos.
+func (c *Chain) applyUtxos(block *types.Block) error {
+	undo, err := c.utxos.ConnectBlock(block, CalcBlockSubsidy(c.params, block.Height))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadSpend, err)
+	}
+
+	c.unflushed++
+	if c.store.ReadOnly() {
+		return nil
+	}
+	return c.utxos.SaveUndo(block.Hash, undo)
+}
+
+// maybeFlushUtxos writes the utxo set once utxoFlushInterval blocks were
+// applied since it was last written
+func (c *Chain) maybeFlushUtxos() error {
+	if c.unflushed < utxoFlushInterval {
+		return nil
+	}
+	return c.flushUtxos()
+}
+
+// flushUtxos writes the utxo set if blocks were applied since it was last
+// written
+func (c *Chain) flushUtxos() error {
+	if c.unflushed == 0 || c.store.ReadOnly() {
+		return nil
+	}
+	if err := c.utxos.Flush(); err != nil {
+		return err
+	}
+	c.unflushed = 0
+	return nil
+}
+
+// Close writes the utxo set and releases the underlying store and its
+// datadir lock
+func (c *Chain) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.ValidateBlock(block); err != nil {
+	flushErr := c.flushUtxos()
+	if err := c.store.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// AddBlock adds a new block to the block tree. Blocks on a side branch are
+// stored, and the best chain is reorganized onto the branch once it has
+// more cumulative work than the current one. A block whose parent is not
+// known is held as an orphan and ErrOrphanBlock is returned; it is added
+// automatically once the parent is.
+func (c *Chain) AddBlock(block *types.Block) error {
+	c.mu.Lock()
+	defer c.unlockAndNotify(c.tip())
+
+	if c.store.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	if block == nil {
+		return errors.New("block validation failed: block cannot be nil")
+	}
+
+	if _, exists := c.index[block.Hash]; exists || c.orphans.has(block.Hash) {
+		return ErrDuplicateBlock
+	}
+
+	// Check proof of work before holding on to a block we cannot place yet
+	if err := c.checkBlockSanity(block); err != nil {
 		return fmt.Errorf("block validation failed: %w", err)
 	}
 
-	block.UpdateHash()
+	if _, ok := c.index[block.Header.PrevBlockHash]; !ok {
+		c.orphans.add(block, time.Now())
+		return ErrOrphanBlock
+	}
+
+	if err := c.acceptBlock(block); err != nil {
+		return err
+	}
+
+	c.processOrphans(block.Hash)
+	return nil
+}
+
+// acceptBlock validates a block whose parent is known against its branch,
+// stores it and switches to its branch if it has the most work
+func (c *Chain) acceptBlock(block *types.Block) error {
+	parent := c.index[block.Header.PrevBlockHash]
+	if err := c.checkBlockContext(block, parent); err != nil {
+		return fmt.Errorf("block validation failed: %w", err)
+	}
+
+	if parent.isInvalid() {
+		return ErrInvalidAncestor
+	}
 
 	// Save
 	if err := c.store.SaveBlock(block); err != nil {
 		return fmt.Errorf("failed to save block: %w", err)
 	}
 
-	// Update the chain state
-	c.currentHeight = block.Height
-	c.latestHash = block.Hash
+	node := newBlockNode(block, parent)
+	c.index[node.hash] = node
+
+	// Switch branches only on strictly more work, so the first seen of two
+	// equal branches stays active
+	if node.workSum.Cmp(c.tip().workSum) <= 0 {
+		return nil
+	}
+
+	return c.reorganize(node)
+}
+
+// processOrphans accepts the orphans waiting for the block, and in turn the
+// orphans waiting for those. Orphans that fail validation are dropped.
+func (c *Chain) processOrphans(hash [32]byte) {
+	queue := [][32]byte{hash}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, orphan := range c.orphans.takeChildren(parent) {
+			if err := c.acceptBlock(orphan); err == nil {
+				queue = append(queue, orphan.Hash)
+			}
+		}
+	}
+}
+
+// OrphanRoot returns the hash of the first missing ancestor of an orphan,
+// which is the block to request from peers. For blocks that are not
+// orphans the hash itself is returned.
+func (c *Chain) OrphanRoot(hash [32]byte) [32]byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.orphans.root(hash)
+}
+
+// tip returns the node at the end of the best chain
+func (c *Chain) tip() *blockNode {
+	return c.bestChain[len(c.bestChain)-1]
+}
+
+// reorganize makes newTip the end of the best chain, disconnecting blocks
+// back to the fork point and connecting the new branch. If a block of the
+// new branch turns out invalid the previous best chain is restored.
+func (c *Chain) reorganize(newTip *blockNode) error {
+	oldTip := c.tip()
+	fork := findFork(oldTip, newTip)
+	if fork == nil {
+		return errors.New("new tip does not share a fork point with the best chain")
+	}
+
+	// Collect the branch to attach in ascending height order
+	attach := make([]*blockNode, 0, newTip.height-fork.height)
+	for node := newTip; node != fork; node = node.parent {
+		attach = append(attach, node)
+	}
+	for i, j := 0, len(attach)-1; i < j; i, j = i+1, j-1 {
+		attach[i], attach[j] = attach[j], attach[i]
+	}
+
+	if err := c.disconnectTo(fork); err != nil {
+		return err
+	}
+
+	for i, node := range attach {
+		if err := c.connectBlock(node); err != nil {
+			// The failing block and everything built on it is invalid
+			for _, bad := range attach[i:] {
+				bad.status |= statusInvalid
+			}
+
+			if restoreErr := c.restoreBranch(fork, oldTip); restoreErr != nil {
+				return fmt.Errorf("failed to restore best chain after %v: %w", err, restoreErr)
+			}
+			return fmt.Errorf("failed to connect block %x: %w", node.hash, err)
+		}
+	}
+
+	return nil
+}
+
+// restoreBranch returns the best chain to the branch ending at tip after a
+// failed reorganization
+func (c *Chain) restoreBranch(fork, tip *blockNode) error {
+	if err := c.disconnectTo(fork); err != nil {
+		return err
+	}
+
+	var branch []*blockNode
+	for node := tip; node != fork; node = node.parent {
+		branch = append(branch, node)
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		if err := c.connectBlock(branch[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disconnectTo removes blocks from the end of the best chain until fork is the tip
+func (c *Chain) disconnectTo(fork *blockNode) error {
+	for c.tip() != fork {
+		if err := c.disconnectBlock(c.tip()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectBlock appends the node to the best chain
+func (c *Chain) connectBlock(node *blockNode) error {
+	if node.isInvalid() {
+		return errors.New("block is marked invalid")
+	}
+	if node.parent != c.tip() {
+		return errors.New("block does not extend the best chain")
+	}
+
+	block, err := c.store.GetBlockByHash(node.hash)
+	if err != nil {
+		return err
+	}
+	if err := c.applyUtxos(block); err != nil {
+		return err
+	}
+	if err := c.maybeFlushUtxos(); err != nil {
+		return err
+	}
+
+	if err := c.store.SetBestBlock(node.hash); err != nil {
+		return fmt.Errorf("failed to save best block: %w", err)
+	}
+
+	node.status |= statusValid
+	c.bestChain = append(c.bestChain, node)
+	c.notify(EventBlockConnected, block)
+	return nil
+}
+
+// disconnectBlock removes the tip of the best chain
+func (c *Chain) disconnectBlock(node *blockNode) error {
+	if node != c.tip() || node.parent == nil {
+		return errors.New("can only disconnect the tip of the best chain")
+	}
+
+	block, err := c.store.GetBlockByHash(node.hash)
+	if err != nil {
+		return err
+	}
+	undo, err := c.utxos.LoadUndo(node.hash)
+	if err != nil {
+		return err
+	}
+	if err := c.utxos.DisconnectBlock(block, undo); err != nil {
+		return fmt.Errorf("failed to disconnect block %x: %w", node.hash, err)
+	}
+	c.unflushed++
+	if err := c.maybeFlushUtxos(); err != nil {
+		return err
+	}
+
+	if err := c.store.SetBestBlock(node.parent.hash); err != nil {
+		return fmt.Errorf("failed to save best block: %w", err)
+	}
 
+	c.bestChain = c.bestChain[:len(c.bestChain)-1]
+	c.notify(EventBlockDisconnected, block)
 	return nil
 }
 
-// GetBlock retrieves a block by height
+// GetBlock retrieves a block of the best chain by height
 func (c *Chain) GetBlock(height uint64) (*types.Block, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return c.store.GetBlock(height)
+	if height >= uint64(len(c.bestChain)) {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	return c.store.GetBlockByHash(c.bestChain[height].hash)
 }
 
 // GetLatestBlock returns the most recent block of the chain
@@ -80,64 +542,144 @@ func (c *Chain) GetLatestBlock() (*types.Block, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return c.store.GetBlock(c.currentHeight)
+	return c.store.GetBlockByHash(c.tip().hash)
 }
 
-// ValidateBlock checks if a new block can be added
+// ValidateBlock checks if a block can be added on top of its parent, which
+// may be the tip of the best chain or any block of a side branch
 func (c *Chain) ValidateBlock(block *types.Block) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.validateBlock(block)
+}
+
+// validateBlock checks a block, the caller must hold the lock
+func (c *Chain) validateBlock(block *types.Block) error {
 	if block == nil {
 		return errors.New("block cannot be nil")
 	}
 
-	if c.currentHeight == 0 && block.Height == 0 {
-		// First block must be genesis
-		if block.Header.PrevBlockHash != [32]byte{} {
-			return errors.New("genesis block must have zero previous hash")
-		}
-		return nil
+	if err := c.checkBlockSanity(block); err != nil {
+		return err
 	}
 
-	prevBlock, err := c.store.GetBlock(c.currentHeight)
-	if err != nil {
-		return fmt.Errorf("failed to get previous block: %w", err)
+	parent, ok := c.index[block.Header.PrevBlockHash]
+	if !ok {
+		return fmt.Errorf("%w: %x", ErrUnknownParent, block.Header.PrevBlockHash)
 	}
 
-	// Check height
-	if block.Height != prevBlock.Height+1 {
-		return errors.New("invalid block height")
+	if err := c.checkBlockContext(block, parent); err != nil {
+		return err
+	}
+
+	// Blocks extending the tip can also be checked against the utxo set,
+	// side branches are only checked once they are connected
+	if parent == c.tip() {
+		if err := c.utxos.CheckBlock(block, CalcBlockSubsidy(c.params, block.Height)); err != nil {
+			return fmt.Errorf("%w: %w", ErrBadSpend, err)
+		}
 	}
 
-	// Check previous hash
-	if block.Header.PrevBlockHash != prevBlock.Hash {
-		return errors.New("invalid previous block hash")
+	return nil
+}
 
+// checkBlockSanity performs the checks that do not depend on other blocks
+func (c *Chain) checkBlockSanity(block *types.Block) error {
+	// The block must fit the limits of the binary encoding so it can be
+	// stored and relayed
+	if size := block.SerializeSize(); size > types.MaxBlockSize {
+		return fmt.Errorf("%w: size %d exceeds %d", ErrBlockTooLarge, size, types.MaxBlockSize)
+	}
+	sigOps := 0
+	for i := range block.Transactions {
+		if err := block.Transactions[i].CheckLimits(); err != nil {
+			return fmt.Errorf("%w: transaction %d: %w", ErrBlockTooLarge, i, err)
+		}
+		sigOps += block.Transactions[i].SigOpCount()
+	}
+	if sigOps > types.MaxBlockSigOps {
+		return fmt.Errorf("%w: %d signature checks exceed %d", ErrBlockTooLarge, sigOps, types.MaxBlockSigOps)
 	}
 
-	// Verify Merkle root
+	// Verify Merkle and witness roots
 	expectedRoot := crypto.CalculateMerkleRoot(getTransactionHashes(block.Transactions))
 	if block.Header.MerkleRoot != expectedRoot {
-		return errors.New("invalid merkle root")
+		return ErrBadMerkleRoot
+	}
+	if block.Header.WitnessRoot != block.ComputeWitnessRoot() {
+		return ErrBadWitnessRoot
 	}
 
 	// Verify block hash
-	expectedHash := crypto.Hash(block.GetHeaderBytes())
-	if block.Hash != expectedHash {
-		return errors.New("invalid block hash")
+	if block.Hash != block.ComputeHash() {
+		return ErrBadBlockHash
 	}
 
-	if !crypto.CheckProofOfWork(block.Hash, block.Header.Difficulty) {
-		return errors.New("proof of work verification failed")
+	if err := checkHeaderSanity(c.params, &block.Header, block.Hash); err != nil {
+		return err
 	}
 
-	for _, tx := range block.Transactions {
-		if err := validateTransaction(&tx); err != nil {
-			return fmt.Errorf("invalid transaction: %w", err)
+	if err := checkCoinbase(block); err != nil {
+		return err
+	}
+	if block.Transactions[0].Hash != block.Transactions[0].ComputeHash() {
+		return fmt.Errorf("%w: hash does not match its content", ErrBadCoinbase)
+	}
+
+	for _, tx := range block.Transactions[1:] {
+		if err := CheckTransaction(&tx); err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.Hash, err)
 		}
 	}
 
 	return nil
 }
 
+// checkBlockContext checks the block against the branch it extends
+func (c *Chain) checkBlockContext(block *types.Block, parent *blockNode) error {
+	// Check height
+	if block.Height != parent.height+1 {
+		return ErrBadHeight
+	}
+
+	// Check the height committed in the coinbase
+	coinbaseHeight, err := block.Transactions[0].CoinbaseHeight()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadCoinbase, err)
+	}
+	if coinbaseHeight != block.Height {
+		return fmt.Errorf("%w: commits to height %d, block is at %d", ErrBadCoinbase, coinbaseHeight, block.Height)
+	}
+
+	return checkHeaderContext(c.params, &block.Header, block.Height, parent)
+}
+
+// CalcNextRequiredDifficulty returns the compact target the next block on
+// top of the current tip must carry
+func (c *Chain) CalcNextRequiredDifficulty() (uint32, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	tip := c.tip()
+	return calcNextRequiredDifficulty(c.params, tip.height+1, tip.ancestorHeader)
+}
+
+// MedianTimePast returns the median timestamp of the most recent blocks,
+// the next block's timestamp must be after it
+func (c *Chain) MedianTimePast() (time.Time, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	tip := c.tip()
+	return calcMedianTimePast(c.params, tip.height, tip.ancestorHeader)
+}
+
+// Params returns the network rules of the chain
+func (c *Chain) Params() *chaincfg.Params {
+	return c.params
+}
+
 // Helper function to get transaction hashes
 func getTransactionHashes(txs []types.Transaction) [][32]byte {
 	hashes := make([][32]byte, len(txs))
@@ -147,28 +689,72 @@ func getTransactionHashes(txs []types.Transaction) [][32]byte {
 	return hashes
 }
 
-// validateTransaction verifies a single transaction
-func validateTransaction(tx *types.Transaction) error {
+// checkCoinbase verifies the block starts with its only coinbase
+func checkCoinbase(block *types.Block) error {
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("%w: block has no coinbase transaction", ErrBadCoinbase)
+	}
+
+	coinbase := &block.Transactions[0]
+	if !coinbase.IsCoinbase() {
+		return fmt.Errorf("%w: first transaction is not a coinbase", ErrBadCoinbase)
+	}
+	dataLen := len(coinbase.Inputs[0].Signature)
+	if dataLen < types.MinCoinbaseDataLen || dataLen > types.MaxCoinbaseDataLen {
+		return fmt.Errorf("%w: data length %d out of range", ErrBadCoinbase, dataLen)
+	}
+
+	for _, tx := range block.Transactions[1:] {
+		if tx.IsCoinbase() {
+			return fmt.Errorf("%w: block has more than one coinbase transaction", ErrBadCoinbase)
+		}
+	}
+	return nil
+}
+
+// CheckTransaction verifies a single non-coinbase transaction on its own:
+// its ID and the signatures of its inputs. Spends are checked against the
+// utxo set once it is in a block.
+func CheckTransaction(tx *types.Transaction) error {
+	if len(tx.Inputs) == 0 {
+		return fmt.Errorf("%w: no inputs", ErrBadTransaction)
+	}
+
+	// The ID must be derived from the content, not claimed
+	if tx.Hash != tx.ComputeHash() {
+		return fmt.Errorf("%w: hash does not match its content", ErrBadTransaction)
+	}
+
 	// Verify each input
-	for _, input := range tx.Inputs {
+	for i, input := range tx.Inputs {
 		pubKey, err := crypto.BytesToPublicKey(input.PublicKey)
 		if err != nil {
-			return fmt.Errorf("invalid public key in transaction: %w", err)
+			return fmt.Errorf("%w: invalid public key: %w", ErrBadSignature, err)
 		}
 
 		// Verify signature
-		if !crypto.Verify(pubKey, tx.Hash[:], input.Signature) {
-			return errors.New("invalid transaction signature")
+		sigHash := tx.SigHash(i)
+		if !crypto.Verify(pubKey, sigHash[:], input.Signature) {
+			return ErrBadSignature
 		}
 	}
 	return nil
 }
 
+// FetchUtxo returns the unspent output at the outpoint as of the tip of
+// the best chain, or nil if it does not exist or is spent
+func (c *Chain) FetchUtxo(op utxo.Outpoint) *utxo.Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.utxos.Get(op)
+}
+
 // GetHeight returns the chain's current height
 func (c *Chain) GetHeight() uint64 {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.currentHeight
+	return c.tip().height
 }
 
 // GetBlockByHash returns the block by its hash
@@ -179,14 +765,46 @@ func (c *Chain) GetBlockByHash(hash [32]byte) (*types.Block, error) {
 	return c.store.GetBlockByHash(hash)
 }
 
+// HaveBlock reports whether the block is known, on any branch or as an orphan
+func (c *Chain) HaveBlock(hash [32]byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.index[hash]
+	return ok || c.orphans.has(hash)
+}
+
+// IsMainChain reports whether the block is part of the best chain
+func (c *Chain) IsMainChain(hash [32]byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	node, ok := c.index[hash]
+	return ok && c.isMainChain(node)
+}
+
+// isMainChain reports whether the node is on the best chain, the caller
+// must hold the lock
+func (c *Chain) isMainChain(node *blockNode) bool {
+	return node.height < uint64(len(c.bestChain)) && c.bestChain[node.height] == node
+}
+
+// ChainWork returns the total work of the best chain
+func (c *Chain) ChainWork() *big.Int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return new(big.Int).Set(c.tip().workSum)
+}
+
 // CreateGenesisBlock creates the first block
 func (c *Chain) CreateGenesisBlock() *types.Block {
 	header := types.BlockHeader{
 		Version:       1,
 		PrevBlockHash: [32]byte{}, // all zeros
 		MerkleRoot:    [32]byte{},
-		Timestamp:     time.Now(),
-		Difficulty:    1,
+		Timestamp:     c.params.GenesisTimestamp,
+		Difficulty:    c.params.PowLimitBits,
 		Nonce:         0,
 	}
 
@@ -201,7 +819,10 @@ func (c *Chain) CreateGenesisBlock() *types.Block {
 	return genesisBlock
 }
 
-// IsEmpty checks if chain has any blocks
+// IsEmpty checks if chain has any blocks beyond genesis
 func (c *Chain) IsEmpty() bool {
-	return c.currentHeight == 0
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.tip().height == 0
 }
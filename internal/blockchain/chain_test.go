@@ -1,12 +1,32 @@
 package blockchain
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
 	"github.com/fkapsahili/mini-blockchain/internal/types"
+	"github.com/fkapsahili/mini-blockchain/internal/utxo"
 )
 
+// solveBlock updates the block hash and searches for a nonce that meets
+// the block's difficulty
+func solveBlock(block *types.Block) {
+	block.UpdateHash()
+	for !crypto.CheckProofOfWork(block.Hash, block.Header.Difficulty) {
+		block.Header.Nonce++
+		block.Hash = block.ComputeHash()
+	}
+}
+
 func TestNewChain(t *testing.T) {
 	tempDir := t.TempDir()
 	chain, err := NewChain(tempDir)
@@ -33,19 +53,24 @@ func TestAddBlock(t *testing.T) {
 		t.Fatal("Failed to retrieve latest block: %w", err)
 	}
 
+	bits, err := chain.CalcNextRequiredDifficulty()
+	if err != nil {
+		t.Fatalf("CalcNextRequiredDifficulty() error = %v", err)
+	}
+
 	newBlock := &types.Block{
 		Header: types.BlockHeader{
 			Version:       1,
 			PrevBlockHash: genesis.Hash,
 			MerkleRoot:    [32]byte{},
 			Timestamp:     time.Now(),
-			Difficulty:    1,
+			Difficulty:    bits,
 			Nonce:         0,
 		},
 		Height:       genesis.Height + 1,
-		Transactions: []types.Transaction{},
+		Transactions: []types.Transaction{types.NewCoinbaseTransaction(genesis.Height+1, 0, nil)},
 	}
-	newBlock.UpdateHash()
+	solveBlock(newBlock)
 
 	err = chain.AddBlock(newBlock)
 	if err != nil {
@@ -74,10 +99,40 @@ func TestValidateBlock(t *testing.T) {
 		t.Fatal("Failed to create new chain: %w", err)
 	}
 
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatal("Failed to retrieve latest block: %w", err)
+	}
+
+	// childOf returns a solved block on top of genesis
+	childOf := func(bits uint32, timestamp time.Time) *types.Block {
+		block := &types.Block{
+			Header: types.BlockHeader{
+				Version:       1,
+				PrevBlockHash: genesis.Hash,
+				Timestamp:     timestamp,
+				Difficulty:    bits,
+			},
+			Height:       1,
+			Transactions: []types.Transaction{types.NewCoinbaseTransaction(1, 0, nil)},
+		}
+		solveBlock(block)
+		return block
+	}
+
+	// A solved header whose witness root doesn't match the transactions
+	badWitness := childOf(chaincfg.MainNetParams.PowLimitBits, time.Now())
+	badWitness.Header.WitnessRoot = [32]byte{}
+	for badWitness.Hash = badWitness.ComputeHash(); !crypto.CheckProofOfWork(badWitness.Hash, badWitness.Header.Difficulty); {
+		badWitness.Header.Nonce++
+		badWitness.Hash = badWitness.ComputeHash()
+	}
+
 	tests := []struct {
 		name    string
 		block   *types.Block
 		wantErr bool
+		is      error // Rule violation the error must wrap, if set
 	}{
 		{
 			name:    "nil block",
@@ -94,6 +149,35 @@ func TestValidateBlock(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:    "valid block",
+			block:   childOf(chaincfg.MainNetParams.PowLimitBits, time.Now()),
+			wantErr: false,
+		},
+		{
+			name:    "wrong difficulty",
+			block:   childOf(chaincfg.RegTestParams.PowLimitBits, time.Now()),
+			wantErr: true,
+			is:      ErrBadProofOfWork,
+		},
+		{
+			name:    "witness root not committing to the transactions",
+			block:   badWitness,
+			wantErr: true,
+			is:      ErrBadWitnessRoot,
+		},
+		{
+			name:    "timestamp not after median time",
+			block:   childOf(chaincfg.MainNetParams.PowLimitBits, genesis.Header.Timestamp),
+			wantErr: true,
+			is:      ErrBadTimestamp,
+		},
+		{
+			name:    "timestamp in the future",
+			block:   childOf(chaincfg.MainNetParams.PowLimitBits, time.Now().Add(3*time.Hour)),
+			wantErr: true,
+			is:      ErrFutureTimestamp,
+		},
 	}
 
 	for _, tt := range tests {
@@ -102,6 +186,259 @@ func TestValidateBlock(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ValidateBlock() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Errorf("ValidateBlock() error = %v, want %v", err, tt.is)
+			}
 		})
 	}
 }
+
+func TestOpenChainReadOnly(t *testing.T) {
+	tempDir := t.TempDir()
+
+	if _, err := OpenChain(tempDir, Options{ReadOnly: true}); err == nil {
+		t.Fatal("OpenChain() on empty datadir should fail in read-only mode")
+	}
+
+	chain, err := NewChain(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create new chain: %v", err)
+	}
+	if _, err := OpenChain(tempDir, Options{ReadOnly: true}); err == nil {
+		t.Error("OpenChain() should fail while a writer holds the datadir")
+	}
+	if err := chain.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	reader1, err := OpenChain(tempDir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open chain read-only: %v", err)
+	}
+	defer reader1.Close()
+
+	reader2, err := OpenChain(tempDir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Readers should share the datadir: %v", err)
+	}
+	defer reader2.Close()
+
+	if _, err := NewChain(tempDir); err == nil {
+		t.Error("NewChain() should fail while readers hold the datadir")
+	}
+
+	genesis, err := reader1.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+	if err := reader1.AddBlock(genesis); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("AddBlock() error = %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestOpenChainLegacyFormat(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Blocks of the JSON format were named by height and carry hashes of
+	// an older header encoding
+	var legacy []types.Block
+	for height := uint64(0); height < 3; height++ {
+		block := types.Block{
+			Header: types.BlockHeader{
+				Version:   1,
+				Timestamp: time.Unix(1700000000+int64(height)*60, 0).UTC(),
+			},
+			Hash:   [32]byte{byte(height + 1)},
+			Height: height,
+		}
+		if height > 0 {
+			block.Header.PrevBlockHash = legacy[height-1].Hash
+			block.Transactions = []types.Transaction{types.NewCoinbaseTransaction(height, 0, []types.TransactionOutput{{Amount: 1}})}
+		}
+		legacy = append(legacy, block)
+
+		data, err := json.Marshal(&block)
+		if err != nil {
+			t.Fatalf("json.Marshal() error = %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("block_%d.json", height)), data, 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	// Migrating needs write access
+	if _, err := OpenChain(tempDir, Options{ReadOnly: true}); !errors.Is(err, storage.ErrLegacyFormat) {
+		t.Errorf("OpenChain(ReadOnly: true) error = %v, want %v", err, storage.ErrLegacyFormat)
+	}
+
+	chain, err := NewChain(tempDir)
+	if err != nil {
+		t.Fatalf("NewChain() error = %v", err)
+	}
+	defer chain.Close()
+
+	if got := chain.GetHeight(); got != 2 {
+		t.Errorf("GetHeight() = %d, want 2", got)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tempDir, "block_*.json")); len(files) != 0 {
+		t.Errorf("JSON block files left after migration: %v", files)
+	}
+
+	// The migrated blocks link up under their new hashes
+	tip, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	for block := tip; block.Height > 0; {
+		if block.Hash != block.ComputeHash() {
+			t.Errorf("block %d hash = %x, want %x", block.Height, block.Hash, block.ComputeHash())
+		}
+		parent, err := chain.GetBlockByHash(block.Header.PrevBlockHash)
+		if err != nil {
+			t.Fatalf("parent of block %d: %v", block.Height, err)
+		}
+		if parent.Height != block.Height-1 {
+			t.Errorf("parent of block %d has height %d", block.Height, parent.Height)
+		}
+		block = parent
+	}
+}
+
+func TestOpenChainVersion1Format(t *testing.T) {
+	tempDir := t.TempDir()
+	chain := newRegTestChain(t, tempDir)
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	blocks := append([]*types.Block{genesis}, buildBranch(t, chain, genesis, 2, 0)...)
+	chain.Close()
+
+	// Version 1 headers had no witness root, so the blocks were known by
+	// other hashes
+	files, _ := filepath.Glob(filepath.Join(tempDir, "block_*.dat"))
+	for _, path := range files {
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Remove() error = %v", err)
+		}
+	}
+	const witnessRootOffset = 4 + 32 + 32
+	var prev [32]byte
+	for _, block := range blocks {
+		old := *block
+		old.Header.PrevBlockHash = prev
+		data := codec.Marshal(&old)
+		v1 := append(data[:witnessRootOffset:witnessRootOffset], data[witnessRootOffset+32:]...)
+		prev = crypto.Hash(v1[:types.BlockHeaderSize-32])
+
+		file := append([]byte("mblk\x01\x00\x00\x00"), v1...)
+		if err := os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("block_%x.dat", prev)), file, 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "best_block"), []byte(fmt.Sprintf("%x", prev)), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := OpenChain(tempDir, Options{ReadOnly: true, Params: &chaincfg.RegTestParams}); !errors.Is(err, storage.ErrLegacyFormat) {
+		t.Errorf("OpenChain(ReadOnly: true) error = %v, want %v", err, storage.ErrLegacyFormat)
+	}
+
+	// The migrated blocks get back the hashes they have with a witness root
+	chain = newRegTestChain(t, tempDir)
+	defer chain.Close()
+	for _, want := range blocks {
+		got, err := chain.GetBlock(want.Height)
+		if err != nil {
+			t.Fatalf("GetBlock(%d) error = %v", want.Height, err)
+		}
+		if got.Hash != want.Hash {
+			t.Errorf("block %d hash = %x, want %x", want.Height, got.Hash, want.Hash)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(tempDir, "block_*.dat")); len(files) != len(blocks) {
+		t.Errorf("%d block files after migration, want %d", len(files), len(blocks))
+	}
+}
+
+func TestCoinbaseRules(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	address := crypto.HashToAddress(&key.PublicKey)
+	subsidy := CalcBlockSubsidy(chain.Params(), 1)
+
+	// withTransactions returns a solved child of parent with the given transactions
+	withTransactions := func(parent *types.Block, txs ...types.Transaction) *types.Block {
+		block := childBlock(parent, 0)
+		block.Transactions = txs
+		solveBlock(block)
+		return block
+	}
+	payout := func(amount uint64) []types.TransactionOutput {
+		return []types.TransactionOutput{{Amount: amount, PublicKeyHash: address}}
+	}
+
+	rejected := []struct {
+		name  string
+		block *types.Block
+	}{
+		{"no coinbase", withTransactions(genesis)},
+		{"claims more than the subsidy", withTransactions(genesis, types.NewCoinbaseTransaction(1, 0, payout(subsidy+1)))},
+		{"commits to the wrong height", withTransactions(genesis, types.NewCoinbaseTransaction(2, 0, payout(subsidy)))},
+		{"two coinbases", withTransactions(genesis,
+			types.NewCoinbaseTransaction(1, 0, payout(subsidy)),
+			types.NewCoinbaseTransaction(1, 1, nil))},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := chain.AddBlock(tt.block); err == nil {
+				t.Error("AddBlock() should fail")
+			}
+		})
+	}
+
+	funding := withTransactions(genesis, types.NewCoinbaseTransaction(1, 0, payout(subsidy)))
+	if err := chain.AddBlock(funding); err != nil {
+		t.Fatalf("AddBlock() of funding block error = %v", err)
+	}
+
+	// Spend the coinbase leaving a fee of 10 for the next miner
+	spend := types.Transaction{
+		Version: 1,
+		Inputs:  []types.TransactionInput{{PrevTxHash: funding.Transactions[0].Hash}},
+		Outputs: payout(subsidy - 10),
+	}
+	if err := spend.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	// A claimed ID that does not match the content is rejected
+	forged := spend
+	forged.Hash = [32]byte{0x02}
+	if err := chain.AddBlock(withTransactions(funding, types.NewCoinbaseTransaction(2, 0, payout(subsidy+10)), forged)); err == nil {
+		t.Error("AddBlock() should fail for a transaction with a forged hash")
+	}
+
+	greedy := withTransactions(funding, types.NewCoinbaseTransaction(2, 0, payout(subsidy+11)), spend)
+	if err := chain.AddBlock(greedy); err == nil {
+		t.Error("AddBlock() should fail when the coinbase claims more than subsidy plus fees")
+	}
+
+	collecting := withTransactions(funding, types.NewCoinbaseTransaction(2, 0, payout(subsidy+10)), spend)
+	if err := chain.AddBlock(collecting); err != nil {
+		t.Fatalf("AddBlock() of block collecting fees error = %v", err)
+	}
+	if entry := chain.FetchUtxo(utxo.Outpoint{TxHash: spend.Hash}); entry == nil || entry.Amount != subsidy-10 {
+		t.Errorf("FetchUtxo() = %+v, want amount %d", entry, subsidy-10)
+	}
+}
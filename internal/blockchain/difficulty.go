@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// ancestorFunc returns the header of the block at height on the chain being
+// extended
+type ancestorFunc func(height uint64) (*types.BlockHeader, error)
+
+// calcNextRequiredDifficulty returns the compact target a block at height
+// must carry, given access to its ancestors
+func calcNextRequiredDifficulty(params *chaincfg.Params, height uint64, ancestor ancestorFunc) (uint32, error) {
+	if height == 0 || params.RetargetMode == chaincfg.RetargetNone {
+		return params.PowLimitBits, nil
+	}
+
+	prev, err := ancestor(height - 1)
+	if err != nil {
+		return 0, err
+	}
+
+	switch params.RetargetMode {
+	case chaincfg.RetargetPeriodic:
+		return calcPeriodicRetarget(params, height, prev, ancestor)
+	case chaincfg.RetargetMovingAverage:
+		return calcMovingAverageRetarget(params, height, prev, ancestor)
+	default:
+		return 0, fmt.Errorf("unsupported retarget mode %v", params.RetargetMode)
+	}
+}
+
+// calcPeriodicRetarget keeps the previous target except at multiples of the
+// retarget interval, where it scales the target by the observed timespan of
+// the last interval
+func calcPeriodicRetarget(params *chaincfg.Params, height uint64, prev *types.BlockHeader, ancestor ancestorFunc) (uint32, error) {
+	interval := params.RetargetInterval
+	if interval == 0 || height%interval != 0 {
+		return prev.Difficulty, nil
+	}
+
+	// Measure the last interval block times, the first period has to make
+	// do with one fewer since the genesis block has no parent
+	gaps := interval
+	if height == interval {
+		gaps--
+	}
+	if gaps == 0 {
+		return prev.Difficulty, nil
+	}
+
+	first, err := ancestor(height - 1 - gaps)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := time.Duration(gaps) * params.TargetBlockTime
+	actual := prev.Timestamp.Sub(first.Timestamp)
+
+	return retarget(params, crypto.CompactToBig(prev.Difficulty), actual, expected), nil
+}
+
+// calcMovingAverageRetarget scales the average target of the last window
+// blocks by their observed timespan
+func calcMovingAverageRetarget(params *chaincfg.Params, height uint64, prev *types.BlockHeader, ancestor ancestorFunc) (uint32, error) {
+	window := min(params.AveragingWindow, height-1)
+	if window == 0 {
+		return prev.Difficulty, nil
+	}
+
+	sum := new(big.Int)
+	for h := height - window; h < height; h++ {
+		header, err := ancestor(h)
+		if err != nil {
+			return 0, err
+		}
+		sum.Add(sum, crypto.CompactToBig(header.Difficulty))
+	}
+	average := sum.Div(sum, new(big.Int).SetUint64(window))
+
+	first, err := ancestor(height - window - 1)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := time.Duration(window) * params.TargetBlockTime
+	actual := prev.Timestamp.Sub(first.Timestamp)
+
+	return retarget(params, average, actual, expected), nil
+}
+
+// retarget scales target by actual/expected, bounded by the maximum
+// adjustment factor and the proof of work limit
+func retarget(params *chaincfg.Params, target *big.Int, actual, expected time.Duration) uint32 {
+	factor := time.Duration(max(params.MaxAdjustmentFactor, 1))
+	actual = max(actual, expected/factor)
+	actual = min(actual, expected*factor)
+
+	newTarget := new(big.Int).Mul(target, big.NewInt(int64(actual)))
+	newTarget.Div(newTarget, big.NewInt(int64(expected)))
+
+	limit := crypto.CompactToBig(params.PowLimitBits)
+	if newTarget.Cmp(limit) > 0 {
+		newTarget.Set(limit)
+	}
+
+	return crypto.BigToCompact(newTarget)
+}
+
+// calcMedianTimePast returns the median timestamp of up to
+// MedianTimeBlocks blocks ending at height
+func calcMedianTimePast(params *chaincfg.Params, height uint64, ancestor ancestorFunc) (time.Time, error) {
+	count := min(uint64(params.MedianTimeBlocks), height+1)
+	if count == 0 {
+		count = 1
+	}
+
+	timestamps := make([]time.Time, 0, count)
+	for h := height + 1 - count; h <= height; h++ {
+		header, err := ancestor(h)
+		if err != nil {
+			return time.Time{}, err
+		}
+		timestamps = append(timestamps, header.Timestamp)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i].Before(timestamps[j])
+	})
+	return timestamps[len(timestamps)/2], nil
+}
@@ -0,0 +1,145 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// headerChain returns an ancestor lookup over count headers spaced by
+// spacing and all carrying bits
+func headerChain(count int, bits uint32, spacing time.Duration) ancestorFunc {
+	start := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	headers := make([]types.BlockHeader, count)
+	for i := range headers {
+		headers[i] = types.BlockHeader{
+			Timestamp:  start.Add(time.Duration(i) * spacing),
+			Difficulty: bits,
+		}
+	}
+
+	return func(height uint64) (*types.BlockHeader, error) {
+		if height >= uint64(len(headers)) {
+			return nil, fmt.Errorf("no header at height %d", height)
+		}
+		return &headers[height], nil
+	}
+}
+
+func TestPeriodicRetarget(t *testing.T) {
+	params := chaincfg.Params{
+		PowLimitBits:        0x207fffff,
+		TargetBlockTime:     time.Minute,
+		RetargetMode:        chaincfg.RetargetPeriodic,
+		RetargetInterval:    10,
+		MaxAdjustmentFactor: 4,
+	}
+	const bits = 0x1f0fffff
+	half := crypto.BigToCompact(new(big.Int).Rsh(crypto.CompactToBig(bits), 1))
+
+	tests := []struct {
+		name    string
+		height  uint64
+		spacing time.Duration
+		want    uint32
+	}{
+		{"between retargets", 15, 10 * time.Second, bits},
+		{"on schedule", 20, time.Minute, bits},
+		{"twice too fast", 20, 30 * time.Second, half},
+		{"first period", 10, 30 * time.Second, half},
+		{"clamped when far too fast", 20, time.Second, 0x1f03ffff},
+		{"clamped when far too slow", 20, time.Hour, 0x1f3ffffc},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := calcNextRequiredDifficulty(&params, tt.height, headerChain(int(tt.height), bits, tt.spacing))
+			if err != nil {
+				t.Fatalf("calcNextRequiredDifficulty() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("calcNextRequiredDifficulty() = %08x, want %08x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetargetCappedAtLimit(t *testing.T) {
+	params := chaincfg.Params{
+		PowLimitBits:        0x1f0fffff,
+		TargetBlockTime:     time.Minute,
+		RetargetMode:        chaincfg.RetargetPeriodic,
+		RetargetInterval:    10,
+		MaxAdjustmentFactor: 4,
+	}
+
+	got, err := calcNextRequiredDifficulty(&params, 20, headerChain(20, params.PowLimitBits, time.Hour))
+	if err != nil {
+		t.Fatalf("calcNextRequiredDifficulty() error = %v", err)
+	}
+	if got != params.PowLimitBits {
+		t.Errorf("calcNextRequiredDifficulty() = %08x, want %08x", got, params.PowLimitBits)
+	}
+}
+
+func TestMovingAverageRetarget(t *testing.T) {
+	params := chaincfg.Params{
+		PowLimitBits:        0x207fffff,
+		TargetBlockTime:     time.Minute,
+		RetargetMode:        chaincfg.RetargetMovingAverage,
+		AveragingWindow:     5,
+		MaxAdjustmentFactor: 2,
+	}
+	const bits = 0x1f0fffff
+
+	onSchedule, err := calcNextRequiredDifficulty(&params, 30, headerChain(30, bits, time.Minute))
+	if err != nil {
+		t.Fatalf("calcNextRequiredDifficulty() error = %v", err)
+	}
+	if onSchedule != bits {
+		t.Errorf("on schedule = %08x, want %08x", onSchedule, uint32(bits))
+	}
+
+	fast, err := calcNextRequiredDifficulty(&params, 30, headerChain(30, bits, 20*time.Second))
+	if err != nil {
+		t.Fatalf("calcNextRequiredDifficulty() error = %v", err)
+	}
+	if crypto.CompactToBig(fast).Cmp(crypto.CompactToBig(bits)) >= 0 {
+		t.Errorf("fast blocks = %08x, want a target below %08x", fast, uint32(bits))
+	}
+
+	// Half the target is the most a single adjustment may tighten it
+	if got := crypto.GetDifficulty(fast, bits); got < 1.99 || got > 2.01 {
+		t.Errorf("fast blocks difficulty = %v, want about 2", got)
+	}
+}
+
+func TestNoRetarget(t *testing.T) {
+	params := chaincfg.RegTestParams
+	got, err := calcNextRequiredDifficulty(&params, 100, headerChain(100, 0x1d00ffff, time.Millisecond))
+	if err != nil {
+		t.Fatalf("calcNextRequiredDifficulty() error = %v", err)
+	}
+	if got != params.PowLimitBits {
+		t.Errorf("calcNextRequiredDifficulty() = %08x, want %08x", got, params.PowLimitBits)
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	params := chaincfg.Params{MedianTimeBlocks: 11}
+	ancestor := headerChain(20, 0x207fffff, time.Minute)
+
+	got, err := calcMedianTimePast(&params, 19, ancestor)
+	if err != nil {
+		t.Fatalf("calcMedianTimePast() error = %v", err)
+	}
+	want, _ := ancestor(14)
+	if !got.Equal(want.Timestamp) {
+		t.Errorf("calcMedianTimePast() = %v, want %v", got, want.Timestamp)
+	}
+}
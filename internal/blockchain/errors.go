@@ -0,0 +1,60 @@
+package blockchain
+
+import "errors"
+
+// Consensus rule violations. Validation errors wrap one of them, so callers
+// like the peer server can tell why a block or header was rejected.
+var (
+	// ErrBlockTooLarge is returned for blocks exceeding the encoding limits
+	ErrBlockTooLarge = errors.New("block exceeds size limits")
+
+	// ErrBadMerkleRoot is returned when the merkle root does not commit to
+	// the block's transactions
+	ErrBadMerkleRoot = errors.New("invalid merkle root")
+
+	// ErrBadWitnessRoot is returned when the witness root does not commit
+	// to the full transactions, signatures included
+	ErrBadWitnessRoot = errors.New("invalid witness root")
+
+	// ErrBadBlockHash is returned when the claimed hash is not the header's
+	ErrBadBlockHash = errors.New("invalid block hash")
+
+	// ErrBadProofOfWork is returned when the hash misses the target or the
+	// target is out of range
+	ErrBadProofOfWork = errors.New("invalid proof of work")
+
+	// ErrBadDifficulty is returned when the target is not the one required
+	// by the retarget rules
+	ErrBadDifficulty = errors.New("difficulty does not match required")
+
+	// ErrBadTimestamp is returned when the timestamp is not after the median
+	// time of the previous blocks
+	ErrBadTimestamp = errors.New("block timestamp is not after median time of previous blocks")
+
+	// ErrFutureTimestamp is returned when the timestamp is too far ahead of
+	// our clock, the block may become valid later
+	ErrFutureTimestamp = errors.New("block timestamp too far in the future")
+
+	// ErrBadHeight is returned when the height doesn't follow the parent's
+	ErrBadHeight = errors.New("invalid block height")
+
+	// ErrBadCoinbase is returned when the coinbase is missing or malformed
+	ErrBadCoinbase = errors.New("invalid coinbase")
+
+	// ErrBadTransaction is returned for malformed transactions
+	ErrBadTransaction = errors.New("invalid transaction")
+
+	// ErrBadSignature is returned when an input's signature does not verify
+	ErrBadSignature = errors.New("invalid transaction signature")
+
+	// ErrBadSpend is returned when transactions spend outputs that don't
+	// exist or don't belong to them, or create more than they spend
+	ErrBadSpend = errors.New("invalid spend")
+
+	// ErrInvalidAncestor is returned for blocks on top of an invalid block
+	ErrInvalidAncestor = errors.New("block builds on an invalid block")
+
+	// ErrHeaderNotLinked is returned when a header does not follow the
+	// previous header of a header chain
+	ErrHeaderNotLinked = errors.New("header does not connect to the previous header")
+)
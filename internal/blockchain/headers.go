@@ -0,0 +1,214 @@
+package blockchain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// MaxHeadersPerMsg is the most headers LocateHeaders returns at once
+const MaxHeadersPerMsg = 2000
+
+// checkHeaderSanity checks the proof of work of a header against its hash
+func checkHeaderSanity(params *chaincfg.Params, header *types.BlockHeader, hash [32]byte) error {
+	target := crypto.CompactToBig(header.Difficulty)
+	if target.Sign() <= 0 || target.Cmp(crypto.CompactToBig(params.PowLimitBits)) > 0 {
+		return fmt.Errorf("%w: target %08x out of range", ErrBadProofOfWork, header.Difficulty)
+	}
+
+	if !crypto.CheckProofOfWork(hash, header.Difficulty) {
+		return ErrBadProofOfWork
+	}
+	return nil
+}
+
+// checkHeaderContext checks the difficulty and timestamp of a header at
+// height against the branch ending at parent
+func checkHeaderContext(params *chaincfg.Params, header *types.BlockHeader, height uint64, parent *blockNode) error {
+	// Check the difficulty demanded by the retarget rules
+	requiredBits, err := calcNextRequiredDifficulty(params, height, parent.ancestorHeader)
+	if err != nil {
+		return fmt.Errorf("failed to calculate required difficulty: %w", err)
+	}
+	if header.Difficulty != requiredBits {
+		return fmt.Errorf("%w: %08x, want %08x", ErrBadDifficulty, header.Difficulty, requiredBits)
+	}
+
+	// Check the timestamp against the median of recent blocks and the clock
+	medianTime, err := calcMedianTimePast(params, parent.height, parent.ancestorHeader)
+	if err != nil {
+		return fmt.Errorf("failed to calculate median time: %w", err)
+	}
+	if !header.Timestamp.After(medianTime) {
+		return ErrBadTimestamp
+	}
+	if header.Timestamp.After(time.Now().Add(params.MaxFutureBlockTime)) {
+		return ErrFutureTimestamp
+	}
+
+	return nil
+}
+
+// blockLocator returns hashes of the branch ending at node, dense near the
+// tip and exponentially sparser towards the genesis block, which is always
+// included. A peer finds the fork point with its own chain from it.
+func blockLocator(node *blockNode) [][32]byte {
+	var locator [][32]byte
+	step := uint64(1)
+	for node != nil {
+		locator = append(locator, node.hash)
+		if node.height == 0 {
+			break
+		}
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		height := uint64(0)
+		if node.height > step {
+			height = node.height - step
+		}
+		node = node.Ancestor(height)
+	}
+	return locator
+}
+
+// BlockLocator returns a locator for the tip of the best chain
+func (c *Chain) BlockLocator() [][32]byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return blockLocator(c.tip())
+}
+
+// LocateHeaders returns the headers of the best chain following the first
+// locator hash that is on it, up to and including stop or at most max.
+// Without a match the headers following the genesis block are returned.
+func (c *Chain) LocateHeaders(locator [][32]byte, stop [32]byte, max int) []types.BlockHeader {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	start := uint64(1)
+	for _, hash := range locator {
+		if node, ok := c.index[hash]; ok && c.isMainChain(node) {
+			start = node.height + 1
+			break
+		}
+	}
+
+	var headers []types.BlockHeader
+	for height := start; height < uint64(len(c.bestChain)) && len(headers) < max; height++ {
+		node := c.bestChain[height]
+		headers = append(headers, node.header)
+		if node.hash == stop {
+			break
+		}
+	}
+	return headers
+}
+
+// HeaderChain is a branch of headers extending a block of the chain, used
+// to download and check the headers of blocks before their bodies. Each
+// header must link to the previous one, carry valid proof of work and the
+// required difficulty, and have an acceptable timestamp.
+type HeaderChain struct {
+	params *chaincfg.Params
+	base   *blockNode
+	nodes  []*blockNode
+}
+
+// NewHeaderChain starts a header chain on top of the block with the given
+// hash, which may be on any branch
+func (c *Chain) NewHeaderChain(base [32]byte) (*HeaderChain, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	node, ok := c.index[base]
+	if !ok {
+		return nil, fmt.Errorf("base block %x: %w", base, ErrUnknownParent)
+	}
+	if node.isInvalid() {
+		return nil, fmt.Errorf("base block %x is invalid", base)
+	}
+
+	// Nodes of the index never change their links or headers, so the
+	// header chain can walk through them without the chain lock
+	return &HeaderChain{params: c.params, base: node}, nil
+}
+
+// tip returns the last node of the header chain
+func (h *HeaderChain) tip() *blockNode {
+	if len(h.nodes) == 0 {
+		return h.base
+	}
+	return h.nodes[len(h.nodes)-1]
+}
+
+// Add checks headers that continue the header chain and appends them. On
+// error the headers before the failing one are kept.
+func (h *HeaderChain) Add(headers []types.BlockHeader) error {
+	for i := range headers {
+		header := &headers[i]
+		parent := h.tip()
+		hash := header.ComputeHash()
+
+		if header.PrevBlockHash != parent.hash {
+			return fmt.Errorf("%w: %x does not follow %x", ErrHeaderNotLinked, hash, parent.hash)
+		}
+		if err := checkHeaderSanity(h.params, header, hash); err != nil {
+			return fmt.Errorf("header %x: %w", hash, err)
+		}
+		if err := checkHeaderContext(h.params, header, parent.height+1, parent); err != nil {
+			return fmt.Errorf("header %x: %w", hash, err)
+		}
+
+		h.nodes = append(h.nodes, newHeaderNode(header, hash, parent))
+	}
+	return nil
+}
+
+// newHeaderNode creates a node for a header on top of parent
+func newHeaderNode(header *types.BlockHeader, hash [32]byte, parent *blockNode) *blockNode {
+	return newBlockNode(&types.Block{Header: *header, Hash: hash, Height: parent.height + 1}, parent)
+}
+
+// BaseHeight returns the height of the block the header chain starts on
+func (h *HeaderChain) BaseHeight() uint64 {
+	return h.base.height
+}
+
+// Height returns the height of the last header
+func (h *HeaderChain) Height() uint64 {
+	return h.tip().height
+}
+
+// TipHash returns the hash of the last header
+func (h *HeaderChain) TipHash() [32]byte {
+	return h.tip().hash
+}
+
+// HashAt returns the hash of the header at height, which must be above the
+// base and at most the height of the last header
+func (h *HeaderChain) HashAt(height uint64) ([32]byte, bool) {
+	if height <= h.base.height || height > h.Height() {
+		return [32]byte{}, false
+	}
+	return h.nodes[height-h.base.height-1].hash, true
+}
+
+// Locator returns a block locator for the last header
+func (h *HeaderChain) Locator() [][32]byte {
+	return blockLocator(h.tip())
+}
+
+// HasMoreWork reports whether the header chain has more work than the best
+// chain, so that its blocks would become the best chain
+func (c *Chain) HasMoreWork(h *HeaderChain) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return h.tip().workSum.Cmp(c.tip().workSum) > 0
+}
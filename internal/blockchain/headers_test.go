@@ -0,0 +1,163 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// solveHeader searches a nonce for the header
+func solveHeader(header *types.BlockHeader) {
+	for header.Nonce = 0; !crypto.CheckProofOfWork(header.ComputeHash(), header.Difficulty); header.Nonce++ {
+	}
+}
+
+func TestHeaderChain(t *testing.T) {
+	source := newRegTestChain(t, t.TempDir())
+	defer source.Close()
+	genesis, err := source.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	blocks := buildBranch(t, source, genesis, 3, 0)
+
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	tests := []struct {
+		name   string
+		modify func(h *types.BlockHeader)
+	}{
+		{"not linked", func(h *types.BlockHeader) {
+			h.PrevBlockHash = [32]byte{1}
+			solveHeader(h)
+		}},
+		{"bad proof of work", func(h *types.BlockHeader) {
+			for crypto.CheckProofOfWork(h.ComputeHash(), h.Difficulty) {
+				h.Nonce++
+			}
+		}},
+		{"wrong difficulty", func(h *types.BlockHeader) {
+			h.Difficulty = 0x2000ffff
+			solveHeader(h)
+		}},
+		{"timestamp not after median time", func(h *types.BlockHeader) {
+			h.Timestamp = genesis.Header.Timestamp
+			solveHeader(h)
+		}},
+		{"timestamp in the future", func(h *types.BlockHeader) {
+			h.Timestamp = time.Now().Add(3 * time.Hour)
+			solveHeader(h)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc, err := chain.NewHeaderChain(genesis.Hash)
+			if err != nil {
+				t.Fatalf("NewHeaderChain() error = %v", err)
+			}
+
+			header := blocks[0].Header
+			tt.modify(&header)
+			if err := hc.Add([]types.BlockHeader{header}); err == nil {
+				t.Error("Add() error = nil, want error")
+			}
+			if hc.Height() != 0 {
+				t.Errorf("Height() = %d after a rejected header, want 0", hc.Height())
+			}
+		})
+	}
+
+	hc, err := chain.NewHeaderChain(genesis.Hash)
+	if err != nil {
+		t.Fatalf("NewHeaderChain() error = %v", err)
+	}
+	headers := []types.BlockHeader{blocks[0].Header, blocks[1].Header, blocks[2].Header}
+	if err := hc.Add(headers); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if hc.Height() != 3 || hc.TipHash() != blocks[2].Hash {
+		t.Errorf("tip = %d %x, want 3 %x", hc.Height(), hc.TipHash(), blocks[2].Hash)
+	}
+	if hash, ok := hc.HashAt(2); !ok || hash != blocks[1].Hash {
+		t.Errorf("HashAt(2) = %x, %v, want %x", hash, ok, blocks[1].Hash)
+	}
+	if _, ok := hc.HashAt(0); ok {
+		t.Error("HashAt() of the base should fail")
+	}
+	if !chain.HasMoreWork(hc) {
+		t.Error("HasMoreWork() = false for a longer header chain")
+	}
+	if locator := hc.Locator(); locator[0] != blocks[2].Hash || locator[len(locator)-1] != genesis.Hash {
+		t.Errorf("Locator() = %x, want tip first and genesis last", locator)
+	}
+}
+
+func TestLocateHeaders(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	blocks := buildBranch(t, chain, genesis, 5, 0)
+	side := buildBranch(t, chain, genesis, 1, time.Minute)
+
+	tests := []struct {
+		name    string
+		locator [][32]byte
+		stop    [32]byte
+		max     int
+		want    []*types.Block
+	}{
+		{"after first known", [][32]byte{{1}, blocks[2].Hash, blocks[0].Hash}, [32]byte{}, MaxHeadersPerMsg, blocks[3:]},
+		{"side branch skipped", [][32]byte{side[0].Hash, blocks[3].Hash}, [32]byte{}, MaxHeadersPerMsg, blocks[4:]},
+		{"up to stop", [][32]byte{genesis.Hash}, blocks[1].Hash, MaxHeadersPerMsg, blocks[:2]},
+		{"at most max", [][32]byte{genesis.Hash}, [32]byte{}, 3, blocks[:3]},
+		{"no match", [][32]byte{{1}}, [32]byte{}, MaxHeadersPerMsg, blocks},
+		{"up to date", [][32]byte{blocks[4].Hash}, [32]byte{}, MaxHeadersPerMsg, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chain.LocateHeaders(tt.locator, tt.stop, tt.max)
+			if len(got) != len(tt.want) {
+				t.Fatalf("LocateHeaders() returned %d headers, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if hash := got[i].ComputeHash(); hash != tt.want[i].Hash {
+					t.Errorf("LocateHeaders()[%d] = %x, want %x", i, hash, tt.want[i].Hash)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockLocator(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	blocks := buildBranch(t, chain, genesis, 30, 0)
+
+	// Ten consecutive blocks from the tip, then doubling steps
+	wantHeights := []uint64{30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 19, 15, 7, 0}
+	locator := chain.BlockLocator()
+	if len(locator) != len(wantHeights) {
+		t.Fatalf("BlockLocator() has %d hashes, want %d", len(locator), len(wantHeights))
+	}
+	for i, height := range wantHeights {
+		want := genesis.Hash
+		if height > 0 {
+			want = blocks[height-1].Hash
+		}
+		if locator[i] != want {
+			t.Errorf("BlockLocator()[%d] = %x, want block at height %d", i, locator[i], height)
+		}
+	}
+}
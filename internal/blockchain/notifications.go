@@ -0,0 +1,283 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// DefaultObserverQueueSize is how many events may wait for a subscriber
+// by default
+const DefaultObserverQueueSize = 64
+
+// ErrSlowObserver ends a subscription with DropSlow set whose queue filled
+// up
+var ErrSlowObserver = errors.New("observer fell behind the chain")
+
+// EventType identifies the kind of a chain event
+type EventType int
+
+const (
+	// EventBlockConnected is sent when a block is appended to the best chain
+	EventBlockConnected EventType = iota
+	// EventBlockDisconnected is sent when a block is removed from the best
+	// chain during a reorganization
+	EventBlockDisconnected
+	// EventTipChanged is sent once per AddBlock that leaves the best chain
+	// with a new tip, after the events that led to it
+	EventTipChanged
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventBlockConnected:
+		return "block connected"
+	case EventBlockDisconnected:
+		return "block disconnected"
+	case EventTipChanged:
+		return "tip changed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event describes a change of the best chain
+type Event struct {
+	Type  EventType
+	Block *types.Block // The new tip for EventTipChanged
+}
+
+// Observer receives the changes of the best chain. Its methods are called
+// in order from a goroutine of its subscription, outside the chain lock,
+// so they may query the chain.
+type Observer interface {
+	BlockConnected(block *types.Block)
+	BlockDisconnected(block *types.Block)
+	TipChanged(tip *types.Block)
+}
+
+// ObserverFuncs adapts functions to an Observer, nil functions ignore
+// their events
+type ObserverFuncs struct {
+	OnBlockConnected    func(block *types.Block)
+	OnBlockDisconnected func(block *types.Block)
+	OnTipChanged        func(tip *types.Block)
+}
+
+// BlockConnected implements Observer
+func (f ObserverFuncs) BlockConnected(block *types.Block) {
+	if f.OnBlockConnected != nil {
+		f.OnBlockConnected(block)
+	}
+}
+
+// BlockDisconnected implements Observer
+func (f ObserverFuncs) BlockDisconnected(block *types.Block) {
+	if f.OnBlockDisconnected != nil {
+		f.OnBlockDisconnected(block)
+	}
+}
+
+// TipChanged implements Observer
+func (f ObserverFuncs) TipChanged(tip *types.Block) {
+	if f.OnTipChanged != nil {
+		f.OnTipChanged(tip)
+	}
+}
+
+// SubscribeOptions controls how events are queued for a subscriber
+type SubscribeOptions struct {
+	// QueueSize is how many events may wait for the subscriber, defaults
+	// to DefaultObserverQueueSize
+	QueueSize int
+
+	// DropSlow ends the subscription with ErrSlowObserver once its queue
+	// is full. By default the chain waits for the subscriber instead, which
+	// holds up writers of the chain but never loses events.
+	DropSlow bool
+}
+
+// Subscription queues chain events for a subscriber
+type Subscription struct {
+	chain     *Chain
+	dropSlow  bool
+	events    chan Event
+	cancelled chan struct{}
+	once      sync.Once
+
+	// mu orders sending events against closing the channel
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+// Events returns the channel events are delivered on. It is closed when
+// the subscription ends.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns ErrSlowObserver if the subscription was dropped for falling
+// behind, and nil otherwise
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Cancel ends the subscription. Events already queued may still be
+// received from Events, observers receive none after Cancel returns
+// unless it is called from one of their methods.
+func (s *Subscription) Cancel() {
+	s.once.Do(func() { close(s.cancelled) })
+	s.chain.removeSubscription(s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+// deliver queues an event, waiting for room unless the subscription drops
+// slow subscribers
+func (s *Subscription) deliver(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	if s.dropSlow {
+		select {
+		case s.events <- event:
+		default:
+			s.err = ErrSlowObserver
+			s.closeLocked()
+			s.chain.removeSubscription(s)
+		}
+		return
+	}
+	select {
+	case s.events <- event:
+	case <-s.cancelled:
+	}
+}
+
+// closeLocked closes the event channel once, the caller must hold mu
+func (s *Subscription) closeLocked() {
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+// Subscribe registers for all future events, which are delivered on the
+// channel of the subscription in the order the changes happened
+func (c *Chain) Subscribe(opts SubscribeOptions) *Subscription {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultObserverQueueSize
+	}
+	sub := &Subscription{
+		chain:     c,
+		dropSlow:  opts.DropSlow,
+		events:    make(chan Event, opts.QueueSize),
+		cancelled: make(chan struct{}),
+	}
+
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+
+	c.subscribers = append(c.subscribers, sub)
+	return sub
+}
+
+// Observe calls the methods of an observer for all future events until
+// the subscription is cancelled. An observer that adds blocks itself must
+// set DropSlow, or it may wait on its own full queue.
+func (c *Chain) Observe(observer Observer, opts SubscribeOptions) *Subscription {
+	sub := c.Subscribe(opts)
+	go func() {
+		for event := range sub.events {
+			select {
+			case <-sub.cancelled:
+				return
+			default:
+			}
+
+			switch event.Type {
+			case EventBlockConnected:
+				observer.BlockConnected(event.Block)
+			case EventBlockDisconnected:
+				observer.BlockDisconnected(event.Block)
+			case EventTipChanged:
+				observer.TipChanged(event.Block)
+			}
+		}
+	}()
+	return sub
+}
+
+// removeSubscription stops delivering events to a subscription
+func (c *Chain) removeSubscription(sub *Subscription) {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+
+	c.subscribers = slices.DeleteFunc(c.subscribers, func(s *Subscription) bool { return s == sub })
+}
+
+// notify queues an event for delivery once the chain is unlocked, the
+// caller must hold the lock
+func (c *Chain) notify(typ EventType, block *types.Block) {
+	c.pending = append(c.pending, Event{Type: typ, Block: block})
+}
+
+// unlockAndNotify releases the chain lock and delivers the queued events,
+// followed by EventTipChanged if the tip is no longer oldTip. Delivery is
+// serialized before unlocking so events of concurrent writers are not
+// reordered.
+func (c *Chain) unlockAndNotify(oldTip *blockNode) {
+	if tip := c.tip(); tip != oldTip {
+		if block := c.pendingBlock(tip.hash); block != nil {
+			c.notify(EventTipChanged, block)
+		}
+	}
+	pending := c.pending
+	c.pending = nil
+
+	if len(pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+	c.mu.Unlock()
+
+	c.subscribersMu.Lock()
+	subscribers := slices.Clone(c.subscribers)
+	c.subscribersMu.Unlock()
+
+	for _, event := range pending {
+		for _, sub := range subscribers {
+			sub.deliver(event)
+		}
+	}
+}
+
+// pendingBlock returns the block of a queued connect event, or loads it
+func (c *Chain) pendingBlock(hash [32]byte) *types.Block {
+	for i := len(c.pending) - 1; i >= 0; i-- {
+		if c.pending[i].Block.Hash == hash {
+			return c.pending[i].Block
+		}
+	}
+	block, err := c.store.GetBlockByHash(hash)
+	if err != nil {
+		return nil
+	}
+	return block
+}
@@ -0,0 +1,132 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// nextEvent returns the next event of a subscription, failing the test if
+// none arrives
+func nextEvent(t *testing.T, sub *Subscription) (Event, bool) {
+	t.Helper()
+	select {
+	case event, ok := <-sub.Events():
+		return event, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+		return Event{}, false
+	}
+}
+
+func TestObserve(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	type call struct {
+		method string
+		hash   [32]byte
+		height uint64 // Chain height seen from the observer
+	}
+	calls := make(chan call, 10)
+	sub := chain.Observe(ObserverFuncs{
+		OnBlockConnected: func(block *types.Block) {
+			calls <- call{"BlockConnected", block.Hash, chain.GetHeight()}
+		},
+		OnTipChanged: func(tip *types.Block) {
+			calls <- call{"TipChanged", tip.Hash, chain.GetHeight()}
+		},
+	}, SubscribeOptions{})
+	defer sub.Cancel()
+
+	blocks := buildBranch(t, chain, genesis, 2, 0)
+
+	want := []call{
+		{"BlockConnected", blocks[0].Hash, 1},
+		{"TipChanged", blocks[0].Hash, 1},
+		{"BlockConnected", blocks[1].Hash, 2},
+		{"TipChanged", blocks[1].Hash, 2},
+	}
+	for i, w := range want {
+		select {
+		case got := <-calls:
+			// The observer runs behind the chain, it sees at least the height
+			// of the event
+			if got.method != w.method || got.hash != w.hash || got.height < w.height {
+				t.Errorf("call %d = %s %x at height %d, want %s %x", i, got.method, got.hash, got.height, w.method, w.hash)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("call %d not made", i)
+		}
+	}
+
+	sub.Cancel()
+	buildBranch(t, chain, blocks[1], 1, 0)
+	select {
+	case got := <-calls:
+		t.Errorf("call after Cancel = %s %x", got.method, got.hash)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriptionBackpressure(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	waiting := chain.Subscribe(SubscribeOptions{QueueSize: 1})
+	dropped := chain.Subscribe(SubscribeOptions{QueueSize: 1, DropSlow: true})
+
+	// Each block sends two events, the second waits for room
+	added := make(chan []*types.Block, 1)
+	go func() { added <- buildBranch(t, chain, genesis, 1, 0) }()
+
+	select {
+	case <-added:
+		t.Fatal("AddBlock() returned before the waiting subscriber had room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	connected, _ := nextEvent(t, waiting)
+	tip, _ := nextEvent(t, waiting)
+	if connected.Type != EventBlockConnected || tip.Type != EventTipChanged || tip.Block.Hash != connected.Block.Hash {
+		t.Errorf("events = %v, %v, want block connected and tip changed", connected.Type, tip.Type)
+	}
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddBlock() still waiting after the subscriber caught up")
+	}
+
+	// The dropping subscriber kept the first event and lost the rest
+	if event, ok := nextEvent(t, dropped); !ok || event.Type != EventBlockConnected {
+		t.Errorf("first event = %v, %v, want block connected", event.Type, ok)
+	}
+	if _, ok := nextEvent(t, dropped); ok {
+		t.Error("events of the dropped subscription are still open")
+	}
+	if err := dropped.Err(); !errors.Is(err, ErrSlowObserver) {
+		t.Errorf("Err() = %v, want %v", err, ErrSlowObserver)
+	}
+	if err := waiting.Err(); err != nil {
+		t.Errorf("Err() of the waiting subscription = %v, want nil", err)
+	}
+
+	// A cancelled subscriber no longer holds up the chain
+	waiting.Cancel()
+	buildBranch(t, chain, tip.Block, 2, 0)
+	if _, ok := <-waiting.Events(); ok {
+		t.Error("events of the cancelled subscription are still open")
+	}
+}
@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+const (
+	// maxOrphanBlocks is the most orphans held at once
+	maxOrphanBlocks = 100
+
+	// maxOrphanBytes bounds the approximate memory held by orphans
+	maxOrphanBytes = 32 << 20
+
+	// orphanTTL is how long an orphan waits for its parent
+	orphanTTL = 20 * time.Minute
+)
+
+// orphanBlock is a block waiting for its parent
+type orphanBlock struct {
+	block      *types.Block
+	size       int
+	expiration time.Time
+}
+
+// orphanPool holds blocks whose parent is not known yet, keyed by their own
+// hash and by the hash of the missing parent
+type orphanPool struct {
+	orphans  map[[32]byte]*orphanBlock
+	byParent map[[32]byte][]*orphanBlock
+
+	maxOrphans int
+	maxBytes   int
+	ttl        time.Duration
+	totalBytes int
+}
+
+// newOrphanPool creates an empty orphan pool with the given limits
+func newOrphanPool(maxOrphans, maxBytes int, ttl time.Duration) *orphanPool {
+	return &orphanPool{
+		orphans:    make(map[[32]byte]*orphanBlock),
+		byParent:   make(map[[32]byte][]*orphanBlock),
+		maxOrphans: maxOrphans,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+	}
+}
+
+// has reports whether the block is held as an orphan
+func (p *orphanPool) has(hash [32]byte) bool {
+	_, ok := p.orphans[hash]
+	return ok
+}
+
+// add stores the orphan, evicting expired orphans and then the ones closest
+// to expiry until the pool is within its limits
+func (p *orphanPool) add(block *types.Block, now time.Time) {
+	if p.has(block.Hash) {
+		return
+	}
+
+	p.expire(now)
+
+	orphan := &orphanBlock{
+		block:      block,
+		size:       approxBlockSize(block),
+		expiration: now.Add(p.ttl),
+	}
+	if orphan.size > p.maxBytes {
+		return
+	}
+
+	for len(p.orphans) >= p.maxOrphans || p.totalBytes+orphan.size > p.maxBytes {
+		p.remove(p.oldest())
+	}
+
+	p.orphans[block.Hash] = orphan
+	parent := block.Header.PrevBlockHash
+	p.byParent[parent] = append(p.byParent[parent], orphan)
+	p.totalBytes += orphan.size
+}
+
+// takeChildren removes and returns the orphans waiting for parent
+func (p *orphanPool) takeChildren(parent [32]byte) []*types.Block {
+	children := p.byParent[parent]
+	blocks := make([]*types.Block, 0, len(children))
+	for _, orphan := range children {
+		blocks = append(blocks, orphan.block)
+	}
+	for _, orphan := range children {
+		p.remove(orphan)
+	}
+	return blocks
+}
+
+// root walks back through the orphans starting at hash and returns the
+// hash of the first ancestor that is not an orphan
+func (p *orphanPool) root(hash [32]byte) [32]byte {
+	for {
+		orphan, ok := p.orphans[hash]
+		if !ok {
+			return hash
+		}
+		hash = orphan.block.Header.PrevBlockHash
+	}
+}
+
+// expire removes all orphans that waited longer than the TTL
+func (p *orphanPool) expire(now time.Time) {
+	for _, orphan := range p.orphans {
+		if now.After(orphan.expiration) {
+			p.remove(orphan)
+		}
+	}
+}
+
+// oldest returns the orphan closest to expiry
+func (p *orphanPool) oldest() *orphanBlock {
+	var oldest *orphanBlock
+	for _, orphan := range p.orphans {
+		if oldest == nil || orphan.expiration.Before(oldest.expiration) {
+			oldest = orphan
+		}
+	}
+	return oldest
+}
+
+// remove deletes the orphan from both maps
+func (p *orphanPool) remove(orphan *orphanBlock) {
+	hash := orphan.block.Hash
+	if _, ok := p.orphans[hash]; !ok {
+		return
+	}
+	delete(p.orphans, hash)
+	p.totalBytes -= orphan.size
+
+	parent := orphan.block.Header.PrevBlockHash
+	siblings := p.byParent[parent]
+	for i, sibling := range siblings {
+		if sibling == orphan {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.byParent, parent)
+	} else {
+		p.byParent[parent] = siblings
+	}
+}
+
+// approxBlockSize estimates the memory held by a block
+func approxBlockSize(block *types.Block) int {
+	size := 128
+	for _, tx := range block.Transactions {
+		size += 64
+		for _, input := range tx.Inputs {
+			size += 40 + len(input.PublicKey) + len(input.Signature)
+		}
+		for _, output := range tx.Outputs {
+			size += 8 + len(output.PublicKeyHash)
+		}
+	}
+	return size
+}
@@ -0,0 +1,109 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+func TestOrphanBlocks(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	child := childBlock(genesis, 0)
+	grandchild := childBlock(child, 0)
+	greatGrandchild := childBlock(grandchild, 0)
+
+	if err := chain.ValidateBlock(grandchild); !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("ValidateBlock() error = %v, want %v", err, ErrUnknownParent)
+	}
+
+	for _, orphan := range []*types.Block{greatGrandchild, grandchild} {
+		if err := chain.AddBlock(orphan); !errors.Is(err, ErrOrphanBlock) {
+			t.Fatalf("AddBlock() error = %v, want %v", err, ErrOrphanBlock)
+		}
+	}
+	if err := chain.AddBlock(grandchild); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("AddBlock() of held orphan error = %v, want %v", err, ErrDuplicateBlock)
+	}
+
+	if !chain.HaveBlock(greatGrandchild.Hash) {
+		t.Error("HaveBlock() should report orphans")
+	}
+	if got := chain.OrphanRoot(greatGrandchild.Hash); got != child.Hash {
+		t.Errorf("OrphanRoot() = %x, want %x", got, child.Hash)
+	}
+	if got := chain.GetHeight(); got != 0 {
+		t.Errorf("GetHeight() = %d, want 0 while parent is missing", got)
+	}
+
+	// The missing parent connects the whole orphan chain
+	if err := chain.AddBlock(child); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	if got := chain.GetHeight(); got != 3 {
+		t.Errorf("GetHeight() = %d, want 3", got)
+	}
+	if got := chain.OrphanRoot(greatGrandchild.Hash); got != greatGrandchild.Hash {
+		t.Errorf("OrphanRoot() of connected block = %x, want itself", got)
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	now := time.Now()
+	parent := &types.Block{Header: types.BlockHeader{Timestamp: now}}
+
+	orphans := make([]*types.Block, 4)
+	for i := range orphans {
+		orphans[i] = childBlock(parent, time.Duration(i)*time.Minute)
+	}
+
+	pool := newOrphanPool(3, maxOrphanBytes, time.Minute)
+	for i, orphan := range orphans {
+		pool.add(orphan, now.Add(time.Duration(i)*time.Second))
+	}
+
+	// The orphan closest to expiry made room for the newest one
+	if pool.has(orphans[0].Hash) {
+		t.Error("Oldest orphan should have been evicted")
+	}
+	if len(pool.orphans) != 3 {
+		t.Errorf("len(orphans) = %d, want 3", len(pool.orphans))
+	}
+
+	// Adding after the TTL expires everything that was waiting
+	late := childBlock(parent, time.Hour)
+	pool.add(late, now.Add(2*time.Minute))
+	if len(pool.orphans) != 1 || !pool.has(late.Hash) {
+		t.Errorf("Pool holds %d orphans after expiry, want only the new one", len(pool.orphans))
+	}
+
+	children := pool.takeChildren(parent.Hash)
+	if len(children) != 1 || children[0].Hash != late.Hash {
+		t.Errorf("takeChildren() = %d blocks, want the remaining orphan", len(children))
+	}
+	if len(pool.orphans) != 0 || len(pool.byParent) != 0 || pool.totalBytes != 0 {
+		t.Error("Pool should be empty after taking all children")
+	}
+}
+
+func TestOrphanPoolByteLimit(t *testing.T) {
+	now := time.Now()
+	parent := &types.Block{Header: types.BlockHeader{Timestamp: now}}
+	first, second := childBlock(parent, 0), childBlock(parent, time.Minute)
+
+	pool := newOrphanPool(maxOrphanBlocks, approxBlockSize(first), time.Minute)
+	pool.add(first, now)
+	pool.add(second, now.Add(time.Second))
+
+	if pool.has(first.Hash) || !pool.has(second.Hash) {
+		t.Error("Byte limit should evict the older orphan")
+	}
+}
@@ -0,0 +1,285 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+	"github.com/fkapsahili/mini-blockchain/internal/utxo"
+)
+
+// newRegTestChain opens a chain with trivial proof of work in dir
+func newRegTestChain(t *testing.T, dir string) *Chain {
+	t.Helper()
+
+	chain, err := OpenChain(dir, Options{Params: &chaincfg.RegTestParams})
+	if err != nil {
+		t.Fatalf("Failed to open chain: %v", err)
+	}
+	return chain
+}
+
+// childBlock returns a solved block on top of parent, offset makes sibling
+// blocks distinct
+func childBlock(parent *types.Block, offset time.Duration) *types.Block {
+	block := &types.Block{
+		Header: types.BlockHeader{
+			Version:       1,
+			PrevBlockHash: parent.Hash,
+			Timestamp:     parent.Header.Timestamp.Add(time.Second + offset),
+			Difficulty:    chaincfg.RegTestParams.PowLimitBits,
+		},
+		Height:       parent.Height + 1,
+		Transactions: []types.Transaction{types.NewCoinbaseTransaction(parent.Height+1, 0, nil)},
+	}
+	solveBlock(block)
+	return block
+}
+
+// buildBranch adds count blocks on top of parent and returns them
+func buildBranch(t *testing.T, chain *Chain, parent *types.Block, count int, offset time.Duration) []*types.Block {
+	t.Helper()
+
+	branch := make([]*types.Block, 0, count)
+	for i := 0; i < count; i++ {
+		block := childBlock(parent, offset)
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock() at height %d error = %v", block.Height, err)
+		}
+		branch = append(branch, block)
+		parent = block
+	}
+	return branch
+}
+
+func TestReorganize(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	mainBranch := buildBranch(t, chain, genesis, 2, 0)
+	if got := chain.GetHeight(); got != 2 {
+		t.Fatalf("GetHeight() = %d, want 2", got)
+	}
+
+	// A competing branch of equal work does not replace the first seen one
+	sideBranch := buildBranch(t, chain, genesis, 2, time.Minute)
+	latest, _ := chain.GetLatestBlock()
+	if latest.Hash != mainBranch[1].Hash {
+		t.Fatalf("Tip = %x, want first seen branch %x", latest.Hash, mainBranch[1].Hash)
+	}
+	if chain.IsMainChain(sideBranch[1].Hash) {
+		t.Error("Side branch block should not be on the main chain")
+	}
+
+	// One more block gives the side branch more work
+	sideBranch = append(sideBranch, buildBranch(t, chain, sideBranch[1], 1, 0)...)
+	if got := chain.GetHeight(); got != 3 {
+		t.Fatalf("GetHeight() after reorg = %d, want 3", got)
+	}
+
+	for i, block := range sideBranch {
+		got, err := chain.GetBlock(uint64(i + 1))
+		if err != nil {
+			t.Fatalf("GetBlock(%d) error = %v", i+1, err)
+		}
+		if got.Hash != block.Hash {
+			t.Errorf("GetBlock(%d) = %x, want %x", i+1, got.Hash, block.Hash)
+		}
+	}
+	if chain.IsMainChain(mainBranch[0].Hash) {
+		t.Error("Disconnected block should not be on the main chain")
+	}
+	if !chain.HaveBlock(mainBranch[0].Hash) {
+		t.Error("Disconnected block should still be known")
+	}
+}
+
+func TestReorganizePersists(t *testing.T) {
+	dir := t.TempDir()
+	chain := newRegTestChain(t, dir)
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	buildBranch(t, chain, genesis, 1, 0)
+	side := buildBranch(t, chain, genesis, 2, time.Minute)
+	wantWork := chain.ChainWork()
+	chain.Close()
+
+	reopened := newRegTestChain(t, dir)
+	defer reopened.Close()
+
+	latest, err := reopened.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+	if latest.Hash != side[1].Hash {
+		t.Errorf("Tip after reopen = %x, want %x", latest.Hash, side[1].Hash)
+	}
+	if reopened.ChainWork().Cmp(wantWork) != 0 {
+		t.Errorf("ChainWork() after reopen = %s, want %s", reopened.ChainWork(), wantWork)
+	}
+
+	// Side branches are restored too and can still be extended
+	if err := reopened.AddBlock(childBlock(side[0], time.Hour)); err != nil {
+		t.Errorf("AddBlock() on restored side branch error = %v", err)
+	}
+}
+
+func TestReorganizeInvalidBranch(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	mainBranch := buildBranch(t, chain, genesis, 1, 0)
+	side := buildBranch(t, chain, genesis, 1, time.Minute)
+
+	// A signed transaction spending an output that never existed passes the
+	// context-free checks but fails when the block is connected
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	tx := types.Transaction{
+		Version: 1,
+		Inputs:  []types.TransactionInput{{PrevTxHash: [32]byte{0xee}}},
+		Outputs: []types.TransactionOutput{{Amount: 1, PublicKeyHash: crypto.HashToAddress(&key.PublicKey)}},
+	}
+	if err := tx.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	bad := childBlock(side[0], 0)
+	bad.Transactions = append(bad.Transactions, tx)
+	solveBlock(bad)
+
+	if err := chain.AddBlock(bad); err == nil {
+		t.Fatal("AddBlock() of a block spending a missing output should fail")
+	}
+
+	latest, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+	if latest.Hash != mainBranch[0].Hash {
+		t.Errorf("Tip = %x, want restored %x", latest.Hash, mainBranch[0].Hash)
+	}
+
+	// Blocks building on the invalid block are rejected outright
+	if err := chain.AddBlock(childBlock(bad, 0)); err == nil {
+		t.Error("AddBlock() on top of an invalid block should fail")
+	}
+}
+
+func TestReorganizeNotifications(t *testing.T) {
+	chain := newRegTestChain(t, t.TempDir())
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+	mainBranch := buildBranch(t, chain, genesis, 1, 0)
+
+	sub := chain.Subscribe(SubscribeOptions{})
+	defer sub.Cancel()
+
+	side := buildBranch(t, chain, genesis, 2, time.Minute)
+
+	// The side branch is stored before it has more work, a single tip
+	// change follows the reorganization
+	want := []Event{
+		{EventBlockDisconnected, mainBranch[0]},
+		{EventBlockConnected, side[0]},
+		{EventBlockConnected, side[1]},
+		{EventTipChanged, side[1]},
+	}
+	for i, w := range want {
+		select {
+		case got := <-sub.Events():
+			if got.Type != w.Type || got.Block.Hash != w.Block.Hash {
+				t.Errorf("event %d = %v %x, want %v %x", i, got.Type, got.Block.Hash, w.Type, w.Block.Hash)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+	select {
+	case got := <-sub.Events():
+		t.Errorf("unexpected event %v %x", got.Type, got.Block.Hash)
+	default:
+	}
+}
+
+func TestUtxoSetCatchUp(t *testing.T) {
+	dir := t.TempDir()
+	chain := newRegTestChain(t, dir)
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	// Blocks whose coinbase pays an output, so each leaves a trace in the
+	// set. The branches pay different addresses to tell their outputs apart.
+	paying := func(parent *types.Block, count int, offset time.Duration) []*types.Block {
+		payTo := make([]byte, 20)
+		payTo[0] = byte(offset / time.Minute)
+		var branch []*types.Block
+		for i := 0; i < count; i++ {
+			block := childBlock(parent, offset)
+			block.Transactions[0] = types.NewCoinbaseTransaction(block.Height, 0, []types.TransactionOutput{{Amount: 1, PublicKeyHash: payTo}})
+			solveBlock(block)
+			if err := chain.AddBlock(block); err != nil {
+				t.Fatalf("AddBlock() at height %d error = %v", block.Height, err)
+			}
+			branch = append(branch, block)
+			parent = block
+		}
+		return branch
+	}
+
+	mainBranch := paying(genesis, 2, 0)
+	if err := chain.flushUtxos(); err != nil {
+		t.Fatalf("flushUtxos() error = %v", err)
+	}
+	sideBranch := paying(genesis, 3, time.Minute)
+
+	// Connecting blocks doesn't rewrite the set every time
+	saved, err := utxo.Open(dir)
+	if err != nil {
+		t.Fatalf("utxo.Open() error = %v", err)
+	}
+	if saved.BestHash() != mainBranch[1].Hash {
+		t.Fatalf("Saved set at %x, want %x", saved.BestHash(), mainBranch[1].Hash)
+	}
+
+	// Crash without writing the set, which is still at the old branch
+	chain.store.Close()
+
+	reopened := newRegTestChain(t, dir)
+	defer reopened.Close()
+	for _, block := range mainBranch {
+		if reopened.FetchUtxo(utxo.Outpoint{TxHash: block.Transactions[0].Hash}) != nil {
+			t.Errorf("Output of disconnected block %d still unspent", block.Height)
+		}
+	}
+	for _, block := range sideBranch {
+		if reopened.FetchUtxo(utxo.Outpoint{TxHash: block.Transactions[0].Hash}) == nil {
+			t.Errorf("Output of connected block %d missing", block.Height)
+		}
+	}
+}
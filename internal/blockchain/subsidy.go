@@ -0,0 +1,84 @@
+package blockchain
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+)
+
+// maxHalvings is the number of halvings after which the subsidy is zero
+const maxHalvings = 64
+
+// CalcBlockSubsidy returns the amount the coinbase of the block at height
+// may mint on top of the fees it collects. The genesis block mints nothing,
+// the subsidy halves every SubsidyHalvingInterval blocks and stops once
+// MaxSupply has been minted.
+func CalcBlockSubsidy(params *chaincfg.Params, height uint64) uint64 {
+	if height == 0 {
+		return 0
+	}
+
+	issued := issuedBefore(params, height)
+	if issued >= params.MaxSupply {
+		return 0
+	}
+	return min(baseSubsidy(params, height), params.MaxSupply-issued)
+}
+
+// baseSubsidy returns the halved subsidy for height ignoring the supply cap
+func baseSubsidy(params *chaincfg.Params, height uint64) uint64 {
+	if params.SubsidyHalvingInterval == 0 {
+		return params.InitialSubsidy
+	}
+
+	halvings := height / params.SubsidyHalvingInterval
+	if halvings >= maxHalvings {
+		return 0
+	}
+	return params.InitialSubsidy >> halvings
+}
+
+// issuedBefore returns the uncapped subsidy of all blocks below height,
+// saturating at the largest uint64
+func issuedBefore(params *chaincfg.Params, height uint64) uint64 {
+	interval := params.SubsidyHalvingInterval
+	if interval == 0 {
+		return mulSaturating(height-1, params.InitialSubsidy)
+	}
+
+	var total uint64
+	for era := uint64(0); era < maxHalvings; era++ {
+		hi, eraStart := bits.Mul64(era, interval)
+		if hi != 0 || eraStart >= height {
+			break
+		}
+
+		start := max(eraStart, 1)
+		end := height
+		if next := eraStart + interval; next > eraStart && next < height {
+			end = next
+		}
+
+		total = addSaturating(total, mulSaturating(end-start, params.InitialSubsidy>>era))
+	}
+	return total
+}
+
+// addSaturating adds without wrapping around
+func addSaturating(a, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
+
+// mulSaturating multiplies without wrapping around
+func mulSaturating(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	if hi != 0 {
+		return math.MaxUint64
+	}
+	return lo
+}
@@ -0,0 +1,52 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+)
+
+func TestCalcBlockSubsidy(t *testing.T) {
+	regtest := &chaincfg.RegTestParams
+	capped := &chaincfg.Params{InitialSubsidy: 10, MaxSupply: 25}
+	halving := &chaincfg.Params{InitialSubsidy: 8, SubsidyHalvingInterval: 2, MaxSupply: 100}
+
+	tests := []struct {
+		name   string
+		params *chaincfg.Params
+		height uint64
+		want   uint64
+	}{
+		{"genesis mints nothing", regtest, 0, 0},
+		{"first block", regtest, 1, 50 * chaincfg.Coin},
+		{"last block before halving", regtest, 149, 50 * chaincfg.Coin},
+		{"first halving", regtest, 150, 25 * chaincfg.Coin},
+		{"second halving", regtest, 300, 25 * chaincfg.Coin / 2},
+		{"after all halvings", regtest, 64 * 150, 0},
+		{"before the cap", capped, 2, 10},
+		{"reaching the cap", capped, 3, 5},
+		{"past the cap", capped, 4, 0},
+		{"halving schedule", halving, 3, 4},
+		{"halving schedule to zero", halving, 8, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CalcBlockSubsidy(tt.params, tt.height); got != tt.want {
+				t.Errorf("CalcBlockSubsidy(%d) = %d, want %d", tt.height, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTotalSupplyWithinCap(t *testing.T) {
+	params := &chaincfg.Params{InitialSubsidy: 1000, SubsidyHalvingInterval: 10, MaxSupply: 15000}
+
+	var total uint64
+	for height := uint64(1); height < 1000; height++ {
+		total += CalcBlockSubsidy(params, height)
+	}
+	if total != params.MaxSupply {
+		t.Errorf("Total supply = %d, want %d", total, params.MaxSupply)
+	}
+}
@@ -0,0 +1,158 @@
+package chaincfg
+
+import (
+	"fmt"
+	"time"
+)
+
+// Coin is the number of base units in one coin
+const Coin uint64 = 100_000_000
+
+// RetargetMode selects how the required difficulty is adjusted
+type RetargetMode int
+
+const (
+	// RetargetNone keeps the difficulty at the proof of work limit
+	RetargetNone RetargetMode = iota
+	// RetargetPeriodic adjusts the difficulty once every RetargetInterval blocks
+	RetargetPeriodic
+	// RetargetMovingAverage adjusts the difficulty on every block from the
+	// average target and block time of the last AveragingWindow blocks
+	RetargetMovingAverage
+)
+
+// String returns the name of the retarget mode
+func (m RetargetMode) String() string {
+	switch m {
+	case RetargetNone:
+		return "none"
+	case RetargetPeriodic:
+		return "periodic"
+	case RetargetMovingAverage:
+		return "moving-average"
+	default:
+		return fmt.Sprintf("RetargetMode(%d)", int(m))
+	}
+}
+
+// Params defines the consensus rules of a network
+type Params struct {
+	// Name identifies the network
+	Name string
+
+	// Net is the magic value starting every peer message, it keeps nodes
+	// of different networks from talking to each other
+	Net uint32
+
+	// DefaultPort is the port peers listen on
+	DefaultPort uint16
+
+	// DefaultRPCPort is the port the JSON-RPC server listens on
+	DefaultRPCPort uint16
+
+	// GenesisTimestamp is the timestamp of the genesis block
+	GenesisTimestamp time.Time
+
+	// PowLimitBits is the compact encoding of the easiest allowed target
+	PowLimitBits uint32
+
+	// TargetBlockTime is the desired average time between blocks
+	TargetBlockTime time.Duration
+
+	// RetargetMode selects the difficulty adjustment algorithm
+	RetargetMode RetargetMode
+
+	// RetargetInterval is the number of blocks between periodic adjustments
+	RetargetInterval uint64
+
+	// AveragingWindow is the number of blocks the moving average covers
+	AveragingWindow uint64
+
+	// MaxAdjustmentFactor bounds how far a single adjustment may move the
+	// target in either direction
+	MaxAdjustmentFactor int64
+
+	// MedianTimeBlocks is the number of previous blocks whose median
+	// timestamp a new block must exceed
+	MedianTimeBlocks int
+
+	// MaxFutureBlockTime is how far ahead of the local clock a block
+	// timestamp may be
+	MaxFutureBlockTime time.Duration
+
+	// InitialSubsidy is the amount a coinbase may mint before any halving
+	InitialSubsidy uint64
+
+	// SubsidyHalvingInterval is the number of blocks between halvings
+	SubsidyHalvingInterval uint64
+
+	// MaxSupply caps the total amount ever minted by coinbases
+	MaxSupply uint64
+}
+
+// MainNetParams are the consensus rules of the main network
+var MainNetParams = Params{
+	Name:                   "mainnet",
+	Net:                    0x6d696e69,
+	DefaultPort:            8333,
+	DefaultRPCPort:         8332,
+	GenesisTimestamp:       time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC),
+	PowLimitBits:           0x1f0fffff,
+	TargetBlockTime:        time.Minute,
+	RetargetMode:           RetargetPeriodic,
+	RetargetInterval:       120,
+	MaxAdjustmentFactor:    4,
+	MedianTimeBlocks:       11,
+	MaxFutureBlockTime:     2 * time.Hour,
+	InitialSubsidy:         50 * Coin,
+	SubsidyHalvingInterval: 210_000,
+	MaxSupply:              21_000_000 * Coin,
+}
+
+// TestNetParams are the consensus rules of the test network, which retargets
+// on every block so that it recovers quickly when miners come and go
+var TestNetParams = Params{
+	Name:                   "testnet",
+	Net:                    0x74657374,
+	DefaultPort:            18333,
+	DefaultRPCPort:         18332,
+	GenesisTimestamp:       time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC),
+	PowLimitBits:           0x1f0fffff,
+	TargetBlockTime:        30 * time.Second,
+	RetargetMode:           RetargetMovingAverage,
+	AveragingWindow:        17,
+	MaxAdjustmentFactor:    2,
+	MedianTimeBlocks:       11,
+	MaxFutureBlockTime:     2 * time.Hour,
+	InitialSubsidy:         50 * Coin,
+	SubsidyHalvingInterval: 210_000,
+	MaxSupply:              21_000_000 * Coin,
+}
+
+// RegTestParams are the consensus rules for local regression testing, with
+// a trivial target that never adjusts
+var RegTestParams = Params{
+	Name:                   "regtest",
+	Net:                    0x72656774,
+	DefaultPort:            18444,
+	DefaultRPCPort:         18443,
+	GenesisTimestamp:       time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC),
+	PowLimitBits:           0x207fffff,
+	TargetBlockTime:        time.Second,
+	RetargetMode:           RetargetNone,
+	MedianTimeBlocks:       11,
+	MaxFutureBlockTime:     2 * time.Hour,
+	InitialSubsidy:         50 * Coin,
+	SubsidyHalvingInterval: 150,
+	MaxSupply:              21_000_000 * Coin,
+}
+
+// ParamsForName returns the parameters of the named network
+func ParamsForName(name string) (*Params, error) {
+	for _, params := range []*Params{&MainNetParams, &TestNetParams, &RegTestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
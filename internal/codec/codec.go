@@ -0,0 +1,302 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the version of the binary encoding, data written to disk is
+// tagged with it so the format can evolve. Version 2 added the witness root
+// to block headers.
+const Version uint32 = 2
+
+var (
+	// ErrLimitExceeded is returned when decoding would read past the limit
+	ErrLimitExceeded = errors.New("encoded data exceeds limit")
+
+	// ErrNonCanonical is returned for encodings that are valid but not the
+	// unique canonical form, such as varints with redundant bytes
+	ErrNonCanonical = errors.New("non-canonical encoding")
+
+	// ErrTrailingData is returned when input remains after decoding a value
+	ErrTrailingData = errors.New("trailing data after value")
+)
+
+// Encoder is implemented by types with a canonical binary encoding
+type Encoder interface {
+	Encode(w *Writer)
+}
+
+// Decoder is implemented by types that can be decoded from their canonical
+// binary encoding
+type Decoder interface {
+	Decode(r *Reader)
+}
+
+// Marshal returns the canonical encoding of v
+func Marshal(v Encoder) []byte {
+	var buf bytes.Buffer
+	v.Encode(NewWriter(&buf))
+	return buf.Bytes()
+}
+
+// Unmarshal decodes data into v, all of data must be consumed
+func Unmarshal(data []byte, v Decoder) error {
+	r := NewReader(bytes.NewReader(data), int64(len(data)))
+	v.Decode(r)
+	if err := r.Err(); err != nil {
+		// The limit is the end of data, so hitting it means data is truncated
+		if errors.Is(err, ErrLimitExceeded) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if r.Remaining() != 0 {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// Writer writes little-endian integers, varints and length-prefixed byte
+// strings. The first error is kept and later writes become no-ops.
+type Writer struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+// NewWriter creates a writer on top of w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Err returns the first error encountered while writing
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(b)
+}
+
+// WriteUint8 writes a single byte
+func (w *Writer) WriteUint8(v uint8) {
+	w.buf[0] = v
+	w.write(w.buf[:1])
+}
+
+// WriteUint16 writes v as 2 little-endian bytes
+func (w *Writer) WriteUint16(v uint16) {
+	binary.LittleEndian.PutUint16(w.buf[:2], v)
+	w.write(w.buf[:2])
+}
+
+// WriteUint32 writes v as 4 little-endian bytes
+func (w *Writer) WriteUint32(v uint32) {
+	binary.LittleEndian.PutUint32(w.buf[:4], v)
+	w.write(w.buf[:4])
+}
+
+// WriteUint64 writes v as 8 little-endian bytes
+func (w *Writer) WriteUint64(v uint64) {
+	binary.LittleEndian.PutUint64(w.buf[:8], v)
+	w.write(w.buf[:8])
+}
+
+// WriteInt32 writes v as 4 little-endian bytes
+func (w *Writer) WriteInt32(v int32) {
+	w.WriteUint32(uint32(v))
+}
+
+// WriteInt64 writes v as 8 little-endian bytes
+func (w *Writer) WriteInt64(v int64) {
+	w.WriteUint64(uint64(v))
+}
+
+// WriteVarInt writes v as an unsigned LEB128 varint
+func (w *Writer) WriteVarInt(v uint64) {
+	n := binary.PutUvarint(w.buf[:], v)
+	w.write(w.buf[:n])
+}
+
+// WriteHash writes a 32-byte hash
+func (w *Writer) WriteHash(h [32]byte) {
+	w.write(h[:])
+}
+
+// WriteBytes writes b prefixed with its length
+func (w *Writer) WriteBytes(b []byte) {
+	w.WriteVarInt(uint64(len(b)))
+	w.write(b)
+}
+
+// Reader is the counterpart of Writer. It never reads more than its limit
+// in total, so a length prefix can't make it allocate unbounded memory.
+// The first error is kept and later reads return zero values.
+type Reader struct {
+	r         io.Reader
+	remaining int64
+	buf       [8]byte
+	err       error
+}
+
+// NewReader creates a reader on top of r that reads at most limit bytes
+func NewReader(r io.Reader, limit int64) *Reader {
+	return &Reader{r: r, remaining: limit}
+}
+
+// Err returns the first error encountered while reading
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Remaining returns how many bytes may still be read
+func (r *Reader) Remaining() int64 {
+	return r.remaining
+}
+
+// Fail records err unless an earlier error is already recorded, decoders
+// use it to reject values that are well-formed but invalid
+func (r *Reader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *Reader) read(b []byte) bool {
+	if r.err != nil {
+		return false
+	}
+	if int64(len(b)) > r.remaining {
+		r.err = ErrLimitExceeded
+		return false
+	}
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+		return false
+	}
+	r.remaining -= int64(len(b))
+	return true
+}
+
+// ReadUint8 reads a single byte
+func (r *Reader) ReadUint8() uint8 {
+	if !r.read(r.buf[:1]) {
+		return 0
+	}
+	return r.buf[0]
+}
+
+// ReadUint16 reads 2 little-endian bytes
+func (r *Reader) ReadUint16() uint16 {
+	if !r.read(r.buf[:2]) {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(r.buf[:2])
+}
+
+// ReadUint32 reads 4 little-endian bytes
+func (r *Reader) ReadUint32() uint32 {
+	if !r.read(r.buf[:4]) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(r.buf[:4])
+}
+
+// ReadUint64 reads 8 little-endian bytes
+func (r *Reader) ReadUint64() uint64 {
+	if !r.read(r.buf[:8]) {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(r.buf[:8])
+}
+
+// ReadInt32 reads 4 little-endian bytes
+func (r *Reader) ReadInt32() int32 {
+	return int32(r.ReadUint32())
+}
+
+// ReadInt64 reads 8 little-endian bytes
+func (r *Reader) ReadInt64() int64 {
+	return int64(r.ReadUint64())
+}
+
+// ReadVarInt reads an unsigned LEB128 varint in its shortest form
+func (r *Reader) ReadVarInt() uint64 {
+	var v uint64
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b := r.ReadUint8()
+		if r.err != nil {
+			return 0
+		}
+		if i == binary.MaxVarintLen64-1 && b > 1 {
+			r.Fail(errors.New("varint overflows 64 bits"))
+			return 0
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			// A zero final byte means the value fit in fewer bytes
+			if b == 0 && i > 0 {
+				r.Fail(ErrNonCanonical)
+				return 0
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+// ReadCount reads a varint element count. Every element takes at least one
+// byte, so a count above the remaining input is rejected before the
+// caller allocates for it.
+func (r *Reader) ReadCount(max uint64) int {
+	return r.ReadCountOf(max, 1)
+}
+
+// ReadCountOf reads a varint count of elements that each take at least
+// minSize bytes. A count whose elements can't fit the remaining input is
+// rejected before the caller allocates for it.
+func (r *Reader) ReadCountOf(max uint64, minSize uint64) int {
+	n := r.ReadVarInt()
+	if r.err != nil {
+		return 0
+	}
+	if n > max {
+		r.Fail(fmt.Errorf("count %d exceeds maximum %d", n, max))
+		return 0
+	}
+	if n > uint64(r.remaining)/minSize {
+		r.Fail(ErrLimitExceeded)
+		return 0
+	}
+	return int(n)
+}
+
+// ReadHash reads a 32-byte hash
+func (r *Reader) ReadHash() [32]byte {
+	var h [32]byte
+	r.read(h[:])
+	return h
+}
+
+// ReadBytes reads a length-prefixed byte string of at most max bytes
+func (r *Reader) ReadBytes(max uint64) []byte {
+	n := r.ReadCount(max)
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	if !r.read(b) {
+		return nil
+	}
+	return b
+}
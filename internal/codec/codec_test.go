@@ -0,0 +1,147 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestVarIntRoundTrip(t *testing.T) {
+	tests := []struct {
+		value   uint64
+		wantLen int
+	}{
+		{0, 1},
+		{127, 1},
+		{128, 2},
+		{16383, 2},
+		{16384, 3},
+		{math.MaxUint32, 5},
+		{math.MaxUint64, 10},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		NewWriter(&buf).WriteVarInt(tt.value)
+		if buf.Len() != tt.wantLen {
+			t.Errorf("WriteVarInt(%d) wrote %d bytes, want %d", tt.value, buf.Len(), tt.wantLen)
+		}
+
+		r := NewReader(&buf, 16)
+		if got := r.ReadVarInt(); got != tt.value || r.Err() != nil {
+			t.Errorf("ReadVarInt() = %d, %v, want %d", got, r.Err(), tt.value)
+		}
+	}
+}
+
+func TestReadVarIntRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"redundant zero byte", []byte{0x80, 0x00}, ErrNonCanonical},
+		{"padded small value", []byte{0x81, 0x80, 0x00}, ErrNonCanonical},
+		{"truncated", []byte{0x80}, io.ErrUnexpectedEOF},
+		{"empty", nil, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(tt.data), 16)
+			r.ReadVarInt()
+			if !errors.Is(r.Err(), tt.wantErr) {
+				t.Errorf("ReadVarInt() error = %v, want %v", r.Err(), tt.wantErr)
+			}
+		})
+	}
+
+	overflow := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}
+	r := NewReader(bytes.NewReader(overflow), 16)
+	if r.ReadVarInt(); r.Err() == nil {
+		t.Error("ReadVarInt() should fail on overflow")
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	// A length prefix larger than the input must fail before allocating
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteVarInt(1 << 40)
+	r := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if b := r.ReadBytes(math.MaxUint64); b != nil || !errors.Is(r.Err(), ErrLimitExceeded) {
+		t.Errorf("ReadBytes() = %v, %v, want %v", b, r.Err(), ErrLimitExceeded)
+	}
+
+	// Counts whose elements can't fit the remaining input
+	buf.Reset()
+	w.WriteVarInt(4)
+	w.WriteUint64(0)
+	r = NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if n := r.ReadCountOf(100, 4); n != 0 || !errors.Is(r.Err(), ErrLimitExceeded) {
+		t.Errorf("ReadCountOf() = %d, %v, want %v", n, r.Err(), ErrLimitExceeded)
+	}
+
+	// Bytes longer than the field maximum
+	buf.Reset()
+	w.WriteBytes([]byte("hello"))
+	r = NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if r.ReadBytes(4); r.Err() == nil {
+		t.Error("ReadBytes() should fail above the maximum")
+	}
+
+	// Reads stop at the limit even if more data is available
+	r = NewReader(bytes.NewReader(make([]byte, 16)), 6)
+	r.ReadUint32()
+	r.ReadUint32()
+	if !errors.Is(r.Err(), ErrLimitExceeded) {
+		t.Errorf("ReadUint32() error = %v, want %v", r.Err(), ErrLimitExceeded)
+	}
+
+	// Errors are sticky
+	if got := r.ReadUint8(); got != 0 || !errors.Is(r.Err(), ErrLimitExceeded) {
+		t.Errorf("ReadUint8() after error = %d, %v", got, r.Err())
+	}
+}
+
+type pair struct {
+	a uint32
+	b []byte
+}
+
+func (p *pair) Encode(w *Writer) {
+	w.WriteUint32(p.a)
+	w.WriteBytes(p.b)
+}
+
+func (p *pair) Decode(r *Reader) {
+	p.a = r.ReadUint32()
+	p.b = r.ReadBytes(8)
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	in := pair{a: 0xdeadbeef, b: []byte("abc")}
+	data := Marshal(&in)
+
+	want := []byte{0xef, 0xbe, 0xad, 0xde, 0x03, 'a', 'b', 'c'}
+	if !bytes.Equal(data, want) {
+		t.Errorf("Marshal() = %x, want %x", data, want)
+	}
+
+	var out pair
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if out.a != in.a || !bytes.Equal(out.b, in.b) {
+		t.Errorf("Unmarshal() = %+v, want %+v", out, in)
+	}
+
+	if err := Unmarshal(append(data, 0x00), &out); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("Unmarshal() with trailing byte error = %v, want %v", err, ErrTrailingData)
+	}
+	if err := Unmarshal(data[:6], &out); err == nil {
+		t.Error("Unmarshal() of truncated data should fail")
+	}
+}
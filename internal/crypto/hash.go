@@ -31,28 +31,38 @@ func Verify(publicKey *ecdsa.PublicKey, data []byte, signature []byte) bool {
 	return ecdsa.VerifyASN1(publicKey, data, signature)
 }
 
+// AddressLen is the length of an address, the public key hash outputs pay to
+const AddressLen = 20
+
 // HashToAddress converts a public key to a blockchain address
 func HashToAddress(publicKey *ecdsa.PublicKey) []byte {
-	// Convert ECDSA public key to ECDH public key
-	curve := ecdh.P256()
-
-	pubBytes := make([]byte, 0, 64)
-	pubBytes = append(pubBytes, publicKey.X.Bytes()...)
-	pubBytes = append(pubBytes, publicKey.Y.Bytes()...)
-
-	ecdhPub, err := curve.NewPublicKey(pubBytes)
-	if err != nil {
+	pubKeyBytes := PublicKeyToBytes(publicKey)
+	if pubKeyBytes == nil {
 		return nil
 	}
 
-	pubKeyBytes := ecdhPub.Bytes()
+	return BytesToAddress(pubKeyBytes)
+}
 
+// BytesToAddress converts a public key serialized by PublicKeyToBytes to a
+// blockchain address without parsing it
+func BytesToAddress(pubKeyBytes []byte) []byte {
 	// SHA256 hash of the public key
 	sha256Hash := sha256.Sum256(pubKeyBytes)
 
-	address := sha256Hash[:20]
+	return sha256Hash[:AddressLen]
+}
 
-	return address
+// PublicKeyToBytes serializes a public key in uncompressed form, the format
+// BytesToPublicKey expects
+func PublicKeyToBytes(publicKey *ecdsa.PublicKey) []byte {
+	// Convert ECDSA public key to ECDH public key
+	ecdhPub, err := publicKey.ECDH()
+	if err != nil {
+		return nil
+	}
+
+	return ecdhPub.Bytes()
 }
 
 // CalculateMerkleRoot computes the merkle root of a slice of hashes
@@ -82,32 +92,6 @@ func CalculateMerkleRoot(hashes [][32]byte) [32]byte {
 	return current[0]
 }
 
-// CheckProofOfWork verifies if a hash meets the difficulty target
-func CheckProofOfWork(hash [32]byte, difficulty uint32) bool {
-	// Convert difficulty to target: more zeros = more difficult
-	target := byte(256 - difficulty)
-
-	return hash[0] < target
-}
-
-// GenerateProofOfWork finds a nonce that makes the block hash meet difficulty
-func GenerateProofOfWork(data []byte, difficulty uint32) (uint32, [32]byte) {
-	var nonce uint32
-	var hash [32]byte
-
-	for {
-		// Append nonce to data
-		withNonce := append(data, byte(nonce))
-		hash = Hash(withNonce)
-
-		if CheckProofOfWork(hash, difficulty) {
-			return nonce, hash
-		}
-
-		nonce++
-	}
-}
-
 // BytesToPublicKey converts a byte slice to an ECDSA public key
 func BytesToPublicKey(pub []byte) (*ecdsa.PublicKey, error) {
 	curve := ecdh.P256()
@@ -78,3 +78,27 @@ func TestSignAndVerify(t *testing.T) {
 		t.Error("Verification should fail with wrong data")
 	}
 }
+
+func TestHashToAddress(t *testing.T) {
+	privKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	address := HashToAddress(&privKey.PublicKey)
+	if len(address) != 20 {
+		t.Fatalf("HashToAddress() length = %d, want 20", len(address))
+	}
+
+	// The serialized key parses back to the same address
+	pubKey, err := BytesToPublicKey(PublicKeyToBytes(&privKey.PublicKey))
+	if err != nil {
+		t.Fatalf("BytesToPublicKey() error = %v", err)
+	}
+	if got := HashToAddress(pubKey); string(got) != string(address) {
+		t.Errorf("HashToAddress() after round trip = %x, want %x", got, address)
+	}
+	if got := BytesToAddress(PublicKeyToBytes(&privKey.PublicKey)); string(got) != string(address) {
+		t.Errorf("BytesToAddress() = %x, want %x", got, address)
+	}
+}
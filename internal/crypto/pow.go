@@ -0,0 +1,133 @@
+package crypto
+
+import (
+	"math"
+	"math/big"
+)
+
+var (
+	// bigOne is 1 as a big integer
+	bigOne = big.NewInt(1)
+
+	// oneLsh256 is 2^256, one more than the largest possible hash value
+	oneLsh256 = new(big.Int).Lsh(bigOne, 256)
+)
+
+// CompactToBig expands a compact "bits" value into a 256-bit target.
+//
+// The compact format packs a number as a base-256 floating point value: the
+// most significant byte is the exponent (the length of the number in bytes)
+// and the lower three bytes are the mantissa, with bit 23 as the sign bit.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+	return bn
+}
+
+// BigToCompact packs a target into the compact "bits" format. Precision
+// beyond the three byte mantissa is truncated.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+
+	// The sign bit is part of the mantissa, so shift it out of the way
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// HashToBig interprets a hash as a big-endian 256-bit number
+func HashToBig(hash [32]byte) *big.Int {
+	return new(big.Int).SetBytes(hash[:])
+}
+
+// CheckProofOfWork verifies if a hash is at or below the compact target
+func CheckProofOfWork(hash [32]byte, bits uint32) bool {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 || target.BitLen() > 256 {
+		return false
+	}
+
+	return HashToBig(hash).Cmp(target) <= 0
+}
+
+// CalcWork returns the expected number of hashes needed to find a block
+// for the compact target, which is 2^256 / (target + 1)
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	denominator := new(big.Int).Add(target, bigOne)
+	return new(big.Int).Div(oneLsh256, denominator)
+}
+
+// GetDifficulty returns how many times harder the compact target is than
+// the easiest allowed target powLimitBits
+func GetDifficulty(bits, powLimitBits uint32) float64 {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	ratio := new(big.Rat).SetFrac(CompactToBig(powLimitBits), target)
+	difficulty, _ := ratio.Float64()
+	return difficulty
+}
+
+// DifficultyToCompact returns the compact target that is difficulty times
+// harder than powLimitBits. Difficulties below one or NaN yield the limit
+// itself, difficulties too high for any target above zero yield target 1,
+// the hardest valid target.
+func DifficultyToCompact(difficulty float64, powLimitBits uint32) uint32 {
+	if !(difficulty > 1) {
+		return powLimitBits
+	}
+	hardest := BigToCompact(big.NewInt(1))
+	if math.IsInf(difficulty, 1) {
+		return hardest
+	}
+
+	limit := new(big.Rat).SetInt(CompactToBig(powLimitBits))
+	ratio := new(big.Rat).SetFloat64(difficulty)
+	target := new(big.Rat).Quo(limit, ratio)
+
+	n := new(big.Int).Quo(target.Num(), target.Denom())
+	if n.Sign() <= 0 {
+		return hardest
+	}
+	return BigToCompact(n)
+}
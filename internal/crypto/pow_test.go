@@ -0,0 +1,109 @@
+package crypto
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		compact uint32
+		want    string
+	}{
+		{"zero", 0x00000000, "0"},
+		{"small exponent", 0x03123456, "123456"},
+		{"bitcoin genesis", 0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{"pow limit", 0x207fffff, "7fffff0000000000000000000000000000000000000000000000000000000000"},
+		{"negative", 0x04923456, "-12345600"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CompactToBig(tt.compact)
+			if got.Text(16) != tt.want {
+				t.Errorf("CompactToBig(%08x) = %s, want %s", tt.compact, got.Text(16), tt.want)
+			}
+			if back := BigToCompact(got); back != tt.compact {
+				t.Errorf("BigToCompact() = %08x, want %08x", back, tt.compact)
+			}
+		})
+	}
+}
+
+func TestBigToCompactNormalizesSignBit(t *testing.T) {
+	// 0x80 would set the sign bit in the mantissa, so the exponent grows
+	n := big.NewInt(0x80)
+	if got := BigToCompact(n); got != 0x02008000 {
+		t.Errorf("BigToCompact(0x80) = %08x, want %08x", got, 0x02008000)
+	}
+}
+
+func TestCheckProofOfWork(t *testing.T) {
+	var low, high [32]byte
+	low[31] = 0x01
+	for i := range high {
+		high[i] = 0xff
+	}
+
+	tests := []struct {
+		name string
+		hash [32]byte
+		bits uint32
+		want bool
+	}{
+		{"hash below target", low, 0x207fffff, true},
+		{"hash above target", high, 0x207fffff, false},
+		{"hash equals target", low, 0x01010000, true},
+		{"zero target", low, 0x00000000, false},
+		{"negative target", low, 0x04923456, false},
+		{"overflowing target", low, 0xff7fffff, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckProofOfWork(tt.hash, tt.bits); got != tt.want {
+				t.Errorf("CheckProofOfWork() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalcWork(t *testing.T) {
+	// The limit target is just under 2^255, so about two hashes are needed
+	if got := CalcWork(0x207fffff); got.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("CalcWork(0x207fffff) = %s, want 2", got)
+	}
+
+	easy, hard := CalcWork(0x207fffff), CalcWork(0x1f7fffff)
+	if hard.Cmp(easy) <= 0 {
+		t.Errorf("CalcWork() of a smaller target = %s, want more than %s", hard, easy)
+	}
+}
+
+func TestDifficultyConversion(t *testing.T) {
+	const limit = 0x207fffff
+
+	if got := GetDifficulty(limit, limit); got != 1 {
+		t.Errorf("GetDifficulty(limit) = %v, want 1", got)
+	}
+	if got := GetDifficulty(0x1f7fffff, limit); got != 256 {
+		t.Errorf("GetDifficulty(0x1f7fffff) = %v, want 256", got)
+	}
+	if got := DifficultyToCompact(256, limit); got != 0x1f7fffff {
+		t.Errorf("DifficultyToCompact(256) = %08x, want %08x", got, 0x1f7fffff)
+	}
+	for _, difficulty := range []float64{0.5, -1, math.NaN(), math.Inf(-1)} {
+		if got := DifficultyToCompact(difficulty, limit); got != limit {
+			t.Errorf("DifficultyToCompact(%v) = %08x, want %08x", difficulty, got, limit)
+		}
+	}
+	// Targets that would round below 1 are clamped to the hardest target
+	const hardest = 0x01010000
+	for _, difficulty := range []float64{1e80, math.Inf(1)} {
+		if got := DifficultyToCompact(difficulty, limit); got != hardest {
+			t.Errorf("DifficultyToCompact(%v) = %08x, want %08x", difficulty, got, hardest)
+		}
+	}
+}
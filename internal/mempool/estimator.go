@@ -0,0 +1,377 @@
+package mempool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// feeEstimatesFile is the name of the fee statistics inside the data
+// directory
+const feeEstimatesFile = "fee_estimates.json"
+
+// feeEstimatesVersion is the version of the persisted statistics, others
+// are discarded
+const feeEstimatesVersion = 1
+
+const (
+	// MaxConfirmTarget is the largest number of blocks an estimate can be
+	// asked for
+	MaxConfirmTarget = 25
+
+	// minBucketRate and maxBucketRate bound the fee rate buckets, which are
+	// bucketSpacing apart. Rates outside fall into the first or last one.
+	minBucketRate = float64(DefaultMinFeeRate)
+	maxBucketRate = 1e7
+	bucketSpacing = 1.1
+
+	// shortDecay and longDecay scale the statistics down with every block,
+	// forgetting transactions after tens and hundreds of blocks
+	shortDecay = 0.962
+	longDecay  = 0.998
+
+	// economicalThreshold and conservativeThreshold are the shares of
+	// transactions of a fee rate that must have confirmed in time
+	economicalThreshold   = 0.85
+	conservativeThreshold = 0.95
+)
+
+// ErrInsufficientData is returned when too few transactions were seen to
+// estimate a fee rate
+var ErrInsufficientData = errors.New("not enough transactions seen to estimate a fee rate")
+
+// EstimateMode trades a lower fee for a higher chance of confirming in time
+type EstimateMode int
+
+const (
+	// EstimateConservative looks at a long history and asks for the rate
+	// almost all transactions confirmed in time at
+	EstimateConservative EstimateMode = iota
+	// EstimateEconomical looks at recent blocks only and accepts more
+	// transactions missing the target
+	EstimateEconomical
+)
+
+// String returns the name of the mode
+func (m EstimateMode) String() string {
+	switch m {
+	case EstimateConservative:
+		return "conservative"
+	case EstimateEconomical:
+		return "economical"
+	default:
+		return fmt.Sprintf("EstimateMode(%d)", int(m))
+	}
+}
+
+// ParseEstimateMode returns the mode of a name returned by String
+func ParseEstimateMode(s string) (EstimateMode, error) {
+	switch s {
+	case "conservative":
+		return EstimateConservative, nil
+	case "economical":
+		return EstimateEconomical, nil
+	default:
+		return 0, fmt.Errorf("unknown estimate mode %q", s)
+	}
+}
+
+// feeStats counts transactions per fee rate bucket, decayed with every
+// block
+type feeStats struct {
+	Decay float64 `json:"decay"`
+	// Confirmed holds per target the transactions of each bucket that
+	// confirmed within that many blocks
+	Confirmed [][]float64 `json:"confirmed"`
+	// Total holds the transactions of each bucket that confirmed or gave
+	// up, FeeSum the sum of their fee rates
+	Total  []float64 `json:"total"`
+	FeeSum []float64 `json:"feesum"`
+}
+
+// newFeeStats creates empty statistics for buckets
+func newFeeStats(decay float64, buckets int) *feeStats {
+	s := &feeStats{
+		Decay:     decay,
+		Confirmed: make([][]float64, MaxConfirmTarget),
+		Total:     make([]float64, buckets),
+		FeeSum:    make([]float64, buckets),
+	}
+	for i := range s.Confirmed {
+		s.Confirmed[i] = make([]float64, buckets)
+	}
+	return s
+}
+
+// valid reports whether loaded statistics fit the decay and buckets
+func (s *feeStats) valid(decay float64, buckets int) bool {
+	if s == nil || s.Decay != decay || len(s.Confirmed) != MaxConfirmTarget || len(s.Total) != buckets || len(s.FeeSum) != buckets {
+		return false
+	}
+	for _, confirmed := range s.Confirmed {
+		if len(confirmed) != buckets {
+			return false
+		}
+	}
+	return true
+}
+
+// decay ages the statistics by one block
+func (s *feeStats) decay() {
+	for _, confirmed := range s.Confirmed {
+		for i := range confirmed {
+			confirmed[i] *= s.Decay
+		}
+	}
+	for i := range s.Total {
+		s.Total[i] *= s.Decay
+		s.FeeSum[i] *= s.Decay
+	}
+}
+
+// record counts a transaction that confirmed after waited blocks, or gave
+// up when waited is 0
+func (s *feeStats) record(bucket int, rate FeeRate, waited int) {
+	s.Total[bucket]++
+	s.FeeSum[bucket] += float64(rate)
+	if waited <= 0 {
+		return
+	}
+	for target := waited; target <= MaxConfirmTarget; target++ {
+		s.Confirmed[target-1][bucket]++
+	}
+}
+
+// estimate returns the average fee rate of the cheapest range of buckets
+// in which at least threshold of the transactions confirmed within target
+// blocks. Ranges hold enough transactions to tell, pending counts the
+// unconfirmed transactions of each bucket already waiting longer.
+func (s *feeStats) estimate(target int, threshold float64, pending []float64) (FeeRate, bool) {
+	// On average a tenth of a transaction per block over the horizon
+	sufficient := 0.1 / (1 - s.Decay)
+
+	var best FeeRate
+	found := false
+	var confirmed, total, count, feeSum float64
+	for bucket := len(s.Total) - 1; bucket >= 0; bucket-- {
+		confirmed += s.Confirmed[target-1][bucket]
+		total += s.Total[bucket] + pending[bucket]
+		count += s.Total[bucket]
+		feeSum += s.FeeSum[bucket]
+		if total < sufficient || count == 0 {
+			continue
+		}
+		if confirmed/total < threshold {
+			break
+		}
+		best, found = FeeRate(math.Round(feeSum/count)), true
+		confirmed, total, count, feeSum = 0, 0, 0, 0
+	}
+	return best, found
+}
+
+// trackedTx is a pooled transaction waiting to be confirmed
+type trackedTx struct {
+	rate   FeeRate
+	height uint64 // Height of the best chain when it was added
+}
+
+// FeeEstimator learns the fee rates needed to get transactions confirmed
+// within a number of blocks. It records for every transaction accepted to
+// the pool its fee rate and how many blocks it waited, and keeps its
+// statistics in the data directory across restarts.
+type FeeEstimator struct {
+	dataDir string
+	sub     *blockchain.Subscription
+	buckets []float64 // Upper bounds of the fee rate buckets
+
+	mu      sync.Mutex
+	height  uint64 // Height of the last block counted
+	short   *feeStats
+	long    *feeStats
+	tracked map[[32]byte]trackedTx
+}
+
+// feeEstimates is the persisted form of a FeeEstimator
+type feeEstimates struct {
+	Version int       `json:"version"`
+	Short   *feeStats `json:"short"`
+	Long    *feeStats `json:"long"`
+}
+
+// OpenFeeEstimator loads the statistics persisted in dataDir and follows
+// the best chain until Close. An empty dataDir keeps them in memory only.
+func OpenFeeEstimator(dataDir string, chain *blockchain.Chain) (*FeeEstimator, error) {
+	if chain == nil {
+		return nil, errors.New("chain is required")
+	}
+	var buckets []float64
+	for bound := minBucketRate; bound < maxBucketRate; bound *= bucketSpacing {
+		buckets = append(buckets, bound)
+	}
+	e := &FeeEstimator{
+		dataDir: dataDir,
+		buckets: buckets,
+		height:  chain.GetHeight(),
+		short:   newFeeStats(shortDecay, len(buckets)+1),
+		long:    newFeeStats(longDecay, len(buckets)+1),
+		tracked: make(map[[32]byte]trackedTx),
+	}
+
+	if dataDir != "" {
+		data, err := os.ReadFile(filepath.Join(dataDir, feeEstimatesFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read fee estimates: %w", err)
+		}
+		if err == nil {
+			var saved feeEstimates
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal fee estimates: %w", err)
+			}
+			// Statistics of another layout are dropped, they are relearned
+			if saved.Version == feeEstimatesVersion && saved.Short.valid(shortDecay, len(buckets)+1) && saved.Long.valid(longDecay, len(buckets)+1) {
+				e.short, e.long = saved.Short, saved.Long
+			}
+		}
+	}
+
+	e.sub = chain.Observe(blockchain.ObserverFuncs{OnBlockConnected: e.blockConnected}, blockchain.SubscribeOptions{})
+	return e, nil
+}
+
+// Close stops following the chain and persists the statistics
+func (e *FeeEstimator) Close() error {
+	e.sub.Cancel()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.dataDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(feeEstimates{
+		Version: feeEstimatesVersion,
+		Short:   e.short,
+		Long:    e.long,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal fee estimates: %w", err)
+	}
+	return storage.WriteFileAtomic(filepath.Join(e.dataDir, feeEstimatesFile), data)
+}
+
+// bucket returns the bucket of a fee rate
+func (e *FeeEstimator) bucket(rate FeeRate) int {
+	for i, bound := range e.buckets {
+		if float64(rate) <= bound {
+			return i
+		}
+	}
+	return len(e.buckets)
+}
+
+// observeTransaction starts waiting for a transaction accepted to the pool
+// to be confirmed
+func (e *FeeEstimator) observeTransaction(desc *TxDesc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.tracked[desc.Tx.Hash] = trackedTx{rate: desc.FeeRate, height: desc.Height}
+}
+
+// removeTransaction stops waiting for a transaction the pool dropped
+// without it being mined, like one replaced, evicted or expired
+func (e *FeeEstimator) removeTransaction(hash [32]byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.tracked, hash)
+}
+
+// blockConnected counts the tracked transactions a block confirms and gives
+// up on those waiting longer than MaxConfirmTarget
+func (e *FeeEstimator) blockConnected(block *types.Block) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Blocks connected again after a reorganization were counted already
+	if block.Height <= e.height {
+		return
+	}
+	e.height = block.Height
+	e.short.decay()
+	e.long.decay()
+
+	for _, tx := range block.Transactions {
+		tracked, ok := e.tracked[tx.Hash]
+		if !ok {
+			continue
+		}
+		delete(e.tracked, tx.Hash)
+		// Transactions seen after the block was mined tell nothing
+		if tracked.height >= block.Height {
+			continue
+		}
+		waited := int(block.Height - tracked.height)
+		if waited > MaxConfirmTarget {
+			waited = 0
+		}
+		e.record(tracked.rate, waited)
+	}
+	for hash, tracked := range e.tracked {
+		if tracked.height+MaxConfirmTarget <= block.Height {
+			delete(e.tracked, hash)
+			e.record(tracked.rate, 0)
+		}
+	}
+}
+
+// record counts a transaction in both statistics, the caller must hold
+// the lock
+func (e *FeeEstimator) record(rate FeeRate, waited int) {
+	bucket := e.bucket(rate)
+	e.short.record(bucket, rate, waited)
+	e.long.record(bucket, rate, waited)
+}
+
+// EstimateFee returns the fee rate a transaction should pay to be
+// confirmed within target blocks. Targets beyond MaxConfirmTarget are
+// estimated for MaxConfirmTarget. Conservative estimates are never below
+// economical ones.
+func (e *FeeEstimator) EstimateFee(target int, mode EstimateMode) (FeeRate, error) {
+	if target < 1 {
+		return 0, fmt.Errorf("confirmation target %d must be at least 1", target)
+	}
+	target = min(target, MaxConfirmTarget)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Pooled transactions that waited longer than the target already
+	// missed it
+	pending := make([]float64, len(e.buckets)+1)
+	for _, tracked := range e.tracked {
+		if tracked.height+uint64(target) <= e.height {
+			pending[e.bucket(tracked.rate)]++
+		}
+	}
+
+	rate, ok := e.short.estimate(target, economicalThreshold, pending)
+	if mode == EstimateConservative {
+		if long, found := e.long.estimate(target, conservativeThreshold, pending); found && (!ok || long > rate) {
+			rate, ok = long, true
+		}
+	}
+	if !ok {
+		return 0, fmt.Errorf("%w within %d blocks", ErrInsufficientData, target)
+	}
+	return rate, nil
+}
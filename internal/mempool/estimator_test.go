@@ -0,0 +1,138 @@
+package mempool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// estimatorTx returns a distinct transaction pooled at height paying rate
+func estimatorTx(n int, height uint64, rate FeeRate) *TxDesc {
+	tx := &types.Transaction{Version: 1, LockTime: uint32(n)}
+	tx.Hash = tx.ComputeHash()
+	return &TxDesc{Tx: tx, Height: height, FeeRate: rate}
+}
+
+func TestFeeEstimator(t *testing.T) {
+	h := newHarness(t, 1)
+	dir := t.TempDir()
+	e, err := OpenFeeEstimator(dir, h.chain)
+	if err != nil {
+		t.Fatalf("OpenFeeEstimator() error = %v", err)
+	}
+	if _, err := e.EstimateFee(1, EstimateEconomical); !errors.Is(err, ErrInsufficientData) {
+		t.Errorf("EstimateFee() without data error = %v, want %v", err, ErrInsufficientData)
+	}
+
+	// Every block confirms the high paying transaction of the block before
+	// and the low paying one of five blocks before. Blocks are handed to
+	// the estimator directly, the chain doesn't validate them.
+	const high, low FeeRate = 10_000, 2000
+	height := h.chain.GetHeight()
+	var lows []*TxDesc
+	for i := 0; i < 40; i++ {
+		hi := estimatorTx(2*i, height, high)
+		lo := estimatorTx(2*i+1, height, low)
+		e.observeTransaction(hi)
+		e.observeTransaction(lo)
+		lows = append(lows, lo)
+
+		height++
+		block := &types.Block{Height: height, Transactions: []types.Transaction{*hi.Tx}}
+		if i >= 4 {
+			block.Transactions = append(block.Transactions, *lows[i-4].Tx)
+		}
+		e.blockConnected(block)
+	}
+
+	tests := []struct {
+		target int
+		mode   EstimateMode
+		want   FeeRate
+	}{
+		{1, EstimateEconomical, high},
+		{4, EstimateEconomical, high},
+		{5, EstimateEconomical, low},
+		{MaxConfirmTarget + 10, EstimateEconomical, low},
+		{1, EstimateConservative, high},
+	}
+	for _, tt := range tests {
+		if got, err := e.EstimateFee(tt.target, tt.mode); err != nil || got != tt.want {
+			t.Errorf("EstimateFee(%d, %v) = %v, %v, want %v", tt.target, tt.mode, got, err, tt.want)
+		}
+	}
+	if _, err := e.EstimateFee(0, EstimateEconomical); err == nil {
+		t.Error("EstimateFee() of target 0 error = nil")
+	}
+
+	// Blocks seen again after a reorganization are not counted twice
+	e.blockConnected(&types.Block{Height: height, Transactions: []types.Transaction{*lows[36].Tx}})
+	if got, err := e.EstimateFee(4, EstimateEconomical); err != nil || got != high {
+		t.Errorf("EstimateFee() after a reconnected block = %v, %v, want %v", got, err, high)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	loaded, err := OpenFeeEstimator(dir, h.chain)
+	if err != nil {
+		t.Fatalf("OpenFeeEstimator() error = %v", err)
+	}
+	defer loaded.Close()
+	if got, err := loaded.EstimateFee(5, EstimateEconomical); err != nil || got != low {
+		t.Errorf("EstimateFee() after reopening = %v, %v, want %v", got, err, low)
+	}
+}
+
+func TestFeeEstimatorForgetsDroppedTransactions(t *testing.T) {
+	h := newHarness(t, 2)
+	e, err := OpenFeeEstimator("", h.chain)
+	if err != nil {
+		t.Fatalf("OpenFeeEstimator() error = %v", err)
+	}
+	defer e.Close()
+	now := time.Now()
+	pool := h.newPool(Config{FeeEstimator: e, ReplaceByFee: true, Expiry: time.Hour})
+	pool.now = func() time.Time { return now }
+
+	expiring := h.spend(h.key, h.coins[1:2], 0, coinAmount-1000)
+	if err := pool.ProcessTransaction(expiring); err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+	now = now.Add(30 * time.Minute)
+	bumped := h.spend(h.key, h.coins[:1], 0, coinAmount-1000)
+	if err := pool.ProcessTransaction(bumped); err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+	dropped := e.bucket(pool.Lookup(bumped.Hash).FeeRate)
+	replacement := h.spend(h.key, h.coins[:1], 1, coinAmount-20_000)
+	if err := pool.ProcessTransaction(replacement); err != nil {
+		t.Fatalf("ProcessTransaction() of the replacement error = %v", err)
+	}
+	kept := e.bucket(pool.Lookup(replacement.Hash).FeeRate)
+	if kept == dropped {
+		t.Fatalf("replacement pays into the bucket %d of the replaced transaction", kept)
+	}
+
+	now = now.Add(31 * time.Minute)
+	pool.mu.Lock()
+	pool.expire()
+	pool.mu.Unlock()
+	if pool.HaveTransaction(expiring.Hash) {
+		t.Fatal("expired transaction still pooled")
+	}
+
+	// Only the replacement is left to give up on
+	height := h.chain.GetHeight()
+	for i := uint64(1); i <= MaxConfirmTarget; i++ {
+		e.blockConnected(&types.Block{Height: height + i})
+	}
+	if got := e.short.Total[dropped]; got != 0 {
+		t.Errorf("Total of the dropped transactions' bucket = %v, want 0", got)
+	}
+	if got := e.short.Total[kept]; got == 0 {
+		t.Error("Total of the replacement's bucket = 0, want it given up on")
+	}
+}
@@ -0,0 +1,25 @@
+package mempool
+
+import "fmt"
+
+// FeeRate is a fee per 1000 bytes of encoded transaction, fine enough to
+// tell apart transactions paying less than one unit per byte
+type FeeRate uint64
+
+// NewFeeRate returns the rate of a fee paid for size bytes
+func NewFeeRate(fee uint64, size int) FeeRate {
+	if size <= 0 {
+		return 0
+	}
+	return FeeRate(fee * 1000 / uint64(size))
+}
+
+// Fee returns the fee the rate asks for size bytes
+func (r FeeRate) Fee(size int) uint64 {
+	return uint64(r) * uint64(size) / 1000
+}
+
+// String returns the rate per byte
+func (r FeeRate) String() string {
+	return fmt.Sprintf("%d.%03d/B", r/1000, r%1000)
+}
@@ -0,0 +1,802 @@
+// Package mempool holds the unconfirmed transactions of a node until they
+// are mined
+package mempool
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/miner"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+	"github.com/fkapsahili/mini-blockchain/internal/utxo"
+)
+
+const (
+	// DefaultMaxSize is the byte size of the pool when the config leaves
+	// it unset
+	DefaultMaxSize = 32 << 20
+
+	// DefaultExpiry is how long a transaction may stay unconfirmed when the
+	// config leaves it unset
+	DefaultExpiry = 72 * time.Hour
+
+	// DefaultMinFeeRate is the lowest fee rate accepted when the config
+	// leaves it unset, one unit per byte
+	DefaultMinFeeRate FeeRate = 1000
+
+	// MaxTxSize is the largest transaction accepted, leaving most of a
+	// block to others
+	MaxTxSize = 100_000
+
+	// DefaultMaxReplacementEvictions is how many transactions a replacement
+	// may evict when the config leaves it unset
+	DefaultMaxReplacementEvictions = 100
+)
+
+// Reasons for refusing a transaction that say nothing about its validity.
+// Invalid transactions are refused with an error wrapping one of the
+// blockchain validation errors instead.
+var (
+	// ErrDuplicate is returned for a transaction already in the pool
+	ErrDuplicate = errors.New("transaction already in pool")
+
+	// ErrMissingInputs is returned when an input spends an output that is
+	// neither unspent in the best chain nor created by a pooled
+	// transaction. The transaction may be confirmed already or spend a
+	// parent we haven't seen.
+	ErrMissingInputs = errors.New("transaction spends unknown or spent outputs")
+
+	// ErrDoubleSpend is returned when an input spends an output already
+	// spent by a pooled transaction and replacements are disabled
+	ErrDoubleSpend = errors.New("output already spent by a pooled transaction")
+
+	// ErrReplacementRejected is returned when a transaction conflicting
+	// with pooled ones doesn't meet the rules to replace them
+	ErrReplacementRejected = errors.New("replacement rejected")
+
+	// ErrFeeTooLow is returned when the fee rate is below the minimum
+	ErrFeeTooLow = errors.New("fee rate below minimum")
+
+	// ErrPoolFull is returned when the pool has no room for a transaction
+	// paying less than the ones it would have to evict
+	ErrPoolFull = errors.New("pool is full of transactions paying higher fee rates")
+
+	// ErrTxTooLarge is returned for transactions larger than MaxTxSize
+	ErrTxTooLarge = errors.New("transaction too large")
+
+	// ErrNotFound is returned for transactions not in the pool
+	ErrNotFound = errors.New("transaction not in pool")
+)
+
+// Config configures a Pool
+type Config struct {
+	// Chain provides the unspent outputs transactions spend and confirms
+	// pooled transactions
+	Chain *blockchain.Chain
+
+	// MaxSize bounds the encoded size of all pooled transactions, defaults
+	// to DefaultMaxSize
+	MaxSize int
+
+	// Expiry is how long a transaction may stay in the pool, defaults to
+	// DefaultExpiry
+	Expiry time.Duration
+
+	// MinFeeRate is the lowest fee rate accepted, defaults to
+	// DefaultMinFeeRate
+	MinFeeRate FeeRate
+
+	// ReplaceByFee lets a transaction replace the pooled transactions
+	// spending the same outputs, and their descendants, if it pays a higher
+	// fee and fee rate than each of them. Without it the first seen
+	// transaction stays.
+	ReplaceByFee bool
+
+	// MaxReplacementEvictions bounds how many transactions a replacement
+	// may evict, defaults to DefaultMaxReplacementEvictions
+	MaxReplacementEvictions int
+
+	// FeeEstimator learns fee rates from the transactions submitted to the
+	// pool, nil disables it
+	FeeEstimator *FeeEstimator
+
+	// OnAccept is called with every transaction added to the pool, outside
+	// the pool lock
+	OnAccept func(tx *types.Transaction)
+}
+
+// TxDesc describes a pooled transaction
+type TxDesc struct {
+	Tx      *types.Transaction
+	Added   time.Time
+	Height  uint64 // Height of the best chain when it was added
+	Fee     uint64
+	Size    int
+	FeeRate FeeRate
+
+	// packageFee and packageSize add up the transaction and its pooled
+	// descendants, which a miner would take along to collect its fee
+	packageFee  uint64
+	packageSize int
+
+	rateIndex int // Position in the eviction heap
+	ageIndex  int // Position in the expiry heap
+}
+
+// evictionRate is the rate a transaction is evicted by: the higher of its
+// own and that of its descendant package, so a child paying for its parent
+// keeps both in the pool
+func (d *TxDesc) evictionRate() FeeRate {
+	return max(d.FeeRate, NewFeeRate(d.packageFee, d.packageSize))
+}
+
+// Pool holds validated unconfirmed transactions. It follows the best chain,
+// dropping transactions once they are confirmed or conflict with the chain
+// and taking back those of blocks a reorganization disconnects.
+type Pool struct {
+	cfg Config
+	sub *blockchain.Subscription
+
+	// now returns the current time, replaced by tests
+	now func() time.Time
+
+	mu    sync.RWMutex
+	txs   map[[32]byte]*TxDesc
+	spent map[utxo.Outpoint]*TxDesc // Pooled spender of each outpoint
+	size  int
+
+	byRate txHeap // Next transaction to evict for room
+	byAge  txHeap // Next transaction to expire
+
+	// disconnected holds the blocks of a reorganization until the new tip
+	// is known, the tip first
+	disconnected []*types.Block
+}
+
+// New creates a pool that follows the best chain until Close
+func New(cfg Config) (*Pool, error) {
+	if cfg.Chain == nil {
+		return nil, errors.New("chain is required")
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = DefaultExpiry
+	}
+	if cfg.MinFeeRate == 0 {
+		cfg.MinFeeRate = DefaultMinFeeRate
+	}
+	if cfg.MaxReplacementEvictions <= 0 {
+		cfg.MaxReplacementEvictions = DefaultMaxReplacementEvictions
+	}
+
+	p := &Pool{
+		cfg:    cfg,
+		now:    time.Now,
+		txs:    make(map[[32]byte]*TxDesc),
+		spent:  make(map[utxo.Outpoint]*TxDesc),
+		byRate: newEvictionHeap(),
+		byAge:  newExpiryHeap(),
+	}
+	p.sub = cfg.Chain.Observe(p, blockchain.SubscribeOptions{})
+	return p, nil
+}
+
+// Close stops following the chain
+func (p *Pool) Close() {
+	p.sub.Cancel()
+}
+
+// ProcessTransaction validates a transaction against the best chain and
+// the pool and adds it
+func (p *Pool) ProcessTransaction(tx *types.Transaction) error {
+	if err := checkTransaction(tx); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	desc, err := p.maybeAccept(tx)
+	// Observed under the lock, so the estimator can't hear of an eviction
+	// before the transaction itself
+	if err == nil && p.cfg.FeeEstimator != nil {
+		p.cfg.FeeEstimator.observeTransaction(desc)
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if p.cfg.OnAccept != nil {
+		p.cfg.OnAccept(desc.Tx)
+	}
+	return nil
+}
+
+// checkTransaction checks what can be checked without the chain
+func checkTransaction(tx *types.Transaction) error {
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase outside a block", blockchain.ErrBadTransaction)
+	}
+	if err := tx.CheckLimits(); err != nil {
+		return fmt.Errorf("%w: %w", blockchain.ErrBadTransaction, err)
+	}
+	if size := tx.SerializeSize(); size > MaxTxSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrTxTooLarge, size, MaxTxSize)
+	}
+	if err := blockchain.CheckTransaction(tx); err != nil {
+		return err
+	}
+
+	seen := make(map[utxo.Outpoint]bool, len(tx.Inputs))
+	for _, input := range tx.Inputs {
+		op := utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}
+		if seen[op] {
+			return fmt.Errorf("%w: spends %s twice", blockchain.ErrBadTransaction, op)
+		}
+		seen[op] = true
+	}
+	return nil
+}
+
+// maybeAccept checks the spends and fee of a transaction and adds it, the
+// caller must hold the lock
+func (p *Pool) maybeAccept(tx *types.Transaction) (*TxDesc, error) {
+	if _, ok := p.txs[tx.Hash]; ok {
+		return nil, fmt.Errorf("%w: %x", ErrDuplicate, tx.Hash)
+	}
+
+	conflicts := p.conflicts(tx)
+	if len(conflicts) > 0 && !p.cfg.ReplaceByFee {
+		return nil, fmt.Errorf("%w: %x spends the same outputs", ErrDoubleSpend, conflicts[0].Tx.Hash)
+	}
+	fee, err := p.checkInputs(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	size := tx.SerializeSize()
+	rate := NewFeeRate(fee, size)
+	if rate < p.cfg.MinFeeRate {
+		return nil, fmt.Errorf("%w: %v < %v", ErrFeeTooLow, rate, p.cfg.MinFeeRate)
+	}
+
+	var replaced []*TxDesc
+	if len(conflicts) > 0 {
+		if replaced, err = p.checkReplacement(tx, fee, size, conflicts); err != nil {
+			return nil, err
+		}
+		// Room is made with the replaced transactions gone, they come back
+		// if there still is none. Children go first so their ancestors'
+		// packages are updated one by one.
+		for i := len(replaced) - 1; i >= 0; i-- {
+			p.remove(replaced[i])
+		}
+	}
+	if err := p.makeRoom(tx, size, rate); err != nil {
+		for _, desc := range replaced {
+			p.add(desc)
+		}
+		return nil, err
+	}
+	for _, desc := range replaced {
+		p.forget(desc)
+	}
+
+	desc := &TxDesc{
+		Tx:      tx,
+		Added:   p.now(),
+		Height:  p.cfg.Chain.GetHeight(),
+		Fee:     fee,
+		Size:    size,
+		FeeRate: rate,
+	}
+	p.add(desc)
+	return desc, nil
+}
+
+// conflicts returns the pooled transactions spending outputs tx spends,
+// the caller must hold the lock
+func (p *Pool) conflicts(tx *types.Transaction) []*TxDesc {
+	var conflicts []*TxDesc
+	seen := make(map[[32]byte]bool)
+	for _, input := range tx.Inputs {
+		spender, ok := p.spent[utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}]
+		if ok && !seen[spender.Tx.Hash] {
+			seen[spender.Tx.Hash] = true
+			conflicts = append(conflicts, spender)
+		}
+	}
+	return conflicts
+}
+
+// checkReplacement checks that tx may replace the transactions it
+// conflicts with and returns them with their descendants. It must pay a
+// higher fee rate than each conflict, more fees than all it evicts
+// together and on top of that the minimum fee for its own size.
+func (p *Pool) checkReplacement(tx *types.Transaction, fee uint64, size int, conflicts []*TxDesc) ([]*TxDesc, error) {
+	rate := NewFeeRate(fee, size)
+	for _, conflict := range conflicts {
+		if rate <= conflict.FeeRate {
+			return nil, fmt.Errorf("%w: fee rate %v does not exceed %v of %x", ErrReplacementRejected, rate, conflict.FeeRate, conflict.Tx.Hash)
+		}
+	}
+
+	var replaced []*TxDesc
+	seen := make(map[[32]byte]bool)
+	for _, conflict := range conflicts {
+		for _, desc := range p.withDescendants(conflict) {
+			if !seen[desc.Tx.Hash] {
+				seen[desc.Tx.Hash] = true
+				replaced = append(replaced, desc)
+			}
+		}
+	}
+	if len(replaced) > p.cfg.MaxReplacementEvictions {
+		return nil, fmt.Errorf("%w: it would evict %d transactions, more than %d", ErrReplacementRejected, len(replaced), p.cfg.MaxReplacementEvictions)
+	}
+
+	var replacedFees uint64
+	for _, desc := range replaced {
+		replacedFees += desc.Fee
+	}
+	for _, input := range tx.Inputs {
+		if seen[input.PrevTxHash] {
+			return nil, fmt.Errorf("%w: it spends the transaction %x it replaces", ErrReplacementRejected, input.PrevTxHash)
+		}
+	}
+	if fee <= replacedFees {
+		return nil, fmt.Errorf("%w: fee %d does not exceed the %d it replaces", ErrReplacementRejected, fee, replacedFees)
+	}
+	if minFee := p.cfg.MinFeeRate.Fee(size); fee-replacedFees < minFee {
+		return nil, fmt.Errorf("%w: additional fee %d is below the minimum %d for its size", ErrReplacementRejected, fee-replacedFees, minFee)
+	}
+	return replaced, nil
+}
+
+// checkInputs verifies the inputs spend outputs of the best chain or the
+// pool that belong to them, and returns the fee
+func (p *Pool) checkInputs(tx *types.Transaction) (uint64, error) {
+	var inputSum uint64
+	for _, input := range tx.Inputs {
+		op := utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}
+		output, err := p.fetchOutput(op)
+		if err != nil {
+			return 0, err
+		}
+		if err := utxo.CheckOwner(input.PublicKey, output.PublicKeyHash); err != nil {
+			return 0, fmt.Errorf("%w: input %s: %w", blockchain.ErrBadSpend, op, err)
+		}
+		if inputSum > math.MaxUint64-output.Amount {
+			return 0, fmt.Errorf("%w: input amounts overflow", blockchain.ErrBadSpend)
+		}
+		inputSum += output.Amount
+	}
+
+	outputSum, err := utxo.SumOutputs(tx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", blockchain.ErrBadTransaction, err)
+	}
+	if outputSum > inputSum {
+		return 0, fmt.Errorf("%w: %w: %d > %d", blockchain.ErrBadSpend, utxo.ErrInsufficientInputs, outputSum, inputSum)
+	}
+	return inputSum - outputSum, nil
+}
+
+// fetchOutput returns an output created by a pooled transaction or unspent
+// in the best chain
+func (p *Pool) fetchOutput(op utxo.Outpoint) (*types.TransactionOutput, error) {
+	if parent, ok := p.txs[op.TxHash]; ok {
+		if int(op.Index) >= len(parent.Tx.Outputs) {
+			return nil, fmt.Errorf("%w: output %s does not exist", blockchain.ErrBadSpend, op)
+		}
+		return &parent.Tx.Outputs[op.Index], nil
+	}
+
+	entry := p.cfg.Chain.FetchUtxo(op)
+	if entry == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMissingInputs, op)
+	}
+	return &types.TransactionOutput{Amount: entry.Amount, PublicKeyHash: entry.PublicKeyHash}, nil
+}
+
+// makeRoom evicts the transactions with the lowest eviction rates, and
+// their descendants, until a transaction of size bytes fits. It fails if
+// that would evict a transaction paying at least rate or an ancestor of tx.
+func (p *Pool) makeRoom(tx *types.Transaction, size int, rate FeeRate) error {
+	if p.size+size <= p.cfg.MaxSize {
+		return nil
+	}
+	p.expire()
+	if p.size+size <= p.cfg.MaxSize {
+		return nil
+	}
+
+	// Candidates are popped off the heap while choosing and pushed back
+	// before anything is evicted
+	ancestors := p.ancestors(tx)
+	evict := make(map[[32]byte]bool)
+	var candidates, evicted []*TxDesc
+	freed := 0
+	var err error
+	for err == nil && p.size-freed+size > p.cfg.MaxSize {
+		if p.byRate.Len() == 0 {
+			err = fmt.Errorf("%w: fee rate %v", ErrPoolFull, rate)
+			break
+		}
+		desc := heap.Pop(&p.byRate).(*TxDesc)
+		candidates = append(candidates, desc)
+		if evict[desc.Tx.Hash] {
+			continue
+		}
+		if desc.evictionRate() >= rate {
+			err = fmt.Errorf("%w: fee rate %v", ErrPoolFull, rate)
+			break
+		}
+		for _, d := range p.withDescendants(desc) {
+			if ancestors[d.Tx.Hash] {
+				err = fmt.Errorf("%w: it would evict its own parent %x", ErrPoolFull, d.Tx.Hash)
+				break
+			}
+			if !evict[d.Tx.Hash] {
+				evict[d.Tx.Hash] = true
+				evicted = append(evicted, d)
+				freed += d.Size
+			}
+		}
+	}
+	for _, desc := range candidates {
+		heap.Push(&p.byRate, desc)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Descendants follow their ancestors, evicting backwards removes
+	// children first
+	for i := len(evicted) - 1; i >= 0; i-- {
+		p.evict(evicted[i])
+	}
+	return nil
+}
+
+// ancestors returns the hashes of the pooled transactions tx spends from,
+// directly or through other pooled transactions
+func (p *Pool) ancestors(tx *types.Transaction) map[[32]byte]bool {
+	ancestors := make(map[[32]byte]bool)
+	queue := []*types.Transaction{tx}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, input := range next.Inputs {
+			parent, ok := p.txs[input.PrevTxHash]
+			if ok && !ancestors[parent.Tx.Hash] {
+				ancestors[parent.Tx.Hash] = true
+				queue = append(queue, parent.Tx)
+			}
+		}
+	}
+	return ancestors
+}
+
+// withDescendants returns desc and the pooled transactions spending from
+// it, directly or through other pooled transactions, parents first
+func (p *Pool) withDescendants(desc *TxDesc) []*TxDesc {
+	result := []*TxDesc{desc}
+	seen := map[[32]byte]bool{desc.Tx.Hash: true}
+	for i := 0; i < len(result); i++ {
+		tx := result[i].Tx
+		for index := range tx.Outputs {
+			child, ok := p.spent[utxo.Outpoint{TxHash: tx.Hash, Index: uint32(index)}]
+			if ok && !seen[child.Tx.Hash] {
+				seen[child.Tx.Hash] = true
+				result = append(result, child)
+			}
+		}
+	}
+	return result
+}
+
+// add inserts a transaction, the caller must hold the lock
+func (p *Pool) add(desc *TxDesc) {
+	p.txs[desc.Tx.Hash] = desc
+	for _, input := range desc.Tx.Inputs {
+		p.spent[utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}] = desc
+	}
+	p.size += desc.Size
+
+	desc.packageFee, desc.packageSize = desc.Fee, desc.Size
+	heap.Push(&p.byRate, desc)
+	heap.Push(&p.byAge, desc)
+
+	ancestors := p.ancestors(desc.Tx)
+	if p.hasChildren(desc) {
+		// Taken back from a disconnected block after its children, which
+		// now join the packages of its ancestors too
+		p.updatePackage(desc)
+		for hash := range ancestors {
+			p.updatePackage(p.txs[hash])
+		}
+		return
+	}
+	for hash := range ancestors {
+		ancestor := p.txs[hash]
+		ancestor.packageFee += desc.Fee
+		ancestor.packageSize += desc.Size
+		p.byRate.fix(ancestor)
+	}
+}
+
+// remove deletes a transaction but not its descendants, the caller must
+// hold the lock
+func (p *Pool) remove(desc *TxDesc) {
+	if _, ok := p.txs[desc.Tx.Hash]; !ok {
+		return
+	}
+	ancestors := p.ancestors(desc.Tx)
+	leaf := !p.hasChildren(desc)
+
+	delete(p.txs, desc.Tx.Hash)
+	for _, input := range desc.Tx.Inputs {
+		delete(p.spent, utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex})
+	}
+	p.size -= desc.Size
+	p.byRate.remove(desc)
+	p.byAge.remove(desc)
+
+	for hash := range ancestors {
+		ancestor := p.txs[hash]
+		if !leaf {
+			// Its children may still descend from the ancestor another way
+			p.updatePackage(ancestor)
+			continue
+		}
+		ancestor.packageFee -= desc.Fee
+		ancestor.packageSize -= desc.Size
+		p.byRate.fix(ancestor)
+	}
+}
+
+// hasChildren reports whether a pooled transaction spends from desc
+func (p *Pool) hasChildren(desc *TxDesc) bool {
+	for index := range desc.Tx.Outputs {
+		if _, ok := p.spent[utxo.Outpoint{TxHash: desc.Tx.Hash, Index: uint32(index)}]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// updatePackage adds up the descendant package of a transaction again
+func (p *Pool) updatePackage(desc *TxDesc) {
+	desc.packageFee, desc.packageSize = 0, 0
+	for _, d := range p.withDescendants(desc) {
+		desc.packageFee += d.Fee
+		desc.packageSize += d.Size
+	}
+	p.byRate.fix(desc)
+}
+
+// evict deletes a transaction that won't be mined from this pool, the
+// caller must hold the lock
+func (p *Pool) evict(desc *TxDesc) {
+	p.remove(desc)
+	p.forget(desc)
+}
+
+// forget stops the fee estimator from waiting for a transaction that left
+// the pool without being mined, which says nothing about its fee rate
+func (p *Pool) forget(desc *TxDesc) {
+	if p.cfg.FeeEstimator != nil {
+		p.cfg.FeeEstimator.removeTransaction(desc.Tx.Hash)
+	}
+}
+
+// removeWithDescendants evicts a transaction and everything spending from
+// it, children first, the caller must hold the lock
+func (p *Pool) removeWithDescendants(desc *TxDesc) {
+	descs := p.withDescendants(desc)
+	for i := len(descs) - 1; i >= 0; i-- {
+		p.evict(descs[i])
+	}
+}
+
+// expire removes the transactions older than the expiry and their
+// descendants, the caller must hold the lock
+func (p *Pool) expire() {
+	cutoff := p.now().Add(-p.cfg.Expiry)
+	for desc := p.byAge.peek(); desc != nil && desc.Added.Before(cutoff); desc = p.byAge.peek() {
+		p.removeWithDescendants(desc)
+	}
+}
+
+// sorted returns the pooled transactions by fee rate, highest first, the
+// caller must hold the lock
+func (p *Pool) sorted() []*TxDesc {
+	descs := make([]*TxDesc, 0, len(p.txs))
+	for _, desc := range p.txs {
+		descs = append(descs, desc)
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		if descs[i].FeeRate != descs[j].FeeRate {
+			return descs[i].FeeRate > descs[j].FeeRate
+		}
+		return descs[i].Added.Before(descs[j].Added)
+	})
+	return descs
+}
+
+// HaveTransaction reports whether the transaction is in the pool
+func (p *Pool) HaveTransaction(hash [32]byte) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.txs[hash]
+	return ok
+}
+
+// FetchTransaction returns a transaction of the pool
+func (p *Pool) FetchTransaction(hash [32]byte) (*types.Transaction, error) {
+	desc := p.Lookup(hash)
+	if desc == nil {
+		return nil, fmt.Errorf("%w: %x", ErrNotFound, hash)
+	}
+	return desc.Tx, nil
+}
+
+// Lookup returns the description of a pooled transaction, or nil
+func (p *Pool) Lookup(hash [32]byte) *TxDesc {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.txs[hash]
+}
+
+// Spender returns the pooled transaction spending an outpoint, or nil
+func (p *Pool) Spender(op utxo.Outpoint) *TxDesc {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.spent[op]
+}
+
+// TxHashes returns the hashes of the pooled transactions
+func (p *Pool) TxHashes() [][32]byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	hashes := make([][32]byte, 0, len(p.txs))
+	for hash := range p.txs {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// TxDescs returns the pooled transactions ordered by fee rate, highest
+// first
+func (p *Pool) TxDescs() []*TxDesc {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.sorted()
+}
+
+// MiningDescs returns the pooled transactions for block templates,
+// ordered by fee rate. It implements miner.TxSource.
+func (p *Pool) MiningDescs() []*miner.TxDesc {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	sorted := p.sorted()
+	descs := make([]*miner.TxDesc, len(sorted))
+	for i, desc := range sorted {
+		descs[i] = &miner.TxDesc{Tx: desc.Tx, Fee: desc.Fee}
+	}
+	return descs
+}
+
+// Count returns the number of pooled transactions
+func (p *Pool) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.txs)
+}
+
+// Size returns the encoded size of the pooled transactions
+func (p *Pool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.size
+}
+
+// BlockConnected removes the transactions a block confirms and those
+// spending the same outputs, which can never confirm now. It implements
+// blockchain.Observer.
+func (p *Pool) BlockConnected(block *types.Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		if tx.IsCoinbase() {
+			continue
+		}
+		if desc, ok := p.txs[tx.Hash]; ok {
+			p.remove(desc)
+		}
+		for _, input := range tx.Inputs {
+			if conflict, ok := p.spent[utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}]; ok {
+				p.removeWithDescendants(conflict)
+			}
+		}
+	}
+	p.expire()
+}
+
+// BlockDisconnected holds on to the transactions of a block removed from
+// the best chain until the reorganization completes. It implements
+// blockchain.Observer.
+func (p *Pool) BlockDisconnected(block *types.Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.disconnected = append(p.disconnected, block)
+}
+
+// TipChanged takes back the transactions of disconnected blocks that the
+// new branch did not confirm, oldest first so parents precede children.
+// It implements blockchain.Observer.
+func (p *Pool) TipChanged(tip *types.Block) {
+	p.mu.Lock()
+	disconnected := p.disconnected
+	p.disconnected = nil
+	if len(disconnected) == 0 {
+		p.mu.Unlock()
+		return
+	}
+
+	var accepted []*types.Transaction
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		block := disconnected[i]
+		for j := range block.Transactions {
+			tx := &block.Transactions[j]
+			if tx.IsCoinbase() || checkTransaction(tx) != nil {
+				continue
+			}
+			if desc, err := p.maybeAccept(tx); err == nil {
+				accepted = append(accepted, desc.Tx)
+			}
+		}
+	}
+	p.removeUnspendable()
+	p.mu.Unlock()
+
+	if p.cfg.OnAccept != nil {
+		for _, tx := range accepted {
+			p.cfg.OnAccept(tx)
+		}
+	}
+}
+
+// removeUnspendable removes the transactions spending outputs that are
+// neither pooled nor unspent in the best chain anymore, like those of a
+// disconnected coinbase. The caller must hold the lock.
+func (p *Pool) removeUnspendable() {
+	for _, desc := range p.txs {
+		for _, input := range desc.Tx.Inputs {
+			op := utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}
+			if _, err := p.fetchOutput(op); err != nil {
+				p.removeWithDescendants(desc)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package mempool
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/miner"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+	"github.com/fkapsahili/mini-blockchain/internal/utxo"
+)
+
+// harness is a regtest chain with a key owning confirmed outputs to spend
+type harness struct {
+	t     *testing.T
+	chain *blockchain.Chain
+	key   *ecdsa.PrivateKey
+	coins []utxo.Outpoint // Confirmed outputs of coinAmount owned by key
+}
+
+// coinAmount is the amount of each output of the harness
+const coinAmount = 100_000
+
+// newHarness opens a chain and confirms count outputs for key
+func newHarness(t *testing.T, count int) *harness {
+	t.Helper()
+	chain, err := blockchain.OpenChain(t.TempDir(), blockchain.Options{Params: &chaincfg.RegTestParams})
+	if err != nil {
+		t.Fatalf("OpenChain() error = %v", err)
+	}
+	t.Cleanup(func() { chain.Close() })
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	h := &harness{t: t, chain: chain, key: key}
+
+	funding := h.mine(h.tip(), 0, nil)
+	split := h.spend(key, []utxo.Outpoint{{TxHash: funding.Transactions[0].Hash}}, 0, splitAmounts(funding.Transactions[0].Outputs[0].Amount, count)...)
+	h.mine(funding, 0, []*types.Transaction{split})
+	for i := 0; i < count; i++ {
+		h.coins = append(h.coins, utxo.Outpoint{TxHash: split.Hash, Index: uint32(i)})
+	}
+	return h
+}
+
+// splitAmounts returns count outputs of coinAmount and the change
+func splitAmounts(total uint64, count int) []uint64 {
+	amounts := make([]uint64, 0, count+1)
+	for i := 0; i < count; i++ {
+		amounts = append(amounts, coinAmount)
+	}
+	return append(amounts, total-uint64(count)*coinAmount)
+}
+
+// newPool creates a pool on the chain of the harness
+func (h *harness) newPool(cfg Config) *Pool {
+	h.t.Helper()
+	cfg.Chain = h.chain
+	pool, err := New(cfg)
+	if err != nil {
+		h.t.Fatalf("New() error = %v", err)
+	}
+	h.t.Cleanup(pool.Close)
+	return pool
+}
+
+// tip returns the tip of the best chain
+func (h *harness) tip() *types.Block {
+	h.t.Helper()
+	tip, err := h.chain.GetLatestBlock()
+	if err != nil {
+		h.t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	return tip
+}
+
+// mine adds a block with txs on top of parent paying its subsidy to the
+// key, offset makes sibling blocks distinct
+func (h *harness) mine(parent *types.Block, offset time.Duration, txs []*types.Transaction) *types.Block {
+	h.t.Helper()
+	height := parent.Height + 1
+	block := &types.Block{
+		Header: types.BlockHeader{
+			Version:       1,
+			PrevBlockHash: parent.Hash,
+			Timestamp:     parent.Header.Timestamp.Add(time.Second + offset),
+			Difficulty:    chaincfg.RegTestParams.PowLimitBits,
+		},
+		Transactions: []types.Transaction{types.NewCoinbaseTransaction(height, 0, []types.TransactionOutput{{
+			Amount:        blockchain.CalcBlockSubsidy(&chaincfg.RegTestParams, height),
+			PublicKeyHash: crypto.HashToAddress(&h.key.PublicKey),
+		}})},
+		Height: height,
+	}
+	for _, tx := range txs {
+		block.Transactions = append(block.Transactions, *tx)
+	}
+	block.UpdateRoots()
+	if _, err := miner.New(miner.Config{Threads: 1}).Solve(context.Background(), block); err != nil {
+		h.t.Fatalf("Solve() error = %v", err)
+	}
+	if err := h.chain.AddBlock(block); err != nil {
+		h.t.Fatalf("AddBlock() error = %v", err)
+	}
+	return block
+}
+
+// spend returns a transaction spending inputs with key into outputs of the
+// amounts paying to the harness key. The fee is what is left.
+func (h *harness) spend(key *ecdsa.PrivateKey, inputs []utxo.Outpoint, lockTime uint32, amounts ...uint64) *types.Transaction {
+	h.t.Helper()
+	tx := &types.Transaction{Version: 1, LockTime: lockTime}
+	for _, op := range inputs {
+		tx.Inputs = append(tx.Inputs, types.TransactionInput{PrevTxHash: op.TxHash, OutputIndex: op.Index})
+	}
+	for _, amount := range amounts {
+		tx.Outputs = append(tx.Outputs, types.TransactionOutput{Amount: amount, PublicKeyHash: crypto.HashToAddress(&h.key.PublicKey)})
+	}
+	if err := tx.Sign(key); err != nil {
+		h.t.Fatalf("Sign() error = %v", err)
+	}
+	return tx
+}
+
+// waitFor polls cond until it holds, pools follow the chain asynchronously
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProcessTransaction(t *testing.T) {
+	h := newHarness(t, 3)
+	var accepted []*types.Transaction
+	pool := h.newPool(Config{OnAccept: func(tx *types.Transaction) { accepted = append(accepted, tx) }})
+
+	parent := h.spend(h.key, h.coins[:1], 0, coinAmount-1000)
+	if err := pool.ProcessTransaction(parent); err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+	// Children may spend outputs of pooled parents
+	child := h.spend(h.key, []utxo.Outpoint{{TxHash: parent.Hash}}, 0, coinAmount-2000)
+	if err := pool.ProcessTransaction(child); err != nil {
+		t.Fatalf("ProcessTransaction() of a child error = %v", err)
+	}
+
+	stranger, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	coinbase := types.NewCoinbaseTransaction(9, 0, nil)
+	tests := []struct {
+		name    string
+		tx      *types.Transaction
+		wantErr error
+	}{
+		{"duplicate", parent, ErrDuplicate},
+		{"double spend", h.spend(h.key, h.coins[:1], 1, coinAmount-5000), ErrDoubleSpend},
+		{"unknown output", h.spend(h.key, []utxo.Outpoint{{TxHash: [32]byte{1}}}, 0, 1), ErrMissingInputs},
+		{"spent output", h.spend(h.key, []utxo.Outpoint{{TxHash: h.tip().Transactions[1].Inputs[0].PrevTxHash}}, 0, 1), ErrMissingInputs},
+		{"output of a pooled transaction that does not exist", h.spend(h.key, []utxo.Outpoint{{TxHash: parent.Hash, Index: 5}}, 0, 1), blockchain.ErrBadSpend},
+		{"someone else's output", h.spend(stranger, h.coins[1:2], 0, coinAmount-1000), blockchain.ErrBadSpend},
+		{"spends more than its inputs", h.spend(h.key, h.coins[1:2], 0, coinAmount+1), blockchain.ErrBadSpend},
+		{"fee below the minimum", h.spend(h.key, h.coins[1:2], 0, coinAmount-10), ErrFeeTooLow},
+		{"spends an output twice", h.spend(h.key, []utxo.Outpoint{h.coins[1], h.coins[1]}, 0, 1), blockchain.ErrBadTransaction},
+		{"coinbase", &coinbase, blockchain.ErrBadTransaction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := pool.ProcessTransaction(tt.tx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ProcessTransaction() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if pool.Count() != 2 || len(accepted) != 2 || accepted[0] != parent || accepted[1] != child {
+		t.Errorf("pool holds %d, accepted %d, want the parent and the child", pool.Count(), len(accepted))
+	}
+	desc := pool.Lookup(parent.Hash)
+	if desc == nil || desc.Fee != 1000 || desc.Size != parent.SerializeSize() || desc.FeeRate != NewFeeRate(1000, desc.Size) {
+		t.Errorf("Lookup() = %+v, want fee 1000 for %d bytes", desc, parent.SerializeSize())
+	}
+	if got := pool.Spender(h.coins[0]); got == nil || got.Tx != parent {
+		t.Errorf("Spender() = %v, want the parent", got)
+	}
+	if got := pool.Spender(h.coins[1]); got != nil {
+		t.Errorf("Spender() of an unspent output = %x, want nil", got.Tx.Hash)
+	}
+	if _, err := pool.FetchTransaction([32]byte{1}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FetchTransaction() of an unknown transaction error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	h := newHarness(t, 5)
+	size := h.spend(h.key, h.coins[:1], 0, 1).SerializeSize()
+	// Room for three transactions, signatures vary by a few bytes
+	pool := h.newPool(Config{MaxSize: 3*size + 10})
+
+	low := h.spend(h.key, h.coins[0:1], 0, coinAmount-1000)
+	high := h.spend(h.key, h.coins[1:2], 0, coinAmount-5000)
+	lowChild := h.spend(h.key, []utxo.Outpoint{{TxHash: low.Hash}}, 0, coinAmount-2200)
+	for _, tx := range []*types.Transaction{low, high, lowChild} {
+		if err := pool.ProcessTransaction(tx); err != nil {
+			t.Fatalf("ProcessTransaction() error = %v", err)
+		}
+	}
+
+	descs := pool.TxDescs()
+	if len(descs) != 3 || descs[0].Tx != high || descs[1].Tx != lowChild || descs[2].Tx != low {
+		t.Errorf("TxDescs() not ordered by fee rate")
+	}
+
+	// Paying less than everything in a full pool is refused
+	if err := pool.ProcessTransaction(h.spend(h.key, h.coins[2:3], 0, coinAmount-900)); !errors.Is(err, ErrPoolFull) {
+		t.Errorf("ProcessTransaction() of a low fee transaction error = %v, want %v", err, ErrPoolFull)
+	}
+
+	// A better paying transaction evicts the package paying the lowest
+	// rate, the child goes with its parent
+	better := h.spend(h.key, h.coins[3:4], 0, coinAmount-3000)
+	if err := pool.ProcessTransaction(better); err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+	if pool.HaveTransaction(low.Hash) || pool.HaveTransaction(lowChild.Hash) || !pool.HaveTransaction(high.Hash) || !pool.HaveTransaction(better.Hash) {
+		t.Errorf("pool holds %d transactions, want the lowest fee rate and its child evicted", pool.Count())
+	}
+	if want := high.SerializeSize() + better.SerializeSize(); pool.Size() != want {
+		t.Errorf("Size() = %d, want %d", pool.Size(), want)
+	}
+}
+
+func TestEvictionKeepsPaidForParents(t *testing.T) {
+	h := newHarness(t, 4)
+	size := h.spend(h.key, h.coins[:1], 0, 1).SerializeSize()
+	pool := h.newPool(Config{MaxSize: 3*size + 10})
+
+	// The child pays for its parent, together they beat mid
+	parent := h.spend(h.key, h.coins[0:1], 0, coinAmount-500)
+	child := h.spend(h.key, []utxo.Outpoint{{TxHash: parent.Hash}}, 0, coinAmount-10000)
+	mid := h.spend(h.key, h.coins[1:2], 0, coinAmount-2000)
+	for _, tx := range []*types.Transaction{parent, child, mid} {
+		if err := pool.ProcessTransaction(tx); err != nil {
+			t.Fatalf("ProcessTransaction() error = %v", err)
+		}
+	}
+
+	better := h.spend(h.key, h.coins[2:3], 0, coinAmount-3000)
+	if err := pool.ProcessTransaction(better); err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+	if pool.HaveTransaction(mid.Hash) || !pool.HaveTransaction(parent.Hash) || !pool.HaveTransaction(child.Hash) || !pool.HaveTransaction(better.Hash) {
+		t.Errorf("pool holds %d transactions, want mid evicted instead of the parent its child pays for", pool.Count())
+	}
+
+	// Once the child is confirmed the parent is judged by its own rate
+	pool.mu.Lock()
+	if desc := pool.txs[parent.Hash]; desc.packageFee != 10000 || desc.packageSize != parent.SerializeSize()+child.SerializeSize() {
+		t.Errorf("package of the parent = %d fee in %d bytes, want both transactions", desc.packageFee, desc.packageSize)
+	}
+	pool.remove(pool.txs[child.Hash])
+	if desc := pool.txs[parent.Hash]; desc.evictionRate() != desc.FeeRate {
+		t.Errorf("evictionRate() = %v without the child, want its own %v", desc.evictionRate(), desc.FeeRate)
+	}
+	pool.mu.Unlock()
+}
+
+func TestReplaceByFee(t *testing.T) {
+	h := newHarness(t, 3)
+	var accepted []*types.Transaction
+	pool := h.newPool(Config{
+		ReplaceByFee:            true,
+		MaxReplacementEvictions: 2,
+		OnAccept:                func(tx *types.Transaction) { accepted = append(accepted, tx) },
+	})
+
+	// Paying 1000 and another 1000 for its child
+	stuck := h.spend(h.key, h.coins[:1], 0, coinAmount-1000)
+	child := h.spend(h.key, []utxo.Outpoint{{TxHash: stuck.Hash}}, 0, coinAmount-2000)
+	// A chain of three, one more than a replacement may evict
+	long := h.spend(h.key, h.coins[1:2], 0, coinAmount-1000)
+	longChild := h.spend(h.key, []utxo.Outpoint{{TxHash: long.Hash}}, 0, coinAmount-2000)
+	longGrandchild := h.spend(h.key, []utxo.Outpoint{{TxHash: longChild.Hash}}, 0, coinAmount-3000)
+	for _, tx := range []*types.Transaction{stuck, child, long, longChild, longGrandchild} {
+		if err := pool.ProcessTransaction(tx); err != nil {
+			t.Fatalf("ProcessTransaction() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		tx   *types.Transaction
+	}{
+		{"lower fee rate", h.spend(h.key, h.coins[:1], 1, coinAmount-900)},
+		{"fee not above the replaced ones", h.spend(h.key, h.coins[:1], 2, coinAmount-1900)},
+		{"no fee for its own size", h.spend(h.key, h.coins[:1], 3, coinAmount-2050)},
+		{"spends a replaced transaction", h.spend(h.key, []utxo.Outpoint{h.coins[0], {TxHash: stuck.Hash}}, 4, 10_000)},
+		{"evicts too many", h.spend(h.key, h.coins[1:2], 5, coinAmount-50_000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := pool.ProcessTransaction(tt.tx); !errors.Is(err, ErrReplacementRejected) {
+				t.Errorf("ProcessTransaction() error = %v, want %v", err, ErrReplacementRejected)
+			}
+		})
+	}
+	if pool.Count() != 5 || len(accepted) != 5 {
+		t.Fatalf("pool holds %d, accepted %d after rejected replacements, want 5", pool.Count(), len(accepted))
+	}
+
+	bumped := h.spend(h.key, h.coins[:1], 6, coinAmount-5000)
+	if err := pool.ProcessTransaction(bumped); err != nil {
+		t.Fatalf("ProcessTransaction() of a replacement error = %v", err)
+	}
+	if pool.HaveTransaction(stuck.Hash) || pool.HaveTransaction(child.Hash) || !pool.HaveTransaction(bumped.Hash) {
+		t.Errorf("pool holds %d transactions, want the replaced one and its child evicted", pool.Count())
+	}
+	if got := pool.Spender(h.coins[0]); got == nil || got.Tx != bumped {
+		t.Errorf("Spender() = %v, want the replacement", got)
+	}
+	if got := pool.Spender(utxo.Outpoint{TxHash: stuck.Hash}); got != nil {
+		t.Errorf("Spender() of a replaced output = %x, want nil", got.Tx.Hash)
+	}
+	if len(accepted) != 6 || accepted[5] != bumped {
+		t.Errorf("accepted %d, want the replacement last", len(accepted))
+	}
+}
+
+func TestFollowChain(t *testing.T) {
+	h := newHarness(t, 4)
+	pool := h.newPool(Config{})
+
+	confirmed := h.spend(h.key, h.coins[0:1], 0, coinAmount-1000)
+	conflict := h.spend(h.key, h.coins[1:2], 0, coinAmount-1000)
+	conflictChild := h.spend(h.key, []utxo.Outpoint{{TxHash: conflict.Hash}}, 0, coinAmount-2000)
+	stays := h.spend(h.key, h.coins[2:3], 0, coinAmount-1000)
+	for _, tx := range []*types.Transaction{confirmed, conflict, conflictChild, stays} {
+		if err := pool.ProcessTransaction(tx); err != nil {
+			t.Fatalf("ProcessTransaction() error = %v", err)
+		}
+	}
+
+	// A block confirming one transaction and double spending another
+	fork := h.tip()
+	doubleSpend := h.spend(h.key, h.coins[1:2], 0, coinAmount-3000)
+	block := h.mine(fork, 0, []*types.Transaction{confirmed, doubleSpend})
+	waitFor(t, "confirmed and conflicting transactions to leave", func() bool { return pool.Count() == 1 })
+	if !pool.HaveTransaction(stays.Hash) {
+		t.Errorf("unrelated transaction %x was removed", stays.Hash)
+	}
+
+	// A longer branch without the block takes its transactions back, the
+	// double spend wins over the children that conflicted with it
+	side := h.mine(fork, time.Minute, nil)
+	h.mine(side, 0, nil)
+	if h.chain.IsMainChain(block.Hash) {
+		t.Fatal("reorganization did not happen")
+	}
+	waitFor(t, "disconnected transactions to return", func() bool { return pool.Count() == 3 })
+	for _, tx := range []*types.Transaction{confirmed, doubleSpend, stays} {
+		if !pool.HaveTransaction(tx.Hash) {
+			t.Errorf("transaction %x not in the pool after the reorganization", tx.Hash)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	h := newHarness(t, 2)
+	pool := h.newPool(Config{Expiry: time.Hour})
+
+	parent := h.spend(h.key, h.coins[0:1], 0, coinAmount-1000)
+	if err := pool.ProcessTransaction(parent); err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+	pool.mu.Lock()
+	pool.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+	pool.mu.Unlock()
+	child := h.spend(h.key, []utxo.Outpoint{{TxHash: parent.Hash}}, 0, coinAmount-2000)
+	if err := pool.ProcessTransaction(child); err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+
+	// Expiry runs as blocks connect, children go with their parents
+	pool.mu.Lock()
+	pool.now = func() time.Time { return time.Now().Add(61 * time.Minute) }
+	pool.mu.Unlock()
+	h.mine(h.tip(), 0, nil)
+	waitFor(t, "expired transactions to leave", func() bool { return pool.Count() == 0 })
+}
@@ -0,0 +1,134 @@
+package mempool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// mempoolFile is the name of the saved pool inside the data directory
+const mempoolFile = "mempool.dat"
+
+// mempoolFileVersion starts the saved pool, files of other versions are
+// ignored
+const mempoolFileVersion = 1
+
+// savedTx is a transaction read back from the saved pool
+type savedTx struct {
+	tx    *types.Transaction
+	added time.Time
+}
+
+// Save writes the pooled transactions to dataDir so Load can restore them
+// after a restart. Each is written with the time it was added, oldest
+// first.
+func (p *Pool) Save(dataDir string) error {
+	p.mu.RLock()
+	descs := make([]*TxDesc, 0, len(p.txs))
+	for _, desc := range p.txs {
+		descs = append(descs, desc)
+	}
+	p.mu.RUnlock()
+	sort.Slice(descs, func(i, j int) bool { return descs[i].Added.Before(descs[j].Added) })
+
+	var buf bytes.Buffer
+	w := codec.NewWriter(&buf)
+	w.WriteUint32(mempoolFileVersion)
+	w.WriteVarInt(uint64(len(descs)))
+	for _, desc := range descs {
+		desc.Tx.Encode(w)
+		w.WriteInt64(desc.Added.UnixNano())
+	}
+	if err := w.Err(); err != nil {
+		return fmt.Errorf("failed to encode transaction pool: %w", err)
+	}
+	return storage.WriteFileAtomic(filepath.Join(dataDir, mempoolFile), buf.Bytes())
+}
+
+// Load adds the transactions saved in dataDir that are still valid on the
+// best chain and haven't expired, keeping the time they were first added.
+// Restored transactions are accepted like new ones and returned, so the
+// caller can announce them. A missing file or one of another version
+// restores nothing.
+func (p *Pool) Load(dataDir string) ([]*TxDesc, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, mempoolFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read saved transactions: %w", err)
+	}
+
+	r := codec.NewReader(bytes.NewReader(data), int64(len(data)))
+	if version := r.ReadUint32(); r.Err() == nil && version != mempoolFileVersion {
+		return nil, nil
+	}
+	saved := make([]savedTx, r.ReadCount(uint64(len(data))))
+	for i := range saved {
+		saved[i].tx = new(types.Transaction)
+		saved[i].tx.Decode(r)
+		saved[i].added = time.Unix(0, r.ReadInt64())
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode saved transactions: %w", err)
+	}
+
+	p.mu.Lock()
+
+	cutoff := p.now().Add(-p.cfg.Expiry)
+	pending := saved[:0]
+	for _, s := range saved {
+		if !s.added.Before(cutoff) && checkTransaction(s.tx) == nil {
+			pending = append(pending, s)
+		}
+	}
+
+	// Transactions normally follow their parents, but parents that were
+	// taken back by a reorganization were added after their children
+	var restored []*TxDesc
+	for len(pending) > 0 {
+		var retry []savedTx
+		for _, s := range pending {
+			desc, err := p.maybeAccept(s.tx)
+			if errors.Is(err, ErrMissingInputs) {
+				retry = append(retry, s)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			desc.Added = s.added
+			p.byAge.fix(desc)
+			p.byRate.fix(desc)
+			restored = append(restored, desc)
+		}
+		if len(retry) == len(pending) {
+			break
+		}
+		pending = retry
+	}
+	// Transactions evicted while restoring the rest were never accepted
+	restored = slices.DeleteFunc(restored, func(desc *TxDesc) bool { return p.txs[desc.Tx.Hash] != desc })
+	if p.cfg.FeeEstimator != nil {
+		for _, desc := range restored {
+			p.cfg.FeeEstimator.observeTransaction(desc)
+		}
+	}
+	p.mu.Unlock()
+
+	if p.cfg.OnAccept != nil {
+		for _, desc := range restored {
+			p.cfg.OnAccept(desc.Tx)
+		}
+	}
+	return restored, nil
+}
@@ -0,0 +1,86 @@
+package mempool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+	"github.com/fkapsahili/mini-blockchain/internal/utxo"
+)
+
+func TestSaveLoad(t *testing.T) {
+	h := newHarness(t, 3)
+	dir := t.TempDir()
+	pool := h.newPool(Config{})
+
+	parent := h.spend(h.key, h.coins[:1], 0, coinAmount-1000)
+	child := h.spend(h.key, []utxo.Outpoint{{TxHash: parent.Hash}}, 0, coinAmount-2000)
+	confirmed := h.spend(h.key, h.coins[1:2], 0, coinAmount-1000)
+	for _, tx := range []*types.Transaction{parent, child, confirmed} {
+		if err := pool.ProcessTransaction(tx); err != nil {
+			t.Fatalf("ProcessTransaction() error = %v", err)
+		}
+	}
+	added := pool.Lookup(parent.Hash).Added
+	if err := pool.Save(dir); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// One of them is confirmed while the node is down
+	h.mine(h.tip(), 0, []*types.Transaction{confirmed})
+
+	// Restored transactions are accepted like new ones
+	e, err := OpenFeeEstimator("", h.chain)
+	if err != nil {
+		t.Fatalf("OpenFeeEstimator() error = %v", err)
+	}
+	defer e.Close()
+	var accepted int
+	restarted := h.newPool(Config{FeeEstimator: e, OnAccept: func(*types.Transaction) { accepted++ }})
+	restored, err := restarted.Load(dir)
+	if err != nil || len(restored) != 2 {
+		t.Fatalf("Load() = %d, %v, want 2 restored", len(restored), err)
+	}
+	if accepted != 2 {
+		t.Errorf("OnAccept called %d times, want 2", accepted)
+	}
+	for _, desc := range restored {
+		if _, ok := e.tracked[desc.Tx.Hash]; !ok {
+			t.Errorf("restored transaction %x not tracked by the fee estimator", desc.Tx.Hash)
+		}
+	}
+	if !restarted.HaveTransaction(parent.Hash) || !restarted.HaveTransaction(child.Hash) || restarted.HaveTransaction(confirmed.Hash) {
+		t.Errorf("restored pool holds %d transactions, want the unconfirmed parent and child", restarted.Count())
+	}
+	if got := restarted.Lookup(parent.Hash).Added; !got.Equal(added) {
+		t.Errorf("restored transaction added at %v, want %v", got, added)
+	}
+
+	expiring := h.newPool(Config{Expiry: time.Hour})
+	expiring.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if restored, err := expiring.Load(dir); err != nil || len(restored) != 0 {
+		t.Errorf("Load() of expired transactions = %d, %v, want 0", len(restored), err)
+	}
+
+	// Files of another version are ignored, damaged ones reported
+	path := filepath.Join(dir, mempoolFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	stale := append([]byte{mempoolFileVersion + 1, 0, 0, 0}, data[4:]...)
+	if err := os.WriteFile(path, stale, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if restored, err := h.newPool(Config{}).Load(dir); err != nil || len(restored) != 0 {
+		t.Errorf("Load() of another version = %d, %v, want 0, nil", len(restored), err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-3], 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := h.newPool(Config{}).Load(dir); err == nil {
+		t.Error("Load() of a truncated file error = nil")
+	}
+}
@@ -0,0 +1,81 @@
+package mempool
+
+import "container/heap"
+
+// txHeap orders pooled transactions so the next to go is found without
+// sorting the pool, it implements heap.Interface
+type txHeap struct {
+	descs []*TxDesc
+	less  func(a, b *TxDesc) bool
+	index func(desc *TxDesc) *int // Position of a transaction in this heap
+}
+
+// newEvictionHeap orders transactions by eviction rate, lowest first and
+// the newest of equal rates first
+func newEvictionHeap() txHeap {
+	return txHeap{
+		less: func(a, b *TxDesc) bool {
+			if ra, rb := a.evictionRate(), b.evictionRate(); ra != rb {
+				return ra < rb
+			}
+			return a.Added.After(b.Added)
+		},
+		index: func(desc *TxDesc) *int { return &desc.rateIndex },
+	}
+}
+
+// newExpiryHeap orders transactions by the time they were added, oldest
+// first
+func newExpiryHeap() txHeap {
+	return txHeap{
+		less:  func(a, b *TxDesc) bool { return a.Added.Before(b.Added) },
+		index: func(desc *TxDesc) *int { return &desc.ageIndex },
+	}
+}
+
+func (h txHeap) Len() int { return len(h.descs) }
+
+func (h txHeap) Less(i, j int) bool { return h.less(h.descs[i], h.descs[j]) }
+
+func (h txHeap) Swap(i, j int) {
+	h.descs[i], h.descs[j] = h.descs[j], h.descs[i]
+	*h.index(h.descs[i]) = i
+	*h.index(h.descs[j]) = j
+}
+
+func (h *txHeap) Push(x any) {
+	desc := x.(*TxDesc)
+	*h.index(desc) = len(h.descs)
+	h.descs = append(h.descs, desc)
+}
+
+func (h *txHeap) Pop() any {
+	last := len(h.descs) - 1
+	desc := h.descs[last]
+	h.descs[last] = nil
+	h.descs = h.descs[:last]
+	*h.index(desc) = -1
+	return desc
+}
+
+// peek returns the next transaction to go, or nil
+func (h *txHeap) peek() *TxDesc {
+	if len(h.descs) == 0 {
+		return nil
+	}
+	return h.descs[0]
+}
+
+// remove takes a transaction out of the heap
+func (h *txHeap) remove(desc *TxDesc) {
+	if i := *h.index(desc); i >= 0 {
+		heap.Remove(h, i)
+	}
+}
+
+// fix moves a transaction whose key changed to its new position
+func (h *txHeap) fix(desc *TxDesc) {
+	if i := *h.index(desc); i >= 0 {
+		heap.Fix(h, i)
+	}
+}
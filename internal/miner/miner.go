@@ -0,0 +1,207 @@
+package miner
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// nonceSpace is the number of header nonces tried per extra nonce
+var nonceSpace uint64 = 1 << 32
+
+// hashBatch is how many hashes a worker tries between checking for cancellation
+const hashBatch = 1 << 12
+
+// ExtraNonceFunc updates a block once its nonce space is exhausted so that
+// the header hashes differently. It must keep the block valid.
+type ExtraNonceFunc func(block *types.Block, extraNonce uint64)
+
+// Config configures a Miner
+type Config struct {
+	// Threads is the number of worker goroutines, defaults to the number of CPUs
+	Threads int
+	// UpdateExtraNonce is called with an increasing extra nonce, defaults to
+	// rewriting the extra nonce of the block's coinbase
+	UpdateExtraNonce ExtraNonceFunc
+}
+
+// Result describes a solved block
+type Result struct {
+	Block      *types.Block
+	Hashes     uint64
+	ExtraNonce uint64
+	Elapsed    time.Duration
+}
+
+// HashRate returns the average hashes per second of the search
+func (r *Result) HashRate() float64 {
+	return hashRate(r.Hashes, r.Elapsed)
+}
+
+// Miner searches for block nonces that satisfy the proof of work
+type Miner struct {
+	threads          int
+	updateExtraNonce ExtraNonceFunc
+
+	hashes  atomic.Uint64
+	started atomic.Int64
+}
+
+// New creates a new miner
+func New(cfg Config) *Miner {
+	if cfg.Threads <= 0 {
+		cfg.Threads = runtime.NumCPU()
+	}
+	if cfg.UpdateExtraNonce == nil {
+		cfg.UpdateExtraNonce = UpdateCoinbaseExtraNonce
+	}
+
+	return &Miner{
+		threads:          cfg.Threads,
+		updateExtraNonce: cfg.UpdateExtraNonce,
+	}
+}
+
+// UpdateCoinbaseExtraNonce rebuilds the block's coinbase with the extra
+// nonce and updates the Merkle root. Blocks without a coinbase have their
+// timestamp moved forward instead.
+func UpdateCoinbaseExtraNonce(block *types.Block, extraNonce uint64) {
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		block.Header.Timestamp = block.Header.Timestamp.Add(time.Second)
+		return
+	}
+
+	coinbase := &block.Transactions[0]
+	*coinbase = types.NewCoinbaseTransaction(block.Height, extraNonce, coinbase.Outputs)
+	block.UpdateRoots()
+}
+
+// HashRate returns the hashes per second of the current or last search
+func (m *Miner) HashRate() float64 {
+	started := m.started.Load()
+	if started == 0 {
+		return 0
+	}
+	return hashRate(m.hashes.Load(), time.Since(time.Unix(0, started)))
+}
+
+// Solve mines the block in place by iterating the header nonce across all
+// worker goroutines. When the nonce space is exhausted the extra nonce is
+// advanced and the search restarts. Solve returns the context error when
+// cancelled before a solution is found.
+func (m *Miner) Solve(ctx context.Context, block *types.Block) (*Result, error) {
+	if block == nil {
+		return nil, errors.New("block cannot be nil")
+	}
+
+	start := time.Now()
+	m.hashes.Store(0)
+	m.started.Store(start.UnixNano())
+
+	for extraNonce := uint64(0); ; extraNonce++ {
+		if extraNonce > 0 {
+			m.updateExtraNonce(block, extraNonce)
+		}
+
+		nonce, hash, found := m.search(ctx, block)
+		if found {
+			block.Header.Nonce = nonce
+			block.Hash = hash
+			return &Result{
+				Block:      block,
+				Hashes:     m.hashes.Load(),
+				ExtraNonce: extraNonce,
+				Elapsed:    time.Since(start),
+			}, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// search splits the nonce space into one range per worker and returns the
+// first nonce found
+func (m *Miner) search(ctx context.Context, block *types.Block) (uint32, [32]byte, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	header := block.GetHeaderBytes()
+	difficulty := block.Header.Difficulty
+
+	type solution struct {
+		nonce uint32
+		hash  [32]byte
+	}
+	solutions := make(chan solution, m.threads)
+
+	var wg sync.WaitGroup
+	chunk := nonceSpace / uint64(m.threads)
+	for i := 0; i < m.threads; i++ {
+		first := uint64(i) * chunk
+		last := first + chunk
+		if i == m.threads-1 {
+			last = nonceSpace
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if nonce, hash, ok := m.work(ctx, header, difficulty, first, last); ok {
+				solutions <- solution{nonce, hash}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(solutions)
+
+	sol, ok := <-solutions
+	return sol.nonce, sol.hash, ok
+}
+
+// work hashes the nonces in [first, last) on a private copy of the header
+func (m *Miner) work(ctx context.Context, header []byte, difficulty uint32, first, last uint64) (uint32, [32]byte, bool) {
+	buf := make([]byte, len(header))
+	copy(buf, header)
+	noncePos := len(buf) - 4
+
+	var count uint64
+	for n := first; n < last; n++ {
+		binary.LittleEndian.PutUint32(buf[noncePos:], uint32(n))
+		hash := crypto.Hash(buf)
+		count++
+
+		if crypto.CheckProofOfWork(hash, difficulty) {
+			m.hashes.Add(count)
+			return uint32(n), hash, true
+		}
+
+		if count == hashBatch {
+			m.hashes.Add(count)
+			count = 0
+			if ctx.Err() != nil {
+				return 0, [32]byte{}, false
+			}
+		}
+	}
+
+	m.hashes.Add(count)
+	return 0, [32]byte{}, false
+}
+
+// hashRate converts a hash count over a duration to hashes per second
+func hashRate(hashes uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(hashes) / elapsed.Seconds()
+}
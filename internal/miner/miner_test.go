@@ -0,0 +1,134 @@
+package miner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// newBlock returns an unsolved block on top of parent
+func newBlock(parent *types.Block, difficulty uint32) *types.Block {
+	block := &types.Block{
+		Header: types.BlockHeader{
+			Version:       1,
+			PrevBlockHash: parent.Hash,
+			Timestamp:     time.Now(),
+			Difficulty:    difficulty,
+		},
+		Transactions: []types.Transaction{types.NewCoinbaseTransaction(parent.Height+1, 0, nil)},
+		Height:       parent.Height + 1,
+	}
+	block.UpdateRoots()
+	return block
+}
+
+func TestSolve(t *testing.T) {
+	chain, err := blockchain.NewChain(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create new chain: %v", err)
+	}
+	defer chain.Close()
+
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest block: %v", err)
+	}
+
+	bits, err := chain.CalcNextRequiredDifficulty()
+	if err != nil {
+		t.Fatalf("CalcNextRequiredDifficulty() error = %v", err)
+	}
+
+	block := newBlock(genesis, bits)
+	result, err := New(Config{Threads: 4}).Solve(context.Background(), block)
+	if err != nil {
+		t.Fatalf("Solve() error = %v", err)
+	}
+	if result.Hashes == 0 {
+		t.Error("Solve() reported zero hashes")
+	}
+
+	if err := chain.ValidateBlock(block); err != nil {
+		t.Fatalf("ValidateBlock() error = %v", err)
+	}
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+}
+
+func TestSolveExtraNonce(t *testing.T) {
+	defer func(n uint64) { nonceSpace = n }(nonceSpace)
+	nonceSpace = 8
+
+	var calls uint64
+	m := New(Config{
+		Threads: 2,
+		UpdateExtraNonce: func(block *types.Block, extraNonce uint64) {
+			calls++
+			if extraNonce != calls {
+				t.Errorf("extra nonce = %d, want %d", extraNonce, calls)
+			}
+			block.Header.Timestamp = block.Header.Timestamp.Add(time.Second)
+		},
+	})
+
+	parent := &types.Block{Height: 0}
+	// One in 32 hashes meets a target of 2^251
+	block := newBlock(parent, 0x20080000)
+	result, err := m.Solve(context.Background(), block)
+	if err != nil {
+		t.Fatalf("Solve() error = %v", err)
+	}
+
+	if result.ExtraNonce != calls {
+		t.Errorf("Result.ExtraNonce = %d, want %d", result.ExtraNonce, calls)
+	}
+	if uint64(block.Header.Nonce) >= nonceSpace {
+		t.Errorf("Nonce = %d, outside of nonce space", block.Header.Nonce)
+	}
+	if block.Hash != block.ComputeHash() {
+		t.Errorf("Hash = %x, want %x", block.Hash, block.ComputeHash())
+	}
+	if !crypto.CheckProofOfWork(block.Hash, block.Header.Difficulty) {
+		t.Error("Solved block does not meet its difficulty")
+	}
+}
+
+func TestUpdateCoinbaseExtraNonce(t *testing.T) {
+	block := newBlock(&types.Block{Height: 4}, 0x20080000)
+	original := block.Transactions[0].Hash
+
+	UpdateCoinbaseExtraNonce(block, 7)
+
+	coinbase := block.Transactions[0]
+	if coinbase.Hash == original {
+		t.Error("Extra nonce should change the coinbase")
+	}
+	if height, err := coinbase.CoinbaseHeight(); err != nil || height != block.Height {
+		t.Errorf("CoinbaseHeight() = %d, %v, want %d", height, err, block.Height)
+	}
+	if block.Header.MerkleRoot != block.ComputeMerkleRoot() || block.Header.WitnessRoot != block.ComputeWitnessRoot() {
+		t.Error("roots should commit to the updated coinbase")
+	}
+}
+
+func TestSolveCancel(t *testing.T) {
+	// A target of one is practically unreachable
+	block := newBlock(&types.Block{}, 0x03000001)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	m := New(Config{Threads: 2})
+	if _, err := m.Solve(ctx, block); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Solve() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if m.HashRate() <= 0 {
+		t.Error("HashRate() should be positive after searching")
+	}
+}
@@ -0,0 +1,338 @@
+package miner
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+	"github.com/fkapsahili/mini-blockchain/internal/utxo"
+)
+
+// maxCountGrowth is how much the encoded transaction count of a block may
+// grow as transactions are added to it
+const maxCountGrowth = 8
+
+// TxDesc describes an unconfirmed transaction a template may include
+type TxDesc struct {
+	Tx  *types.Transaction
+	Fee uint64
+}
+
+// TxSource provides the unconfirmed transactions templates are built from
+type TxSource interface {
+	// MiningDescs returns the transactions that may be mined, in any
+	// order
+	MiningDescs() []*TxDesc
+}
+
+// BlockTemplate is an unsolved block on top of the tip, ready to mine
+type BlockTemplate struct {
+	Block *types.Block
+
+	// Fees and SigOps hold the fee and signature checks of each
+	// transaction of the block. The coinbase entry holds the total fees.
+	Fees   []uint64
+	SigOps []int
+}
+
+// TemplateConfig configures a TemplateGenerator
+type TemplateConfig struct {
+	// Chain is the chain templates build on
+	Chain *blockchain.Chain
+
+	// TxSource provides the transactions to include, nil builds templates
+	// holding only the coinbase
+	TxSource TxSource
+
+	// MaxBlockSize bounds the encoded size of templates, defaults to
+	// types.MaxBlockSize
+	MaxBlockSize int
+
+	// MaxSigOps bounds the signature checks of templates, defaults to
+	// types.MaxBlockSigOps
+	MaxSigOps int
+}
+
+// TemplateGenerator builds block templates. Transactions are selected by
+// the fee rate of their package, the transaction with its unconfirmed
+// ancestors not in the block yet, so a child paying a high fee gets a
+// low paying parent mined.
+type TemplateGenerator struct {
+	cfg TemplateConfig
+
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// NewTemplateGenerator creates a template generator
+func NewTemplateGenerator(cfg TemplateConfig) (*TemplateGenerator, error) {
+	if cfg.Chain == nil {
+		return nil, errors.New("chain is required")
+	}
+	if cfg.MaxBlockSize <= 0 || cfg.MaxBlockSize > types.MaxBlockSize {
+		cfg.MaxBlockSize = types.MaxBlockSize
+	}
+	if cfg.MaxSigOps <= 0 || cfg.MaxSigOps > types.MaxBlockSigOps {
+		cfg.MaxSigOps = types.MaxBlockSigOps
+	}
+	return &TemplateGenerator{cfg: cfg, now: time.Now}, nil
+}
+
+// NewBlockTemplate returns a template on top of the tip whose coinbase pays
+// the block subsidy and the fees of the selected transactions to payTo
+func (g *TemplateGenerator) NewBlockTemplate(payTo []byte) (*BlockTemplate, error) {
+	chain := g.cfg.Chain
+	latestBlock, err := chain.GetLatestBlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest block: %w", err)
+	}
+
+	bits, err := chain.CalcNextRequiredDifficulty()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate difficulty: %w", err)
+	}
+
+	medianTime, err := chain.MedianTimePast()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate median time: %w", err)
+	}
+
+	timestamp := g.now()
+	if !timestamp.After(medianTime) {
+		timestamp = medianTime.Add(time.Second)
+	}
+
+	height := latestBlock.Height + 1
+	subsidy := blockchain.CalcBlockSubsidy(chain.Params(), height)
+	coinbase := types.NewCoinbaseTransaction(height, 0, []types.TransactionOutput{{
+		Amount:        subsidy,
+		PublicKeyHash: payTo,
+	}})
+	block := &types.Block{
+		Header: types.BlockHeader{
+			Version:       1,
+			PrevBlockHash: latestBlock.Hash,
+			Timestamp:     timestamp,
+			Difficulty:    bits,
+		},
+		Transactions: []types.Transaction{coinbase},
+		Height:       height,
+	}
+
+	var selected []*TxDesc
+	if g.cfg.TxSource != nil {
+		// The coinbase amount has a fixed width, so its size is known
+		// before the fees are
+		selected = g.selectTransactions(block.SerializeSize() + maxCountGrowth)
+	}
+
+	template := &BlockTemplate{
+		Fees:   []uint64{0},
+		SigOps: []int{0},
+	}
+	var fees uint64
+	for _, desc := range selected {
+		block.Transactions = append(block.Transactions, *desc.Tx)
+		template.Fees = append(template.Fees, desc.Fee)
+		template.SigOps = append(template.SigOps, desc.Tx.SigOpCount())
+		fees += desc.Fee
+	}
+	template.Fees[0] = fees
+
+	block.Transactions[0] = types.NewCoinbaseTransaction(height, 0, []types.TransactionOutput{{
+		Amount:        subsidy + fees,
+		PublicKeyHash: payTo,
+	}})
+	block.UpdateRoots()
+	template.Block = block
+	return template, nil
+}
+
+// candidate is a transaction of the source considered for a template
+type candidate struct {
+	desc     *TxDesc
+	size     int
+	sigOps   int
+	order    int // Position in the source, breaks ties
+	parents  []*candidate
+	children []*candidate
+
+	selected bool
+	// skipped candidates spend outputs the chain doesn't have, or didn't
+	// fit and never will
+	skipped bool
+
+	// gen invalidates queued scores of the candidate once its package
+	// changes
+	gen int
+}
+
+// selectTransactions picks the transactions of a block that already takes
+// baseSize bytes, parents before the transactions spending them
+func (g *TemplateGenerator) selectTransactions(baseSize int) []*TxDesc {
+	descs := g.cfg.TxSource.MiningDescs()
+	candidates := make(map[[32]byte]*candidate, len(descs))
+	for i, desc := range descs {
+		candidates[desc.Tx.Hash] = &candidate{
+			desc:   desc,
+			size:   desc.Tx.SerializeSize(),
+			sigOps: desc.Tx.SigOpCount(),
+			order:  i,
+		}
+	}
+
+	// Link the candidates to their parents, inputs outside the source must
+	// be unspent in the chain. The source may lag behind the chain.
+	queue := make(packageQueue, 0, len(candidates))
+	for _, desc := range descs {
+		c := candidates[desc.Tx.Hash]
+		for _, input := range desc.Tx.Inputs {
+			if parent, ok := candidates[input.PrevTxHash]; ok {
+				parent.children = append(parent.children, c)
+				c.parents = append(c.parents, parent)
+				continue
+			}
+			op := utxo.Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}
+			if g.cfg.Chain.FetchUtxo(op) == nil {
+				c.skipped = true
+			}
+		}
+		queue = append(queue, newPackageScore(c))
+	}
+	heap.Init(&queue)
+
+	var selected []*TxDesc
+	size, sigOps := baseSize, 0
+	for queue.Len() > 0 {
+		score := heap.Pop(&queue).(*packageScore)
+		c := score.candidate
+		if c.selected || c.skipped || score.gen != c.gen {
+			continue
+		}
+
+		pkg := unselectedAncestors(c)
+		pkgSize, pkgSigOps := 0, 0
+		for _, member := range pkg {
+			if member.skipped {
+				c.skipped = true
+				break
+			}
+			pkgSize += member.size
+			pkgSigOps += member.sigOps
+		}
+		if c.skipped {
+			continue
+		}
+		if size+pkgSize > g.cfg.MaxBlockSize || sigOps+pkgSigOps > g.cfg.MaxSigOps {
+			c.skipped = true
+			continue
+		}
+
+		size += pkgSize
+		sigOps += pkgSigOps
+		for _, member := range pkg {
+			member.selected = true
+			selected = append(selected, member.desc)
+		}
+		// The packages of their descendants got smaller
+		for _, member := range pkg {
+			for _, d := range unselectedDescendants(member) {
+				d.gen++
+				heap.Push(&queue, newPackageScore(d))
+			}
+		}
+	}
+	return selected
+}
+
+// unselectedAncestors returns the candidate and its ancestors not selected
+// yet, parents first
+func unselectedAncestors(c *candidate) []*candidate {
+	var pkg []*candidate
+	seen := make(map[*candidate]bool)
+	var visit func(c *candidate)
+	visit = func(c *candidate) {
+		if seen[c] || c.selected {
+			return
+		}
+		seen[c] = true
+		for _, parent := range c.parents {
+			visit(parent)
+		}
+		pkg = append(pkg, c)
+	}
+	visit(c)
+	return pkg
+}
+
+// unselectedDescendants returns the descendants of a candidate not
+// selected yet
+func unselectedDescendants(c *candidate) []*candidate {
+	var descendants []*candidate
+	seen := make(map[*candidate]bool)
+	queue := append([]*candidate(nil), c.children...)
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if seen[d] || d.selected {
+			continue
+		}
+		seen[d] = true
+		descendants = append(descendants, d)
+		queue = append(queue, d.children...)
+	}
+	return descendants
+}
+
+// packageScore is the fee rate of a candidate's package when it was queued
+type packageScore struct {
+	candidate *candidate
+	gen       int
+	fee       uint64
+	size      int
+}
+
+// newPackageScore scores the current package of a candidate
+func newPackageScore(c *candidate) *packageScore {
+	score := &packageScore{candidate: c, gen: c.gen}
+	for _, member := range unselectedAncestors(c) {
+		score.fee += member.desc.Fee
+		score.size += member.size
+	}
+	return score
+}
+
+// packageQueue is a max-heap of package fee rates
+type packageQueue []*packageScore
+
+func (q packageQueue) Len() int { return len(q) }
+
+func (q packageQueue) Less(i, j int) bool {
+	// Compare fee/size by cross multiplying, in 128 bits so large fees
+	// can't overflow
+	a, b := q[i], q[j]
+	lhsHi, lhsLo := bits.Mul64(a.fee, uint64(b.size))
+	rhsHi, rhsLo := bits.Mul64(b.fee, uint64(a.size))
+	if lhsHi != rhsHi {
+		return lhsHi > rhsHi
+	}
+	if lhsLo != rhsLo {
+		return lhsLo > rhsLo
+	}
+	return a.candidate.order < b.candidate.order
+}
+
+func (q packageQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packageQueue) Push(x any) { *q = append(*q, x.(*packageScore)) }
+
+func (q *packageQueue) Pop() any {
+	old := *q
+	score := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return score
+}
@@ -0,0 +1,169 @@
+package miner
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"testing"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// sliceSource provides a fixed list of transactions
+type sliceSource []*TxDesc
+
+func (s sliceSource) MiningDescs() []*TxDesc { return s }
+
+// mineTemplate solves a template and adds it to the chain
+func mineTemplate(t *testing.T, chain *blockchain.Chain, template *BlockTemplate) {
+	t.Helper()
+	if _, err := New(Config{Threads: 1}).Solve(context.Background(), template.Block); err != nil {
+		t.Fatalf("Solve() error = %v", err)
+	}
+	if err := chain.AddBlock(template.Block); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+}
+
+// spend returns a transaction signed by key spending an output of prev
+// into one output of amount
+func spend(t *testing.T, key *ecdsa.PrivateKey, prev *types.Transaction, index uint32, amount uint64) *types.Transaction {
+	t.Helper()
+	tx := &types.Transaction{
+		Version: 1,
+		Inputs:  []types.TransactionInput{{PrevTxHash: prev.Hash, OutputIndex: index}},
+		Outputs: []types.TransactionOutput{{Amount: amount, PublicKeyHash: crypto.HashToAddress(&key.PublicKey)}},
+	}
+	if err := tx.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	return tx
+}
+
+func TestNewBlockTemplate(t *testing.T) {
+	chain, err := blockchain.OpenChain(t.TempDir(), blockchain.Options{Params: &chaincfg.RegTestParams})
+	if err != nil {
+		t.Fatalf("OpenChain() error = %v", err)
+	}
+	defer chain.Close()
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	payTo := crypto.HashToAddress(&key.PublicKey)
+
+	empty, err := NewTemplateGenerator(TemplateConfig{Chain: chain})
+	if err != nil {
+		t.Fatalf("NewTemplateGenerator() error = %v", err)
+	}
+	funding, err := empty.NewBlockTemplate(payTo)
+	if err != nil {
+		t.Fatalf("NewBlockTemplate() error = %v", err)
+	}
+	mineTemplate(t, chain, funding)
+
+	// Split the reward into two coins of 100,000
+	coinbase := &funding.Block.Transactions[0]
+	split := &types.Transaction{Version: 1, Inputs: []types.TransactionInput{{PrevTxHash: coinbase.Hash}}}
+	for i := 0; i < 2; i++ {
+		split.Outputs = append(split.Outputs, types.TransactionOutput{Amount: 100_000, PublicKeyHash: payTo})
+	}
+	if err := split.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	splitFee := coinbase.Outputs[0].Amount - 200_000
+	funded, err := NewTemplateGenerator(TemplateConfig{Chain: chain, TxSource: sliceSource{{Tx: split, Fee: splitFee}}})
+	if err != nil {
+		t.Fatalf("NewTemplateGenerator() error = %v", err)
+	}
+	splitting, err := funded.NewBlockTemplate(payTo)
+	if err != nil {
+		t.Fatalf("NewBlockTemplate() error = %v", err)
+	}
+	mineTemplate(t, chain, splitting)
+
+	// The parent pays little, its child pays for both. The package of the
+	// two beats mid, mid beats the parent alone.
+	parent := spend(t, key, split, 0, 100_000-100)
+	child := spend(t, key, parent, 0, 100_000-10_100)
+	mid := spend(t, key, split, 1, 100_000-3000)
+	unknown := spend(t, key, &types.Transaction{Hash: [32]byte{1}}, 0, 1)
+	// Children come before parents, the template must order them
+	source := sliceSource{
+		{Tx: child, Fee: 10_000},
+		{Tx: mid, Fee: 3000},
+		{Tx: unknown, Fee: 50_000},
+		{Tx: parent, Fee: 100},
+	}
+
+	base, err := empty.NewBlockTemplate(payTo)
+	if err != nil {
+		t.Fatalf("NewBlockTemplate() error = %v", err)
+	}
+	baseSize := base.Block.SerializeSize() + maxCountGrowth
+
+	subsidy := blockchain.CalcBlockSubsidy(chain.Params(), chain.GetHeight()+1)
+	tests := []struct {
+		name   string
+		cfg    TemplateConfig
+		want   []*types.Transaction
+		sigOps int
+	}{
+		{"all", TemplateConfig{}, []*types.Transaction{parent, child, mid}, 3},
+		{"child pays for its parent", TemplateConfig{MaxBlockSize: baseSize + parent.SerializeSize() + child.SerializeSize() + 10}, []*types.Transaction{parent, child}, 2},
+		{"package over the sig op limit", TemplateConfig{MaxSigOps: 1}, []*types.Transaction{mid}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Chain = chain
+			tt.cfg.TxSource = source
+			g, err := NewTemplateGenerator(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewTemplateGenerator() error = %v", err)
+			}
+			template, err := g.NewBlockTemplate(payTo)
+			if err != nil {
+				t.Fatalf("NewBlockTemplate() error = %v", err)
+			}
+
+			block := template.Block
+			if len(block.Transactions) != len(tt.want)+1 {
+				t.Fatalf("template holds %d transactions, want %d", len(block.Transactions)-1, len(tt.want))
+			}
+			var fees uint64
+			sigOps := 0
+			for i, want := range tt.want {
+				if block.Transactions[i+1].Hash != want.Hash {
+					t.Errorf("transaction %d = %x, want %x", i+1, block.Transactions[i+1].Hash, want.Hash)
+				}
+				fees += template.Fees[i+1]
+				sigOps += template.SigOps[i+1]
+			}
+			if template.Fees[0] != fees || block.Transactions[0].Outputs[0].Amount != subsidy+fees {
+				t.Errorf("coinbase pays %d with fees %d, want %d", block.Transactions[0].Outputs[0].Amount, template.Fees[0], subsidy+fees)
+			}
+			if sigOps != tt.sigOps {
+				t.Errorf("template takes %d signature checks, want %d", sigOps, tt.sigOps)
+			}
+			if block.Header.MerkleRoot != block.ComputeMerkleRoot() || block.Header.WitnessRoot != block.ComputeWitnessRoot() {
+				t.Error("roots do not commit to the transactions")
+			}
+			if size := block.SerializeSize(); tt.cfg.MaxBlockSize > 0 && size > tt.cfg.MaxBlockSize {
+				t.Errorf("template of %d bytes exceeds %d", size, tt.cfg.MaxBlockSize)
+			}
+		})
+	}
+
+	// The chain takes the template it was built for
+	g, err := NewTemplateGenerator(TemplateConfig{Chain: chain, TxSource: source})
+	if err != nil {
+		t.Fatalf("NewTemplateGenerator() error = %v", err)
+	}
+	full, err := g.NewBlockTemplate(payTo)
+	if err != nil {
+		t.Fatalf("NewBlockTemplate() error = %v", err)
+	}
+	mineTemplate(t, chain, full)
+}
@@ -0,0 +1,411 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
+)
+
+// peersFile is the name of the address database inside the data directory
+const peersFile = "peers.json"
+
+const (
+	// newBucketCount and triedBucketCount are the number of buckets of the
+	// new and tried tables, bucketSize the addresses each bucket holds
+	newBucketCount   = 256
+	triedBucketCount = 64
+	bucketSize       = 64
+
+	// newBucketsPerSourceGroup bounds how many new buckets the addresses
+	// learned from one network group can occupy, so a single source can
+	// never fill the table
+	newBucketsPerSourceGroup = 8
+
+	// maxFailedAttempts is how often an address that never worked may fail
+	// before it is forgotten
+	maxFailedAttempts = 10
+
+	// retryInterval is how long a failed address is not tried again
+	retryInterval = 10 * time.Minute
+
+	// seedSource is the source recorded for configured seed addresses
+	seedSource = "seed"
+)
+
+// KnownAddress is an entry of the address database
+type KnownAddress struct {
+	Addr        string // host:port to dial
+	Source      string // Host the address was learned from
+	FirstSeen   time.Time
+	LastSeen    time.Time // Most recent time the address was announced
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Attempts    int // Failed attempts since the last success
+	Tried       bool
+}
+
+// addrSnapshot is the persisted form of the database
+type addrSnapshot struct {
+	Key       [32]byte
+	Addresses []KnownAddress
+}
+
+// AddrManager is the database of peer addresses. Addresses start in the
+// new table and move to the tried table once a connection to them worked.
+// Both tables are split into buckets chosen by network group and a secret
+// key, and outbound peers are picked from a random bucket, so addresses
+// from one source or one network can't dominate the selection.
+type AddrManager struct {
+	dataDir string
+
+	mu      sync.Mutex
+	key     [32]byte
+	addrs   map[string]*KnownAddress
+	buckets map[string]int // Bucket of each address in its table
+	newTbl  [newBucketCount]map[string]struct{}
+	tried   [triedBucketCount]map[string]struct{}
+}
+
+// OpenAddrManager loads the address database persisted in dataDir, or
+// creates an empty one if none was saved yet. An empty dataDir keeps the
+// database in memory only.
+func OpenAddrManager(dataDir string) (*AddrManager, error) {
+	m := &AddrManager{
+		dataDir: dataDir,
+		addrs:   make(map[string]*KnownAddress),
+		buckets: make(map[string]int),
+	}
+	for i := range m.newTbl {
+		m.newTbl[i] = make(map[string]struct{})
+	}
+	for i := range m.tried {
+		m.tried[i] = make(map[string]struct{})
+	}
+	if _, err := rand.Read(m.key[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate bucket key: %w", err)
+	}
+
+	if dataDir == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dataDir, peersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer database: %w", err)
+	}
+
+	var snap addrSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal peer database: %w", err)
+	}
+
+	// Buckets are recomputed, the key keeps them stable across restarts
+	m.key = snap.Key
+	for _, ka := range snap.Addresses {
+		ka := ka
+		if ka.Tried {
+			m.insertTried(&ka)
+		} else {
+			m.insertNew(&ka)
+		}
+	}
+	return m, nil
+}
+
+// Flush persists the database to the data directory
+func (m *AddrManager) Flush() error {
+	if m.dataDir == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	snap := addrSnapshot{
+		Key:       m.key,
+		Addresses: make([]KnownAddress, 0, len(m.addrs)),
+	}
+	for _, ka := range m.addrs {
+		snap.Addresses = append(snap.Addresses, *ka)
+	}
+	m.mu.Unlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal peer database: %w", err)
+	}
+	return storage.WriteFileAtomic(filepath.Join(m.dataDir, peersFile), data)
+}
+
+// Len returns the number of known addresses
+func (m *AddrManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.addrs)
+}
+
+// Lookup returns a copy of the entry of an address
+func (m *AddrManager) Lookup(addr string) (KnownAddress, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ka, ok := m.addrs[addr]
+	if !ok {
+		return KnownAddress{}, false
+	}
+	return *ka, true
+}
+
+// AddAddress records an address announced at lastSeen by source. It
+// reports whether the address was new.
+func (m *AddrManager) AddAddress(addr, source string, lastSeen time.Time) bool {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ka, ok := m.addrs[addr]; ok {
+		if lastSeen.After(ka.LastSeen) {
+			ka.LastSeen = lastSeen
+		}
+		return false
+	}
+
+	m.insertNew(&KnownAddress{
+		Addr:      addr,
+		Source:    source,
+		FirstSeen: time.Now(),
+		LastSeen:  lastSeen,
+	})
+	return true
+}
+
+// insertNew places an address in its new bucket, evicting the stalest
+// entry of a full bucket. The caller must hold the lock.
+func (m *AddrManager) insertNew(ka *KnownAddress) {
+	ka.Tried = false
+	bucket := m.newBucket(ka.Addr, ka.Source)
+	if len(m.newTbl[bucket]) >= bucketSize {
+		m.remove(m.stalest(m.newTbl[bucket], func(ka *KnownAddress) time.Time { return ka.LastSeen }))
+	}
+
+	m.addrs[ka.Addr] = ka
+	m.buckets[ka.Addr] = bucket
+	m.newTbl[bucket][ka.Addr] = struct{}{}
+}
+
+// insertTried places an address in its tried bucket. The stalest entry of
+// a full bucket goes back to the new table. The caller must hold the lock.
+func (m *AddrManager) insertTried(ka *KnownAddress) {
+	ka.Tried = true
+	bucket := m.triedBucket(ka.Addr)
+	if len(m.tried[bucket]) >= bucketSize {
+		evicted := m.addrs[m.stalest(m.tried[bucket], func(ka *KnownAddress) time.Time { return ka.LastSuccess })]
+		m.remove(evicted.Addr)
+		m.insertNew(evicted)
+	}
+
+	m.addrs[ka.Addr] = ka
+	m.buckets[ka.Addr] = bucket
+	m.tried[bucket][ka.Addr] = struct{}{}
+}
+
+// stalest returns the address of the bucket with the oldest time
+func (m *AddrManager) stalest(bucket map[string]struct{}, at func(*KnownAddress) time.Time) string {
+	var oldest *KnownAddress
+	for addr := range bucket {
+		if ka := m.addrs[addr]; oldest == nil || at(ka).Before(at(oldest)) {
+			oldest = ka
+		}
+	}
+	return oldest.Addr
+}
+
+// remove drops an address from its table, the caller must hold the lock
+func (m *AddrManager) remove(addr string) {
+	ka, ok := m.addrs[addr]
+	if !ok {
+		return
+	}
+	if ka.Tried {
+		delete(m.tried[m.buckets[addr]], addr)
+	} else {
+		delete(m.newTbl[m.buckets[addr]], addr)
+	}
+	delete(m.addrs, addr)
+	delete(m.buckets, addr)
+}
+
+// RemoveAddress forgets an address, for example our own
+func (m *AddrManager) RemoveAddress(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(addr)
+}
+
+// Attempt records a connection attempt to an address. Addresses that
+// never worked are forgotten after too many failed attempts.
+func (m *AddrManager) Attempt(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ka, ok := m.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.LastAttempt = time.Now()
+	ka.Attempts++
+	if ka.Attempts >= maxFailedAttempts && ka.LastSuccess.IsZero() {
+		m.remove(addr)
+	}
+}
+
+// Good records a successful connection, moving the address to the tried
+// table. Unknown addresses, like those given on the command line, are
+// added with the peer itself as source.
+func (m *AddrManager) Good(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	ka, ok := m.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr, Source: hostOf(addr), FirstSeen: now}
+	}
+	ka.LastSeen = now
+	ka.LastAttempt = now
+	ka.LastSuccess = now
+	ka.Attempts = 0
+
+	if ok && ka.Tried {
+		return
+	}
+	m.remove(addr)
+	m.insertTried(ka)
+}
+
+// Select picks an address to connect to. A table is chosen at random and
+// then a random bucket of it, addresses for which skip returns true and
+// those that failed recently are passed over.
+func (m *AddrManager) Select(skip func(addr string) bool) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newBuckets, triedBuckets := nonEmpty(m.newTbl[:]), nonEmpty(m.tried[:])
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		buckets := newBuckets
+		if len(buckets) == 0 || (len(triedBuckets) > 0 && mrand.IntN(2) == 0) {
+			buckets = triedBuckets
+		}
+		if len(buckets) == 0 {
+			break
+		}
+		bucket := buckets[mrand.IntN(len(buckets))]
+
+		n := mrand.IntN(len(bucket))
+		for addr := range bucket {
+			if n > 0 {
+				n--
+				continue
+			}
+			ka := m.addrs[addr]
+			if skip(addr) || (ka.Attempts > 0 && now.Sub(ka.LastAttempt) < retryInterval) {
+				break
+			}
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// nonEmpty returns the buckets of a table that hold addresses
+func nonEmpty(table []map[string]struct{}) []map[string]struct{} {
+	var buckets []map[string]struct{}
+	for _, bucket := range table {
+		if len(bucket) > 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// Sample returns up to max random addresses to share with a peer
+func (m *AddrManager) Sample(max int) []KnownAddress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sample := make([]KnownAddress, 0, min(max, len(m.addrs)))
+	for _, ka := range m.addrs {
+		if len(sample) == max {
+			break
+		}
+		if ka.Attempts == 0 || !ka.LastSuccess.IsZero() {
+			sample = append(sample, *ka)
+		}
+	}
+	mrand.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+	return sample
+}
+
+// newBucket returns the new bucket of an address. Each source group maps
+// to at most newBucketsPerSourceGroup buckets.
+func (m *AddrManager) newBucket(addr, source string) int {
+	sourceGroup := groupKey(source)
+	slot := m.hash(sourceGroup, groupKey(hostOf(addr))) % newBucketsPerSourceGroup
+	return int(m.hash(sourceGroup, fmt.Sprint(slot)) % newBucketCount)
+}
+
+// triedBucket returns the tried bucket of an address, addresses of one
+// network group share a bucket
+func (m *AddrManager) triedBucket(addr string) int {
+	return int(m.hash(groupKey(hostOf(addr))) % triedBucketCount)
+}
+
+// hash derives a bucket number from the secret key and parts
+func (m *AddrManager) hash(parts ...string) uint64 {
+	h := sha256.New()
+	h.Write(m.key[:])
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// hostOf returns the host of a host:port address, or the address itself
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// groupKey returns the network group of a host: the /16 of an IPv4
+// address, the /32 of an IPv6 address, or the name itself
+func groupKey(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d", ip4[0], ip4[1])
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
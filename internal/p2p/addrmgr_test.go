@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddrManagerSourceBuckets(t *testing.T) {
+	m, err := OpenAddrManager("")
+	if err != nil {
+		t.Fatalf("OpenAddrManager() error = %v", err)
+	}
+
+	// One source announcing addresses from many networks only reaches a
+	// few buckets, so it can't fill the table
+	for i := 0; i < 4096; i++ {
+		addr := fmt.Sprintf("10.%d.%d.1:8333", i/256, i%256)
+		m.AddAddress(addr, "192.0.2.1", time.Now())
+	}
+	if got, max := m.Len(), newBucketsPerSourceGroup*bucketSize; got > max {
+		t.Errorf("Len() = %d from one source, want at most %d", got, max)
+	}
+
+	// Another source still gets its addresses in
+	if !m.AddAddress("10.200.0.1:8333", "198.51.100.1", time.Now()) {
+		t.Error("AddAddress() from a second source = false, want true")
+	}
+	if m.AddAddress("10.200.0.1:8333", "198.51.100.1", time.Now()) {
+		t.Error("AddAddress() twice = true, want false")
+	}
+}
+
+func TestAddrManagerAttempts(t *testing.T) {
+	m, err := OpenAddrManager("")
+	if err != nil {
+		t.Fatalf("OpenAddrManager() error = %v", err)
+	}
+	m.AddAddress("10.0.0.1:8333", "192.0.2.1", time.Now())
+	m.AddAddress("10.0.0.2:8333", "192.0.2.1", time.Now())
+
+	// A failed address is not selected again right away
+	m.Attempt("10.0.0.1:8333")
+	for i := 0; i < 20; i++ {
+		if addr, ok := m.Select(func(string) bool { return false }); !ok || addr != "10.0.0.2:8333" {
+			t.Fatalf("Select() = %q, %v, want 10.0.0.2:8333", addr, ok)
+		}
+	}
+	if _, ok := m.Select(func(addr string) bool { return addr == "10.0.0.2:8333" }); ok {
+		t.Error("Select() should pass over skipped and failed addresses")
+	}
+
+	// A working address moves to the tried table
+	m.Good("10.0.0.1:8333")
+	ka, ok := m.Lookup("10.0.0.1:8333")
+	if !ok || !ka.Tried || ka.Attempts != 0 || ka.LastSuccess.IsZero() {
+		t.Errorf("Lookup() after Good() = %+v, %v", ka, ok)
+	}
+
+	// Addresses that never work are forgotten
+	for i := 0; i < maxFailedAttempts; i++ {
+		m.Attempt("10.0.0.2:8333")
+	}
+	if _, ok := m.Lookup("10.0.0.2:8333"); ok {
+		t.Error("Lookup() of an address that always failed should fail")
+	}
+}
+
+func TestAddrManagerPersistence(t *testing.T) {
+	dir := t.TempDir()
+	m, err := OpenAddrManager(dir)
+	if err != nil {
+		t.Fatalf("OpenAddrManager() error = %v", err)
+	}
+	lastSeen := time.Now().Add(-time.Hour).Round(0)
+	m.AddAddress("10.0.0.1:8333", "192.0.2.1", lastSeen)
+	m.Good("10.0.0.2:8333")
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	loaded, err := OpenAddrManager(dir)
+	if err != nil {
+		t.Fatalf("OpenAddrManager() error = %v", err)
+	}
+	if loaded.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", loaded.Len())
+	}
+	if ka, _ := loaded.Lookup("10.0.0.1:8333"); ka.Tried || !ka.LastSeen.Equal(lastSeen) || ka.Source != "192.0.2.1" {
+		t.Errorf("Lookup() = %+v, want the new address as saved", ka)
+	}
+	if ka, _ := loaded.Lookup("10.0.0.2:8333"); !ka.Tried || ka.LastSuccess.IsZero() {
+		t.Errorf("Lookup() = %+v, want the tried address as saved", ka)
+	}
+	if loaded.key != m.key {
+		t.Error("bucket key changed across restarts")
+	}
+}
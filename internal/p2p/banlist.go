@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
+)
+
+// banListFile is the name of the ban list inside the data directory
+const banListFile = "banlist.json"
+
+// Ban keeps a host from connecting until it expires
+type Ban struct {
+	Host    string
+	Reason  string
+	Created time.Time
+	Until   time.Time
+}
+
+// BanList holds the banned hosts. Every change is persisted right away so
+// bans survive restarts.
+type BanList struct {
+	dataDir string
+
+	mu   sync.Mutex
+	bans map[string]Ban
+}
+
+// OpenBanList loads the ban list persisted in dataDir, or creates an empty
+// one if none was saved yet. An empty dataDir keeps the list in memory only.
+func OpenBanList(dataDir string) (*BanList, error) {
+	b := &BanList{
+		dataDir: dataDir,
+		bans:    make(map[string]Ban),
+	}
+
+	if dataDir == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dataDir, banListFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ban list: %w", err)
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ban list: %w", err)
+	}
+	for _, ban := range bans {
+		b.bans[ban.Host] = ban
+	}
+	return b, nil
+}
+
+// Ban bans host for duration, replacing an earlier ban of it
+func (b *BanList) Ban(host string, duration time.Duration, reason string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.bans[host] = Ban{Host: host, Reason: reason, Created: now, Until: now.Add(duration)}
+	return b.flush()
+}
+
+// Unban lifts the ban of host and reports whether there was one
+func (b *BanList) Unban(host string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.bans[host]; !ok {
+		return false, nil
+	}
+	delete(b.bans, host)
+	return true, b.flush()
+}
+
+// Clear lifts all bans
+func (b *BanList) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clear(b.bans)
+	return b.flush()
+}
+
+// IsBanned reports whether host is banned
+func (b *BanList) IsBanned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban, ok := b.bans[host]
+	return ok && time.Now().Before(ban.Until)
+}
+
+// List returns the bans in effect ordered by host
+func (b *BanList) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Host < bans[j].Host })
+	return bans
+}
+
+// flush persists the bans in effect, the caller must hold the lock
+func (b *BanList) flush() error {
+	now := time.Now()
+	for host, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, host)
+		}
+	}
+
+	if b.dataDir == "" {
+		return nil
+	}
+
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, ban)
+	}
+	data, err := json.Marshal(bans)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ban list: %w", err)
+	}
+	return storage.WriteFileAtomic(filepath.Join(b.dataDir, banListFile), data)
+}
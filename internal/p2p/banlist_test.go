@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	dir := t.TempDir()
+	b, err := OpenBanList(dir)
+	if err != nil {
+		t.Fatalf("OpenBanList() error = %v", err)
+	}
+	if err := b.Ban("192.0.2.1", time.Hour, "invalid proof of work"); err != nil {
+		t.Fatalf("Ban() error = %v", err)
+	}
+	if err := b.Ban("192.0.2.2", time.Hour, "invalid merkle root"); err != nil {
+		t.Fatalf("Ban() error = %v", err)
+	}
+	if err := b.Ban("192.0.2.3", -time.Second, "expired"); err != nil {
+		t.Fatalf("Ban() error = %v", err)
+	}
+
+	loaded, err := OpenBanList(dir)
+	if err != nil {
+		t.Fatalf("OpenBanList() error = %v", err)
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", true},
+		{"192.0.2.3", false},
+		{"192.0.2.4", false},
+	}
+	for _, tt := range tests {
+		if got := loaded.IsBanned(tt.host); got != tt.want {
+			t.Errorf("IsBanned(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	bans := loaded.List()
+	if len(bans) != 2 || bans[0].Host != "192.0.2.1" || bans[0].Reason != "invalid proof of work" {
+		t.Errorf("List() = %+v, want the two bans in effect ordered by host", bans)
+	}
+
+	if ok, err := loaded.Unban("192.0.2.1"); !ok || err != nil {
+		t.Errorf("Unban() = %v, %v, want true, nil", ok, err)
+	}
+	if ok, _ := loaded.Unban("192.0.2.1"); ok {
+		t.Error("Unban() of a host that isn't banned = true")
+	}
+	if err := loaded.Clear(); err != nil {
+		t.Fatalf("Clear() error = %v", err)
+	}
+
+	cleared, err := OpenBanList(dir)
+	if err != nil {
+		t.Fatalf("OpenBanList() error = %v", err)
+	}
+	if bans := cleared.List(); len(bans) != 0 {
+		t.Errorf("List() after Clear() = %+v, want none", bans)
+	}
+}
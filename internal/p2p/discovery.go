@@ -0,0 +1,273 @@
+package p2p
+
+import (
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxRelayedAddrs is the size up to which fresh addr messages are
+	// relayed, larger ones answer a getaddr
+	maxRelayedAddrs = 10
+
+	// addrRelayPeers is how many peers a fresh address is relayed to
+	addrRelayPeers = 2
+
+	// addrFreshness is how recent an address must be to be relayed
+	addrFreshness = 10 * time.Minute
+)
+
+// Intervals of the address manager loop, variables so tests can shorten
+// them
+var (
+	// connectInterval is how often a new outbound peer is picked from the
+	// address database while below the outbound limit
+	connectInterval = 5 * time.Second
+
+	// addrFlushInterval is how often the address database is persisted
+	addrFlushInterval = 2 * time.Minute
+)
+
+// addrLoop opens outbound connections to known addresses and persists the
+// address database until the server stops
+func (s *Server) addrLoop() {
+	defer s.wg.Done()
+
+	connectTicker := time.NewTicker(connectInterval)
+	defer connectTicker.Stop()
+	flushTicker := time.NewTicker(addrFlushInterval)
+	defer flushTicker.Stop()
+
+	for {
+		select {
+		case <-connectTicker.C:
+			s.connectToKnownAddress()
+		case <-flushTicker.C:
+			s.flushAddrs()
+		case <-s.quit:
+			s.flushAddrs()
+			return
+		}
+	}
+}
+
+// flushAddrs persists the address database
+func (s *Server) flushAddrs() {
+	if err := s.cfg.AddrManager.Flush(); err != nil {
+		s.logf("Failed to save peer addresses: %v", err)
+	}
+}
+
+// connectToKnownAddress dials an address of the database if there are
+// fewer outbound peers than allowed
+func (s *Server) connectToKnownAddress() {
+	s.mu.Lock()
+	if s.stopped || len(s.persistent)+len(s.outbound) >= s.cfg.MaxOutbound {
+		s.mu.Unlock()
+		return
+	}
+	busy := make(map[string]struct{}, len(s.peers)+len(s.persistent)+len(s.outbound))
+	for p := range s.peers {
+		busy[p.addr] = struct{}{}
+	}
+	for addr := range s.persistent {
+		busy[addr] = struct{}{}
+	}
+	for addr := range s.outbound {
+		busy[addr] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	addr, ok := s.cfg.AddrManager.Select(func(addr string) bool {
+		_, ok := busy[addr]
+		return ok || s.isBanned(addr)
+	})
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.outbound[addr] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go s.dialOnce(addr)
+}
+
+// dialOnce connects to an address of the database and serves the peer
+// until it disconnects, the address is not redialed
+func (s *Server) dialOnce(addr string) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.outbound, addr)
+		s.mu.Unlock()
+	}()
+
+	s.cfg.AddrManager.Attempt(addr)
+	conn, err := s.dial(addr)
+	if err != nil {
+		s.logf("Failed to connect to %s: %v", addr, err)
+		return
+	}
+	local := conn.LocalAddr().String()
+	s.mu.Lock()
+	s.dialedFrom[local] = addr
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.dialedFrom, local)
+		s.mu.Unlock()
+	}()
+
+	newPeer(s, conn, addr, false).run()
+}
+
+// forgetSelfAddress removes the address of the database that turned out to
+// be our own. remote is where the connection to ourselves came from.
+func (s *Server) forgetSelfAddress(remote string) {
+	s.mu.Lock()
+	addr, ok := s.dialedFrom[remote]
+	s.mu.Unlock()
+
+	if ok {
+		s.logf("Forgetting own address %s", addr)
+		s.cfg.AddrManager.RemoveAddress(addr)
+	}
+}
+
+// startAddrExchange records a working outbound address, asks the peer for
+// more and announces our own listening port to it
+func (s *Server) startAddrExchange(p *Peer) {
+	if s.cfg.AddrManager == nil {
+		return
+	}
+
+	if !p.inbound {
+		s.cfg.AddrManager.Good(p.addr)
+		p.QueueMessage(&MsgGetAddr{})
+	}
+
+	// The peer fills in the address it sees us connecting from
+	if port, ok := s.listenPort(); ok {
+		p.QueueMessage(&MsgAddr{AddrList: []NetAddress{{
+			Timestamp: time.Now(),
+			IP:        net.IPv6unspecified,
+			Port:      port,
+		}}})
+	}
+}
+
+// listenPort returns the port the server accepts connections on
+func (s *Server) listenPort() (uint16, bool) {
+	if s.listener == nil {
+		return 0, false
+	}
+	_, portStr, err := net.SplitHostPort(s.listener.Addr().String())
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return 0, false
+	}
+	return uint16(port), true
+}
+
+// handleGetAddr answers the first getaddr of a peer with known addresses
+func (s *Server) handleGetAddr(p *Peer) {
+	if s.cfg.AddrManager == nil {
+		return
+	}
+
+	p.mu.Lock()
+	answered := p.sentAddrs
+	p.sentAddrs = true
+	p.mu.Unlock()
+	if answered {
+		return
+	}
+
+	var addrs []NetAddress
+	for _, ka := range s.cfg.AddrManager.Sample(MaxAddrPerMsg) {
+		na, ok := netAddressOf(ka.Addr, ka.LastSeen)
+		if ok {
+			addrs = append(addrs, na)
+		}
+	}
+	if len(addrs) > 0 {
+		p.QueueMessage(&MsgAddr{AddrList: addrs})
+	}
+}
+
+// handleAddr adds the announced addresses to the database. Unspecified IPs
+// are the peer announcing itself. Small batches of fresh addresses that
+// were new to us are relayed to a few other peers.
+func (s *Server) handleAddr(p *Peer, msg *MsgAddr) {
+	if s.cfg.AddrManager == nil {
+		return
+	}
+
+	source := hostOf(p.conn.RemoteAddr().String())
+	now := time.Now()
+	var relay []NetAddress
+	for _, na := range msg.AddrList {
+		if na.Port == 0 {
+			continue
+		}
+		if na.IP.IsUnspecified() {
+			na.IP = net.ParseIP(source)
+			if na.IP == nil {
+				continue
+			}
+		}
+		if na.Timestamp.After(now) {
+			na.Timestamp = now
+		}
+
+		if s.cfg.AddrManager.AddAddress(na.String(), source, na.Timestamp) &&
+			len(msg.AddrList) <= maxRelayedAddrs && now.Sub(na.Timestamp) < addrFreshness {
+			relay = append(relay, na)
+		}
+	}
+
+	if len(relay) > 0 {
+		s.relayAddrs(p, relay)
+	}
+}
+
+// relayAddrs sends addresses to a few random peers other than the source
+func (s *Server) relayAddrs(source *Peer, addrs []NetAddress) {
+	var targets []*Peer
+	for _, p := range s.connectedPeers() {
+		if p != source {
+			targets = append(targets, p)
+		}
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+
+	for _, p := range targets[:min(addrRelayPeers, len(targets))] {
+		p.QueueMessage(&MsgAddr{AddrList: addrs})
+	}
+}
+
+// netAddressOf converts a host:port address for an addr message, names
+// of seeds can't be announced
+func netAddressOf(addr string, lastSeen time.Time) (NetAddress, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return NetAddress{}, false
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return NetAddress{}, false
+	}
+	return NetAddress{Timestamp: lastSeen, IP: ip, Port: uint16(port)}, true
+}
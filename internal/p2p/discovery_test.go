@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+)
+
+// newDiscoveryServer starts a server with an in-memory address manager
+func newDiscoveryServer(t *testing.T, seeds ...string) (*Server, *AddrManager) {
+	t.Helper()
+	addrs, err := OpenAddrManager("")
+	if err != nil {
+		t.Fatalf("OpenAddrManager() error = %v", err)
+	}
+	s, err := NewServer(Config{
+		Params:      &chaincfg.RegTestParams,
+		ListenAddr:  "127.0.0.1:0",
+		AddrManager: addrs,
+		Seeds:       seeds,
+		Logger:      log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+	return s, addrs
+}
+
+func TestAddressDiscovery(t *testing.T) {
+	interval := connectInterval
+	connectInterval = 20 * time.Millisecond
+	t.Cleanup(func() { connectInterval = interval })
+
+	// b learns of a from the seed list and announces itself to it
+	a, aAddrs := newDiscoveryServer(t)
+	b, bAddrs := newDiscoveryServer(t, a.Addr().String())
+	waitFor(t, "b's announcement", func() bool {
+		_, ok := aAddrs.Lookup(b.Addr().String())
+		return ok
+	})
+	if ka, ok := bAddrs.Lookup(a.Addr().String()); !ok || !ka.Tried {
+		t.Errorf("Lookup() of the seed = %+v, %v, want a tried address", ka, ok)
+	}
+
+	// c only knows a and finds b through it
+	c, _ := newDiscoveryServer(t, a.Addr().String())
+	waitFor(t, "c to connect to b", func() bool {
+		for _, p := range c.Peers() {
+			if p.Addr == b.Addr().String() {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestAddressSelfConnection(t *testing.T) {
+	interval := connectInterval
+	connectInterval = 20 * time.Millisecond
+	t.Cleanup(func() { connectInterval = interval })
+
+	// A node learning its own address drops it after trying it
+	a, addrs := newDiscoveryServer(t)
+	addrs.AddAddress(a.Addr().String(), "192.0.2.1", time.Now())
+	waitFor(t, "the own address to be dropped", func() bool { return addrs.Len() == 0 })
+}
@@ -0,0 +1,553 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+const (
+	// ProtocolVersion is the version of the peer protocol spoken by this node
+	ProtocolVersion uint32 = 2
+
+	// MinProtocolVersion is the oldest peer protocol version accepted.
+	// Version 2 added the witness root to block headers, older peers can't
+	// decode them.
+	MinProtocolVersion uint32 = 2
+
+	// commandSize is the length of the zero padded command in a message header
+	commandSize = 12
+
+	// headerSize is the length of a message header: the network magic, the
+	// command, the payload length and the payload checksum
+	headerSize = 4 + commandSize + 4 + 4
+
+	// MaxPayloadSize is the largest message payload accepted, enough for a
+	// block of the maximum size
+	MaxPayloadSize = types.MaxBlockSize + 1024
+
+	// maxUserAgentLen bounds the user agent in version messages
+	maxUserAgentLen = 256
+
+	// MaxInvPerMsg is the most inventory vectors in one message
+	MaxInvPerMsg = 50000
+
+	// invVectSize is the length of an encoded inventory vector
+	invVectSize = 4 + 32
+
+	// MaxLocatorHashes is the most hashes in the locator of a getheaders
+	MaxLocatorHashes = 500
+
+	// MaxHeadersPerMsg is the most block headers in one message
+	MaxHeadersPerMsg = blockchain.MaxHeadersPerMsg
+
+	// MaxAddrPerMsg is the most addresses in one addr message
+	MaxAddrPerMsg = 1000
+
+	// netAddressSize is the length of an encoded network address
+	netAddressSize = 8 + 1 + net.IPv6len + 2
+)
+
+// Commands of the peer protocol
+const (
+	CmdVersion    = "version"
+	CmdVerAck     = "verack"
+	CmdPing       = "ping"
+	CmdPong       = "pong"
+	CmdInv        = "inv"
+	CmdGetData    = "getdata"
+	CmdNotFound   = "notfound"
+	CmdBlock      = "block"
+	CmdTx         = "tx"
+	CmdGetHeaders = "getheaders"
+	CmdHeaders    = "headers"
+	CmdGetAddr    = "getaddr"
+	CmdAddr       = "addr"
+)
+
+var (
+	// ErrWrongNetwork is returned when a message carries another network's magic
+	ErrWrongNetwork = errors.New("message from another network")
+
+	// ErrBadChecksum is returned when the payload does not match its checksum
+	ErrBadChecksum = errors.New("message checksum mismatch")
+
+	// ErrPayloadTooLarge is returned for messages above the payload limit
+	ErrPayloadTooLarge = errors.New("message payload too large")
+
+	// ErrInvalidMessage is returned for malformed commands and payloads
+	ErrInvalidMessage = errors.New("invalid message")
+
+	// ErrUnknownCommand is returned for well-formed messages of an unknown
+	// type, the stream can still be read after it
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+// Message is a peer protocol message
+type Message interface {
+	codec.Encoder
+	codec.Decoder
+
+	// Command returns the command identifying the message type
+	Command() string
+
+	// MaxPayloadSize returns the largest valid payload of the message type
+	MaxPayloadSize() uint32
+}
+
+// makeEmptyMessage returns an empty message for the command to decode into
+func makeEmptyMessage(command string) (Message, error) {
+	switch command {
+	case CmdVersion:
+		return &MsgVersion{}, nil
+	case CmdVerAck:
+		return &MsgVerAck{}, nil
+	case CmdPing:
+		return &MsgPing{}, nil
+	case CmdPong:
+		return &MsgPong{}, nil
+	case CmdInv:
+		return &MsgInv{}, nil
+	case CmdGetData:
+		return &MsgGetData{}, nil
+	case CmdNotFound:
+		return &MsgNotFound{}, nil
+	case CmdBlock:
+		return &MsgBlock{}, nil
+	case CmdTx:
+		return &MsgTx{}, nil
+	case CmdGetHeaders:
+		return &MsgGetHeaders{}, nil
+	case CmdHeaders:
+		return &MsgHeaders{}, nil
+	case CmdGetAddr:
+		return &MsgGetAddr{}, nil
+	case CmdAddr:
+		return &MsgAddr{}, nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownCommand, command)
+	}
+}
+
+// WriteMessage frames the message for the network and writes it with a
+// single call to w, so concurrent writers never interleave frames
+func WriteMessage(w io.Writer, net uint32, msg Message) error {
+	payload := codec.Marshal(msg)
+	if len(payload) > int(msg.MaxPayloadSize()) {
+		return fmt.Errorf("%s: %w", msg.Command(), ErrPayloadTooLarge)
+	}
+
+	var command [commandSize]byte
+	copy(command[:], msg.Command())
+	checksum := crypto.Hash(payload)
+
+	frame := make([]byte, 0, headerSize+len(payload))
+	frame = binary.LittleEndian.AppendUint32(frame, net)
+	frame = append(frame, command[:]...)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, checksum[:4]...)
+	frame = append(frame, payload...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadMessage reads the next message for the network from r. The header
+// is checked before the payload is read, so an oversized length can't
+// make the reader allocate for it.
+func ReadMessage(r io.Reader, net uint32) (Message, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header[0:4]) != net {
+		return nil, ErrWrongNetwork
+	}
+
+	command, err := parseCommand(header[4 : 4+commandSize])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[4+commandSize:])
+	if length > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	msg, err := makeEmptyMessage(command)
+	if err != nil {
+		// Skip the payload so the stream stays in sync
+		if _, copyErr := io.CopyN(io.Discard, r, int64(length)); copyErr != nil {
+			return nil, copyErr
+		}
+		return nil, err
+	}
+	if length > msg.MaxPayloadSize() {
+		return nil, fmt.Errorf("%s: %w", command, ErrPayloadTooLarge)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	checksum := crypto.Hash(payload)
+	if !bytes.Equal(checksum[:4], header[4+commandSize+4:]) {
+		return nil, ErrBadChecksum
+	}
+
+	if err := codec.Unmarshal(payload, msg); err != nil {
+		return nil, fmt.Errorf("%s: %w: %w", command, ErrInvalidMessage, err)
+	}
+	return msg, nil
+}
+
+// parseCommand returns the command of a header, which must be printable
+// ASCII padded with zeros
+func parseCommand(b []byte) (string, error) {
+	n := bytes.IndexByte(b, 0)
+	if n < 0 {
+		n = len(b)
+	}
+	for i, c := range b {
+		if (i < n && (c < 0x21 || c > 0x7e)) || (i >= n && c != 0) {
+			return "", fmt.Errorf("%w: malformed command", ErrInvalidMessage)
+		}
+	}
+	return string(b[:n]), nil
+}
+
+// MsgVersion starts the handshake, each side announces itself with it
+type MsgVersion struct {
+	ProtocolVersion uint32
+	Timestamp       int64  // Sender's clock in Unix seconds
+	Nonce           uint64 // Random per node, detects connections to self
+	UserAgent       string
+	BestHeight      uint64
+}
+
+// Command implements Message
+func (m *MsgVersion) Command() string { return CmdVersion }
+
+// MaxPayloadSize implements Message
+func (m *MsgVersion) MaxPayloadSize() uint32 { return 4 + 8 + 8 + 2 + maxUserAgentLen + 8 }
+
+// Encode implements codec.Encoder
+func (m *MsgVersion) Encode(w *codec.Writer) {
+	w.WriteUint32(m.ProtocolVersion)
+	w.WriteInt64(m.Timestamp)
+	w.WriteUint64(m.Nonce)
+	w.WriteBytes([]byte(m.UserAgent))
+	w.WriteUint64(m.BestHeight)
+}
+
+// Decode implements codec.Decoder
+func (m *MsgVersion) Decode(r *codec.Reader) {
+	m.ProtocolVersion = r.ReadUint32()
+	m.Timestamp = r.ReadInt64()
+	m.Nonce = r.ReadUint64()
+	m.UserAgent = string(r.ReadBytes(maxUserAgentLen))
+	m.BestHeight = r.ReadUint64()
+}
+
+// MsgVerAck acknowledges a version message
+type MsgVerAck struct{}
+
+// Command implements Message
+func (m *MsgVerAck) Command() string { return CmdVerAck }
+
+// MaxPayloadSize implements Message
+func (m *MsgVerAck) MaxPayloadSize() uint32 { return 0 }
+
+// Encode implements codec.Encoder
+func (m *MsgVerAck) Encode(w *codec.Writer) {}
+
+// Decode implements codec.Decoder
+func (m *MsgVerAck) Decode(r *codec.Reader) {}
+
+// MsgPing checks that a peer is still responsive
+type MsgPing struct {
+	Nonce uint64
+}
+
+// Command implements Message
+func (m *MsgPing) Command() string { return CmdPing }
+
+// MaxPayloadSize implements Message
+func (m *MsgPing) MaxPayloadSize() uint32 { return 8 }
+
+// Encode implements codec.Encoder
+func (m *MsgPing) Encode(w *codec.Writer) { w.WriteUint64(m.Nonce) }
+
+// Decode implements codec.Decoder
+func (m *MsgPing) Decode(r *codec.Reader) { m.Nonce = r.ReadUint64() }
+
+// MsgPong answers a ping with its nonce
+type MsgPong struct {
+	Nonce uint64
+}
+
+// Command implements Message
+func (m *MsgPong) Command() string { return CmdPong }
+
+// MaxPayloadSize implements Message
+func (m *MsgPong) MaxPayloadSize() uint32 { return 8 }
+
+// Encode implements codec.Encoder
+func (m *MsgPong) Encode(w *codec.Writer) { w.WriteUint64(m.Nonce) }
+
+// Decode implements codec.Decoder
+func (m *MsgPong) Decode(r *codec.Reader) { m.Nonce = r.ReadUint64() }
+
+// InvType identifies the kind of object an inventory vector refers to
+type InvType uint32
+
+const (
+	InvTypeTx    InvType = 1
+	InvTypeBlock InvType = 2
+)
+
+// String returns the name of the inventory type
+func (t InvType) String() string {
+	switch t {
+	case InvTypeTx:
+		return "tx"
+	case InvTypeBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("InvType(%d)", uint32(t))
+	}
+}
+
+// InvVect identifies a block or transaction by its hash
+type InvVect struct {
+	Type InvType
+	Hash [32]byte
+}
+
+// String returns the type and hex hash of the vector
+func (iv InvVect) String() string {
+	return fmt.Sprintf("%s %x", iv.Type, iv.Hash)
+}
+
+// invList is the payload shared by inv, getdata and notfound
+type invList struct {
+	InvList []InvVect
+}
+
+// MaxPayloadSize implements Message
+func (l *invList) MaxPayloadSize() uint32 { return 4 + MaxInvPerMsg*invVectSize }
+
+// Encode implements codec.Encoder
+func (l *invList) Encode(w *codec.Writer) {
+	w.WriteVarInt(uint64(len(l.InvList)))
+	for _, iv := range l.InvList {
+		w.WriteUint32(uint32(iv.Type))
+		w.WriteHash(iv.Hash)
+	}
+}
+
+// Decode implements codec.Decoder
+func (l *invList) Decode(r *codec.Reader) {
+	l.InvList = nil
+	if n := r.ReadCount(MaxInvPerMsg); n > 0 {
+		l.InvList = make([]InvVect, n)
+	}
+	for i := range l.InvList {
+		l.InvList[i].Type = InvType(r.ReadUint32())
+		l.InvList[i].Hash = r.ReadHash()
+	}
+}
+
+// MsgInv announces blocks and transactions the sender has
+type MsgInv struct{ invList }
+
+// Command implements Message
+func (m *MsgInv) Command() string { return CmdInv }
+
+// MsgGetData requests the objects of an earlier inv
+type MsgGetData struct{ invList }
+
+// Command implements Message
+func (m *MsgGetData) Command() string { return CmdGetData }
+
+// MsgNotFound answers a getdata for objects the sender does not have
+type MsgNotFound struct{ invList }
+
+// Command implements Message
+func (m *MsgNotFound) Command() string { return CmdNotFound }
+
+// MsgBlock carries a block
+type MsgBlock struct {
+	Block types.Block
+}
+
+// Command implements Message
+func (m *MsgBlock) Command() string { return CmdBlock }
+
+// MaxPayloadSize implements Message
+func (m *MsgBlock) MaxPayloadSize() uint32 { return types.MaxBlockSize }
+
+// Encode implements codec.Encoder
+func (m *MsgBlock) Encode(w *codec.Writer) { m.Block.Encode(w) }
+
+// Decode implements codec.Decoder
+func (m *MsgBlock) Decode(r *codec.Reader) { m.Block.Decode(r) }
+
+// MsgTx carries a transaction
+type MsgTx struct {
+	Tx types.Transaction
+}
+
+// Command implements Message
+func (m *MsgTx) Command() string { return CmdTx }
+
+// MaxPayloadSize implements Message
+func (m *MsgTx) MaxPayloadSize() uint32 { return types.MaxBlockSize }
+
+// Encode implements codec.Encoder
+func (m *MsgTx) Encode(w *codec.Writer) { m.Tx.Encode(w) }
+
+// Decode implements codec.Decoder
+func (m *MsgTx) Decode(r *codec.Reader) { m.Tx.Decode(r) }
+
+// MsgGetHeaders requests the headers of the sender's best chain following
+// the first locator hash on it, up to HashStop or MaxHeadersPerMsg
+type MsgGetHeaders struct {
+	Locator  [][32]byte
+	HashStop [32]byte // Zero to get as many headers as possible
+}
+
+// Command implements Message
+func (m *MsgGetHeaders) Command() string { return CmdGetHeaders }
+
+// MaxPayloadSize implements Message
+func (m *MsgGetHeaders) MaxPayloadSize() uint32 { return 2 + (MaxLocatorHashes+1)*32 }
+
+// Encode implements codec.Encoder
+func (m *MsgGetHeaders) Encode(w *codec.Writer) {
+	w.WriteVarInt(uint64(len(m.Locator)))
+	for _, hash := range m.Locator {
+		w.WriteHash(hash)
+	}
+	w.WriteHash(m.HashStop)
+}
+
+// Decode implements codec.Decoder
+func (m *MsgGetHeaders) Decode(r *codec.Reader) {
+	m.Locator = nil
+	if n := r.ReadCount(MaxLocatorHashes); n > 0 {
+		m.Locator = make([][32]byte, n)
+	}
+	for i := range m.Locator {
+		m.Locator[i] = r.ReadHash()
+	}
+	m.HashStop = r.ReadHash()
+}
+
+// MsgHeaders answers a getheaders with consecutive block headers
+type MsgHeaders struct {
+	Headers []types.BlockHeader
+}
+
+// Command implements Message
+func (m *MsgHeaders) Command() string { return CmdHeaders }
+
+// MaxPayloadSize implements Message
+func (m *MsgHeaders) MaxPayloadSize() uint32 {
+	return 4 + MaxHeadersPerMsg*types.BlockHeaderSize
+}
+
+// Encode implements codec.Encoder
+func (m *MsgHeaders) Encode(w *codec.Writer) {
+	w.WriteVarInt(uint64(len(m.Headers)))
+	for i := range m.Headers {
+		m.Headers[i].Encode(w)
+	}
+}
+
+// Decode implements codec.Decoder
+func (m *MsgHeaders) Decode(r *codec.Reader) {
+	m.Headers = nil
+	if n := r.ReadCount(MaxHeadersPerMsg); n > 0 {
+		m.Headers = make([]types.BlockHeader, n)
+	}
+	for i := range m.Headers {
+		m.Headers[i].Decode(r)
+	}
+}
+
+// NetAddress is the address of a node announced in addr messages
+type NetAddress struct {
+	Timestamp time.Time // When the node was last seen
+	IP        net.IP    // Unspecified in a node's announcement of itself
+	Port      uint16
+}
+
+// String returns the address as host:port
+func (na NetAddress) String() string {
+	return net.JoinHostPort(na.IP.String(), strconv.Itoa(int(na.Port)))
+}
+
+// MsgGetAddr asks a peer for addresses of other nodes
+type MsgGetAddr struct{}
+
+// Command implements Message
+func (m *MsgGetAddr) Command() string { return CmdGetAddr }
+
+// MaxPayloadSize implements Message
+func (m *MsgGetAddr) MaxPayloadSize() uint32 { return 0 }
+
+// Encode implements codec.Encoder
+func (m *MsgGetAddr) Encode(w *codec.Writer) {}
+
+// Decode implements codec.Decoder
+func (m *MsgGetAddr) Decode(r *codec.Reader) {}
+
+// MsgAddr announces addresses of nodes accepting connections
+type MsgAddr struct {
+	AddrList []NetAddress
+}
+
+// Command implements Message
+func (m *MsgAddr) Command() string { return CmdAddr }
+
+// MaxPayloadSize implements Message
+func (m *MsgAddr) MaxPayloadSize() uint32 { return 3 + MaxAddrPerMsg*netAddressSize }
+
+// Encode implements codec.Encoder
+func (m *MsgAddr) Encode(w *codec.Writer) {
+	w.WriteVarInt(uint64(len(m.AddrList)))
+	for _, na := range m.AddrList {
+		w.WriteInt64(na.Timestamp.Unix())
+		w.WriteBytes(na.IP.To16())
+		w.WriteUint16(na.Port)
+	}
+}
+
+// Decode implements codec.Decoder
+func (m *MsgAddr) Decode(r *codec.Reader) {
+	m.AddrList = nil
+	if n := r.ReadCount(MaxAddrPerMsg); n > 0 {
+		m.AddrList = make([]NetAddress, n)
+	}
+	for i := range m.AddrList {
+		na := &m.AddrList[i]
+		na.Timestamp = time.Unix(r.ReadInt64(), 0).UTC()
+		na.IP = net.IP(r.ReadBytes(net.IPv6len))
+		na.Port = r.ReadUint16()
+		if r.Err() == nil && len(na.IP) != net.IPv6len {
+			r.Fail(fmt.Errorf("address of %d bytes", len(na.IP)))
+		}
+	}
+}
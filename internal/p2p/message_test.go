@@ -0,0 +1,156 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+const testNet = 0x74737400
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []Message{
+		&MsgVersion{ProtocolVersion: ProtocolVersion, Timestamp: 1735689600, Nonce: 7, UserAgent: "/test:1/", BestHeight: 42},
+		&MsgVerAck{},
+		&MsgPing{Nonce: 0xdeadbeef},
+		&MsgPong{Nonce: 0xdeadbeef},
+		&MsgGetHeaders{Locator: [][32]byte{{1}, {2}}, HashStop: [32]byte{3}},
+		&MsgHeaders{Headers: []types.BlockHeader{{
+			Version:       1,
+			PrevBlockHash: [32]byte{1},
+			MerkleRoot:    [32]byte{2},
+			Timestamp:     time.Unix(1735689600, 0).UTC(),
+			Difficulty:    0x207fffff,
+			Nonce:         9,
+		}}},
+		&MsgGetAddr{},
+		&MsgAddr{AddrList: []NetAddress{
+			{Timestamp: time.Unix(1735689600, 0).UTC(), IP: net.ParseIP("10.0.0.1"), Port: 8333},
+			{Timestamp: time.Unix(1735689601, 0).UTC(), IP: net.ParseIP("2001:db8::1"), Port: 18333},
+		}},
+	}
+
+	for _, msg := range tests {
+		t.Run(msg.Command(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteMessage(&buf, testNet, msg); err != nil {
+				t.Fatalf("WriteMessage() error = %v", err)
+			}
+
+			got, err := ReadMessage(&buf, testNet)
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("ReadMessage() = %+v, want %+v", got, msg)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("ReadMessage() left %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+// frame returns an encoded ping that the test can corrupt
+func frame(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, testNet, &MsgPing{Nonce: 1}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadMessageRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+		wantErr error
+	}{
+		{"wrong network", func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b, testNet+1)
+			return b
+		}, ErrWrongNetwork},
+		{"bad checksum", func(b []byte) []byte {
+			b[len(b)-1] ^= 0xff
+			return b
+		}, ErrBadChecksum},
+		{"oversized payload", func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[4+commandSize:], MaxPayloadSize+1)
+			return b
+		}, ErrPayloadTooLarge},
+		{"payload above message limit", func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[4+commandSize:], 9)
+			return append(b, 0)
+		}, ErrPayloadTooLarge},
+		{"malformed command", func(b []byte) []byte {
+			b[4] = '\n'
+			return b
+		}, ErrInvalidMessage},
+		{"truncated payload", func(b []byte) []byte {
+			return b[:len(b)-1]
+		}, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.corrupt(frame(t))
+			if _, err := ReadMessage(bytes.NewReader(data), testNet); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadMessage() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadMessageSkipsUnknownCommand(t *testing.T) {
+	data := frame(t)
+	copy(data[4:4+commandSize], "future\x00\x00\x00\x00\x00\x00")
+	data = append(data, frame(t)...)
+
+	r := bytes.NewReader(data)
+	if _, err := ReadMessage(r, testNet); !errors.Is(err, ErrUnknownCommand) {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrUnknownCommand)
+	}
+
+	// The next message is still readable
+	msg, err := ReadMessage(r, testNet)
+	if err != nil {
+		t.Fatalf("ReadMessage() after unknown command error = %v", err)
+	}
+	if msg.Command() != CmdPing {
+		t.Errorf("ReadMessage() = %s, want %s", msg.Command(), CmdPing)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+		wantErr bool
+	}{
+		{"padded", "ping\x00\x00\x00\x00\x00\x00\x00\x00", "ping", false},
+		{"full length", "abcdefghijkl", "abcdefghijkl", false},
+		{"data after padding", "ping\x00x\x00\x00\x00\x00\x00\x00", "", true},
+		{"not printable", "pi\nng\x00\x00\x00\x00\x00\x00\x00", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCommand([]byte(tt.command))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"errors"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+)
+
+const (
+	// DefaultBanThreshold is the ban score at which a peer is banned when
+	// the config leaves it unset
+	DefaultBanThreshold = 100
+
+	// DefaultBanDuration is how long a host stays banned when the config
+	// leaves it unset
+	DefaultBanDuration = 24 * time.Hour
+)
+
+// misbehaviorScores maps rejection reasons to the ban score they add. Data
+// no honest node sends is scored with the default threshold, mistakes an
+// honest node can make on a fork or with a skewed clock score less or not
+// at all.
+var misbehaviorScores = []struct {
+	err   error
+	score int
+}{
+	{blockchain.ErrBadProofOfWork, 100},
+	{blockchain.ErrBadBlockHash, 100},
+	{blockchain.ErrBadMerkleRoot, 100},
+	{blockchain.ErrBadWitnessRoot, 100},
+	{blockchain.ErrBadSignature, 100},
+	{blockchain.ErrBlockTooLarge, 100},
+	{blockchain.ErrBadDifficulty, 100},
+	{blockchain.ErrBadHeight, 100},
+	{blockchain.ErrBadCoinbase, 100},
+	{blockchain.ErrBadTransaction, 100},
+	{blockchain.ErrBadSpend, 100},
+	{blockchain.ErrInvalidAncestor, 100},
+	{blockchain.ErrBadTimestamp, 20},
+	{blockchain.ErrHeaderNotLinked, 20},
+	{ErrLowWorkHeaders, 20},
+	{ErrPayloadTooLarge, 100},
+	{ErrInvalidMessage, 100},
+	{ErrBadChecksum, 50},
+}
+
+// misbehaviorScore returns the ban score of err, 0 if it is no misbehavior
+func misbehaviorScore(err error) int {
+	for _, s := range misbehaviorScores {
+		if errors.Is(err, s.err) {
+			return s.score
+		}
+	}
+	return 0
+}
+
+// misbehaving adds the score of err to the ban score of the peer. A peer
+// reaching the threshold is disconnected and its host banned.
+func (s *Server) misbehaving(p *Peer, err error) {
+	score := misbehaviorScore(err)
+	if score == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	p.banScore += score
+	banScore := p.banScore
+	p.mu.Unlock()
+	if banScore < s.cfg.BanThreshold {
+		s.logf("Misbehavior of %s (score %d): %v", p.addr, banScore, err)
+		return
+	}
+
+	host := hostOf(p.conn.RemoteAddr().String())
+	s.logf("Banning %s for %v: %v", host, s.cfg.BanDuration, err)
+	if s.cfg.BanList != nil {
+		if err := s.cfg.BanList.Ban(host, s.cfg.BanDuration, err.Error()); err != nil {
+			s.logf("Failed to save ban list: %v", err)
+		}
+	}
+	p.Disconnect()
+}
+
+// isBanned reports whether the host of addr is banned
+func (s *Server) isBanned(addr string) bool {
+	return s.cfg.BanList != nil && s.cfg.BanList.IsBanned(hostOf(addr))
+}
+
+// ErrNoBanList is returned when banning on a server without a ban list
+var ErrNoBanList = errors.New("ban list disabled")
+
+// Ban bans host for duration, or for the configured duration if it is 0,
+// and disconnects its peers
+func (s *Server) Ban(host string, duration time.Duration, reason string) error {
+	if s.cfg.BanList == nil {
+		return ErrNoBanList
+	}
+	if duration <= 0 {
+		duration = s.cfg.BanDuration
+	}
+	if err := s.cfg.BanList.Ban(host, duration, reason); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	var banned []*Peer
+	for _, peers := range []map[*Peer]struct{}{s.peers, s.pending} {
+		for p := range peers {
+			if hostOf(p.conn.RemoteAddr().String()) == host {
+				banned = append(banned, p)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range banned {
+		p.Disconnect()
+	}
+	return nil
+}
+
+// Unban lifts the ban of host and reports whether there was one
+func (s *Server) Unban(host string) (bool, error) {
+	if s.cfg.BanList == nil {
+		return false, ErrNoBanList
+	}
+	return s.cfg.BanList.Unban(host)
+}
+
+// ClearBans lifts all bans
+func (s *Server) ClearBans() error {
+	if s.cfg.BanList == nil {
+		return ErrNoBanList
+	}
+	return s.cfg.BanList.Clear()
+}
+
+// Bans returns the bans in effect ordered by host
+func (s *Server) Bans() []Ban {
+	if s.cfg.BanList == nil {
+		return nil
+	}
+	return s.cfg.BanList.List()
+}
@@ -0,0 +1,149 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+)
+
+func TestMisbehaviorScore(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"bad proof of work", fmt.Errorf("block 1: %w", blockchain.ErrBadProofOfWork), 100},
+		{"bad signature", fmt.Errorf("%w: input 0", blockchain.ErrBadSignature), 100},
+		{"oversized message", fmt.Errorf("block: %w", ErrPayloadTooLarge), 100},
+		{"bad checksum", ErrBadChecksum, 50},
+		{"header not linked", blockchain.ErrHeaderNotLinked, 20},
+		{"future timestamp", blockchain.ErrFutureTimestamp, 0},
+		{"closed connection", io.EOF, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := misbehaviorScore(tt.err); got != tt.want {
+				t.Errorf("misbehaviorScore() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// dialHandshake connects to s and completes the handshake as a raw peer
+func dialHandshake(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	net := chaincfg.RegTestParams.Net
+	if err := WriteMessage(conn, net, &MsgVersion{ProtocolVersion: ProtocolVersion, Nonce: 1}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if err := WriteMessage(conn, net, &MsgVerAck{}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	return conn
+}
+
+func TestBanMisbehavingPeer(t *testing.T) {
+	source := newTestChain(t)
+	block := mineBlocks(t, source, 1)[0]
+	for crypto.CheckProofOfWork(block.ComputeHash(), block.Header.Difficulty) {
+		block.Header.Nonce++
+	}
+	block.Hash = block.ComputeHash()
+
+	bans, err := OpenBanList("")
+	if err != nil {
+		t.Fatalf("OpenBanList() error = %v", err)
+	}
+	s, err := NewServer(Config{
+		Params:     &chaincfg.RegTestParams,
+		ListenAddr: "127.0.0.1:0",
+		Chain:      newTestChain(t),
+		BanList:    bans,
+		Logger:     log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	conn := dialHandshake(t, s)
+	waitFor(t, "the handshake", func() bool { return len(s.Peers()) == 1 })
+	if err := WriteMessage(conn, chaincfg.RegTestParams.Net, &MsgBlock{Block: *block}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	waitFor(t, "the ban", func() bool { return bans.IsBanned("127.0.0.1") && len(s.Peers()) == 0 })
+	if ban := bans.List()[0]; ban.Until.Sub(ban.Created) != DefaultBanDuration {
+		t.Errorf("ban lasts %v, want %v", ban.Until.Sub(ban.Created), DefaultBanDuration)
+	}
+
+	// The banned host can't connect again
+	conn, err = net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadMessage(conn, chaincfg.RegTestParams.Net); err == nil {
+		t.Error("ReadMessage() from a server that banned us = nil error, want closed connection")
+	}
+	if peers := s.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() = %v, want none", peers)
+	}
+}
+
+func TestServerBanDisconnects(t *testing.T) {
+	bans, err := OpenBanList("")
+	if err != nil {
+		t.Fatalf("OpenBanList() error = %v", err)
+	}
+	s, err := NewServer(Config{
+		Params:      &chaincfg.RegTestParams,
+		ListenAddr:  "127.0.0.1:0",
+		Chain:       newTestChain(t),
+		BanList:     bans,
+		BanDuration: time.Hour,
+		Logger:      log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	dialHandshake(t, s)
+	waitFor(t, "the handshake", func() bool { return len(s.Peers()) == 1 })
+	if err := s.Ban("127.0.0.1", 0, "test"); err != nil {
+		t.Fatalf("Ban() error = %v", err)
+	}
+	waitFor(t, "the disconnect", func() bool { return len(s.Peers()) == 0 })
+	if got := s.Bans(); len(got) != 1 || got[0].Until.Sub(got[0].Created) != time.Hour {
+		t.Errorf("Bans() = %v, want 127.0.0.1 banned for the configured hour", got)
+	}
+
+	if ok, err := s.Unban("127.0.0.1"); !ok || err != nil {
+		t.Errorf("Unban() = %v, %v, want true", ok, err)
+	}
+	if got := s.Bans(); len(got) != 0 {
+		t.Errorf("Bans() after Unban() = %v, want none", got)
+	}
+}
@@ -0,0 +1,379 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeouts of the peer protocol, variables so tests can shorten them
+var (
+	// handshakeTimeout is how long a new connection may take to exchange
+	// version and verack
+	handshakeTimeout = 30 * time.Second
+
+	// pingInterval is how often peers are pinged
+	pingInterval = 2 * time.Minute
+
+	// pingTimeout is how long a ping may go unanswered
+	pingTimeout = time.Minute
+
+	// idleTimeout disconnects peers that send nothing, it must exceed the
+	// ping interval
+	idleTimeout = 5 * time.Minute
+
+	// writeTimeout bounds writing a single message
+	writeTimeout = time.Minute
+)
+
+// sendQueueSize is the number of messages queued for a peer before
+// QueueMessage blocks
+const sendQueueSize = 64
+
+var (
+	errUnexpectedBefore = errors.New("unexpected message before handshake")
+	errUnexpectedAfter  = errors.New("unexpected message after handshake")
+)
+
+// PeerInfo describes a connected peer
+type PeerInfo struct {
+	Addr            string
+	Inbound         bool
+	ProtocolVersion uint32
+	UserAgent       string
+	BestHeight      uint64
+	ConnectedAt     time.Time
+	PingTime        time.Duration // Round trip of the last answered ping
+	BanScore        int
+}
+
+// Peer is a connection to another node
+type Peer struct {
+	server  *Server
+	conn    net.Conn
+	addr    string
+	inbound bool
+
+	sendQueue chan Message
+	quit      chan struct{}
+	quitOnce  sync.Once
+
+	mu          sync.Mutex
+	version     *MsgVersion
+	bestHeight  uint64 // Highest block the peer is known to have
+	connectedAt time.Time
+	pingNonce   uint64
+	pingSent    time.Time
+	pingTime    time.Duration
+	sentAddrs   bool // Whether a getaddr of the peer was answered
+	banScore    int  // Accumulated misbehavior score
+
+	// knownInventory holds what the peer is known to have, guarded by mu
+	knownInventory *knownInventory
+}
+
+// newPeer creates a peer for an established connection
+func newPeer(s *Server, conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		server:         s,
+		conn:           conn,
+		addr:           addr,
+		inbound:        inbound,
+		sendQueue:      make(chan Message, sendQueueSize),
+		quit:           make(chan struct{}),
+		knownInventory: newKnownInventory(maxKnownInventory),
+	}
+}
+
+// Addr returns the address of the peer
+func (p *Peer) Addr() string {
+	return p.addr
+}
+
+// Inbound reports whether the peer connected to us
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+// Info returns a snapshot of the peer's state
+func (p *Peer) Info() PeerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info := PeerInfo{
+		Addr:        p.addr,
+		Inbound:     p.inbound,
+		ConnectedAt: p.connectedAt,
+		PingTime:    p.pingTime,
+		BanScore:    p.banScore,
+	}
+	if p.version != nil {
+		info.ProtocolVersion = p.version.ProtocolVersion
+		info.UserAgent = p.version.UserAgent
+	}
+	info.BestHeight = p.bestHeight
+	return info
+}
+
+// QueueMessage queues a message to be sent to the peer. It blocks while the
+// send queue is full and drops the message once the peer disconnects.
+func (p *Peer) QueueMessage(msg Message) {
+	select {
+	case p.sendQueue <- msg:
+	case <-p.quit:
+	}
+}
+
+// tryQueueMessage queues a message without waiting, it reports false if
+// the send queue is full. Messages to a disconnected peer are dropped.
+func (p *Peer) tryQueueMessage(msg Message) bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+	}
+	select {
+	case p.sendQueue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// BestHeight returns the height of the best block the peer is known to have
+func (p *Peer) BestHeight() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.bestHeight
+}
+
+// updateBestHeight raises the best height of the peer after it announced
+// or sent a higher block
+func (p *Peer) updateBestHeight(height uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bestHeight = max(p.bestHeight, height)
+}
+
+// Disconnect closes the connection, it is safe to call more than once
+func (p *Peer) Disconnect() {
+	p.quitOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// Done returns a channel that is closed once the peer disconnects
+func (p *Peer) Done() <-chan struct{} {
+	return p.quit
+}
+
+// run performs the handshake and then serves the peer until it disconnects
+func (p *Peer) run() {
+	defer p.Disconnect()
+
+	// Peers still in the handshake are not registered with the server,
+	// so they watch for it stopping themselves
+	go func() {
+		select {
+		case <-p.server.quit:
+			p.Disconnect()
+		case <-p.quit:
+		}
+	}()
+
+	p.server.wg.Add(1)
+	go func() {
+		defer p.server.wg.Done()
+		p.writeLoop()
+	}()
+
+	if err := p.handshake(); err != nil {
+		p.server.logf("Handshake with %s failed: %v", p.addr, err)
+		if errors.Is(err, errSelfConnection) && p.inbound {
+			p.server.forgetSelfAddress(p.conn.RemoteAddr().String())
+		}
+		p.server.misbehaving(p, err)
+		return
+	}
+	if err := p.server.addPeer(p); err != nil {
+		p.server.logf("Dropping %s: %v", p.addr, err)
+		return
+	}
+	defer p.server.removePeer(p)
+
+	p.server.wg.Add(1)
+	go func() {
+		defer p.server.wg.Done()
+		p.pingLoop()
+	}()
+
+	p.server.startAddrExchange(p)
+	p.server.announceTip(p)
+
+	err := p.readLoop()
+	select {
+	case <-p.quit:
+		// Disconnected on purpose, the read error is only the closed connection
+	default:
+		p.server.logf("Disconnecting %s: %v", p.addr, err)
+		p.server.misbehaving(p, err)
+	}
+}
+
+// handshake exchanges version and verack messages. The outbound side
+// sends its version first, the inbound side answers with its own.
+func (p *Peer) handshake() error {
+	if err := p.conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+
+	if !p.inbound {
+		p.QueueMessage(p.server.versionMessage())
+	}
+
+	var gotVersion, gotVerAck bool
+	for !gotVersion || !gotVerAck {
+		msg, err := ReadMessage(p.conn, p.server.net)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *MsgVersion:
+			if gotVersion {
+				return errors.New("duplicate version message")
+			}
+			if err := p.server.checkVersion(msg); err != nil {
+				return err
+			}
+			gotVersion = true
+
+			p.mu.Lock()
+			p.version = msg
+			p.bestHeight = msg.BestHeight
+			p.mu.Unlock()
+
+			if p.inbound {
+				p.QueueMessage(p.server.versionMessage())
+			}
+			p.QueueMessage(&MsgVerAck{})
+
+		case *MsgVerAck:
+			if !gotVersion {
+				return errors.New("verack before version")
+			}
+			gotVerAck = true
+
+		default:
+			return fmt.Errorf("%w: %s", errUnexpectedBefore, msg.Command())
+		}
+	}
+
+	p.mu.Lock()
+	p.connectedAt = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// readLoop reads and handles messages until the connection fails
+func (p *Peer) readLoop() error {
+	for {
+		if err := p.conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return err
+		}
+
+		msg, err := ReadMessage(p.conn, p.server.net)
+		if errors.Is(err, ErrUnknownCommand) {
+			// Newer peers may speak messages we don't know
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *MsgPing:
+			p.QueueMessage(&MsgPong{Nonce: msg.Nonce})
+
+		case *MsgPong:
+			p.handlePong(msg)
+
+		case *MsgVersion, *MsgVerAck:
+			return fmt.Errorf("%w: %s", errUnexpectedAfter, msg.Command())
+
+		default:
+			p.server.handleMessage(p, msg)
+		}
+	}
+}
+
+// handlePong records the round trip time of the outstanding ping
+func (p *Peer) handlePong(msg *MsgPong) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pingNonce != 0 && msg.Nonce == p.pingNonce {
+		p.pingTime = time.Since(p.pingSent)
+		p.pingNonce = 0
+	}
+}
+
+// pingLoop pings the peer periodically and disconnects it when a ping
+// goes unanswered
+func (p *Peer) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.quit:
+			return
+		}
+
+		p.mu.Lock()
+		if p.pingNonce != 0 && time.Since(p.pingSent) > pingTimeout {
+			p.mu.Unlock()
+			p.server.logf("Disconnecting %s: ping timeout", p.addr)
+			p.Disconnect()
+			return
+		}
+		if p.pingNonce != 0 {
+			// Still waiting for the previous pong
+			p.mu.Unlock()
+			continue
+		}
+		nonce := rand.Uint64() | 1
+		p.pingNonce = nonce
+		p.pingSent = time.Now()
+		p.mu.Unlock()
+
+		p.QueueMessage(&MsgPing{Nonce: nonce})
+	}
+}
+
+// writeLoop writes queued messages until the peer disconnects
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.sendQueue:
+			if err := p.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+				p.Disconnect()
+				return
+			}
+			if err := WriteMessage(p.conn, p.server.net, msg); err != nil {
+				p.server.logf("Failed to send %s to %s: %v", msg.Command(), p.addr, err)
+				p.Disconnect()
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
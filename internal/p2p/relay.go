@@ -0,0 +1,313 @@
+package p2p
+
+import (
+	"errors"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+const (
+	// maxKnownInventory is how many inventory vectors are remembered per
+	// peer to avoid announcing objects it already has
+	maxKnownInventory = 1000
+
+	// blockRelayQueueSize is how many connected blocks may wait to be
+	// announced, more are not announced
+	blockRelayQueueSize = 64
+)
+
+// requestTimeout is how long a getdata may go unanswered before the object
+// is requested from another peer, a variable so tests can shorten it
+var requestTimeout = 30 * time.Second
+
+// TxPool holds the unconfirmed transactions that are relayed to peers
+type TxPool interface {
+	// HaveTransaction reports whether the transaction is in the pool
+	HaveTransaction(hash [32]byte) bool
+	// FetchTransaction returns a transaction of the pool
+	FetchTransaction(hash [32]byte) (*types.Transaction, error)
+	// ProcessTransaction validates a transaction and adds it to the pool
+	ProcessTransaction(tx *types.Transaction) error
+}
+
+// knownInventory is a bounded set of inventory vectors, the oldest entry
+// is forgotten when it is full
+type knownInventory struct {
+	set   map[InvVect]struct{}
+	order []InvVect
+	next  int
+}
+
+// newKnownInventory creates a set holding up to max vectors
+func newKnownInventory(max int) *knownInventory {
+	return &knownInventory{
+		set:   make(map[InvVect]struct{}, max),
+		order: make([]InvVect, 0, max),
+	}
+}
+
+// has reports whether iv is in the set
+func (k *knownInventory) has(iv InvVect) bool {
+	_, ok := k.set[iv]
+	return ok
+}
+
+// add inserts iv, evicting the oldest vector if the set is full
+func (k *knownInventory) add(iv InvVect) {
+	if k.has(iv) {
+		return
+	}
+	if len(k.order) < cap(k.order) {
+		k.order = append(k.order, iv)
+	} else {
+		delete(k.set, k.order[k.next])
+		k.order[k.next] = iv
+		k.next = (k.next + 1) % len(k.order)
+	}
+	k.set[iv] = struct{}{}
+}
+
+// pendingRequest is an object requested from a peer
+type pendingRequest struct {
+	peer *Peer
+	sent time.Time
+}
+
+// AnnounceBlock announces a block to every peer not known to have it
+func (s *Server) AnnounceBlock(hash [32]byte) {
+	s.relayInventory(InvVect{Type: InvTypeBlock, Hash: hash})
+}
+
+// AnnounceTransaction announces a transaction to every peer not known to
+// have it
+func (s *Server) AnnounceTransaction(hash [32]byte) {
+	s.relayInventory(InvVect{Type: InvTypeTx, Hash: hash})
+}
+
+// relayInventory queues an inv for every peer that doesn't know iv yet.
+// A peer whose send queue is full is too slow to keep up and disconnected,
+// so it can't hold up the caller.
+func (s *Server) relayInventory(iv InvVect) {
+	s.mu.Lock()
+	peers := make([]*Peer, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		if p.addKnownInventory(iv) && !p.tryQueueMessage(&MsgInv{invList{InvList: []InvVect{iv}}}) {
+			s.logf("Disconnecting %s: send queue full", p.addr)
+			p.Disconnect()
+		}
+	}
+}
+
+// handleBlockConnected queues blocks for relay once they are connected to
+// the best chain, which means they passed full validation. It never waits,
+// so relaying can't hold up the writers of the chain.
+func (s *Server) handleBlockConnected(block *types.Block) {
+	select {
+	case s.blockRelay <- block.Hash:
+	default:
+		s.logf("Not announcing block %x: relay queue full", block.Hash)
+	}
+}
+
+// blockRelayLoop announces the connected blocks until the server stops.
+// Blocks connected while syncing are old, only the tip is announced once
+// the sync ends.
+func (s *Server) blockRelayLoop() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case hash := <-s.blockRelay:
+			if !s.sync.isSyncing() {
+				s.AnnounceBlock(hash)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// handleMessage handles the messages of a peer past the handshake
+func (s *Server) handleMessage(p *Peer, msg Message) {
+	switch msg := msg.(type) {
+	case *MsgInv:
+		s.handleInv(p, msg)
+	case *MsgGetData:
+		s.handleGetData(p, msg)
+	case *MsgNotFound:
+		for _, iv := range msg.InvList {
+			s.finishRequest(p, iv)
+		}
+		if s.sync != nil {
+			s.sync.handleNotFound(p, msg.InvList)
+		}
+	case *MsgBlock:
+		s.handleBlock(p, &msg.Block)
+	case *MsgTx:
+		s.handleTx(p, &msg.Tx)
+	case *MsgGetHeaders:
+		s.handleGetHeaders(p, msg)
+	case *MsgHeaders:
+		if s.sync != nil {
+			s.sync.handleHeaders(p, msg)
+		}
+	case *MsgGetAddr:
+		s.handleGetAddr(p)
+	case *MsgAddr:
+		s.handleAddr(p, msg)
+	}
+}
+
+// handleInv requests the announced objects we don't have. Blocks are not
+// requested while syncing, the sync downloads them in order.
+func (s *Server) handleInv(p *Peer, msg *MsgInv) {
+	var request []InvVect
+	for _, iv := range msg.InvList {
+		p.addKnownInventory(iv)
+		if s.haveInventory(iv) {
+			continue
+		}
+		if iv.Type == InvTypeBlock && s.sync.isSyncing() {
+			s.sync.peerHasNewBlocks(p)
+			continue
+		}
+		if s.startRequest(p, iv) {
+			request = append(request, iv)
+		}
+	}
+
+	if len(request) > 0 {
+		p.QueueMessage(&MsgGetData{invList{InvList: request}})
+	}
+}
+
+// haveInventory reports whether the object is already known locally, or
+// can't be used at all
+func (s *Server) haveInventory(iv InvVect) bool {
+	switch iv.Type {
+	case InvTypeBlock:
+		return s.cfg.Chain == nil || s.cfg.Chain.HaveBlock(iv.Hash)
+	case InvTypeTx:
+		return s.cfg.TxPool == nil || s.cfg.TxPool.HaveTransaction(iv.Hash)
+	default:
+		return true
+	}
+}
+
+// handleGetData sends the requested objects, those we don't have are
+// listed in a notfound reply
+func (s *Server) handleGetData(p *Peer, msg *MsgGetData) {
+	var notFound []InvVect
+	for _, iv := range msg.InvList {
+		switch iv.Type {
+		case InvTypeBlock:
+			if s.cfg.Chain != nil {
+				if block, err := s.cfg.Chain.GetBlockByHash(iv.Hash); err == nil {
+					p.addKnownInventory(iv)
+					p.QueueMessage(&MsgBlock{Block: *block})
+					continue
+				}
+			}
+		case InvTypeTx:
+			if s.cfg.TxPool != nil {
+				if tx, err := s.cfg.TxPool.FetchTransaction(iv.Hash); err == nil {
+					p.addKnownInventory(iv)
+					p.QueueMessage(&MsgTx{Tx: *tx})
+					continue
+				}
+			}
+		}
+		notFound = append(notFound, iv)
+	}
+
+	if len(notFound) > 0 {
+		p.QueueMessage(&MsgNotFound{invList{InvList: notFound}})
+	}
+}
+
+// handleBlock adds a block received from a peer to the chain. Accepted
+// blocks are relayed through the chain notification once connected.
+// An orphan means the peer is ahead by more than one block, so we sync
+// the missing blocks from it.
+func (s *Server) handleBlock(p *Peer, block *types.Block) {
+	iv := InvVect{Type: InvTypeBlock, Hash: block.Hash}
+	p.addKnownInventory(iv)
+	s.finishRequest(p, iv)
+
+	if s.cfg.Chain == nil || s.sync.handleBlock(p, block) {
+		return
+	}
+
+	err := s.cfg.Chain.AddBlock(block)
+	switch {
+	case err == nil, errors.Is(err, blockchain.ErrDuplicateBlock):
+		p.updateBestHeight(block.Height)
+	case errors.Is(err, blockchain.ErrOrphanBlock):
+		s.sync.requestSync(p, block.Height)
+	default:
+		s.logf("Rejected block %x from %s: %v", block.Hash, p.addr, err)
+		s.misbehaving(p, err)
+	}
+}
+
+// handleTx offers a transaction received from a peer to the pool and
+// relays it once accepted
+func (s *Server) handleTx(p *Peer, tx *types.Transaction) {
+	iv := InvVect{Type: InvTypeTx, Hash: tx.Hash}
+	p.addKnownInventory(iv)
+	s.finishRequest(p, iv)
+
+	if s.cfg.TxPool == nil {
+		return
+	}
+
+	if err := s.cfg.TxPool.ProcessTransaction(tx); err != nil {
+		s.logf("Rejected transaction %x from %s: %v", tx.Hash, p.addr, err)
+		s.misbehaving(p, err)
+		return
+	}
+	s.AnnounceTransaction(tx.Hash)
+}
+
+// startRequest records that iv is requested from the peer. It returns
+// false if another request for it is still outstanding.
+func (s *Server) startRequest(p *Peer, iv InvVect) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req, ok := s.requested[iv]; ok && time.Since(req.sent) < requestTimeout {
+		return false
+	}
+	s.requested[iv] = pendingRequest{peer: p, sent: time.Now()}
+	return true
+}
+
+// finishRequest clears the outstanding request for iv made to the peer
+func (s *Server) finishRequest(p *Peer, iv InvVect) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req, ok := s.requested[iv]; ok && req.peer == p {
+		delete(s.requested, iv)
+	}
+}
+
+// addKnownInventory marks iv as known to the peer and reports whether it
+// was new
+func (p *Peer) addKnownInventory(iv InvVect) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.knownInventory.has(iv) {
+		return false
+	}
+	p.knownInventory.add(iv)
+	return true
+}
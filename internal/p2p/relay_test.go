@@ -0,0 +1,263 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/miner"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// newTestChain opens a regtest chain in a temporary directory
+func newTestChain(t *testing.T) *blockchain.Chain {
+	t.Helper()
+	chain, err := blockchain.OpenChain(t.TempDir(), blockchain.Options{Params: &chaincfg.RegTestParams})
+	if err != nil {
+		t.Fatalf("OpenChain() error = %v", err)
+	}
+	t.Cleanup(func() { chain.Close() })
+	return chain
+}
+
+// mineBlocks mines n blocks on the tip of the chain
+func mineBlocks(t *testing.T, chain *blockchain.Chain, n int) []*types.Block {
+	t.Helper()
+	return mineBlocksTo(t, chain, n, nil)
+}
+
+// mineBlocksTo mines n blocks on the tip of the chain paying to payTo, so
+// chains mining to different addresses create different blocks
+func mineBlocksTo(t *testing.T, chain *blockchain.Chain, n int, payTo []byte) []*types.Block {
+	t.Helper()
+	var blocks []*types.Block
+	for i := 0; i < n; i++ {
+		tip, err := chain.GetLatestBlock()
+		if err != nil {
+			t.Fatalf("GetLatestBlock() error = %v", err)
+		}
+		bits, err := chain.CalcNextRequiredDifficulty()
+		if err != nil {
+			t.Fatalf("CalcNextRequiredDifficulty() error = %v", err)
+		}
+		mtp, err := chain.MedianTimePast()
+		if err != nil {
+			t.Fatalf("MedianTimePast() error = %v", err)
+		}
+
+		height := tip.Height + 1
+		block := &types.Block{
+			Header: types.BlockHeader{
+				Version:       1,
+				PrevBlockHash: tip.Hash,
+				Timestamp:     mtp.Add(time.Second),
+				Difficulty:    bits,
+			},
+			Transactions: []types.Transaction{types.NewCoinbaseTransaction(height, 0, []types.TransactionOutput{{
+				Amount:        blockchain.CalcBlockSubsidy(chain.Params(), height),
+				PublicKeyHash: payTo,
+			}})},
+			Height: height,
+		}
+		block.UpdateRoots()
+		if _, err := miner.New(miner.Config{Threads: 1}).Solve(context.Background(), block); err != nil {
+			t.Fatalf("Solve() error = %v", err)
+		}
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock() error = %v", err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// connect connects a to b and waits for the handshake
+func connect(t *testing.T, a, b *Server) {
+	t.Helper()
+	before := len(a.Peers())
+	if err := a.Connect(b.Addr().String()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	waitFor(t, "the handshake", func() bool { return len(a.Peers()) > before })
+}
+
+func TestBlockRelay(t *testing.T) {
+	// a - b - c in a line, blocks mined on a must reach c through b
+	chains := []*blockchain.Chain{newTestChain(t), newTestChain(t), newTestChain(t)}
+	servers := make([]*Server, len(chains))
+	for i, chain := range chains {
+		servers[i] = newTestServer(t, &chaincfg.RegTestParams, chain)
+	}
+	connect(t, servers[0], servers[1])
+	connect(t, servers[1], servers[2])
+
+	blocks := mineBlocks(t, chains[0], 3)
+	tip := blocks[len(blocks)-1]
+
+	for i, chain := range chains[1:] {
+		waitFor(t, "the relayed blocks", func() bool { return chain.IsMainChain(tip.Hash) })
+		if got := chain.GetHeight(); got != 3 {
+			t.Errorf("chain %d GetHeight() = %d, want 3", i+1, got)
+		}
+	}
+}
+
+func TestCatchUpOnConnect(t *testing.T) {
+	ahead := newTestChain(t)
+	blocks := mineBlocks(t, ahead, 5)
+	behind := newTestChain(t)
+
+	a := newTestServer(t, &chaincfg.RegTestParams, ahead)
+	b := newTestServer(t, &chaincfg.RegTestParams, behind)
+	connect(t, b, a)
+
+	// The peer ahead is found in the handshake and synced from
+	waitFor(t, "the catch up", func() bool { return behind.IsMainChain(blocks[4].Hash) })
+}
+
+func TestKnownInventory(t *testing.T) {
+	known := newKnownInventory(2)
+	ivs := []InvVect{
+		{Type: InvTypeBlock, Hash: [32]byte{1}},
+		{Type: InvTypeBlock, Hash: [32]byte{2}},
+		{Type: InvTypeBlock, Hash: [32]byte{3}},
+	}
+
+	known.add(ivs[0])
+	known.add(ivs[1])
+	known.add(ivs[1])
+	if !known.has(ivs[0]) || !known.has(ivs[1]) {
+		t.Fatal("has() = false for added vectors")
+	}
+
+	known.add(ivs[2])
+	if known.has(ivs[0]) {
+		t.Error("has() of the oldest vector = true after eviction")
+	}
+	if !known.has(ivs[1]) || !known.has(ivs[2]) {
+		t.Error("has() = false for the newest vectors")
+	}
+	if known.has(InvVect{Type: InvTypeTx, Hash: [32]byte{2}}) {
+		t.Error("has() should distinguish inventory types")
+	}
+}
+
+// mapTxPool is a TxPool accepting every transaction
+type mapTxPool struct {
+	mu  sync.Mutex
+	txs map[[32]byte]*types.Transaction
+}
+
+func newMapTxPool() *mapTxPool {
+	return &mapTxPool{txs: make(map[[32]byte]*types.Transaction)}
+}
+
+func (m *mapTxPool) HaveTransaction(hash [32]byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.txs[hash]
+	return ok
+}
+
+func (m *mapTxPool) FetchTransaction(hash [32]byte) (*types.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx, ok := m.txs[hash]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return tx, nil
+}
+
+func (m *mapTxPool) ProcessTransaction(tx *types.Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.txs[tx.Hash] = tx
+	return nil
+}
+
+func TestTransactionRelay(t *testing.T) {
+	pools := []*mapTxPool{newMapTxPool(), newMapTxPool(), newMapTxPool()}
+	servers := make([]*Server, len(pools))
+	for i, pool := range pools {
+		s, err := NewServer(Config{
+			Params:     &chaincfg.RegTestParams,
+			ListenAddr: "127.0.0.1:0",
+			TxPool:     pool,
+			Logger:     log.New(io.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatalf("NewServer() error = %v", err)
+		}
+		if err := s.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		t.Cleanup(s.Stop)
+		servers[i] = s
+	}
+	connect(t, servers[0], servers[1])
+	connect(t, servers[1], servers[2])
+
+	tx := types.NewCoinbaseTransaction(1, 0, nil)
+	pools[0].ProcessTransaction(&tx)
+	servers[0].AnnounceTransaction(tx.Hash)
+
+	waitFor(t, "the relayed transaction", func() bool { return pools[2].HaveTransaction(tx.Hash) })
+}
+
+func TestRelayDropsStalledPeer(t *testing.T) {
+	chain := newTestChain(t)
+
+	// The peer is dialed over a pipe, whose writes wait for the other end
+	// to read
+	conns := make(chan net.Conn, 1)
+	s, err := NewServer(Config{
+		Params: &chaincfg.RegTestParams,
+		Chain:  chain,
+		Dial: func(network, address string) (net.Conn, error) {
+			local, remote := net.Pipe()
+			conns <- remote
+			return local, nil
+		},
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+	if err := s.Connect("stalled:1"); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	conn := <-conns
+	defer conn.Close()
+	net := chaincfg.RegTestParams.Net
+	if _, err := ReadMessage(conn, net); err != nil {
+		t.Fatalf("ReadMessage() of version error = %v", err)
+	}
+	if err := WriteMessage(conn, net, &MsgVersion{ProtocolVersion: ProtocolVersion, Nonce: 1}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if err := WriteMessage(conn, net, &MsgVerAck{}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	waitFor(t, "the handshake", func() bool { return len(s.Peers()) == 1 })
+
+	// The peer reads nothing more, yet the chain keeps accepting blocks
+	start := time.Now()
+	mineBlocks(t, chain, 3*(sendQueueSize+blockRelayQueueSize))
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("mining took %v with a peer that doesn't read", elapsed)
+	}
+	waitFor(t, "the stalled peer to be dropped", func() bool { return len(s.Peers()) == 0 })
+}
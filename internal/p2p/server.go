@@ -0,0 +1,507 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+)
+
+const (
+	// defaultMaxInbound and defaultMaxOutbound are the connection limits
+	// used when the config leaves them unset
+	defaultMaxInbound  = 32
+	defaultMaxOutbound = 8
+
+	// maxPendingPerHost limits the inbound connections of a host that are
+	// still in the handshake, so one host can't take every inbound slot
+	maxPendingPerHost = 4
+
+	// DefaultUserAgent identifies this implementation in version messages
+	DefaultUserAgent = "/mini-blockchain:0.1.0/"
+)
+
+// Redial backoff of persistent outbound connections, variables so tests
+// can shorten them
+var (
+	minRetryInterval = 5 * time.Second
+	maxRetryInterval = 5 * time.Minute
+)
+
+var (
+	// ErrServerStopped is returned when using a stopped server
+	ErrServerStopped = errors.New("server stopped")
+
+	// ErrTooManyPeers is returned when a connection limit is reached
+	ErrTooManyPeers = errors.New("too many peers")
+
+	// ErrTooManyPending is returned when a host has too many inbound
+	// connections in the handshake
+	ErrTooManyPending = errors.New("too many pending connections from host")
+
+	// ErrAlreadyConnecting is returned when connecting to an address twice
+	ErrAlreadyConnecting = errors.New("already connecting to address")
+
+	// ErrBanned is returned when connecting to a banned host
+	ErrBanned = errors.New("host is banned")
+
+	// ErrLowWorkHeaders is returned for a header chain that ends without
+	// more work than the best chain
+	ErrLowWorkHeaders = errors.New("header chain has no more work than the best chain")
+
+	errSelfConnection  = errors.New("connected to self")
+	errProtocolVersion = errors.New("protocol version too old")
+)
+
+// Config configures a Server
+type Config struct {
+	// Params selects the network, its magic is checked on every message
+	Params *chaincfg.Params
+
+	// ListenAddr is the address to accept peers on, empty disables inbound
+	// connections
+	ListenAddr string
+
+	// MaxInbound and MaxOutbound limit the number of connections
+	MaxInbound  int
+	MaxOutbound int
+
+	// UserAgent is announced in version messages
+	UserAgent string
+
+	// Chain is the chain whose blocks are relayed and which received
+	// blocks are added to, nil disables block relay
+	Chain *blockchain.Chain
+
+	// TxPool receives relayed transactions, nil disables transaction relay
+	TxPool TxPool
+
+	// AddrManager stores the addresses learned from peers and picks
+	// outbound peers from them, nil disables address discovery
+	AddrManager *AddrManager
+
+	// Seeds are host:port addresses added to the address manager on start
+	Seeds []string
+
+	// BanList keeps banned hosts from connecting, nil only disconnects
+	// misbehaving peers
+	BanList *BanList
+
+	// BanThreshold is the misbehavior score at which a peer is banned and
+	// BanDuration how long its host stays banned
+	BanThreshold int
+	BanDuration  time.Duration
+
+	// Listen and Dial create connections, they default to the net package
+	// and can be replaced to run peers over another transport
+	Listen func(network, address string) (net.Listener, error)
+	Dial   func(network, address string) (net.Conn, error)
+
+	// Logger receives connection events, defaults to the standard logger
+	Logger *log.Logger
+}
+
+// Server manages the connections to other nodes
+type Server struct {
+	cfg   Config
+	net   uint32
+	nonce uint64
+
+	listener net.Listener
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	mu         sync.Mutex
+	peers      map[*Peer]struct{}
+	inbound    int                // Inbound connections, handshaking or not
+	pending    map[*Peer]struct{} // Inbound peers in the handshake
+	persistent map[string]struct{}
+	outbound   map[string]struct{} // Addresses dialed from the address manager
+	// dialedFrom maps the local address of connections dialed from the
+	// address manager to the dialed address, to recognize our own
+	dialedFrom map[string]string
+	requested  map[InvVect]pendingRequest
+	stopped    bool
+
+	// sync downloads the chain from peers, nil without a chain
+	sync *syncManager
+
+	// chainSub delivers the blocks connected to the chain for relay,
+	// blockRelay queues them for blockRelayLoop
+	chainSub   *blockchain.Subscription
+	blockRelay chan [32]byte
+}
+
+// NewServer creates a server, Start must be called to accept connections
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Params == nil {
+		return nil, errors.New("network params are required")
+	}
+	if cfg.MaxInbound <= 0 {
+		cfg.MaxInbound = defaultMaxInbound
+	}
+	if cfg.MaxOutbound <= 0 {
+		cfg.MaxOutbound = defaultMaxOutbound
+	}
+	if cfg.BanThreshold <= 0 {
+		cfg.BanThreshold = DefaultBanThreshold
+	}
+	if cfg.BanDuration <= 0 {
+		cfg.BanDuration = DefaultBanDuration
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent
+	}
+	if cfg.Listen == nil {
+		cfg.Listen = net.Listen
+	}
+	if cfg.Dial == nil {
+		cfg.Dial = func(network, address string) (net.Conn, error) {
+			return net.DialTimeout(network, address, handshakeTimeout)
+		}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+
+	s := &Server{
+		cfg:        cfg,
+		net:        cfg.Params.Net,
+		nonce:      rand.Uint64(),
+		quit:       make(chan struct{}),
+		peers:      make(map[*Peer]struct{}),
+		pending:    make(map[*Peer]struct{}),
+		persistent: make(map[string]struct{}),
+		outbound:   make(map[string]struct{}),
+		dialedFrom: make(map[string]string),
+		requested:  make(map[InvVect]pendingRequest),
+		blockRelay: make(chan [32]byte, blockRelayQueueSize),
+	}
+	if cfg.Chain != nil {
+		s.sync = newSyncManager(s)
+	}
+	return s, nil
+}
+
+// Start accepts inbound connections if a listen address is set, and
+// begins syncing and relaying chain updates and connecting to known
+// addresses
+func (s *Server) Start() error {
+	if s.cfg.ListenAddr != "" {
+		listener, err := s.cfg.Listen("tcp", s.cfg.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", s.cfg.ListenAddr, err)
+		}
+		s.listener = listener
+
+		s.wg.Add(1)
+		go s.acceptLoop()
+	}
+
+	if s.cfg.Chain != nil {
+		s.chainSub = s.cfg.Chain.Observe(blockchain.ObserverFuncs{OnBlockConnected: s.handleBlockConnected}, blockchain.SubscribeOptions{})
+		s.wg.Add(2)
+		go s.sync.run()
+		go s.blockRelayLoop()
+	}
+	if s.cfg.AddrManager != nil {
+		for _, seed := range s.cfg.Seeds {
+			s.cfg.AddrManager.AddAddress(seed, seedSource, time.Now())
+		}
+		s.wg.Add(1)
+		go s.addrLoop()
+	}
+	return nil
+}
+
+// Addr returns the address the server listens on, or nil if it doesn't
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop closes the listener, disconnects all peers and waits for their
+// goroutines to exit
+func (s *Server) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.quit)
+	for p := range s.peers {
+		p.Disconnect()
+	}
+	for p := range s.pending {
+		p.Disconnect()
+	}
+	s.mu.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.chainSub != nil {
+		s.chainSub.Cancel()
+	}
+	s.wg.Wait()
+}
+
+// Connect keeps an outbound connection to addr, redialing with backoff
+// whenever it fails or drops, until the server stops
+func (s *Server) Connect(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrServerStopped
+	}
+	if _, ok := s.persistent[addr]; ok {
+		return fmt.Errorf("%s: %w", addr, ErrAlreadyConnecting)
+	}
+	if len(s.persistent) >= s.cfg.MaxOutbound {
+		return fmt.Errorf("%d outbound: %w", len(s.persistent), ErrTooManyPeers)
+	}
+	s.persistent[addr] = struct{}{}
+
+	s.wg.Add(1)
+	go s.connectLoop(addr)
+	return nil
+}
+
+// Peers returns the peers that completed the handshake
+func (s *Server) Peers() []PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]PeerInfo, 0, len(s.peers))
+	for p := range s.peers {
+		infos = append(infos, p.Info())
+	}
+	return infos
+}
+
+// connectedPeers returns the peers that completed the handshake
+func (s *Server) connectedPeers() []*Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]*Peer, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// connectLoop dials addr until the server stops
+func (s *Server) connectLoop(addr string) {
+	defer s.wg.Done()
+
+	retry := minRetryInterval
+	for {
+		conn, err := s.dial(addr)
+		if err != nil {
+			s.logf("Failed to connect to %s: %v", addr, err)
+		} else {
+			p := newPeer(s, conn, addr, false)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				p.run()
+			}()
+
+			select {
+			case <-p.Done():
+			case <-s.quit:
+				return
+			}
+
+			// Reset the backoff after a connection that got through the handshake
+			if !p.Info().ConnectedAt.IsZero() {
+				retry = minRetryInterval
+			}
+		}
+
+		select {
+		case <-time.After(retry):
+		case <-s.quit:
+			return
+		}
+		retry = min(2*retry, maxRetryInterval)
+	}
+}
+
+// dial connects to addr unless its host is banned
+func (s *Server) dial(addr string) (net.Conn, error) {
+	if s.isBanned(addr) {
+		return nil, ErrBanned
+	}
+	return s.cfg.Dial("tcp", addr)
+}
+
+// acceptLoop accepts inbound connections until the listener is closed
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			s.logf("Failed to accept connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if s.isBanned(conn.RemoteAddr().String()) {
+			s.logf("Rejecting %s: %v", conn.RemoteAddr(), ErrBanned)
+			conn.Close()
+			continue
+		}
+
+		p := newPeer(s, conn, conn.RemoteAddr().String(), true)
+		if err := s.reserveInbound(p); err != nil {
+			s.logf("Rejecting %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.releaseInbound(p)
+			p.run()
+		}()
+	}
+}
+
+// reserveInbound takes an inbound slot for a new connection before its
+// handshake, so connections that never finish it count against the limit
+func (s *Server) reserveInbound(p *Peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inbound >= s.cfg.MaxInbound {
+		return ErrTooManyPeers
+	}
+	host := hostOf(p.addr)
+	pending := 0
+	for other := range s.pending {
+		if hostOf(other.addr) == host {
+			pending++
+		}
+	}
+	if pending >= maxPendingPerHost {
+		return ErrTooManyPending
+	}
+	s.inbound++
+	s.pending[p] = struct{}{}
+	return nil
+}
+
+// releaseInbound frees the slot of an inbound connection once it closed,
+// whether its handshake completed or failed
+func (s *Server) releaseInbound(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inbound--
+	delete(s.pending, p)
+}
+
+// addPeer registers a peer that completed the handshake and syncs from it
+// if it is ahead
+func (s *Server) addPeer(p *Peer) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return ErrServerStopped
+	}
+	s.peers[p] = struct{}{}
+	delete(s.pending, p)
+	s.mu.Unlock()
+
+	s.logf("Connected to %s (inbound: %v)", p.addr, p.inbound)
+	if s.sync != nil {
+		s.sync.peerConnected(p)
+	}
+	return nil
+}
+
+// removePeer unregisters a disconnected peer and forgets its outstanding
+// requests so they can be made to other peers
+func (s *Server) removePeer(p *Peer) {
+	s.mu.Lock()
+	delete(s.peers, p)
+	for iv, req := range s.requested {
+		if req.peer == p {
+			delete(s.requested, iv)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.sync != nil {
+		s.sync.peerDisconnected(p)
+	}
+}
+
+// versionMessage returns the version message announcing this node
+func (s *Server) versionMessage() *MsgVersion {
+	return &MsgVersion{
+		ProtocolVersion: ProtocolVersion,
+		Timestamp:       time.Now().Unix(),
+		Nonce:           s.nonce,
+		UserAgent:       s.cfg.UserAgent,
+		BestHeight:      s.bestHeight(),
+	}
+}
+
+// bestHeight returns the height of the chain, or 0 without one
+func (s *Server) bestHeight() uint64 {
+	if s.cfg.Chain == nil {
+		return 0
+	}
+	return s.cfg.Chain.GetHeight()
+}
+
+// announceTip announces the tip of the chain to a new peer, so it fetches
+// the blocks it misses
+func (s *Server) announceTip(p *Peer) {
+	if s.cfg.Chain == nil {
+		return
+	}
+	tip, err := s.cfg.Chain.GetLatestBlock()
+	if err != nil {
+		return
+	}
+	iv := InvVect{Type: InvTypeBlock, Hash: tip.Hash}
+	if p.addKnownInventory(iv) {
+		p.QueueMessage(&MsgInv{invList{InvList: []InvVect{iv}}})
+	}
+}
+
+// checkVersion checks whether the peer announcing msg can be served
+func (s *Server) checkVersion(msg *MsgVersion) error {
+	if msg.Nonce == s.nonce {
+		return errSelfConnection
+	}
+	if msg.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("%w: %d", errProtocolVersion, msg.ProtocolVersion)
+	}
+	return nil
+}
+
+// logf writes a connection event to the configured logger
+func (s *Server) logf(format string, args ...any) {
+	s.cfg.Logger.Printf(format, args...)
+}
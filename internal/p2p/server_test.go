@@ -0,0 +1,213 @@
+package p2p
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+)
+
+// newTestServer starts a server listening on a random local port, chain
+// may be nil
+func newTestServer(t *testing.T, params *chaincfg.Params, chain *blockchain.Chain) *Server {
+	t.Helper()
+	s, err := NewServer(Config{
+		Params:     params,
+		ListenAddr: "127.0.0.1:0",
+		Chain:      chain,
+		Logger:     log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	chainA := newTestChain(t)
+	chainB := newTestChain(t)
+	mineBlocks(t, chainA, 1)
+	mineBlocks(t, chainB, 2)
+
+	a := newTestServer(t, &chaincfg.RegTestParams, chainA)
+	b := newTestServer(t, &chaincfg.RegTestParams, chainB)
+
+	if err := a.Connect(b.Addr().String()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if err := a.Connect(b.Addr().String()); err == nil {
+		t.Error("Connect() twice to the same address should fail")
+	}
+
+	waitFor(t, "both peers", func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 })
+
+	out := a.Peers()[0]
+	if out.Inbound || out.BestHeight != 2 || out.UserAgent != DefaultUserAgent || out.ProtocolVersion != ProtocolVersion {
+		t.Errorf("outbound peer = %+v", out)
+	}
+	in := b.Peers()[0]
+	if !in.Inbound || in.BestHeight != 1 {
+		t.Errorf("inbound peer = %+v", in)
+	}
+}
+
+func TestServerRejectsOtherNetwork(t *testing.T) {
+	a := newTestServer(t, &chaincfg.RegTestParams, nil)
+	b := newTestServer(t, &chaincfg.TestNetParams, nil)
+
+	if err := a.Connect(b.Addr().String()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if len(a.Peers()) != 0 || len(b.Peers()) != 0 {
+		t.Errorf("Peers() = %v, %v, want none", a.Peers(), b.Peers())
+	}
+}
+
+func TestServerRejectsSelfConnection(t *testing.T) {
+	a := newTestServer(t, &chaincfg.RegTestParams, nil)
+
+	if err := a.Connect(a.Addr().String()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if peers := a.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() = %v, want none", peers)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	interval := pingInterval
+	pingInterval = 20 * time.Millisecond
+	t.Cleanup(func() { pingInterval = interval })
+
+	a := newTestServer(t, &chaincfg.RegTestParams, nil)
+	b := newTestServer(t, &chaincfg.RegTestParams, nil)
+	if err := a.Connect(b.Addr().String()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	waitFor(t, "a ping round trip", func() bool {
+		peers := a.Peers()
+		return len(peers) == 1 && peers[0].PingTime > 0
+	})
+}
+
+func TestPingTimeout(t *testing.T) {
+	interval, timeout := pingInterval, pingTimeout
+	pingInterval, pingTimeout = 20*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { pingInterval, pingTimeout = interval, timeout })
+
+	a := newTestServer(t, &chaincfg.RegTestParams, nil)
+
+	// A raw connection that completes the handshake but never answers pings
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	net := chaincfg.RegTestParams.Net
+	if err := WriteMessage(conn, net, &MsgVersion{ProtocolVersion: ProtocolVersion, Nonce: 1}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if err := WriteMessage(conn, net, &MsgVerAck{}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	// Read until the server gives up on the connection
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := ReadMessage(conn, net); err != nil {
+			break
+		}
+	}
+	waitFor(t, "peer removal", func() bool { return len(a.Peers()) == 0 })
+}
+
+func TestServerReconnects(t *testing.T) {
+	retry := minRetryInterval
+	minRetryInterval = 20 * time.Millisecond
+	t.Cleanup(func() { minRetryInterval = retry })
+
+	a := newTestServer(t, &chaincfg.RegTestParams, nil)
+	b := newTestServer(t, &chaincfg.RegTestParams, nil)
+	if err := a.Connect(b.Addr().String()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	waitFor(t, "the first connection", func() bool { return len(b.Peers()) == 1 })
+
+	// Drop the connection from b's side, a redials
+	b.mu.Lock()
+	for p := range b.peers {
+		p.Disconnect()
+	}
+	b.mu.Unlock()
+
+	waitFor(t, "the drop", func() bool { return len(a.Peers()) == 0 })
+	waitFor(t, "the reconnection", func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 })
+}
+
+func TestServerLimitsPendingInbound(t *testing.T) {
+	s := newTestServer(t, &chaincfg.RegTestParams, nil)
+	counts := func() (inbound, pending int) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.inbound, len(s.pending)
+	}
+
+	// Connections that never send a version hold their slots
+	var idle []net.Conn
+	for i := 0; i < maxPendingPerHost; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+		idle = append(idle, conn)
+	}
+	waitFor(t, "pending connections", func() bool {
+		inbound, pending := counts()
+		return inbound == maxPendingPerHost && pending == maxPendingPerHost
+	})
+
+	// One more from the same host is turned away
+	extra, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, extra); err != nil {
+		t.Errorf("connection over the pending limit not closed: %v", err)
+	}
+
+	// Closing a connection before its handshake frees its slot
+	idle[0].Close()
+	waitFor(t, "released slot", func() bool {
+		inbound, pending := counts()
+		return inbound == maxPendingPerHost-1 && pending == maxPendingPerHost-1
+	})
+}
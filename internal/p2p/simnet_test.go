@@ -0,0 +1,164 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/simnet"
+)
+
+// simNode is a chain and its server on a simulated network
+type simNode struct {
+	host   string
+	chain  *blockchain.Chain
+	server *Server
+}
+
+// newSimNetwork starts n regtest nodes on an in-memory network, at hosts
+// 10.0.0.1 upwards. Timeouts and the redial backoff are shortened so the
+// nodes recover quickly from lost messages and partitions.
+func newSimNetwork(t *testing.T, n int) (*simnet.Network, []*simNode) {
+	t.Helper()
+	minRetry, maxRetry, request, tick, handshake := minRetryInterval, maxRetryInterval, requestTimeout, syncTickInterval, handshakeTimeout
+	minRetryInterval, maxRetryInterval = 20*time.Millisecond, 100*time.Millisecond
+	requestTimeout, syncTickInterval, handshakeTimeout = 300*time.Millisecond, 50*time.Millisecond, time.Second
+	t.Cleanup(func() {
+		minRetryInterval, maxRetryInterval = minRetry, maxRetry
+		requestTimeout, syncTickInterval, handshakeTimeout = request, tick, handshake
+	})
+
+	network := simnet.New(1)
+	port := strconv.Itoa(int(chaincfg.RegTestParams.DefaultPort))
+	nodes := make([]*simNode, n)
+	for i := range nodes {
+		ip := fmt.Sprintf("10.0.0.%d", i+1)
+		host := network.Host(ip)
+		chain := newTestChain(t)
+		s, err := NewServer(Config{
+			Params:     &chaincfg.RegTestParams,
+			ListenAddr: net.JoinHostPort(ip, port),
+			Chain:      chain,
+			Listen:     host.Listen,
+			Dial:       host.Dial,
+			Logger:     log.New(io.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatalf("NewServer() error = %v", err)
+		}
+		if err := s.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		t.Cleanup(s.Stop)
+		nodes[i] = &simNode{host: ip, chain: chain, server: s}
+	}
+	return network, nodes
+}
+
+// waitForTip waits until every node has hash as the tip of its chain
+func waitForTip(t *testing.T, nodes []*simNode, hash [32]byte) {
+	t.Helper()
+	for _, node := range nodes {
+		waitFor(t, fmt.Sprintf("%s to reach %x", node.host, hash[:4]), func() bool {
+			tip, err := node.chain.GetLatestBlock()
+			return err == nil && tip.Hash == hash
+		})
+	}
+}
+
+// waitForPeers waits until every node has count peers
+func waitForPeers(t *testing.T, nodes []*simNode, count int) {
+	t.Helper()
+	for _, node := range nodes {
+		waitFor(t, fmt.Sprintf("%s to have %d peers", node.host, count), func() bool {
+			return len(node.server.Peers()) == count
+		})
+	}
+}
+
+func TestSimForkResolution(t *testing.T) {
+	network, nodes := newSimNetwork(t, 4)
+	for i, node := range nodes {
+		connect(t, node.server, nodes[(i+1)%len(nodes)].server)
+	}
+	common := mineBlocks(t, nodes[0].chain, 2)
+	waitForTip(t, nodes, common[1].Hash)
+
+	// Each half of the ring mines its own branch, the right one is longer
+	left, right := nodes[:2], nodes[2:]
+	network.Partition([]string{left[0].host, left[1].host}, []string{right[0].host, right[1].host})
+	waitForPeers(t, nodes, 1)
+
+	leftBlocks := mineBlocksTo(t, left[0].chain, 2, []byte{1})
+	rightBlocks := mineBlocksTo(t, right[0].chain, 3, []byte{2})
+	waitForTip(t, left, leftBlocks[1].Hash)
+	waitForTip(t, right, rightBlocks[2].Hash)
+
+	// After healing the left half reorganizes to the branch with more work
+	network.Heal()
+	waitForPeers(t, nodes, 2)
+	waitForTip(t, nodes, rightBlocks[2].Hash)
+	if height := left[0].chain.GetHeight(); height != 5 {
+		t.Errorf("GetHeight() = %d after the reorganization, want 5", height)
+	}
+	if left[0].chain.IsMainChain(leftBlocks[0].Hash) {
+		t.Error("IsMainChain() = true for a block of the losing branch")
+	}
+}
+
+func TestSimPropagation(t *testing.T) {
+	network, nodes := newSimNetwork(t, 5)
+	for i := 1; i < len(nodes); i++ {
+		connect(t, nodes[i-1].server, nodes[i].server)
+	}
+
+	// Blocks cross the line of nodes hop by hop
+	network.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	blocks := mineBlocks(t, nodes[0].chain, 3)
+	waitForTip(t, nodes, blocks[2].Hash)
+	if elapsed := time.Since(start); elapsed < 4*20*time.Millisecond {
+		t.Errorf("blocks crossed 4 hops in %v, want at least 4 latencies", elapsed)
+	}
+
+	// Announcements lost on the way are caught up with the next block. The
+	// seed fixes which drop decisions come up, not which messages they hit,
+	// so the test only relies on some writes being lost.
+	network.SetLoss(0.3)
+	lossy := mineBlocksTo(t, nodes[4].chain, 3, []byte{1})
+	waitFor(t, "writes to be dropped", func() bool { return network.Dropped() > 0 })
+	network.SetLoss(0)
+	more := mineBlocksTo(t, nodes[4].chain, 1, []byte{1})
+	waitForTip(t, nodes, more[0].Hash)
+	for _, node := range nodes {
+		for _, block := range lossy {
+			if !node.chain.IsMainChain(block.Hash) {
+				t.Errorf("%s misses block %x mined during the loss", node.host, block.Hash[:4])
+			}
+		}
+	}
+}
+
+func TestSimCatchUpAfterPartition(t *testing.T) {
+	network, nodes := newSimNetwork(t, 3)
+	late := nodes[2]
+	connect(t, late.server, nodes[0].server)
+	connect(t, late.server, nodes[1].server)
+	connect(t, nodes[0].server, nodes[1].server)
+
+	network.Partition([]string{late.host})
+	waitFor(t, "the partition", func() bool { return len(late.server.Peers()) == 0 })
+	blocks := mineBlocks(t, nodes[0].chain, 30)
+	waitForTip(t, nodes[:2], blocks[29].Hash)
+
+	// The cut off node syncs the blocks it missed from both peers
+	network.Heal()
+	waitForTip(t, nodes, blocks[29].Hash)
+	waitFor(t, "the sync to end", func() bool { return !late.server.SyncProgress().Syncing })
+}
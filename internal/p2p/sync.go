@@ -0,0 +1,534 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+const (
+	// downloadWindow bounds how far past the next block to connect bodies
+	// are requested, so a slow peer can't make us buffer the whole chain
+	downloadWindow = 1024
+
+	// maxBlocksInFlight is the most block requests outstanding per peer
+	maxBlocksInFlight = 16
+)
+
+// syncTickInterval is how often the sync manager looks for stalled
+// requests and peers to sync from, a variable so tests can shorten it
+var syncTickInterval = time.Second
+
+// SyncProgress reports the state of the initial block download
+type SyncProgress struct {
+	Syncing      bool   `json:"syncing"`
+	SyncPeer     string `json:"sync_peer,omitempty"`
+	PeerHeight   uint64 `json:"peer_height"`   // Best height announced by the sync peer
+	HeaderHeight uint64 `json:"header_height"` // Height of the last validated header
+	BlockHeight  uint64 `json:"block_height"`  // Height of the best chain
+	InFlight     int    `json:"in_flight"`     // Block bodies requested but not received
+}
+
+// syncBlock is a block of the header chain being downloaded
+type syncBlock struct {
+	hash  [32]byte
+	peer  *Peer // Peer the body was requested from or received from
+	sent  time.Time
+	block *types.Block
+	skip  *Peer // Peer that answered the request with notfound
+}
+
+// syncManager downloads the chain headers first. It fetches the header
+// chain of one sync peer and validates it, then downloads the block bodies
+// in parallel from every peer that has them and connects them in order.
+type syncManager struct {
+	server *Server
+	chain  *blockchain.Chain
+
+	// connectMu serializes connecting downloaded blocks, so they reach the
+	// chain in order even when they arrive from several peers at once
+	connectMu sync.Mutex
+
+	mu       sync.Mutex
+	syncPeer *Peer
+	headers  *blockchain.HeaderChain
+	// headersSent is when the outstanding getheaders was sent, zero once
+	// the sync peer has no more headers
+	headersSent time.Time
+	nextConnect uint64
+	blocks      map[uint64]*syncBlock
+	byHash      map[[32]byte]uint64
+	// exhausted holds the peers a sync ended with, they are only synced
+	// from again after announcing a new block
+	exhausted map[*Peer]struct{}
+}
+
+// outMsg is a message queued once the sync manager's lock is released,
+// so a peer with a full send queue never blocks the others
+type outMsg struct {
+	peer *Peer
+	msg  Message
+}
+
+// newSyncManager creates the sync manager of a server with a chain
+func newSyncManager(s *Server) *syncManager {
+	return &syncManager{
+		server:    s,
+		chain:     s.cfg.Chain,
+		blocks:    make(map[uint64]*syncBlock),
+		byHash:    make(map[[32]byte]uint64),
+		exhausted: make(map[*Peer]struct{}),
+	}
+}
+
+// send queues the messages collected under the lock
+func send(msgs []outMsg) {
+	for _, m := range msgs {
+		m.peer.QueueMessage(m.msg)
+	}
+}
+
+// run checks for stalled requests until the server stops
+func (m *syncManager) run() {
+	defer m.server.wg.Done()
+
+	ticker := time.NewTicker(syncTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.tick()
+		case <-m.server.quit:
+			return
+		}
+	}
+}
+
+// tick drops a stalled sync peer, re-requests timed out bodies and starts
+// syncing when a peer is ahead
+func (m *syncManager) tick() {
+	m.mu.Lock()
+	if m.syncPeer != nil && !m.headersSent.IsZero() && time.Since(m.headersSent) > requestTimeout {
+		stalled := m.syncPeer
+		m.mu.Unlock()
+		m.server.logf("Disconnecting %s: headers request timed out", stalled.addr)
+		stalled.Disconnect()
+		return
+	}
+	for _, sb := range m.blocks {
+		if sb.block == nil && sb.peer != nil && time.Since(sb.sent) > requestTimeout {
+			sb.peer = nil
+		}
+	}
+	if m.headers != nil && m.headersSent.IsZero() && !m.done() && !m.chain.HasMoreWork(m.headers) {
+		// The best chain overtook the downloaded headers
+		if m.syncPeer != nil {
+			m.exhausted[m.syncPeer] = struct{}{}
+		}
+		m.reset()
+	}
+	msgs := m.fillRequests()
+	msgs = append(msgs, m.maybeStartSync()...)
+	m.mu.Unlock()
+
+	send(msgs)
+}
+
+// isSyncing reports whether a header chain is being downloaded
+func (m *syncManager) isSyncing() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.syncPeer != nil || m.headers != nil
+}
+
+// peerConnected starts syncing from a new peer if it is ahead of us
+func (m *syncManager) peerConnected(p *Peer) {
+	m.mu.Lock()
+	msgs := m.maybeStartSync()
+	msgs = append(msgs, m.fillRequests()...)
+	m.mu.Unlock()
+
+	send(msgs)
+}
+
+// peerDisconnected re-requests the bodies a peer did not deliver. Losing
+// the sync peer ends the header download, the headers already validated
+// are still downloaded from the other peers.
+func (m *syncManager) peerDisconnected(p *Peer) {
+	m.mu.Lock()
+	delete(m.exhausted, p)
+	for _, sb := range m.blocks {
+		if sb.block == nil && sb.peer == p {
+			sb.peer = nil
+		}
+		if sb.skip == p {
+			sb.skip = nil
+		}
+	}
+
+	var msgs []outMsg
+	if p == m.syncPeer {
+		m.syncPeer = nil
+		m.headersSent = time.Time{}
+		if m.headers == nil || m.done() {
+			m.reset()
+			msgs = m.maybeStartSync()
+		}
+	}
+	msgs = append(msgs, m.fillRequests()...)
+	m.mu.Unlock()
+
+	send(msgs)
+}
+
+// requestSync is called for blocks and announcements we can't connect,
+// it syncs from the peer if we are not syncing already
+func (m *syncManager) requestSync(p *Peer, height uint64) {
+	p.updateBestHeight(height)
+
+	m.mu.Lock()
+	delete(m.exhausted, p)
+	msgs := m.maybeStartSync()
+	m.mu.Unlock()
+
+	send(msgs)
+}
+
+// peerHasNewBlocks lets a peer that ended a sync be synced from again
+func (m *syncManager) peerHasNewBlocks(p *Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.exhausted, p)
+}
+
+// maybeStartSync picks the peer with the highest chain above ours as sync
+// peer and requests its headers, the caller must hold the lock
+func (m *syncManager) maybeStartSync() []outMsg {
+	if m.syncPeer != nil || m.headers != nil {
+		return nil
+	}
+
+	height := m.chain.GetHeight()
+	var best *Peer
+	for _, p := range m.server.connectedPeers() {
+		if _, ok := m.exhausted[p]; ok {
+			continue
+		}
+		if peerHeight := p.BestHeight(); peerHeight > height && (best == nil || peerHeight > best.BestHeight()) {
+			best = p
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	m.server.logf("Syncing headers from %s at height %d", best.addr, best.BestHeight())
+	m.syncPeer = best
+	m.headersSent = time.Now()
+	return []outMsg{{best, &MsgGetHeaders{Locator: m.chain.BlockLocator()}}}
+}
+
+// handleHeaders validates headers sent by the sync peer and requests the
+// next batch and the new block bodies
+func (m *syncManager) handleHeaders(p *Peer, msg *MsgHeaders) {
+	m.mu.Lock()
+	if p != m.syncPeer || m.headersSent.IsZero() {
+		// Unsolicited, the peer may announce blocks with headers
+		m.mu.Unlock()
+		return
+	}
+
+	if err := m.addHeaders(msg.Headers); err != nil {
+		m.mu.Unlock()
+		m.server.logf("Disconnecting %s: invalid headers: %v", p.addr, err)
+		m.server.misbehaving(p, err)
+		p.Disconnect()
+		return
+	}
+
+	var msgs []outMsg
+	if m.headers != nil {
+		p.updateBestHeight(m.headers.Height())
+	}
+	if len(msg.Headers) == MaxHeadersPerMsg {
+		m.headersSent = time.Now()
+		msgs = append(msgs, outMsg{p, &MsgGetHeaders{Locator: m.headers.Locator()}})
+	} else {
+		m.headersSent = time.Time{}
+	}
+	msgs = append(msgs, m.fillRequests()...)
+	finished := m.headersSent.IsZero() && m.done()
+	if m.headersSent.IsZero() && !finished && !m.chain.HasMoreWork(m.headers) {
+		// The peer claimed to be ahead but its blocks would not become
+		// the best chain, none of them were requested
+		height := m.headers.Height()
+		m.reset()
+		m.mu.Unlock()
+		err := fmt.Errorf("%w, ending at height %d", ErrLowWorkHeaders, height)
+		m.server.logf("Disconnecting %s: %v", p.addr, err)
+		m.server.misbehaving(p, err)
+		p.Disconnect()
+		return
+	}
+	m.mu.Unlock()
+
+	send(msgs)
+	if finished {
+		m.finish()
+	}
+}
+
+// addHeaders extends the header chain, the first batch starts it at the
+// block the sync peer found in our locator. The caller must hold the lock.
+func (m *syncManager) addHeaders(headers []types.BlockHeader) error {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	if m.headers == nil {
+		hc, err := m.chain.NewHeaderChain(headers[0].PrevBlockHash)
+		if err != nil {
+			return err
+		}
+		m.headers = hc
+		m.nextConnect = hc.BaseHeight() + 1
+	}
+	return m.headers.Add(headers)
+}
+
+// done reports whether every block of the header chain was connected, the
+// caller must hold the lock
+func (m *syncManager) done() bool {
+	return m.headers == nil || m.nextConnect > m.headers.Height()
+}
+
+// fillRequests requests the missing bodies within the download window,
+// each from the peer with the fewest requests in flight that has it. No
+// bodies are requested before the headers have more work than the best
+// chain. The caller must hold the lock.
+func (m *syncManager) fillRequests() []outMsg {
+	if m.headers == nil {
+		return nil
+	}
+
+	// Blocks we already have need no download
+	for m.nextConnect <= m.headers.Height() {
+		hash, _ := m.headers.HashAt(m.nextConnect)
+		if _, ok := m.blocks[m.nextConnect]; ok || !m.chain.HaveBlock(hash) {
+			break
+		}
+		m.nextConnect++
+	}
+	if !m.chain.HasMoreWork(m.headers) {
+		return nil
+	}
+
+	inFlight := make(map[*Peer]int)
+	for _, p := range m.server.connectedPeers() {
+		inFlight[p] = 0
+	}
+	for _, sb := range m.blocks {
+		if sb.block == nil && sb.peer != nil {
+			inFlight[sb.peer]++
+		}
+	}
+
+	requests := make(map[*Peer][]InvVect)
+	last := min(m.headers.Height(), m.nextConnect+downloadWindow-1)
+	for height := m.nextConnect; height <= last; height++ {
+		sb, ok := m.blocks[height]
+		if !ok {
+			hash, _ := m.headers.HashAt(height)
+			sb = &syncBlock{hash: hash}
+			m.blocks[height] = sb
+			m.byHash[hash] = height
+		}
+		if sb.block != nil || sb.peer != nil {
+			continue
+		}
+
+		var peer *Peer
+		for p, n := range inFlight {
+			if n >= maxBlocksInFlight || p == sb.skip || p.BestHeight() < height {
+				continue
+			}
+			if peer == nil || n < inFlight[peer] {
+				peer = p
+			}
+		}
+		if peer == nil {
+			continue
+		}
+
+		sb.peer = peer
+		sb.sent = time.Now()
+		inFlight[peer]++
+		requests[peer] = append(requests[peer], InvVect{Type: InvTypeBlock, Hash: sb.hash})
+	}
+
+	var msgs []outMsg
+	for p, ivs := range requests {
+		msgs = append(msgs, outMsg{p, &MsgGetData{invList{InvList: ivs}}})
+	}
+	return msgs
+}
+
+// handleBlock takes a downloaded body of the header chain and connects the
+// blocks that are next in line. It reports false for blocks that are not
+// part of the sync, those are handled as relayed blocks.
+func (m *syncManager) handleBlock(p *Peer, block *types.Block) bool {
+	m.mu.Lock()
+	height, ok := m.byHash[block.Hash]
+	if !ok {
+		m.mu.Unlock()
+		return false
+	}
+	if sb := m.blocks[height]; sb.block == nil {
+		sb.block = block
+		sb.peer = p
+	}
+	m.mu.Unlock()
+
+	m.connectBlocks()
+	return true
+}
+
+// handleNotFound re-requests the bodies a peer doesn't have from others
+func (m *syncManager) handleNotFound(p *Peer, ivs []InvVect) {
+	m.mu.Lock()
+	for _, iv := range ivs {
+		height, ok := m.byHash[iv.Hash]
+		if iv.Type != InvTypeBlock || !ok {
+			continue
+		}
+		if sb := m.blocks[height]; sb.block == nil && sb.peer == p {
+			sb.peer = nil
+			sb.skip = p
+		}
+	}
+	msgs := m.fillRequests()
+	m.mu.Unlock()
+
+	send(msgs)
+}
+
+// connectBlocks adds the downloaded blocks to the chain in order. A block
+// the chain rejects invalidates the rest of the header chain, the peer
+// that sent it is disconnected and the sync starts over.
+func (m *syncManager) connectBlocks() {
+	m.connectMu.Lock()
+	defer m.connectMu.Unlock()
+
+	for {
+		m.mu.Lock()
+		sb := m.blocks[m.nextConnect]
+		if m.headers == nil || sb == nil || sb.block == nil {
+			msgs := m.fillRequests()
+			finished := m.headers != nil && m.headersSent.IsZero() && m.done()
+			m.mu.Unlock()
+
+			send(msgs)
+			if finished {
+				m.finish()
+			}
+			return
+		}
+		delete(m.blocks, m.nextConnect)
+		delete(m.byHash, sb.hash)
+		m.nextConnect++
+		m.mu.Unlock()
+
+		err := m.chain.AddBlock(sb.block)
+		if err != nil && !errors.Is(err, blockchain.ErrDuplicateBlock) {
+			m.server.logf("Disconnecting %s: rejected block %x: %v", sb.peer.addr, sb.hash, err)
+			m.server.misbehaving(sb.peer, err)
+			sb.peer.Disconnect()
+
+			m.mu.Lock()
+			m.reset()
+			m.mu.Unlock()
+			return
+		}
+	}
+}
+
+// finish ends a sync whose blocks are all connected, announces the new tip
+// that wasn't relayed while syncing and syncs from the next peer ahead
+func (m *syncManager) finish() {
+	m.mu.Lock()
+	if !m.done() || !m.headersSent.IsZero() {
+		m.mu.Unlock()
+		return
+	}
+	if m.syncPeer != nil {
+		m.exhausted[m.syncPeer] = struct{}{}
+	}
+	m.reset()
+	msgs := m.maybeStartSync()
+	m.mu.Unlock()
+
+	m.server.logf("Synced to height %d", m.chain.GetHeight())
+	if tip, err := m.chain.GetLatestBlock(); err == nil {
+		m.server.AnnounceBlock(tip.Hash)
+	}
+	send(msgs)
+}
+
+// reset forgets the current sync, the caller must hold the lock
+func (m *syncManager) reset() {
+	m.syncPeer = nil
+	m.headers = nil
+	m.headersSent = time.Time{}
+	m.nextConnect = 0
+	clear(m.blocks)
+	clear(m.byHash)
+}
+
+// progress returns a snapshot of the sync state
+func (m *syncManager) progress() SyncProgress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	progress := SyncProgress{
+		Syncing:     m.syncPeer != nil || m.headers != nil,
+		BlockHeight: m.chain.GetHeight(),
+	}
+	progress.HeaderHeight = progress.BlockHeight
+	if m.syncPeer != nil {
+		progress.SyncPeer = m.syncPeer.addr
+		progress.PeerHeight = m.syncPeer.BestHeight()
+	}
+	if m.headers != nil {
+		progress.HeaderHeight = max(m.headers.Height(), progress.BlockHeight)
+	}
+	for _, sb := range m.blocks {
+		if sb.block == nil && sb.peer != nil {
+			progress.InFlight++
+		}
+	}
+	return progress
+}
+
+// SyncProgress returns the progress of the initial block download
+func (s *Server) SyncProgress() SyncProgress {
+	if s.sync == nil {
+		return SyncProgress{}
+	}
+	return s.sync.progress()
+}
+
+// handleGetHeaders answers a getheaders from the best chain
+func (s *Server) handleGetHeaders(p *Peer, msg *MsgGetHeaders) {
+	if s.cfg.Chain == nil {
+		return
+	}
+	headers := s.cfg.Chain.LocateHeaders(msg.Locator, msg.HashStop, MaxHeadersPerMsg)
+	p.QueueMessage(&MsgHeaders{Headers: headers})
+}
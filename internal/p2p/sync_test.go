@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+func TestHeadersFirstSync(t *testing.T) {
+	// Two peers with the same chain serve the bodies to a new node
+	ahead := newTestChain(t)
+	blocks := mineBlocks(t, ahead, 40)
+	mirror := newTestChain(t)
+	for _, block := range blocks {
+		if err := mirror.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock() error = %v", err)
+		}
+	}
+	behind := newTestChain(t)
+
+	a := newTestServer(t, &chaincfg.RegTestParams, ahead)
+	b := newTestServer(t, &chaincfg.RegTestParams, mirror)
+	c := newTestServer(t, &chaincfg.RegTestParams, behind)
+	connect(t, c, a)
+	connect(t, c, b)
+
+	tip := blocks[len(blocks)-1]
+	waitFor(t, "the sync", func() bool { return behind.IsMainChain(tip.Hash) })
+	waitFor(t, "the sync to end", func() bool { return !c.SyncProgress().Syncing })
+
+	progress := c.SyncProgress()
+	if progress.BlockHeight != 40 || progress.HeaderHeight != 40 || progress.InFlight != 0 {
+		t.Errorf("SyncProgress() = %+v, want blocks and headers at 40", progress)
+	}
+
+	// Blocks mined after the sync are relayed as usual
+	more := mineBlocks(t, ahead, 1)
+	waitFor(t, "the relayed block", func() bool { return behind.IsMainChain(more[0].Hash) })
+}
+
+func TestSyncRejectsInvalidHeaders(t *testing.T) {
+	s := newTestServer(t, &chaincfg.RegTestParams, newTestChain(t))
+
+	// A raw connection claiming a longer chain
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	net := chaincfg.RegTestParams.Net
+	if err := WriteMessage(conn, net, &MsgVersion{ProtocolVersion: ProtocolVersion, Nonce: 1, BestHeight: 10}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if err := WriteMessage(conn, net, &MsgVerAck{}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := ReadMessage(conn, net)
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v before getheaders", err)
+		}
+		getHeaders, ok := msg.(*MsgGetHeaders)
+		if !ok {
+			continue
+		}
+
+		// A header on top of our genesis block without proof of work
+		header := types.BlockHeader{
+			Version:       1,
+			PrevBlockHash: getHeaders.Locator[len(getHeaders.Locator)-1],
+			Timestamp:     time.Now(),
+			Difficulty:    0x1d00ffff,
+		}
+		if err := WriteMessage(conn, net, &MsgHeaders{Headers: []types.BlockHeader{header}}); err != nil {
+			t.Fatalf("WriteMessage() error = %v", err)
+		}
+		break
+	}
+
+	// The server drops the connection
+	for {
+		if _, err := ReadMessage(conn, net); err != nil {
+			break
+		}
+	}
+	waitFor(t, "peer removal", func() bool { return len(s.Peers()) == 0 })
+	if s.SyncProgress().Syncing {
+		t.Error("SyncProgress().Syncing = true after dropping the sync peer")
+	}
+}
+
+func TestSyncRejectsLowerWorkFork(t *testing.T) {
+	ours := newTestChain(t)
+	mineBlocks(t, ours, 5)
+	s := newTestServer(t, &chaincfg.RegTestParams, ours)
+
+	// A valid fork of genesis, shorter than our chain
+	fork := newTestChain(t)
+	forkBlocks := mineBlocksTo(t, fork, 3, make([]byte, 20))
+	headers := make([]types.BlockHeader, len(forkBlocks))
+	for i, block := range forkBlocks {
+		headers[i] = block.Header
+	}
+
+	// A raw connection claiming a longer chain
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	net := chaincfg.RegTestParams.Net
+	if err := WriteMessage(conn, net, &MsgVersion{ProtocolVersion: ProtocolVersion, Nonce: 1, BestHeight: 10}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if err := WriteMessage(conn, net, &MsgVerAck{}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	// The server asks for headers, gets the fork and drops the connection
+	// without asking for a single body
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := ReadMessage(conn, net)
+		if err != nil {
+			break
+		}
+		switch msg := msg.(type) {
+		case *MsgGetHeaders:
+			if err := WriteMessage(conn, net, &MsgHeaders{Headers: headers}); err != nil {
+				t.Fatalf("WriteMessage() error = %v", err)
+			}
+		case *MsgGetData:
+			t.Fatalf("server requested %d bodies of a lower work fork", len(msg.InvList))
+		}
+	}
+	waitFor(t, "peer removal", func() bool { return len(s.Peers()) == 0 })
+	if s.SyncProgress().Syncing {
+		t.Error("SyncProgress().Syncing = true after dropping the sync peer")
+	}
+	if ours.HaveBlock(forkBlocks[0].Hash) {
+		t.Error("block of the lower work fork was stored")
+	}
+}
@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// CookieFile holds the credentials of a running node's server inside
+	// its data directory, as user:password
+	CookieFile = ".cookie"
+
+	// cookieUser is the user name of the credentials in CookieFile
+	cookieUser = "__cookie__"
+)
+
+// WriteCookie creates random credentials and writes them to the data
+// directory, readable by its owner only, for local clients to find
+func WriteCookie(dataDir string) (user, password string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to create RPC credentials: %w", err)
+	}
+	password = hex.EncodeToString(secret)
+
+	// An existing file would keep its permissions
+	path := filepath.Join(dataDir, CookieFile)
+	os.Remove(path)
+	if err := os.WriteFile(path, []byte(cookieUser+":"+password), 0600); err != nil {
+		return "", "", fmt.Errorf("failed to write RPC credentials: %w", err)
+	}
+	return cookieUser, password, nil
+}
+
+// ReadCookie returns the credentials a running node wrote to the data
+// directory
+func ReadCookie(dataDir string) (user, password string, err error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, CookieFile))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read RPC credentials: %w", err)
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return "", "", errors.New("invalid RPC credentials file")
+	}
+	return user, password, nil
+}
+
+// RemoveCookie removes the credentials written by WriteCookie
+func RemoveCookie(dataDir string) error {
+	return os.Remove(filepath.Join(dataDir, CookieFile))
+}
+
+// authorized reports whether a request carries the server's credentials
+func (s *Server) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Both are compared so the time taken doesn't tell which one is wrong
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.Username))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password))
+	return userOK&passwordOK == 1
+}
+
+// isJSON reports whether a request declares a JSON body. Browsers send
+// other types cross-origin without asking first, so they are refused.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
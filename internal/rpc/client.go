@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Client calls the methods of a node's JSON-RPC server
+type Client struct {
+	url      string
+	user     string
+	password string
+	http     *http.Client
+	nextID   atomic.Uint64
+}
+
+// NewClient creates a client for the server at url, like
+// http://127.0.0.1:8332, that authenticates with user and password
+func NewClient(url, user, password string) *Client {
+	return &Client{url: url, user: user, password: password, http: &http.Client{}}
+}
+
+// Call calls method with positional params and decodes its result into
+// result, which may be nil. Errors returned by the server are *Error.
+func (c *Client) Call(ctx context.Context, result any, method string, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal params: %w", err)
+	}
+	id, err := json.Marshal(c.nextID.Add(1))
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&Request{JSONRPC: Version, Method: method, Params: rawParams, ID: id})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.user, c.password)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to call %s: %s: %s", method, resp.Status, bytes.TrimSpace(data))
+	}
+
+	var response Response
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result != nil {
+		if err := json.Unmarshal(response.Result, result); err != nil {
+			return fmt.Errorf("invalid %s result: %w", method, err)
+		}
+	}
+	return nil
+}
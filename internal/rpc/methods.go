@@ -0,0 +1,557 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/mempool"
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// handlers maps method names to their handlers
+var handlers = map[string]handlerFunc{
+	"getblockcount":      (*Server).handleGetBlockCount,
+	"getbestblockhash":   (*Server).handleGetBestBlockHash,
+	"getblock":           (*Server).handleGetBlock,
+	"submitblock":        (*Server).handleSubmitBlock,
+	"sendrawtransaction": (*Server).handleSendRawTransaction,
+	"getrawmempool":      (*Server).handleGetRawMempool,
+	"estimatefee":        (*Server).handleEstimateFee,
+	"generate":           (*Server).handleGenerate,
+	"getblocktemplate":   (*Server).handleGetBlockTemplate,
+	"getsyncprogress":    (*Server).handleGetSyncProgress,
+	"listbanned":         (*Server).handleListBanned,
+	"setban":             (*Server).handleSetBan,
+	"clearbanned":        (*Server).handleClearBanned,
+}
+
+// errNoTxPool is returned by the transaction methods without a pool
+var errNoTxPool = newError(CodeMisc, "transaction pool disabled")
+
+// BlockResult describes a block, hashes are hex encoded
+type BlockResult struct {
+	Hash              string     `json:"hash"`
+	Confirmations     int64      `json:"confirmations"` // -1 off the best chain
+	Height            uint64     `json:"height"`
+	Version           int32      `json:"version"`
+	MerkleRoot        string     `json:"merkleroot"`
+	WitnessRoot       string     `json:"witnessroot"`
+	Time              time.Time  `json:"time"`
+	Bits              string     `json:"bits"`
+	Difficulty        float64    `json:"difficulty"`
+	Nonce             uint32     `json:"nonce"`
+	PreviousBlockHash string     `json:"previousblockhash"`
+	NextBlockHash     string     `json:"nextblockhash,omitempty"`
+	Size              int        `json:"size"`
+	Tx                []TxResult `json:"tx"`
+}
+
+// TxResult describes a transaction
+type TxResult struct {
+	TxID     string           `json:"txid"`
+	Version  uint32           `json:"version"`
+	LockTime uint32           `json:"locktime"`
+	Inputs   []TxInputResult  `json:"vin"`
+	Outputs  []TxOutputResult `json:"vout"`
+}
+
+// TxInputResult describes a transaction input. Coinbase inputs only carry
+// the coinbase data.
+type TxInputResult struct {
+	Coinbase  string `json:"coinbase,omitempty"`
+	TxID      string `json:"txid,omitempty"`
+	Vout      uint32 `json:"vout,omitempty"`
+	PublicKey string `json:"pubkey,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// TxOutputResult describes a transaction output, the address is the hex
+// encoded public key hash
+type TxOutputResult struct {
+	Value   uint64 `json:"value"`
+	N       int    `json:"n"`
+	Address string `json:"address"`
+}
+
+// FeeEstimateResult is a fee rate estimate, the rate is per 1000 bytes
+type FeeEstimateResult struct {
+	FeeRate uint64 `json:"feerate"`
+	Blocks  int    `json:"blocks"` // Target the estimate is for
+	Mode    string `json:"mode"`
+}
+
+// BlockTemplateResult describes a block for external miners to solve,
+// loosely following BIP 22. Miners may replace the coinbase with their own
+// paying up to coinbasevalue, the header then commits to it in both the
+// Merkle root over txids and the witness root over hashes.
+type BlockTemplateResult struct {
+	Version           int32              `json:"version"`
+	PreviousBlockHash string             `json:"previousblockhash"`
+	Height            uint64             `json:"height"`
+	Bits              string             `json:"bits"`
+	Target            string             `json:"target"`
+	CurTime           int64              `json:"curtime"`
+	MinTime           int64              `json:"mintime"`
+	CoinbaseValue     uint64             `json:"coinbasevalue"`
+	CoinbaseTxn       TemplateTxResult   `json:"coinbasetxn"`
+	Transactions      []TemplateTxResult `json:"transactions"`
+	SizeLimit         int                `json:"sizelimit"`
+	SigOpLimit        int                `json:"sigoplimit"`
+}
+
+// BanResult describes a banned host
+type BanResult struct {
+	Address     string    `json:"address"`
+	Reason      string    `json:"reason"`
+	BanCreated  time.Time `json:"ban_created"`
+	BannedUntil time.Time `json:"banned_until"`
+}
+
+// TemplateTxResult describes a transaction of a block template
+type TemplateTxResult struct {
+	Data    string `json:"data"` // Hex of the encoding
+	TxID    string `json:"txid"`
+	Hash    string `json:"hash"`    // Witness hash, the witness root commits to
+	Depends []int  `json:"depends"` // 1-based positions of its parents in transactions
+	Fee     uint64 `json:"fee"`
+	SigOps  int    `json:"sigops"`
+}
+
+// handleGetBlockCount returns the height of the best chain
+func (s *Server) handleGetBlockCount(ctx context.Context, params json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return s.cfg.Chain.GetHeight(), nil
+}
+
+// handleGetBestBlockHash returns the hash of the tip
+func (s *Server) handleGetBestBlockHash(ctx context.Context, params json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	tip, err := s.cfg.Chain.GetLatestBlock()
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(tip.Hash[:]), nil
+}
+
+// handleGetBlock returns a block by height or hash, described or as hex
+// of its encoding when verbose is false: [height|"hash", verbose=true]
+func (s *Server) handleGetBlock(ctx context.Context, params json.RawMessage) (any, error) {
+	var id json.RawMessage
+	verbose := true
+	if err := parseParams(params, 1, &id, &verbose); err != nil {
+		return nil, err
+	}
+
+	block, err := s.lookupBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	if !verbose {
+		return hex.EncodeToString(codec.Marshal(block)), nil
+	}
+	return NewBlockResult(s.cfg.Chain, block), nil
+}
+
+// lookupBlock returns the block of the best chain at a height, or any
+// known block by its hash
+func (s *Server) lookupBlock(id json.RawMessage) (*types.Block, error) {
+	var hashStr string
+	if err := json.Unmarshal(id, &hashStr); err != nil {
+		height, err := strconv.ParseUint(string(id), 10, 64)
+		if err != nil {
+			return nil, newError(CodeInvalidParams, "block must be a height or a hash")
+		}
+		if height > s.cfg.Chain.GetHeight() {
+			return nil, newError(CodeNotFound, "no block at height %d", height)
+		}
+		return s.cfg.Chain.GetBlock(height)
+	}
+
+	hash, err := parseHash(hashStr)
+	if err != nil {
+		return nil, err
+	}
+	block, err := s.cfg.Chain.GetBlockByHash(hash)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, newError(CodeNotFound, "block %s not found", hashStr)
+	}
+	return block, err
+}
+
+// NewBlockResult describes a block of the chain and its place in the best
+// chain
+func NewBlockResult(chain *blockchain.Chain, block *types.Block) *BlockResult {
+	result := &BlockResult{
+		Hash:              hex.EncodeToString(block.Hash[:]),
+		Confirmations:     -1,
+		Height:            block.Height,
+		Version:           block.Header.Version,
+		MerkleRoot:        hex.EncodeToString(block.Header.MerkleRoot[:]),
+		WitnessRoot:       hex.EncodeToString(block.Header.WitnessRoot[:]),
+		Time:              block.Header.Timestamp,
+		Bits:              fmt.Sprintf("%08x", block.Header.Difficulty),
+		Difficulty:        crypto.GetDifficulty(block.Header.Difficulty, chain.Params().PowLimitBits),
+		Nonce:             block.Header.Nonce,
+		PreviousBlockHash: hex.EncodeToString(block.Header.PrevBlockHash[:]),
+		Size:              block.SerializeSize(),
+		Tx:                make([]TxResult, len(block.Transactions)),
+	}
+	for i := range block.Transactions {
+		result.Tx[i] = txResult(&block.Transactions[i])
+	}
+
+	if chain.IsMainChain(block.Hash) {
+		height := chain.GetHeight()
+		result.Confirmations = int64(height - block.Height + 1)
+		if next, err := chain.GetBlock(block.Height + 1); err == nil && block.Height < height {
+			result.NextBlockHash = hex.EncodeToString(next.Hash[:])
+		}
+	}
+	return result
+}
+
+// txResult describes a transaction
+func txResult(tx *types.Transaction) TxResult {
+	result := TxResult{
+		TxID:     hex.EncodeToString(tx.Hash[:]),
+		Version:  tx.Version,
+		LockTime: tx.LockTime,
+		Inputs:   make([]TxInputResult, len(tx.Inputs)),
+		Outputs:  make([]TxOutputResult, len(tx.Outputs)),
+	}
+	for i, input := range tx.Inputs {
+		if tx.IsCoinbase() {
+			result.Inputs[i] = TxInputResult{Coinbase: hex.EncodeToString(input.Signature)}
+			continue
+		}
+		result.Inputs[i] = TxInputResult{
+			TxID:      hex.EncodeToString(input.PrevTxHash[:]),
+			Vout:      input.OutputIndex,
+			PublicKey: hex.EncodeToString(input.PublicKey),
+			Signature: hex.EncodeToString(input.Signature),
+		}
+	}
+	for i, output := range tx.Outputs {
+		result.Outputs[i] = TxOutputResult{
+			Value:   output.Amount,
+			N:       i,
+			Address: hex.EncodeToString(output.PublicKeyHash),
+		}
+	}
+	return result
+}
+
+// handleSubmitBlock adds a hex encoded block to the chain: ["hex"]. As in
+// BIP 22 the result is null for an accepted block and the reason
+// otherwise.
+func (s *Server) handleSubmitBlock(ctx context.Context, params json.RawMessage) (any, error) {
+	var blockHex string
+	if err := parseParams(params, 1, &blockHex); err != nil {
+		return nil, err
+	}
+	var block types.Block
+	if err := decodeHex(blockHex, &block); err != nil {
+		return nil, err
+	}
+
+	err := s.cfg.Chain.AddBlock(&block)
+	switch {
+	case err == nil:
+		return nil, nil
+	case errors.Is(err, blockchain.ErrDuplicateBlock):
+		return "duplicate", nil
+	case errors.Is(err, blockchain.ErrOrphanBlock):
+		return "orphan", nil
+	default:
+		return fmt.Sprintf("rejected: %v", err), nil
+	}
+}
+
+// handleSendRawTransaction adds a hex encoded transaction to the pool and
+// relays it to peers: ["hex"]. It returns the transaction ID.
+func (s *Server) handleSendRawTransaction(ctx context.Context, params json.RawMessage) (any, error) {
+	var txHex string
+	if err := parseParams(params, 1, &txHex); err != nil {
+		return nil, err
+	}
+	if s.cfg.TxPool == nil {
+		return nil, errNoTxPool
+	}
+	var tx types.Transaction
+	if err := decodeHex(txHex, &tx); err != nil {
+		return nil, err
+	}
+
+	if err := s.cfg.TxPool.ProcessTransaction(&tx); err != nil {
+		return nil, newError(CodeRejected, "%v", err)
+	}
+	if s.cfg.Peers != nil {
+		s.cfg.Peers.AnnounceTransaction(tx.Hash)
+	}
+	return hex.EncodeToString(tx.Hash[:]), nil
+}
+
+// handleGetRawMempool returns the IDs of the pooled transactions
+func (s *Server) handleGetRawMempool(ctx context.Context, params json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	if s.cfg.TxPool == nil {
+		return nil, errNoTxPool
+	}
+	hashes := s.cfg.TxPool.TxHashes()
+	ids := make([]string, len(hashes))
+	for i, hash := range hashes {
+		ids[i] = hex.EncodeToString(hash[:])
+	}
+	return ids, nil
+}
+
+// handleEstimateFee returns the fee rate a transaction should pay to be
+// confirmed within a number of blocks: [blocks, "mode"="conservative"]
+func (s *Server) handleEstimateFee(ctx context.Context, params json.RawMessage) (any, error) {
+	var target int
+	modeName := mempool.EstimateConservative.String()
+	if err := parseParams(params, 1, &target, &modeName); err != nil {
+		return nil, err
+	}
+	if s.cfg.FeeEstimator == nil {
+		return nil, newError(CodeMisc, "fee estimation disabled")
+	}
+	mode, err := mempool.ParseEstimateMode(modeName)
+	if err != nil {
+		return nil, newError(CodeInvalidParams, "%v", err)
+	}
+	if target < 1 {
+		return nil, newError(CodeInvalidParams, "blocks must be at least 1")
+	}
+
+	rate, err := s.cfg.FeeEstimator.EstimateFee(target, mode)
+	if errors.Is(err, mempool.ErrInsufficientData) {
+		return nil, newError(CodeMisc, "%v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FeeEstimateResult{
+		FeeRate: uint64(rate),
+		Blocks:  min(target, mempool.MaxConfirmTarget),
+		Mode:    mode.String(),
+	}, nil
+}
+
+// handleGenerate mines a block paying to a hex address and returns it:
+// ["address"=""]. Without an address the reward is unspendable.
+func (s *Server) handleGenerate(ctx context.Context, params json.RawMessage) (any, error) {
+	var address string
+	if err := parseParams(params, 0, &address); err != nil {
+		return nil, err
+	}
+	if s.cfg.Generate == nil {
+		return nil, newError(CodeMisc, "mining disabled")
+	}
+	payTo, err := hex.DecodeString(address)
+	if err != nil || (address != "" && len(payTo) != crypto.AddressLen) {
+		return nil, newError(CodeInvalidParams, "invalid address: expected %d hex characters", 2*crypto.AddressLen)
+	}
+
+	block, err := s.cfg.Generate(ctx, payTo)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlockResult(s.cfg.Chain, block), nil
+}
+
+// handleGetBlockTemplate returns a block on the tip with transactions of
+// the pool for external miners: ["address"=""]. The coinbase pays to the
+// hex address, without one the reward is unspendable.
+func (s *Server) handleGetBlockTemplate(ctx context.Context, params json.RawMessage) (any, error) {
+	var address string
+	if err := parseParams(params, 0, &address); err != nil {
+		return nil, err
+	}
+	if s.cfg.Templates == nil {
+		return nil, newError(CodeMisc, "block templates disabled")
+	}
+	payTo, err := hex.DecodeString(address)
+	if err != nil || (address != "" && len(payTo) != crypto.AddressLen) {
+		return nil, newError(CodeInvalidParams, "invalid address: expected %d hex characters", 2*crypto.AddressLen)
+	}
+
+	template, err := s.cfg.Templates.NewBlockTemplate(payTo)
+	if err != nil {
+		return nil, err
+	}
+	mtp, err := s.cfg.Chain.MedianTimePast()
+	if err != nil {
+		return nil, err
+	}
+	block := template.Block
+	coinbase := &block.Transactions[0]
+	result := &BlockTemplateResult{
+		Version:           block.Header.Version,
+		PreviousBlockHash: hex.EncodeToString(block.Header.PrevBlockHash[:]),
+		Height:            block.Height,
+		Bits:              fmt.Sprintf("%08x", block.Header.Difficulty),
+		Target:            fmt.Sprintf("%064x", crypto.CompactToBig(block.Header.Difficulty)),
+		CurTime:           block.Header.Timestamp.Unix(),
+		MinTime:           mtp.Unix() + 1,
+		CoinbaseValue:     coinbase.Outputs[0].Amount,
+		CoinbaseTxn: TemplateTxResult{
+			Data:    hex.EncodeToString(codec.Marshal(coinbase)),
+			TxID:    hex.EncodeToString(coinbase.Hash[:]),
+			Hash:    hexHash(coinbase.WitnessHash()),
+			Depends: []int{},
+		},
+		Transactions: make([]TemplateTxResult, 0, len(block.Transactions)-1),
+		SizeLimit:    types.MaxBlockSize,
+		SigOpLimit:   types.MaxBlockSigOps,
+	}
+
+	positions := make(map[[32]byte]int)
+	for i := 1; i < len(block.Transactions); i++ {
+		tx := &block.Transactions[i]
+		positions[tx.Hash] = i
+		depends := []int{}
+		for _, input := range tx.Inputs {
+			if pos, ok := positions[input.PrevTxHash]; ok && !slices.Contains(depends, pos) {
+				depends = append(depends, pos)
+			}
+		}
+		result.Transactions = append(result.Transactions, TemplateTxResult{
+			Data:    hex.EncodeToString(codec.Marshal(tx)),
+			TxID:    hex.EncodeToString(tx.Hash[:]),
+			Hash:    hexHash(tx.WitnessHash()),
+			Depends: depends,
+			Fee:     template.Fees[i],
+			SigOps:  template.SigOps[i],
+		})
+	}
+	return result, nil
+}
+
+// handleGetSyncProgress returns how far the node is in syncing from peers
+func (s *Server) handleGetSyncProgress(ctx context.Context, params json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	if s.cfg.Peers == nil {
+		return nil, errNoNetworking
+	}
+	return s.cfg.Peers.SyncProgress(), nil
+}
+
+// errNoNetworking is returned by the peer methods without a peer server
+var errNoNetworking = newError(CodeMisc, "networking disabled")
+
+// handleListBanned returns the bans in effect ordered by host
+func (s *Server) handleListBanned(ctx context.Context, params json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	if s.cfg.Peers == nil {
+		return nil, errNoNetworking
+	}
+	bans := s.cfg.Peers.Bans()
+	results := make([]BanResult, len(bans))
+	for i, ban := range bans {
+		results[i] = BanResult{
+			Address:     ban.Host,
+			Reason:      ban.Reason,
+			BanCreated:  ban.Created,
+			BannedUntil: ban.Until,
+		}
+	}
+	return results, nil
+}
+
+// handleSetBan bans a host and disconnects it, or lifts its ban. The ban
+// lasts the node's ban duration unless seconds is given:
+// ["host", "add"|"remove", seconds=0]
+func (s *Server) handleSetBan(ctx context.Context, params json.RawMessage) (any, error) {
+	var host, command string
+	var seconds int64
+	if err := parseParams(params, 2, &host, &command, &seconds); err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return nil, newError(CodeInvalidParams, "empty host")
+	}
+	if seconds < 0 {
+		return nil, newError(CodeInvalidParams, "negative ban time")
+	}
+	if s.cfg.Peers == nil {
+		return nil, errNoNetworking
+	}
+
+	switch command {
+	case "add":
+		if err := s.cfg.Peers.Ban(host, time.Duration(seconds)*time.Second, "banned over RPC"); err != nil {
+			return nil, err
+		}
+	case "remove":
+		ok, err := s.cfg.Peers.Unban(host)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, newError(CodeNotFound, "%s is not banned", host)
+		}
+	default:
+		return nil, newError(CodeInvalidParams, "command must be add or remove, got %q", command)
+	}
+	return nil, nil
+}
+
+// handleClearBanned lifts all bans
+func (s *Server) handleClearBanned(ctx context.Context, params json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	if s.cfg.Peers == nil {
+		return nil, errNoNetworking
+	}
+	return nil, s.cfg.Peers.ClearBans()
+}
+
+// hexHash encodes a hash as hex
+func hexHash(hash [32]byte) string {
+	return hex.EncodeToString(hash[:])
+}
+
+// parseHash decodes a hex encoded hash
+func parseHash(s string) ([32]byte, error) {
+	var hash [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(hash) {
+		return hash, newError(CodeInvalidParams, "invalid hash %q", s)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// decodeHex decodes the hex of a canonical encoding into v
+func decodeHex(s string, v codec.Decoder) error {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return newError(CodeInvalidParams, "invalid hex: %v", err)
+	}
+	if err := codec.Unmarshal(data, v); err != nil {
+		return newError(CodeInvalidParams, "failed to decode: %v", err)
+	}
+	return nil
+}
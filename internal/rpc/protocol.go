@@ -0,0 +1,82 @@
+// Package rpc serves a JSON-RPC 2.0 interface to a running node over HTTP
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	// CodeMisc is returned for failures without a more specific code
+	CodeMisc = -1
+
+	// CodeNotFound is returned when a block or transaction is unknown
+	CodeNotFound = -5
+
+	// CodeRejected is returned when a transaction is refused
+	CodeRejected = -26
+)
+
+// Version is the JSON-RPC version spoken by the server
+const Version = "2.0"
+
+// Request is a JSON-RPC call. A request without ID is a notification and
+// gets no response.
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// Response answers a Request, it carries either a result or an error
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// Error is a JSON-RPC error object
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// newError creates an error object with a formatted message
+func newError(code int, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// parseParams decodes positional params into args. Only the first
+// required params must be present, the others keep their values when
+// left out.
+func parseParams(raw json.RawMessage, required int, args ...any) error {
+	var params []json.RawMessage
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return newError(CodeInvalidParams, "params must be an array")
+		}
+	}
+	if len(params) < required || len(params) > len(args) {
+		return newError(CodeInvalidParams, "want %d to %d params, got %d", required, len(args), len(params))
+	}
+	for i, param := range params {
+		if err := json.Unmarshal(param, args[i]); err != nil {
+			return newError(CodeInvalidParams, "param %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/mempool"
+	"github.com/fkapsahili/mini-blockchain/internal/miner"
+	"github.com/fkapsahili/mini-blockchain/internal/p2p"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+const (
+	// maxRequestSize bounds a request body, it fits a hex encoded block of
+	// the maximum size
+	maxRequestSize = 2*types.MaxBlockSize + 1<<16
+
+	// shutdownTimeout is how long Stop waits for running requests
+	shutdownTimeout = 5 * time.Second
+)
+
+// TxPool holds the unconfirmed transactions served by the transaction
+// methods
+type TxPool interface {
+	// ProcessTransaction validates a transaction and adds it to the pool
+	ProcessTransaction(tx *types.Transaction) error
+
+	// TxHashes returns the hashes of the transactions in the pool
+	TxHashes() [][32]byte
+}
+
+// FeeEstimator answers the estimatefee method
+type FeeEstimator interface {
+	// EstimateFee returns the fee rate needed to be confirmed within
+	// target blocks
+	EstimateFee(target int, mode mempool.EstimateMode) (mempool.FeeRate, error)
+}
+
+// Config configures a Server
+type Config struct {
+	// ListenAddr is the address to serve HTTP on
+	ListenAddr string
+
+	// Username and Password are the credentials clients must send with
+	// HTTP basic authentication, a password is required
+	Username string
+	Password string
+
+	// Chain answers the block methods and receives submitted blocks
+	Chain *blockchain.Chain
+
+	// TxPool receives submitted transactions, nil disables the transaction
+	// methods
+	TxPool TxPool
+
+	// Peers relays submitted transactions and reports the sync progress,
+	// nil keeps transactions local. Blocks are relayed by the peer server
+	// once the chain connects them.
+	Peers *p2p.Server
+
+	// Generate mines a block on the tip paying to payTo and adds it to the
+	// chain, nil disables the generate method
+	Generate func(ctx context.Context, payTo []byte) (*types.Block, error)
+
+	// FeeEstimator answers fee estimates, nil disables the estimatefee
+	// method
+	FeeEstimator FeeEstimator
+
+	// Templates builds the blocks handed to external miners, nil disables
+	// the getblocktemplate method
+	Templates *miner.TemplateGenerator
+
+	// Logger receives server errors, defaults to the standard logger
+	Logger *log.Logger
+}
+
+// handlerFunc answers a method call with a result that is marshaled to
+// JSON. Errors other than *Error are reported as internal errors. ctx is
+// cancelled when the client goes away or the server stops.
+type handlerFunc func(s *Server, ctx context.Context, params json.RawMessage) (any, error)
+
+// Server answers JSON-RPC requests over HTTP
+type Server struct {
+	cfg      Config
+	listener net.Listener
+	http     *http.Server
+	wg       sync.WaitGroup
+
+	// ctx is the base context of requests, cancelled by Stop so long
+	// running calls like generate end
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wsClients are the connected WebSocket clients, wsClosed refuses new
+	// ones once the server stops
+	wsMu      sync.Mutex
+	wsClients map[*wsClient]struct{}
+	wsClosed  bool
+
+	// chainSub delivers the chain events published to subscribers
+	chainSub *blockchain.Subscription
+}
+
+// NewServer creates a server, Start must be called to accept requests
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Chain == nil {
+		return nil, errors.New("chain is required")
+	}
+	if cfg.Password == "" {
+		return nil, errors.New("password is required")
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+
+	s := &Server{cfg: cfg, wsClients: make(map[*wsClient]struct{})}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.http = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          cfg.Logger,
+		BaseContext:       func(net.Listener) context.Context { return s.ctx },
+	}
+	return s, nil
+}
+
+// Start listens on the configured address and serves requests until Stop
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.ListenAddr, err)
+	}
+	s.listener = listener
+	s.chainSub = s.cfg.Chain.Observe(blockchain.ObserverFuncs{
+		OnBlockConnected:    s.handleBlockConnected,
+		OnBlockDisconnected: s.handleBlockDisconnected,
+	}, blockchain.SubscribeOptions{})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.http.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			s.cfg.Logger.Printf("RPC server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server listens on, or nil before Start
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop closes the listener and WebSocket connections, cancels running
+// requests and waits for them to finish
+func (s *Server) Stop() {
+	s.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	s.http.Shutdown(ctx)
+	if s.chainSub != nil {
+		s.chainSub.Cancel()
+	}
+	s.closeWebSockets()
+	s.wg.Wait()
+}
+
+// ServeHTTP answers a single request or a batch of them, or upgrades
+// requests for WebSocketPath. Every request must be authenticated.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == WebSocketPath {
+		s.serveWebSocket(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isJSON(r) {
+		http.Error(w, "JSON-RPC requests must have Content-Type application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if trimmed := bytes.TrimLeft(body, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '[' {
+		if resp := s.handleRequest(r.Context(), body); resp != nil {
+			writeJSON(w, resp)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeJSON(w, errorResponse(nil, newError(CodeParseError, "invalid JSON: %v", err)))
+		return
+	}
+	if len(batch) == 0 {
+		writeJSON(w, errorResponse(nil, newError(CodeInvalidRequest, "empty batch")))
+		return
+	}
+	var responses []*Response
+	for _, raw := range batch {
+		if resp := s.handleRequest(r.Context(), raw); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, responses)
+}
+
+// handleRequest calls the method of a request, it returns nil for
+// notifications
+func (s *Server) handleRequest(ctx context.Context, raw json.RawMessage) *Response {
+	var req Request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return errorResponse(nil, newError(CodeParseError, "invalid JSON: %v", err))
+	}
+	if req.JSONRPC != Version || req.Method == "" {
+		return errorResponse(req.ID, newError(CodeInvalidRequest, "want a jsonrpc %s request with a method", Version))
+	}
+
+	result, err := s.call(ctx, req.Method, req.Params)
+	if len(req.ID) == 0 {
+		return nil
+	}
+	if err != nil {
+		return errorResponse(req.ID, err)
+	}
+	return &Response{JSONRPC: Version, Result: result, ID: req.ID}
+}
+
+// call runs the handler of a method and marshals its result
+func (s *Server) call(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, *Error) {
+	handler, ok := handlers[method]
+	if !ok {
+		return nil, newError(CodeMethodNotFound, "method %q not found", method)
+	}
+
+	result, err := handler(s, ctx, params)
+	if err != nil {
+		var rpcErr *Error
+		if errors.As(err, &rpcErr) {
+			return nil, rpcErr
+		}
+		return nil, newError(CodeInternalError, "%v", err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, newError(CodeInternalError, "failed to marshal result: %v", err)
+	}
+	return data, nil
+}
+
+// errorResponse answers a request with an error, id is null if the
+// request couldn't be read
+func errorResponse(id json.RawMessage, err *Error) *Response {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &Response{JSONRPC: Version, Error: err, ID: id}
+}
+
+// writeJSON writes v as the response body
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
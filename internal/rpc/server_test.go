@@ -0,0 +1,664 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/blockchain"
+	"github.com/fkapsahili/mini-blockchain/internal/chaincfg"
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+	"github.com/fkapsahili/mini-blockchain/internal/mempool"
+	"github.com/fkapsahili/mini-blockchain/internal/miner"
+	"github.com/fkapsahili/mini-blockchain/internal/p2p"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// newTestChain opens a regtest chain in a temporary directory
+func newTestChain(t *testing.T) *blockchain.Chain {
+	t.Helper()
+	chain, err := blockchain.OpenChain(t.TempDir(), blockchain.Options{Params: &chaincfg.RegTestParams})
+	if err != nil {
+		t.Fatalf("OpenChain() error = %v", err)
+	}
+	t.Cleanup(func() { chain.Close() })
+	return chain
+}
+
+// newBlock returns a solved block on the tip of the chain without adding it
+func newBlock(t *testing.T, chain *blockchain.Chain) *types.Block {
+	t.Helper()
+	return newBlockPaying(t, chain, []byte{1, 2, 3})
+}
+
+// newBlockPaying returns a solved block on the tip of the chain paying its
+// reward to payTo without adding it
+func newBlockPaying(t *testing.T, chain *blockchain.Chain, payTo []byte) *types.Block {
+	t.Helper()
+	tip, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	mtp, err := chain.MedianTimePast()
+	if err != nil {
+		t.Fatalf("MedianTimePast() error = %v", err)
+	}
+
+	height := tip.Height + 1
+	block := &types.Block{
+		Header: types.BlockHeader{
+			Version:       1,
+			PrevBlockHash: tip.Hash,
+			Timestamp:     mtp.Add(time.Second),
+			Difficulty:    chain.Params().PowLimitBits,
+		},
+		Transactions: []types.Transaction{types.NewCoinbaseTransaction(height, 0, []types.TransactionOutput{{
+			Amount:        blockchain.CalcBlockSubsidy(chain.Params(), height),
+			PublicKeyHash: payTo,
+		}})},
+		Height: height,
+	}
+	block.UpdateRoots()
+	if _, err := miner.New(miner.Config{Threads: 1}).Solve(context.Background(), block); err != nil {
+		t.Fatalf("Solve() error = %v", err)
+	}
+	return block
+}
+
+// mapTxPool accepts every transaction
+type mapTxPool struct {
+	mu  sync.Mutex
+	txs map[[32]byte]*types.Transaction
+}
+
+func (m *mapTxPool) ProcessTransaction(tx *types.Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(tx.Inputs) == 0 {
+		return errors.New("transaction has no inputs")
+	}
+	m.txs[tx.Hash] = tx
+	return nil
+}
+
+func (m *mapTxPool) TxHashes() [][32]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var hashes [][32]byte
+	for hash := range m.txs {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// testUser and testPassword are the credentials of test servers
+const (
+	testUser     = "user"
+	testPassword = "secret"
+)
+
+// newTestServer starts a server on a random local port, pool may be nil
+func newTestServer(t *testing.T, chain *blockchain.Chain, pool TxPool) *Server {
+	t.Helper()
+	s, err := NewServer(Config{
+		ListenAddr: "127.0.0.1:0",
+		Username:   testUser,
+		Password:   testPassword,
+		Chain:      chain,
+		TxPool:     pool,
+		Logger:     log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// post sends a raw request body and returns the response body
+func post(t *testing.T, s *Server, body string) (int, string) {
+	t.Helper()
+	return send(t, s, http.MethodPost, "application/json", body, true)
+}
+
+// send sends a request, authenticated with the test credentials if auth is
+// set, and returns the response body
+func send(t *testing.T, s *Server, method, contentType, body string, auth bool) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+s.Addr().String(), strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if auth {
+		req.SetBasicAuth(testUser, testPassword)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// call calls a method with a client and decodes its result into result
+func call(t *testing.T, s *Server, result any, method string, params ...any) *Error {
+	t.Helper()
+	err := NewClient("http://"+s.Addr().String(), testUser, testPassword).Call(context.Background(), result, method, params...)
+	if err == nil {
+		return nil
+	}
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Call() error = %v", err)
+	}
+	return rpcErr
+}
+
+func TestChainMethods(t *testing.T) {
+	chain := newTestChain(t)
+	var blocks []*types.Block
+	for i := 0; i < 3; i++ {
+		block := newBlock(t, chain)
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock() error = %v", err)
+		}
+		blocks = append(blocks, block)
+	}
+	s := newTestServer(t, chain, nil)
+
+	var count uint64
+	if err := call(t, s, &count, "getblockcount"); err != nil || count != 3 {
+		t.Errorf("getblockcount = %d, %v, want 3", count, err)
+	}
+	var best string
+	if err := call(t, s, &best, "getbestblockhash"); err != nil || best != hex.EncodeToString(blocks[2].Hash[:]) {
+		t.Errorf("getbestblockhash = %s, %v, want %x", best, err, blocks[2].Hash)
+	}
+
+	tests := []struct {
+		name     string
+		id       any
+		want     *types.Block
+		wantCode int
+	}{
+		{"by height", 2, blocks[1], 0},
+		{"by hash", hex.EncodeToString(blocks[0].Hash[:]), blocks[0], 0},
+		{"tip", 3, blocks[2], 0},
+		{"height above tip", 4, nil, CodeNotFound},
+		{"unknown hash", strings.Repeat("00", 32), nil, CodeNotFound},
+		{"invalid hash", "abc", nil, CodeInvalidParams},
+		{"neither height nor hash", true, nil, CodeInvalidParams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got BlockResult
+			err := call(t, s, &got, "getblock", tt.id)
+			if tt.wantCode != 0 {
+				if err == nil || err.Code != tt.wantCode {
+					t.Errorf("getblock error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getblock error = %v", err)
+			}
+			if got.Hash != hex.EncodeToString(tt.want.Hash[:]) || got.Height != tt.want.Height ||
+				got.PreviousBlockHash != hex.EncodeToString(tt.want.Header.PrevBlockHash[:]) {
+				t.Errorf("getblock = %+v, want block %x at %d", got, tt.want.Hash, tt.want.Height)
+			}
+			if want := int64(4 - tt.want.Height); got.Confirmations != want {
+				t.Errorf("confirmations = %d, want %d", got.Confirmations, want)
+			}
+			if got.WitnessRoot != hex.EncodeToString(tt.want.Header.WitnessRoot[:]) {
+				t.Errorf("witnessroot = %s, want %x", got.WitnessRoot, tt.want.Header.WitnessRoot)
+			}
+			if len(got.Tx) != 1 || got.Tx[0].TxID != hex.EncodeToString(tt.want.Transactions[0].Hash[:]) || got.Tx[0].Outputs[0].Address != "010203" {
+				t.Errorf("tx = %+v, want the coinbase", got.Tx)
+			}
+		})
+	}
+
+	var raw string
+	if err := call(t, s, &raw, "getblock", 1, false); err != nil {
+		t.Fatalf("getblock error = %v", err)
+	}
+	if want := hex.EncodeToString(codec.Marshal(blocks[0])); raw != want {
+		t.Errorf("getblock raw = %s, want %s", raw, want)
+	}
+}
+
+func TestSubmitBlock(t *testing.T) {
+	chain := newTestChain(t)
+	s := newTestServer(t, chain, nil)
+
+	block := newBlock(t, chain)
+	blockHex := hex.EncodeToString(codec.Marshal(block))
+	var result *string
+	if err := call(t, s, &result, "submitblock", blockHex); err != nil || result != nil {
+		t.Fatalf("submitblock = %v, %v, want null", result, err)
+	}
+	if !chain.IsMainChain(block.Hash) {
+		t.Error("submitted block is not on the best chain")
+	}
+	if err := call(t, s, &result, "submitblock", blockHex); err != nil || result == nil || *result != "duplicate" {
+		t.Errorf("submitblock of a known block = %v, %v, want duplicate", result, err)
+	}
+
+	invalid := newBlock(t, chain)
+	invalid.Transactions[0].Outputs[0].Amount++
+	if err := call(t, s, &result, "submitblock", hex.EncodeToString(codec.Marshal(invalid))); err != nil || result == nil || !strings.HasPrefix(*result, "rejected") {
+		t.Errorf("submitblock of an invalid block = %v, %v, want rejected", result, err)
+	}
+	if err := call(t, s, nil, "submitblock", "zz"); err == nil || err.Code != CodeInvalidParams {
+		t.Errorf("submitblock of invalid hex error = %v, want code %d", err, CodeInvalidParams)
+	}
+}
+
+func TestTransactionMethods(t *testing.T) {
+	chain := newTestChain(t)
+	tx := types.Transaction{
+		Version: 1,
+		Inputs:  []types.TransactionInput{{PrevTxHash: [32]byte{1}}},
+		Outputs: []types.TransactionOutput{{Amount: 1}},
+	}
+	tx.Hash = tx.ComputeHash()
+	txHex := hex.EncodeToString(codec.Marshal(&tx))
+
+	if err := call(t, newTestServer(t, chain, nil), nil, "sendrawtransaction", txHex); err == nil {
+		t.Error("sendrawtransaction without a pool error = nil")
+	}
+
+	s := newTestServer(t, chain, &mapTxPool{txs: make(map[[32]byte]*types.Transaction)})
+	var txid string
+	if err := call(t, s, &txid, "sendrawtransaction", txHex); err != nil || txid != hex.EncodeToString(tx.Hash[:]) {
+		t.Errorf("sendrawtransaction = %s, %v, want %x", txid, err, tx.Hash)
+	}
+	var ids []string
+	if err := call(t, s, &ids, "getrawmempool"); err != nil || len(ids) != 1 || ids[0] != txid {
+		t.Errorf("getrawmempool = %v, %v, want [%s]", ids, err, txid)
+	}
+
+	empty := hex.EncodeToString(codec.Marshal(&types.Transaction{}))
+	if err := call(t, s, nil, "sendrawtransaction", empty); err == nil || err.Code != CodeRejected {
+		t.Errorf("sendrawtransaction of a rejected transaction error = %v, want code %d", err, CodeRejected)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	chain := newTestChain(t)
+	if err := call(t, newTestServer(t, chain, nil), nil, "generate"); err == nil || err.Code != CodeMisc {
+		t.Errorf("generate without mining error = %v, want code %d", err, CodeMisc)
+	}
+
+	var gotPayTo []byte
+	s, err := NewServer(Config{
+		ListenAddr: "127.0.0.1:0",
+		Username:   testUser,
+		Password:   testPassword,
+		Chain:      chain,
+		Generate: func(ctx context.Context, payTo []byte) (*types.Block, error) {
+			gotPayTo = payTo
+			block := newBlock(t, chain)
+			return block, chain.AddBlock(block)
+		},
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	address := strings.Repeat("ab", 20)
+	var block BlockResult
+	if err := call(t, s, &block, "generate", address); err != nil {
+		t.Fatalf("generate error = %v", err)
+	}
+	if hex.EncodeToString(gotPayTo) != address {
+		t.Errorf("generate paid to %x, want %s", gotPayTo, address)
+	}
+	if block.Height != 1 || block.Confirmations != 1 {
+		t.Errorf("generate = block at %d with %d confirmations, want the tip at 1", block.Height, block.Confirmations)
+	}
+	if err := call(t, s, nil, "generate", "abcd"); err == nil || err.Code != CodeInvalidParams {
+		t.Errorf("generate to a short address error = %v, want code %d", err, CodeInvalidParams)
+	}
+}
+
+// estimatorFunc adapts a function to a FeeEstimator
+type estimatorFunc func(target int, mode mempool.EstimateMode) (mempool.FeeRate, error)
+
+func (f estimatorFunc) EstimateFee(target int, mode mempool.EstimateMode) (mempool.FeeRate, error) {
+	return f(target, mode)
+}
+
+func TestEstimateFee(t *testing.T) {
+	chain := newTestChain(t)
+	if err := call(t, newTestServer(t, chain, nil), nil, "estimatefee", 1); err == nil || err.Code != CodeMisc {
+		t.Errorf("estimatefee without an estimator error = %v, want code %d", err, CodeMisc)
+	}
+
+	s, err := NewServer(Config{
+		ListenAddr: "127.0.0.1:0",
+		Username:   testUser,
+		Password:   testPassword,
+		Chain:      chain,
+		FeeEstimator: estimatorFunc(func(target int, mode mempool.EstimateMode) (mempool.FeeRate, error) {
+			if target > 10 {
+				return 0, mempool.ErrInsufficientData
+			}
+			return mempool.FeeRate(1000*target + int(mode)), nil
+		}),
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	tests := []struct {
+		name     string
+		params   []any
+		want     FeeEstimateResult
+		wantCode int
+	}{
+		{"conservative by default", []any{2}, FeeEstimateResult{FeeRate: 2000, Blocks: 2, Mode: "conservative"}, 0},
+		{"economical", []any{3, "economical"}, FeeEstimateResult{FeeRate: 3001, Blocks: 3, Mode: "economical"}, 0},
+		{"unknown mode", []any{3, "cheap"}, FeeEstimateResult{}, CodeInvalidParams},
+		{"target 0", []any{0}, FeeEstimateResult{}, CodeInvalidParams},
+		{"not enough data", []any{20}, FeeEstimateResult{}, CodeMisc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got FeeEstimateResult
+			err := call(t, s, &got, "estimatefee", tt.params...)
+			if tt.wantCode != 0 {
+				if err == nil || err.Code != tt.wantCode {
+					t.Errorf("estimatefee error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("estimatefee = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBanMethods(t *testing.T) {
+	chain := newTestChain(t)
+	if err := call(t, newTestServer(t, chain, nil), nil, "listbanned"); err == nil || err.Code != CodeMisc {
+		t.Errorf("listbanned without networking error = %v, want code %d", err, CodeMisc)
+	}
+
+	bans, err := p2p.OpenBanList("")
+	if err != nil {
+		t.Fatalf("OpenBanList() error = %v", err)
+	}
+	peers, err := p2p.NewServer(p2p.Config{
+		Params:     &chaincfg.RegTestParams,
+		ListenAddr: "127.0.0.1:0",
+		Chain:      chain,
+		BanList:    bans,
+		Logger:     log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("p2p.NewServer() error = %v", err)
+	}
+	s, err := NewServer(Config{
+		ListenAddr: "127.0.0.1:0",
+		Username:   testUser,
+		Password:   testPassword,
+		Chain:      chain,
+		Peers:      peers,
+		Logger:     log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	tests := []struct {
+		name     string
+		params   []any
+		wantCode int
+	}{
+		{"add", []any{"10.0.0.1", "add", 60}, 0},
+		{"add for the default duration", []any{"10.0.0.2", "add"}, 0},
+		{"remove", []any{"10.0.0.2", "remove"}, 0},
+		{"remove unbanned host", []any{"10.0.0.3", "remove"}, CodeNotFound},
+		{"unknown command", []any{"10.0.0.3", "ban"}, CodeInvalidParams},
+		{"negative time", []any{"10.0.0.3", "add", -1}, CodeInvalidParams},
+		{"empty host", []any{"", "add"}, CodeInvalidParams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := call(t, s, nil, "setban", tt.params...)
+			if tt.wantCode != 0 {
+				if err == nil || err.Code != tt.wantCode {
+					t.Errorf("setban error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("setban error = %v", err)
+			}
+		})
+	}
+
+	var got []BanResult
+	if err := call(t, s, &got, "listbanned"); err != nil {
+		t.Fatalf("listbanned error = %v", err)
+	}
+	if len(got) != 1 || got[0].Address != "10.0.0.1" || got[0].BannedUntil.Sub(got[0].BanCreated) != time.Minute {
+		t.Errorf("listbanned = %+v, want 10.0.0.1 banned for a minute", got)
+	}
+
+	if err := call(t, s, nil, "clearbanned"); err != nil {
+		t.Fatalf("clearbanned error = %v", err)
+	}
+	if list := bans.List(); len(list) != 0 {
+		t.Errorf("bans after clearbanned = %v, want none", list)
+	}
+}
+
+func TestGetBlockTemplate(t *testing.T) {
+	chain := newTestChain(t)
+	if err := call(t, newTestServer(t, chain, nil), nil, "getblocktemplate"); err == nil || err.Code != CodeMisc {
+		t.Errorf("getblocktemplate without templates error = %v, want code %d", err, CodeMisc)
+	}
+
+	templates, err := miner.NewTemplateGenerator(miner.TemplateConfig{Chain: chain})
+	if err != nil {
+		t.Fatalf("NewTemplateGenerator() error = %v", err)
+	}
+	s, err := NewServer(Config{
+		ListenAddr: "127.0.0.1:0",
+		Username:   testUser,
+		Password:   testPassword,
+		Chain:      chain,
+		Templates:  templates,
+		Logger:     log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	address := strings.Repeat("ab", 20)
+	var template BlockTemplateResult
+	if err := call(t, s, &template, "getblocktemplate", address); err != nil {
+		t.Fatalf("getblocktemplate error = %v", err)
+	}
+	genesis, err := chain.GetLatestBlock()
+	if err != nil {
+		t.Fatalf("GetLatestBlock() error = %v", err)
+	}
+	if template.Height != 1 || template.PreviousBlockHash != hex.EncodeToString(genesis.Hash[:]) {
+		t.Errorf("getblocktemplate = height %d on %s, want 1 on the genesis block", template.Height, template.PreviousBlockHash)
+	}
+	if want := blockchain.CalcBlockSubsidy(chain.Params(), 1); template.CoinbaseValue != want || len(template.Transactions) != 0 {
+		t.Errorf("getblocktemplate coinbase value = %d with %d transactions, want %d", template.CoinbaseValue, len(template.Transactions), want)
+	}
+
+	var coinbase types.Transaction
+	if err := decodeHex(template.CoinbaseTxn.Data, &coinbase); err != nil {
+		t.Fatalf("decoding the coinbase error = %v", err)
+	}
+	if hex.EncodeToString(coinbase.Outputs[0].PublicKeyHash) != address {
+		t.Errorf("coinbase pays to %x, want %s", coinbase.Outputs[0].PublicKeyHash, address)
+	}
+	if want := coinbase.WitnessHash(); template.CoinbaseTxn.Hash != hex.EncodeToString(want[:]) {
+		t.Errorf("coinbase hash = %s, want the witness hash %x", template.CoinbaseTxn.Hash, want)
+	}
+	if err := call(t, s, nil, "getblocktemplate", "abcd"); err == nil || err.Code != CodeInvalidParams {
+		t.Errorf("getblocktemplate to a short address error = %v, want code %d", err, CodeInvalidParams)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	s := newTestServer(t, newTestChain(t), nil)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"parse error", `{"jsonrpc":`, CodeParseError},
+		{"wrong version", `{"jsonrpc":"1.0","id":1,"method":"getblockcount"}`, CodeInvalidRequest},
+		{"unknown method", `{"jsonrpc":"2.0","id":1,"method":"nope"}`, CodeMethodNotFound},
+		{"params not an array", `{"jsonrpc":"2.0","id":1,"method":"getblock","params":{"height":1}}`, CodeInvalidParams},
+		{"too many params", `{"jsonrpc":"2.0","id":1,"method":"getblockcount","params":[1]}`, CodeInvalidParams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, data := post(t, s, tt.body)
+			var resp Response
+			if err := json.Unmarshal([]byte(data), &resp); err != nil {
+				t.Fatalf("Unmarshal() of %q error = %v", data, err)
+			}
+			if resp.Error == nil || resp.Error.Code != tt.wantCode {
+				t.Errorf("error = %v, want code %d", resp.Error, tt.wantCode)
+			}
+		})
+	}
+
+	// A batch answers every call but the notification, in order
+	_, data := post(t, s, `[
+		{"jsonrpc":"2.0","id":"a","method":"getblockcount"},
+		{"jsonrpc":"2.0","method":"getblockcount"},
+		{"jsonrpc":"2.0","id":"b","method":"nope"}
+	]`)
+	var batch []Response
+	if err := json.Unmarshal([]byte(data), &batch); err != nil {
+		t.Fatalf("Unmarshal() of %q error = %v", data, err)
+	}
+	if len(batch) != 2 || string(batch[0].ID) != `"a"` || string(batch[0].Result) != "0" || batch[1].Error == nil {
+		t.Errorf("batch = %s, want the result of a and the error of b", data)
+	}
+
+	if code, _ := post(t, s, `{"jsonrpc":"2.0","method":"getblockcount"}`); code != http.StatusNoContent {
+		t.Errorf("notification status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code, _ := send(t, s, http.MethodGet, "", "", true); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestServer(t, newTestChain(t), nil)
+	const body = `{"jsonrpc":"2.0","id":1,"method":"getblockcount"}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		auth        bool
+		wantStatus  int
+	}{
+		{"authenticated", "application/json", true, http.StatusOK},
+		{"charset", "application/json; charset=utf-8", true, http.StatusOK},
+		{"no credentials", "application/json", false, http.StatusUnauthorized},
+		// Browsers post these cross-origin without a preflight
+		{"plain text", "text/plain", true, http.StatusUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", true, http.StatusUnsupportedMediaType},
+		{"no content type", "", true, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, data := send(t, s, http.MethodPost, tt.contentType, body, tt.auth); code != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", code, strings.TrimSpace(data), tt.wantStatus)
+			}
+		})
+	}
+
+	if err := NewClient("http://"+s.Addr().String(), testUser, "wrong").Call(context.Background(), nil, "getblockcount"); err == nil {
+		t.Error("Call() with a wrong password error = nil")
+	}
+	if _, err := NewServer(Config{ListenAddr: "127.0.0.1:0", Chain: newTestChain(t)}); err == nil {
+		t.Error("NewServer() without a password error = nil")
+	}
+}
+
+func TestCookie(t *testing.T) {
+	dir := t.TempDir()
+	user, password, err := WriteCookie(dir)
+	if err != nil {
+		t.Fatalf("WriteCookie() error = %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, CookieFile))
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("cookie permissions = %v, want 0600", perm)
+	}
+
+	gotUser, gotPassword, err := ReadCookie(dir)
+	if err != nil || gotUser != user || gotPassword != password {
+		t.Errorf("ReadCookie() = %q, %q, %v, want %q, %q", gotUser, gotPassword, err, user, password)
+	}
+
+	// Every start gets new credentials
+	if _, again, _ := WriteCookie(dir); again == password {
+		t.Error("WriteCookie() reused the password")
+	}
+	if err := RemoveCookie(dir); err != nil {
+		t.Fatalf("RemoveCookie() error = %v", err)
+	}
+	if _, _, err := ReadCookie(dir); err == nil {
+		t.Error("ReadCookie() after RemoveCookie() error = nil")
+	}
+}
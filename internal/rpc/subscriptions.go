@@ -0,0 +1,422 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// WebSocketPath is the path WebSocket clients connect to. Besides the
+// subscription methods they may call every other method over it.
+const WebSocketPath = "/ws"
+
+// Subscription topics
+const (
+	// TopicBlockConnected sends a BlockEvent for each block appended to
+	// the best chain
+	TopicBlockConnected = "blockconnected"
+
+	// TopicBlockDisconnected sends a BlockEvent for each block removed
+	// from the best chain by a reorganization, the tip first
+	TopicBlockDisconnected = "blockdisconnected"
+
+	// TopicMempoolTx sends a TxEvent for each transaction accepted to the
+	// pool
+	TopicMempoolTx = "mempooltx"
+
+	// TopicAddressTx sends a TxEvent for each pooled or connected
+	// transaction paying to or spending from one of the given addresses
+	TopicAddressTx = "addresstx"
+)
+
+// NotificationMethod is the method of the notifications carrying events
+const NotificationMethod = "subscription"
+
+// wsSendQueueSize is how many messages may wait for a slow client before
+// it is disconnected, so it can't hold up the chain
+const wsSendQueueSize = 256
+
+// BlockEvent describes a block that was connected or disconnected
+type BlockEvent struct {
+	Hash              string    `json:"hash"`
+	Height            uint64    `json:"height"`
+	PreviousBlockHash string    `json:"previousblockhash"`
+	Time              time.Time `json:"time"`
+	TxIDs             []string  `json:"tx"`
+}
+
+// TxEvent describes a transaction, the block fields are empty for pooled
+// transactions
+type TxEvent struct {
+	TxResult
+	Addresses []string `json:"addresses,omitempty"` // Subscribed addresses the transaction touches
+	BlockHash string   `json:"blockhash,omitempty"`
+	Height    uint64   `json:"height,omitempty"`
+}
+
+// SubscriptionParams are the params of a notification
+type SubscriptionParams struct {
+	Subscription uint64          `json:"subscription"`
+	Topic        string          `json:"topic"`
+	Result       json.RawMessage `json:"result"`
+}
+
+// subscription is a topic a client subscribed to
+type subscription struct {
+	id        uint64
+	topic     string
+	addresses map[string]bool // Hex addresses of TopicAddressTx
+}
+
+// wsClient is a WebSocket connection and its subscriptions
+type wsClient struct {
+	conn *wsConn
+	send chan []byte
+	quit chan struct{}
+	once sync.Once
+
+	mu     sync.Mutex
+	subs   map[uint64]*subscription
+	nextID uint64
+}
+
+// queue sends a message without blocking, a client that can't keep up is
+// disconnected
+func (c *wsClient) queue(data []byte) {
+	select {
+	case c.send <- data:
+	case <-c.quit:
+	default:
+		c.close()
+	}
+}
+
+// close ends the connection, it may be called more than once
+func (c *wsClient) close() {
+	c.once.Do(func() {
+		close(c.quit)
+		c.conn.Close()
+	})
+}
+
+// writeLoop writes queued messages until the client is closed
+func (c *wsClient) writeLoop() {
+	for {
+		select {
+		case data := <-c.send:
+			if err := c.conn.WriteMessage(data); err != nil {
+				c.close()
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// serveWebSocket upgrades a request and answers the calls of the client
+// until it disconnects or the server stops
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	client := &wsClient{
+		conn: conn,
+		send: make(chan []byte, wsSendQueueSize),
+		quit: make(chan struct{}),
+		subs: make(map[uint64]*subscription),
+	}
+
+	s.wsMu.Lock()
+	if s.wsClosed {
+		s.wsMu.Unlock()
+		conn.Close()
+		return
+	}
+	s.wsClients[client] = struct{}{}
+	s.wg.Add(1)
+	s.wsMu.Unlock()
+
+	defer func() {
+		client.close()
+		s.wsMu.Lock()
+		delete(s.wsClients, client)
+		s.wsMu.Unlock()
+		s.wg.Done()
+	}()
+
+	go client.writeLoop()
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, errWSProtocol) {
+				select {
+				case <-client.quit:
+				default:
+					s.cfg.Logger.Printf("WebSocket client %s failed: %v", r.RemoteAddr, err)
+				}
+			}
+			return
+		}
+		if resp := s.handleWSRequest(s.ctx, client, message); resp != nil {
+			data, err := json.Marshal(resp)
+			if err != nil {
+				return
+			}
+			client.queue(data)
+		}
+	}
+}
+
+// handleWSRequest answers a call over WebSocket, it returns nil for
+// notifications
+func (s *Server) handleWSRequest(ctx context.Context, client *wsClient, raw []byte) *Response {
+	var req Request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return errorResponse(nil, newError(CodeParseError, "invalid JSON: %v", err))
+	}
+	if req.JSONRPC != Version || req.Method == "" {
+		return errorResponse(req.ID, newError(CodeInvalidRequest, "want a jsonrpc %s request with a method", Version))
+	}
+
+	var result any
+	var err error
+	switch req.Method {
+	case "subscribe":
+		result, err = client.subscribe(req.Params)
+	case "unsubscribe":
+		result, err = client.unsubscribe(req.Params)
+	default:
+		return s.handleRequest(ctx, raw)
+	}
+	if len(req.ID) == 0 {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = newError(CodeInternalError, "%v", err)
+		}
+		return errorResponse(req.ID, rpcErr)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, newError(CodeInternalError, "failed to marshal result: %v", err))
+	}
+	return &Response{JSONRPC: Version, Result: data, ID: req.ID}
+}
+
+// subscribe adds a subscription and returns its ID: ["topic",
+// ["address", ...]]. Addresses are required for TopicAddressTx only.
+func (c *wsClient) subscribe(params json.RawMessage) (any, error) {
+	var topic string
+	var addresses []string
+	if err := parseParams(params, 1, &topic, &addresses); err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{topic: topic}
+	switch topic {
+	case TopicBlockConnected, TopicBlockDisconnected, TopicMempoolTx:
+		if len(addresses) > 0 {
+			return nil, newError(CodeInvalidParams, "topic %s takes no addresses", topic)
+		}
+	case TopicAddressTx:
+		if len(addresses) == 0 {
+			return nil, newError(CodeInvalidParams, "topic %s needs at least one address", topic)
+		}
+		sub.addresses = make(map[string]bool, len(addresses))
+		for _, address := range addresses {
+			b, err := hex.DecodeString(address)
+			if err != nil || len(b) != crypto.AddressLen {
+				return nil, newError(CodeInvalidParams, "invalid address %q: expected %d hex characters", address, 2*crypto.AddressLen)
+			}
+			sub.addresses[hex.EncodeToString(b)] = true
+		}
+	default:
+		return nil, newError(CodeInvalidParams, "unknown topic %q", topic)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	sub.id = c.nextID
+	c.subs[sub.id] = sub
+	return sub.id, nil
+}
+
+// unsubscribe removes a subscription: [id]
+func (c *wsClient) unsubscribe(params json.RawMessage) (any, error) {
+	var id uint64
+	if err := parseParams(params, 1, &id); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.subs[id]; !ok {
+		return nil, newError(CodeNotFound, "subscription %d not found", id)
+	}
+	delete(c.subs, id)
+	return true, nil
+}
+
+// publish sends an event to every subscription of a topic. event returns
+// the event of a subscription, or nil to skip it.
+func (s *Server) publish(topic string, event func(sub *subscription) any) {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+
+	for client := range s.wsClients {
+		client.mu.Lock()
+		for _, sub := range client.subs {
+			if sub.topic != topic {
+				continue
+			}
+			result := event(sub)
+			if result == nil {
+				continue
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				s.cfg.Logger.Printf("Failed to marshal %s event: %v", topic, err)
+				continue
+			}
+			params, _ := json.Marshal(&SubscriptionParams{Subscription: sub.id, Topic: topic, Result: data})
+			notification, _ := json.Marshal(&Request{JSONRPC: Version, Method: NotificationMethod, Params: params})
+			client.queue(notification)
+		}
+		client.mu.Unlock()
+	}
+}
+
+// hasClients reports whether any WebSocket client is connected, so events
+// aren't built for nobody
+func (s *Server) hasClients() bool {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+
+	return len(s.wsClients) > 0
+}
+
+// closeWebSockets disconnects every client and refuses new ones
+func (s *Server) closeWebSockets() {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+
+	s.wsClosed = true
+	for client := range s.wsClients {
+		client.close()
+	}
+}
+
+// handleBlockConnected publishes a block connected to the best chain and
+// the transactions it confirms
+func (s *Server) handleBlockConnected(block *types.Block) {
+	if !s.hasClients() {
+		return
+	}
+	event := newBlockEvent(block)
+	s.publish(TopicBlockConnected, func(*subscription) any { return event })
+	blockHash := hex.EncodeToString(block.Hash[:])
+	for i := range block.Transactions {
+		s.publishAddressTx(&block.Transactions[i], blockHash, block.Height)
+	}
+}
+
+// handleBlockDisconnected publishes a block removed from the best chain
+func (s *Server) handleBlockDisconnected(block *types.Block) {
+	if !s.hasClients() {
+		return
+	}
+	event := newBlockEvent(block)
+	s.publish(TopicBlockDisconnected, func(*subscription) any { return event })
+}
+
+// NotifyTransaction publishes a transaction accepted to the pool. The
+// owner of the pool calls it, the server can't see transactions relayed by
+// peers.
+func (s *Server) NotifyTransaction(tx *types.Transaction) {
+	if !s.hasClients() {
+		return
+	}
+	event := &TxEvent{TxResult: txResult(tx)}
+	s.publish(TopicMempoolTx, func(*subscription) any { return event })
+	s.publishAddressTx(tx, "", 0)
+}
+
+// publishAddressTx publishes a transaction to the subscriptions of the
+// addresses it touches
+func (s *Server) publishAddressTx(tx *types.Transaction, blockHash string, height uint64) {
+	touched := txAddresses(tx)
+	if len(touched) == 0 {
+		return
+	}
+	var result *TxResult
+	s.publish(TopicAddressTx, func(sub *subscription) any {
+		var matched []string
+		for _, address := range touched {
+			if sub.addresses[address] {
+				matched = append(matched, address)
+			}
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+		if result == nil {
+			r := txResult(tx)
+			result = &r
+		}
+		return &TxEvent{TxResult: *result, Addresses: matched, BlockHash: blockHash, Height: height}
+	})
+}
+
+// newBlockEvent describes a block for its subscribers
+func newBlockEvent(block *types.Block) *BlockEvent {
+	event := &BlockEvent{
+		Hash:              hex.EncodeToString(block.Hash[:]),
+		Height:            block.Height,
+		PreviousBlockHash: hex.EncodeToString(block.Header.PrevBlockHash[:]),
+		Time:              block.Header.Timestamp,
+		TxIDs:             make([]string, len(block.Transactions)),
+	}
+	for i, tx := range block.Transactions {
+		event.TxIDs[i] = hex.EncodeToString(tx.Hash[:])
+	}
+	return event
+}
+
+// txAddresses returns the hex addresses a transaction pays to or spends
+// from, the address of an input is the hash of its public key
+func txAddresses(tx *types.Transaction) []string {
+	seen := make(map[string]bool)
+	var addresses []string
+	add := func(address []byte) {
+		s := hex.EncodeToString(address)
+		if len(address) == crypto.AddressLen && !seen[s] {
+			seen[s] = true
+			addresses = append(addresses, s)
+		}
+	}
+
+	if !tx.IsCoinbase() {
+		for _, input := range tx.Inputs {
+			add(crypto.BytesToAddress(input.PublicKey))
+		}
+	}
+	for _, output := range tx.Outputs {
+		add(output.PublicKeyHash)
+	}
+	return addresses
+}
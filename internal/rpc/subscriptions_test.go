@@ -0,0 +1,357 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// wsTestClient is the client side of a WebSocket connection to a server
+type wsTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	br     *bufio.Reader
+	nextID int
+}
+
+// writeMessage writes a text message in a single frame, masked as clients
+// must
+func (c *wsTestClient) writeMessage(data []byte) error {
+	frame := appendFrameHeader(nil, opText, len(data))
+	frame[1] |= 0x80
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readMessage reads a message of the server, which writes each in a single
+// unmasked frame. It returns io.EOF once the server closes the connection.
+func (c *wsTestClient) readMessage() ([]byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != 0x80|opText && head[0] != 0x80|opClose || head[1]&0x80 != 0 {
+		return nil, fmt.Errorf("unexpected frame header %x", head)
+	}
+	length := uint64(head[1])
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return nil, err
+	}
+	if head[0]&0x0f == opClose {
+		return nil, io.EOF
+	}
+	return payload, nil
+}
+
+// dialWebSocket opens a WebSocket connection to a server
+func dialWebSocket(t *testing.T, s *Server) *wsTestClient {
+	t.Helper()
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	resp, conn, br := wsHandshake(t, s, key, authHeader())
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		t.Fatalf("handshake = %s, accept %q, want 101 and %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"), wsAccept(key))
+	}
+	return &wsTestClient{t: t, conn: conn, br: br}
+}
+
+// authHeader returns the header authenticating with the test credentials
+func authHeader() http.Header {
+	return http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(testUser+":"+testPassword))}}
+}
+
+// wsHandshake sends an opening handshake with the extra header and returns
+// the response and the connection
+func wsHandshake(t *testing.T, s *Server, key string, header http.Header) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var request bytes.Buffer
+	request.WriteString("GET " + WebSocketPath + " HTTP/1.1\r\n" +
+		"Host: " + s.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n")
+	header.Write(&request)
+	request.WriteString("\r\n")
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	return resp, conn, br
+}
+
+// read returns the next message, failing the test after a timeout
+func (c *wsTestClient) read() map[string]json.RawMessage {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := c.readMessage()
+	if err != nil {
+		c.t.Fatalf("readMessage() error = %v", err)
+	}
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		c.t.Fatalf("invalid message %s: %v", data, err)
+	}
+	return message
+}
+
+// call sends a request and returns its response
+func (c *wsTestClient) call(method string, params ...any) *Response {
+	c.t.Helper()
+	c.nextID++
+	rawParams, _ := json.Marshal(params)
+	id, _ := json.Marshal(c.nextID)
+	data, _ := json.Marshal(&Request{JSONRPC: Version, Method: method, Params: rawParams, ID: id})
+	if err := c.writeMessage(data); err != nil {
+		c.t.Fatalf("writeMessage() error = %v", err)
+	}
+
+	message := c.read()
+	var resp Response
+	raw, _ := json.Marshal(message)
+	if err := json.Unmarshal(raw, &resp); err != nil || string(resp.ID) != string(id) {
+		c.t.Fatalf("response = %s, want the response to %s", raw, id)
+	}
+	return &resp
+}
+
+// subscribe subscribes to a topic and returns the subscription ID
+func (c *wsTestClient) subscribe(params ...any) uint64 {
+	c.t.Helper()
+	resp := c.call("subscribe", params...)
+	var id uint64
+	if resp.Error != nil || json.Unmarshal(resp.Result, &id) != nil {
+		c.t.Fatalf("subscribe(%v) = %s, %v", params, resp.Result, resp.Error)
+	}
+	return id
+}
+
+// event reads the next notification and decodes its event into v
+func (c *wsTestClient) event(v any) *SubscriptionParams {
+	c.t.Helper()
+	message := c.read()
+	var method string
+	json.Unmarshal(message["method"], &method)
+	var params SubscriptionParams
+	if method != NotificationMethod || json.Unmarshal(message["params"], &params) != nil {
+		c.t.Fatalf("message = %v, want a notification", message)
+	}
+	if err := json.Unmarshal(params.Result, v); err != nil {
+		c.t.Fatalf("invalid %s event %s: %v", params.Topic, params.Result, err)
+	}
+	return &params
+}
+
+func TestSubscribeBlocks(t *testing.T) {
+	chain := newTestChain(t)
+	s := newTestServer(t, chain, nil)
+	client := dialWebSocket(t, s)
+
+	connected := client.subscribe(TopicBlockConnected)
+	disconnected := client.subscribe(TopicBlockDisconnected)
+
+	// A fork of two blocks built on another chain replaces the first block
+	forkChain := newTestChain(t)
+	var fork []*types.Block
+	for i := 0; i < 2; i++ {
+		block := newBlockPaying(t, forkChain, []byte{4, 5, 6})
+		if err := forkChain.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock() error = %v", err)
+		}
+		fork = append(fork, block)
+	}
+
+	first := newBlock(t, chain)
+	if err := chain.AddBlock(first); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	for _, block := range fork {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("AddBlock() of the fork error = %v", err)
+		}
+	}
+
+	want := []struct {
+		sub   uint64
+		block *types.Block
+	}{
+		{connected, first},
+		{disconnected, first},
+		{connected, fork[0]},
+		{connected, fork[1]},
+	}
+	for i, w := range want {
+		var event BlockEvent
+		params := client.event(&event)
+		if params.Subscription != w.sub || event.Hash != hex.EncodeToString(w.block.Hash[:]) || event.Height != w.block.Height {
+			t.Fatalf("event %d = %d %+v, want subscription %d for block %x at %d", i, params.Subscription, event, w.sub, w.block.Hash, w.block.Height)
+		}
+		if len(event.TxIDs) != 1 || event.TxIDs[0] != hex.EncodeToString(w.block.Transactions[0].Hash[:]) {
+			t.Errorf("event %d txids = %v, want the coinbase", i, event.TxIDs)
+		}
+	}
+
+	if resp := client.call("unsubscribe", connected); resp.Error != nil {
+		t.Fatalf("unsubscribe error = %v", resp.Error)
+	}
+	if resp := client.call("unsubscribe", connected); resp.Error == nil || resp.Error.Code != CodeNotFound {
+		t.Errorf("unsubscribe twice error = %v, want code %d", resp.Error, CodeNotFound)
+	}
+	// Other methods are served over the same connection
+	if resp := client.call("getblockcount"); resp.Error != nil || string(resp.Result) != "2" {
+		t.Errorf("getblockcount = %s, %v, want 2", resp.Result, resp.Error)
+	}
+}
+
+func TestSubscribeTransactions(t *testing.T) {
+	chain := newTestChain(t)
+	s := newTestServer(t, chain, nil)
+	client := dialWebSocket(t, s)
+
+	payee := bytes.Repeat([]byte{0xab}, 20)
+	spender := []byte("public key of the spender")
+	spenderHash := sha256.Sum256(spender)
+	spenderAddress := hex.EncodeToString(spenderHash[:20])
+
+	mempool := client.subscribe(TopicMempoolTx)
+	address := client.subscribe(TopicAddressTx, []string{hex.EncodeToString(payee), spenderAddress})
+
+	tx := &types.Transaction{
+		Version: 1,
+		Inputs:  []types.TransactionInput{{PrevTxHash: [32]byte{1}, PublicKey: spender}},
+		Outputs: []types.TransactionOutput{{Amount: 1, PublicKeyHash: bytes.Repeat([]byte{0xcd}, 20)}},
+	}
+	tx.Hash = tx.ComputeHash()
+	s.NotifyTransaction(tx)
+
+	var event TxEvent
+	if params := client.event(&event); params.Subscription != mempool || event.TxID != hex.EncodeToString(tx.Hash[:]) || event.BlockHash != "" {
+		t.Errorf("mempool event = %d %+v, want subscription %d for %x", params.Subscription, event, mempool, tx.Hash)
+	}
+	event = TxEvent{}
+	if params := client.event(&event); params.Subscription != address || event.TxID != hex.EncodeToString(tx.Hash[:]) ||
+		len(event.Addresses) != 1 || event.Addresses[0] != spenderAddress {
+		t.Errorf("address event = %d %+v, want subscription %d for the spender", params.Subscription, event, address)
+	}
+
+	// Confirmed transactions carry their block
+	block := newBlockPaying(t, chain, payee)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatalf("AddBlock() error = %v", err)
+	}
+	event = TxEvent{}
+	if params := client.event(&event); params.Subscription != address || event.TxID != hex.EncodeToString(block.Transactions[0].Hash[:]) ||
+		event.BlockHash != hex.EncodeToString(block.Hash[:]) || event.Height != 1 || len(event.Outputs) != 1 {
+		t.Errorf("address event = %d %+v, want the coinbase of block %x", params.Subscription, event, block.Hash)
+	}
+
+	tests := []struct {
+		name   string
+		params []any
+	}{
+		{"unknown topic", []any{"blocks"}},
+		{"address without addresses", []any{TopicAddressTx}},
+		{"invalid address", []any{TopicAddressTx, []string{"abcd"}}},
+		{"block topic with addresses", []any{TopicBlockConnected, []string{strings.Repeat("ab", 20)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := client.call("subscribe", tt.params...); resp.Error == nil || resp.Error.Code != CodeInvalidParams {
+				t.Errorf("subscribe(%v) error = %v, want code %d", tt.params, resp.Error, CodeInvalidParams)
+			}
+		})
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	s := newTestServer(t, newTestChain(t), nil)
+
+	withOrigin := func(origin string) http.Header {
+		header := authHeader()
+		header.Set("Origin", origin)
+		return header
+	}
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"no credentials", http.Header{}, http.StatusUnauthorized},
+		{"cross origin", withOrigin("http://example.com"), http.StatusForbidden},
+		{"same origin", withOrigin("http://" + s.Addr().String()), http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _, _ := wsHandshake(t, s, "dGhlIHNhbXBsZSBub25jZQ==", tt.header)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("handshake status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.Addr().String()+WebSocketPath, nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	req.SetBasicAuth(testUser, testPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET without upgrade status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// Stopping the server closes open connections
+	client := dialWebSocket(t, s)
+	s.Stop()
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.readMessage(); err == nil {
+		t.Error("readMessage() after Stop error = nil")
+	}
+}
@@ -0,0 +1,205 @@
+package simnet
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// chunk is a write waiting to be read
+type chunk struct {
+	data []byte
+	at   time.Time // When the reader may see it
+}
+
+// pipe carries the writes of one direction of a connection
+type pipe struct {
+	mu           sync.Mutex
+	chunks       []chunk
+	last         time.Time // Delivery time of the last write, keeps writes in order
+	readerClosed bool
+	writerClosed bool
+	deadline     time.Time
+	changed      chan struct{} // Closed and replaced on every change
+}
+
+func newPipe() *pipe {
+	return &pipe{changed: make(chan struct{})}
+}
+
+// signal wakes up a blocked reader, the caller must hold the lock
+func (p *pipe) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// read blocks until a write is delivered, the deadline passes or either
+// end is closed
+func (p *pipe) read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		if p.readerClosed {
+			p.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		now := time.Now()
+		if !p.deadline.IsZero() && !now.Before(p.deadline) {
+			p.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		if len(p.chunks) > 0 && !now.Before(p.chunks[0].at) {
+			n := copy(b, p.chunks[0].data)
+			p.chunks[0].data = p.chunks[0].data[n:]
+			if len(p.chunks[0].data) == 0 {
+				p.chunks = p.chunks[1:]
+			}
+			p.mu.Unlock()
+			return n, nil
+		}
+		if len(p.chunks) == 0 && p.writerClosed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		wake := p.deadline
+		if len(p.chunks) > 0 && (wake.IsZero() || p.chunks[0].at.Before(wake)) {
+			wake = p.chunks[0].at
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if wake.IsZero() {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// write queues data for delivery after delay
+func (p *pipe) write(data []byte, delay time.Duration) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.writerClosed {
+		return 0, net.ErrClosed
+	}
+	if p.readerClosed {
+		return 0, io.ErrClosedPipe
+	}
+	at := time.Now().Add(delay)
+	if at.Before(p.last) {
+		at = p.last
+	}
+	p.last = at
+	p.chunks = append(p.chunks, chunk{data: append([]byte(nil), data...), at: at})
+	p.signal()
+	return len(data), nil
+}
+
+// setDeadline sets the read deadline
+func (p *pipe) setDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.deadline = t
+	p.signal()
+}
+
+// closeReader fails pending and future reads
+func (p *pipe) closeReader() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readerClosed = true
+	p.signal()
+}
+
+// closeWriter ends the stream once the queued writes are read
+func (p *pipe) closeWriter() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writerClosed = true
+	p.signal()
+}
+
+// conn is one end of a connection
+type conn struct {
+	network   *Network
+	local     *net.TCPAddr
+	remote    *net.TCPAddr
+	in        *pipe
+	out       *pipe
+	closeOnce sync.Once
+}
+
+// newConnPair returns both ends of a connection between local and remote
+func newConnPair(n *Network, local, remote *net.TCPAddr) (*conn, *conn) {
+	a, b := newPipe(), newPipe()
+	return &conn{network: n, local: local, remote: remote, in: a, out: b},
+		&conn{network: n, local: remote, remote: local, in: b, out: a}
+}
+
+// Read reads the data written by the other end
+func (c *conn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+// Write sends b to the other end, unless the network drops it
+func (c *conn) Write(b []byte) (int, error) {
+	if c.network.drop() {
+		c.out.mu.Lock()
+		closed := c.out.writerClosed
+		c.out.mu.Unlock()
+		if closed {
+			return 0, net.ErrClosed
+		}
+		return len(b), nil
+	}
+	return c.out.write(b, c.network.delay())
+}
+
+// Close closes this end, the other end reads the data already written and
+// then io.EOF
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.in.closeReader()
+		c.out.closeWriter()
+		c.network.removeConn(c)
+	})
+	return nil
+}
+
+// LocalAddr returns the address of this end
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the other end
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read deadline, writes never block
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the time after which reads fail
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes are queued without blocking
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package simnet is an in-memory network for tests. Hosts listen and dial
+// through it like through the net package, while the test delays and drops
+// writes and splits the hosts into partitions.
+package simnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// firstEphemeralPort is the first port assigned to dialing connections and
+// to listeners on port 0
+const firstEphemeralPort = 49152
+
+// acceptBacklog is the number of connections queued for Accept before
+// dials are refused
+const acceptBacklog = 16
+
+var (
+	// ErrRefused is returned when dialing an address nobody listens on
+	ErrRefused = errors.New("connection refused")
+
+	// ErrUnreachable is returned when dialing across a partition
+	ErrUnreachable = errors.New("network unreachable")
+
+	// ErrAddrInUse is returned when listening on an address twice
+	ErrAddrInUse = errors.New("address already in use")
+)
+
+// Network connects the hosts of a simulation
+type Network struct {
+	mu        sync.Mutex
+	rng       *rand.Rand
+	latency   time.Duration
+	loss      float64
+	dropped   int
+	listeners map[string]*listener
+	conns     map[*conn]struct{}
+	groups    map[string]int // Partition of each host, unlisted hosts are in 0
+	nextPort  map[string]int
+}
+
+// New creates a network without latency, loss or partitions. The seed fixes
+// the sequence of drop decisions, not which writes they hit: concurrent
+// writers take their turns in the order the scheduler runs them.
+func New(seed uint64) *Network {
+	return &Network{
+		rng:       rand.New(rand.NewPCG(seed, seed)),
+		listeners: make(map[string]*listener),
+		conns:     make(map[*conn]struct{}),
+		groups:    make(map[string]int),
+		nextPort:  make(map[string]int),
+	}
+}
+
+// Host returns the host with the IP address ip. Its Listen and Dial
+// methods match the net package functions.
+func (n *Network) Host(ip string) *Host {
+	return &Host{network: n, ip: net.ParseIP(ip)}
+}
+
+// SetLatency delays every write by d before the other end can read it
+func (n *Network) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.latency = d
+}
+
+// SetLoss drops writes with probability rate. Writes are dropped whole,
+// so a protocol writing one message at a time loses whole messages.
+func (n *Network) SetLoss(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.loss = rate
+}
+
+// Dropped returns the number of writes dropped so far
+func (n *Network) Dropped() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.dropped
+}
+
+// Partition splits the network into groups of hosts that can't reach each
+// other, hosts in no group form one more group. Connections across the
+// groups are closed and dials across them fail.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	clear(n.groups)
+	for i, group := range groups {
+		for _, host := range group {
+			n.groups[host] = i + 1
+		}
+	}
+	var cut []*conn
+	for c := range n.conns {
+		if !n.reachable(c.local.IP.String(), c.remote.IP.String()) {
+			cut = append(cut, c)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, c := range cut {
+		c.Close()
+	}
+}
+
+// Heal removes all partitions
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// reachable reports whether host a can reach host b, the caller must hold
+// the lock
+func (n *Network) reachable(a, b string) bool {
+	return n.groups[a] == n.groups[b]
+}
+
+// drop reports whether the next write is lost
+func (n *Network) drop() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.loss > 0 && n.rng.Float64() < n.loss {
+		n.dropped++
+		return true
+	}
+	return false
+}
+
+// delay returns the current latency
+func (n *Network) delay() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.latency
+}
+
+// ephemeralPort returns an unused port of host, the caller must hold the
+// lock
+func (n *Network) ephemeralPort(host string) int {
+	if n.nextPort[host] == 0 {
+		n.nextPort[host] = firstEphemeralPort
+	}
+	port := n.nextPort[host]
+	n.nextPort[host]++
+	return port
+}
+
+// removeConn forgets a closed connection
+func (n *Network) removeConn(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.conns, c)
+}
+
+// Host is a machine on the network
+type Host struct {
+	network *Network
+	ip      net.IP
+}
+
+// Listen accepts connections on address. Its host part must be empty,
+// unspecified or the host's IP, port 0 picks a free port.
+func (h *Host) Listen(network, address string) (net.Listener, error) {
+	hostPart, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(hostPart); hostPart != "" && !ip.IsUnspecified() && !ip.Equal(h.ip) {
+		return nil, fmt.Errorf("listen %s: address is not of host %s", address, h.ip)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: invalid port", address)
+	}
+
+	n := h.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == 0 {
+		port = n.ephemeralPort(h.ip.String())
+	}
+	addr := &net.TCPAddr{IP: h.ip, Port: port}
+	if _, ok := n.listeners[addr.String()]; ok {
+		return nil, fmt.Errorf("listen %s: %w", addr, ErrAddrInUse)
+	}
+	l := &listener{
+		network: n,
+		addr:    addr,
+		accept:  make(chan *conn, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[addr.String()] = l
+	return l, nil
+}
+
+// Dial connects to a listener at address, an ip:port
+func (h *Host) Dial(network, address string) (net.Conn, error) {
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	n := h.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.reachable(h.ip.String(), remote.IP.String()) {
+		return nil, fmt.Errorf("dial %s: %w", address, ErrUnreachable)
+	}
+	l, ok := n.listeners[remote.String()]
+	if !ok {
+		return nil, fmt.Errorf("dial %s: %w", address, ErrRefused)
+	}
+
+	local := &net.TCPAddr{IP: h.ip, Port: n.ephemeralPort(h.ip.String())}
+	client, server := newConnPair(n, local, l.addr)
+	select {
+	case l.accept <- server:
+	default:
+		return nil, fmt.Errorf("dial %s: backlog full: %w", address, ErrRefused)
+	}
+	n.conns[client] = struct{}{}
+	n.conns[server] = struct{}{}
+	return client, nil
+}
+
+// listener accepts the connections dialed to its address
+type listener struct {
+	network   *Network
+	addr      *net.TCPAddr
+	accept    chan *conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept waits for the next connection
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes the connections not accepted yet
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.addr.String())
+		l.network.mu.Unlock()
+
+		close(l.closed)
+		for {
+			select {
+			case c := <-l.accept:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// Addr returns the address the listener accepts on
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,151 @@
+package simnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// dialPair connects host a to a listener on host b and returns both ends
+func dialPair(t *testing.T, n *Network, a, b string) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := n.Host(b).Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	client, err := n.Host(a).Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestConn(t *testing.T) {
+	n := New(1)
+	client, server := dialPair(t, n, "10.0.0.1", "10.0.0.2")
+
+	if got := server.RemoteAddr().String(); got != client.LocalAddr().String() || got[:9] != "10.0.0.1:" {
+		t.Errorf("RemoteAddr() = %s, want the dialing end %s", got, client.LocalAddr())
+	}
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 3)
+	if n, _ := server.Read(buf); string(buf[:n]) != "hel" {
+		t.Errorf("Read() = %q, want %q", buf[:n], "hel")
+	}
+	if n, _ := server.Read(buf); string(buf[:n]) != "lo" {
+		t.Errorf("Read() = %q, want %q", buf[:n], "lo")
+	}
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() past the deadline error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	// The other end reads what was written before the close, then EOF
+	client.Write([]byte("bye"))
+	client.Close()
+	if n, _ := server.Read(buf); string(buf[:n]) != "bye" {
+		t.Errorf("Read() after close = %q, want %q", buf[:n], "bye")
+	}
+	if _, err := server.Read(buf); err != io.EOF {
+		t.Errorf("Read() error = %v, want EOF", err)
+	}
+	if _, err := server.Write(buf); err == nil {
+		t.Error("Write() to a closed connection error = nil")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	n := New(1)
+	n.SetLatency(50 * time.Millisecond)
+	client, server := dialPair(t, n, "10.0.0.1", "10.0.0.2")
+
+	start := time.Now()
+	client.Write([]byte("a"))
+	client.Write([]byte("b"))
+	buf := make([]byte, 2)
+	for _, want := range []string{"a", "b"} {
+		if n, _ := server.Read(buf); string(buf[:n]) != want {
+			t.Errorf("Read() = %q, want %q", buf[:n], want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("writes arrived after %v, want at least the latency", elapsed)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	n := New(1)
+	n.SetLoss(0.5)
+	client, server := dialPair(t, n, "10.0.0.1", "10.0.0.2")
+
+	const writes = 1000
+	for i := 0; i < writes; i++ {
+		client.Write([]byte{1})
+	}
+	client.Close()
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if len(data) < writes/3 || len(data) > 2*writes/3 {
+		t.Errorf("%d of %d writes arrived, want about half", len(data), writes)
+	}
+	if got := n.Dropped(); got != writes-len(data) {
+		t.Errorf("Dropped() = %d, want %d", got, writes-len(data))
+	}
+}
+
+func TestPartition(t *testing.T) {
+	n := New(1)
+	l, err := n.Host("10.0.0.2").Listen("tcp", ":8333")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	if _, err := n.Host("10.0.0.2").Listen("tcp", "10.0.0.2:8333"); !errors.Is(err, ErrAddrInUse) {
+		t.Errorf("Listen() twice error = %v, want %v", err, ErrAddrInUse)
+	}
+	if _, err := n.Host("10.0.0.1").Dial("tcp", "10.0.0.3:8333"); !errors.Is(err, ErrRefused) {
+		t.Errorf("Dial() without listener error = %v, want %v", err, ErrRefused)
+	}
+
+	client, server := dialPair(t, n, "10.0.0.1", "10.0.0.3")
+	n.Partition([]string{"10.0.0.1"}, []string{"10.0.0.2", "10.0.0.3"})
+
+	buf := make([]byte, 1)
+	if _, err := server.Read(buf); err == nil {
+		t.Error("Read() across a partition error = nil")
+	}
+	if _, err := client.Write(buf); err == nil {
+		t.Error("Write() across a partition error = nil")
+	}
+	if _, err := n.Host("10.0.0.1").Dial("tcp", "10.0.0.2:8333"); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Dial() across a partition error = %v, want %v", err, ErrUnreachable)
+	}
+	if _, err := n.Host("10.0.0.3").Dial("tcp", "10.0.0.2:8333"); err != nil {
+		t.Errorf("Dial() within a partition error = %v", err)
+	}
+
+	n.Heal()
+	if _, err := n.Host("10.0.0.1").Dial("tcp", "10.0.0.2:8333"); err != nil {
+		t.Errorf("Dial() after Heal() error = %v", err)
+	}
+}
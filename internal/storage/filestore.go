@@ -1,143 +1,316 @@
 package storage
 
 import (
-	"encoding/json"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
 	"github.com/fkapsahili/mini-blockchain/internal/types"
 )
 
+const (
+	// blockFilePrefix and blockFileExt surround the hex block hash in block file names
+	blockFilePrefix = "block_"
+	blockFileExt    = ".dat"
+
+	// legacyBlockFileExt ends the block files of the JSON format used before
+	// the binary codec
+	legacyBlockFileExt = ".json"
+
+	// bestBlockFile holds the hex hash of the best chain tip
+	bestBlockFile = "best_block"
+)
+
+// blockFileMagic starts every block file, followed by the codec version
+var blockFileMagic = [4]byte{'m', 'b', 'l', 'k'}
+
+// ErrReadOnly is returned when writing to a store opened read-only
+var ErrReadOnly = errors.New("store is opened read-only")
+
+// ErrLegacyFormat is returned when a data directory opened read-only holds
+// blocks of the JSON format or an older codec version, which are migrated
+// only in read-write mode
+var ErrLegacyFormat = errors.New("data directory holds blocks in an old format")
+
 type FileStore struct {
-	dataDir     string
-	latestBlock *types.Block
-	mu          sync.RWMutex
+	dataDir  string
+	readOnly bool
+	lock     *DirLock
+	mu       sync.RWMutex
 }
 
-// NewFileStore creates a new file-based store
+// NewFileStore creates a new file-based store in read-write mode
 func NewFileStore(dataDir string) (*FileStore, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	return OpenFileStore(dataDir, false)
+}
+
+// OpenFileStore opens a file-based store and locks its data directory.
+// A read-only store takes a shared lock and requires the directory to exist.
+func OpenFileStore(dataDir string, readOnly bool) (*FileStore, error) {
+	if readOnly {
+		if _, err := os.Stat(dataDir); err != nil {
+			return nil, fmt.Errorf("failed to open data directory: %w", err)
+		}
+	} else if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	store := &FileStore{
-		dataDir: dataDir,
+	lock, err := LockDir(dataDir, !readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dataDir, err)
 	}
 
-	latest, err := store.GetLatestBlock()
-	if err == nil {
-		store.latestBlock = latest
+	if err := migrate(dataDir, readOnly); err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("%s: %w", dataDir, err)
 	}
 
-	return store, nil
+	return &FileStore{
+		dataDir:  dataDir,
+		readOnly: readOnly,
+		lock:     lock,
+	}, nil
+}
+
+// migrate rewrites the blocks of the JSON format, and then those of older
+// codec versions, once before the store is used
+func migrate(dataDir string, readOnly bool) error {
+	formats := []struct {
+		files  func(dataDir string) ([]string, error)
+		decode func(data []byte) (*types.Block, error)
+	}{
+		{legacyBlockFiles, decodeJSONBlock},
+		{outdatedBlockFiles, decodeV1Block},
+	}
+	for _, format := range formats {
+		files, err := format.files(dataDir)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		if readOnly {
+			return fmt.Errorf("%w, open it read-write once to migrate it", ErrLegacyFormat)
+		}
+		if err := migrateBlocks(dataDir, files, format.decode); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// blockPath returns the file path for a block at given height
-func (f *FileStore) blockPath(height uint64) string {
-	return filepath.Join(f.dataDir, fmt.Sprintf("block_%d.json", height))
+// ReadOnly reports whether the store was opened read-only
+func (f *FileStore) ReadOnly() bool {
+	return f.readOnly
 }
 
-func (f *FileStore) SaveBlock(block *types.Block) error {
+// Close releases the data directory lock
+func (f *FileStore) Close() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	data, err := json.Marshal(block)
-	if err != nil {
-		return fmt.Errorf("failed to marshal block: %w", err)
-	}
+	return f.lock.Unlock()
+}
+
+// blockPath returns the file path for the block with the given hash
+func (f *FileStore) blockPath(hash [32]byte) string {
+	return filepath.Join(f.dataDir, blockFilePrefix+hex.EncodeToString(hash[:])+blockFileExt)
+}
+
+func (f *FileStore) SaveBlock(block *types.Block) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	path := f.blockPath(block.Height)
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		return fmt.Errorf("failed to write block file: %w", err)
+	if f.readOnly {
+		return ErrReadOnly
 	}
 
-	f.latestBlock = block
-	return nil
+	return WriteFileAtomic(f.blockPath(block.Hash), encodeBlockFile(block))
 }
 
-func (f *FileStore) GetBlock(height uint64) (*types.Block, error) {
+func (f *FileStore) GetBlockByHash(hash [32]byte) (*types.Block, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	// Read block file
-	data, err := os.ReadFile(f.blockPath(height))
-	if err != nil {
-		return nil, fmt.Errorf("failed to read block file: %w", err)
+	block, err := f.readBlock(f.blockPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("block %x: %w", hash, ErrNotFound)
 	}
+	return block, err
+}
 
-	// Deserialize
-	var block types.Block
-	if err := json.Unmarshal(data, &block); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal block: %w", err)
-	}
+// HasBlock reports whether a block with the given hash is stored
+func (f *FileStore) HasBlock(hash [32]byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 
-	return &block, nil
+	_, err := os.Stat(f.blockPath(hash))
+	return err == nil
 }
 
-func (f *FileStore) GetBlockByHash(hash [32]byte) (*types.Block, error) {
+// ForEachBlock calls fn for every stored block in no particular order
+func (f *FileStore) ForEachBlock(fn func(block *types.Block) error) error {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	// For production, we'd want to maintain a hash -> height index
 	files, err := os.ReadDir(f.dataDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read data directory: %w", err)
+		return fmt.Errorf("failed to read data directory: %w", err)
 	}
 
 	for _, file := range files {
-		if filepath.Ext(file.Name()) != ".json" {
+		name := file.Name()
+		if !strings.HasPrefix(name, blockFilePrefix) || !strings.HasSuffix(name, blockFileExt) {
 			continue
 		}
 
-		data, err := os.ReadFile(filepath.Join(f.dataDir, file.Name()))
+		block, err := f.readBlock(filepath.Join(f.dataDir, name))
 		if err != nil {
-			continue
+			return err
 		}
-
-		var block types.Block
-		if err := json.Unmarshal(data, &block); err != nil {
-			continue
+		if err := fn(block); err != nil {
+			return err
 		}
+	}
 
-		if block.Hash == hash {
-			return &block, nil
-		}
+	return nil
+}
+
+// readBlock reads and decodes a block file, the caller must hold the lock
+func (f *FileStore) readBlock(path string) (*types.Block, error) {
+	// Read block file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block file: %w", err)
+	}
+
+	block, err := decodeBlockFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", filepath.Base(path), err)
+	}
+
+	return block, nil
+}
+
+// encodeBlockFile returns the block file contents: the magic, the codec
+// version and the encoded block
+func encodeBlockFile(block *types.Block) []byte {
+	var buf bytes.Buffer
+	buf.Write(blockFileMagic[:])
+	w := codec.NewWriter(&buf)
+	w.WriteUint32(codec.Version)
+	block.Encode(w)
+	return buf.Bytes()
+}
+
+// decodeBlockFile is the inverse of encodeBlockFile
+func decodeBlockFile(data []byte) (*types.Block, error) {
+	if len(data) < len(blockFileMagic)+4 || !bytes.Equal(data[:len(blockFileMagic)], blockFileMagic[:]) {
+		return nil, errors.New("not a block file")
+	}
+	data = data[len(blockFileMagic):]
+
+	if version := binary.LittleEndian.Uint32(data); version != codec.Version {
+		return nil, fmt.Errorf("unsupported encoding version %d", version)
 	}
 
-	return nil, fmt.Errorf("block not found with hash %x", hash)
+	var block types.Block
+	if err := codec.Unmarshal(data[4:], &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
 }
 
-func (f *FileStore) GetLatestBlock() (*types.Block, error) {
+// GetBestBlock returns the hash of the best chain tip
+func (f *FileStore) GetBestBlock() ([32]byte, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	if f.latestBlock != nil {
-		return f.latestBlock, nil
+	var hash [32]byte
+	data, err := os.ReadFile(filepath.Join(f.dataDir, bestBlockFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return hash, fmt.Errorf("best block: %w", ErrNotFound)
 	}
-
-	// Find the highest block number
-	files, err := os.ReadDir(f.dataDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read data directory: %w", err)
+		return hash, fmt.Errorf("failed to read best block: %w", err)
 	}
 
-	var highestHeight uint64
-	for _, file := range files {
-		var height uint64
-		_, err := fmt.Sscanf(file.Name(), "block_%d.json", &height)
-		if err != nil {
-			continue
-		}
-		if height > highestHeight {
-			highestHeight = height
-		}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(decoded) != len(hash) {
+		return hash, fmt.Errorf("corrupt best block file")
 	}
+	copy(hash[:], decoded)
 
-	if highestHeight == 0 {
-		return nil, fmt.Errorf("no blocks found")
+	return hash, nil
+}
+
+// SetBestBlock records the hash of the best chain tip
+func (f *FileStore) SetBestBlock(hash [32]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.readOnly {
+		return ErrReadOnly
 	}
 
-	return f.GetBlock(highestHeight)
+	return WriteFileAtomic(filepath.Join(f.dataDir, bestBlockFile), []byte(hex.EncodeToString(hash[:])))
+}
+
+// WriteFileAtomic replaces the file at path so that readers never see a
+// partially written file, and a crash leaves either the old or the new
+// contents
+func WriteFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	file, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	tmp := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", name, err)
+	}
+	// The rename is only durable once the directory entry is
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync directory of %s: %w", name, err)
+	}
+	return nil
+}
+
+// syncDir flushes the entries of a directory to disk
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
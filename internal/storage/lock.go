@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the name of the lock file inside the data directory
+const lockFileName = "LOCK"
+
+// ErrLocked is returned when the data directory is held by another process
+var ErrLocked = errors.New("data directory is locked by another process")
+
+// DirLock is an advisory lock on a data directory. Writers hold it
+// exclusively, readers share it, so a running node and an offline command
+// never touch the same directory at once.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir acquires a lock on dir. An exclusive lock excludes all other
+// holders, a shared lock only excludes exclusive holders.
+func LockDir(dir string, exclusive bool) (*DirLock, error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &DirLock{file: file}, nil
+}
+
+// Unlock releases the lock
+func (l *DirLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	unlockFile(l.file)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+const (
+	// v1WitnessRootOffset is where version 2 inserted the witness root into
+	// the encoded header, right after the Merkle root
+	v1WitnessRootOffset = 4 + 32 + 32
+
+	// v1HeaderSize is the length of a version 1 header
+	v1HeaderSize = types.BlockHeaderSize - 32
+)
+
+// legacyBlockFiles returns the JSON block files in a data directory
+func legacyBlockFiles(dataDir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dataDir, blockFilePrefix+"*"+legacyBlockFileExt))
+}
+
+// outdatedBlockFiles returns the block files written with an older codec
+// version
+func outdatedBlockFiles(dataDir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir, blockFilePrefix+"*"+blockFileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var outdated []string
+	for _, path := range paths {
+		version, err := blockFileVersion(path)
+		if err != nil {
+			return nil, err
+		}
+		if version < codec.Version {
+			outdated = append(outdated, path)
+		}
+	}
+	return outdated, nil
+}
+
+// blockFileVersion reads the codec version of a block file, files that
+// aren't block files are reported as current for the decoder to refuse
+func blockFileVersion(path string) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+	}
+	defer file.Close()
+
+	var head [len(blockFileMagic) + 4]byte
+	if _, err := io.ReadFull(file, head[:]); err != nil || !bytes.Equal(head[:len(blockFileMagic)], blockFileMagic[:]) {
+		return codec.Version, nil
+	}
+	return binary.LittleEndian.Uint32(head[len(blockFileMagic):]), nil
+}
+
+// decodeJSONBlock decodes a block file of the JSON format
+func decodeJSONBlock(data []byte) (*types.Block, error) {
+	var block types.Block
+	if err := json.Unmarshal(data, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// decodeV1Block decodes a block file of codec version 1, whose header had
+// no witness root. The root is left zero for the migration to compute, the
+// hash is the one the block was stored under.
+func decodeV1Block(data []byte) (*types.Block, error) {
+	data = data[len(blockFileMagic)+4:]
+	if len(data) < v1HeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	upgraded := make([]byte, 0, len(data)+32)
+	upgraded = append(upgraded, data[:v1WitnessRootOffset]...)
+	upgraded = append(upgraded, make([]byte, 32)...)
+	upgraded = append(upgraded, data[v1WitnessRootOffset:]...)
+
+	var block types.Block
+	if err := codec.Unmarshal(upgraded, &block); err != nil {
+		return nil, err
+	}
+	block.Hash = crypto.Hash(data[:v1HeaderSize])
+	return &block, nil
+}
+
+// oldBlock is a block read from a file of an older format
+type oldBlock struct {
+	path  string
+	block *types.Block
+}
+
+// migrateBlocks rewrites block files of an older format, read with decode,
+// as block files of the current codec. The hashes recorded in the old
+// files were computed from an older header encoding, so every block is
+// hashed again and the references to its hash and to the hashes of its
+// transactions are updated in height order. The old files are removed only
+// once the new files and the best block are written, children first, so
+// an interrupted migration runs again on the next open and finds the
+// parents of the blocks it already rewrote.
+func migrateBlocks(dataDir string, files []string, decode func(data []byte) (*types.Block, error)) error {
+	blocks := make([]oldBlock, 0, len(files))
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+		}
+		block, err := decode(data)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", filepath.Base(path), err)
+		}
+		blocks = append(blocks, oldBlock{path: path, block: block})
+	}
+
+	// Parents always have a lower height than their children
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].block.Height < blocks[j].block.Height
+	})
+	best, err := oldBestBlock(dataDir, blocks)
+	if err != nil {
+		return err
+	}
+
+	blockHashes := make(map[[32]byte][32]byte, len(blocks))
+	txHashes := make(map[[32]byte][32]byte)
+	for _, old := range blocks {
+		block := old.block
+		if hash, ok := blockHashes[block.Header.PrevBlockHash]; ok {
+			block.Header.PrevBlockHash = hash
+		}
+		for i := range block.Transactions {
+			tx := &block.Transactions[i]
+			for j := range tx.Inputs {
+				if hash, ok := txHashes[tx.Inputs[j].PrevTxHash]; ok {
+					tx.Inputs[j].PrevTxHash = hash
+				}
+			}
+			oldHash := tx.Hash
+			tx.Hash = tx.ComputeHash()
+			txHashes[oldHash] = tx.Hash
+		}
+
+		oldHash := block.Hash
+		block.UpdateHash()
+		blockHashes[oldHash] = block.Hash
+
+		// Check the block survives the codec before anything is replaced
+		var decoded types.Block
+		if err := codec.Unmarshal(codec.Marshal(block), &decoded); err != nil {
+			return fmt.Errorf("failed to encode block at height %d: %w", block.Height, err)
+		}
+		path := filepath.Join(dataDir, blockFilePrefix+hex.EncodeToString(block.Hash[:])+blockFileExt)
+		if err := WriteFileAtomic(path, encodeBlockFile(block)); err != nil {
+			return err
+		}
+	}
+
+	if hash, ok := blockHashes[best]; ok {
+		best = hash
+	}
+	if err := WriteFileAtomic(filepath.Join(dataDir, bestBlockFile), []byte(hex.EncodeToString(best[:]))); err != nil {
+		return err
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err := os.Remove(blocks[i].path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", filepath.Base(blocks[i].path), err)
+		}
+	}
+	return nil
+}
+
+// oldBestBlock returns the recorded tip of a data directory being migrated.
+// The oldest format recorded none, its tip is the highest block.
+func oldBestBlock(dataDir string, blocks []oldBlock) ([32]byte, error) {
+	var hash [32]byte
+	data, err := os.ReadFile(filepath.Join(dataDir, bestBlockFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return blocks[len(blocks)-1].block.Hash, nil
+	}
+	if err != nil {
+		return hash, fmt.Errorf("failed to read best block: %w", err)
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(decoded) != len(hash) {
+		return hash, fmt.Errorf("corrupt best block file")
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
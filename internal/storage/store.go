@@ -1,10 +1,23 @@
 package storage
 
-import "github.com/fkapsahili/mini-blockchain/internal/types"
+import (
+	"errors"
 
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// ErrNotFound is returned when the requested data is not in the store
+var ErrNotFound = errors.New("not found")
+
+// ChainStore persists blocks of all branches by hash, along with the hash
+// of the tip of the best chain
 type ChainStore interface {
 	SaveBlock(block *types.Block) error
-	GetBlock(height uint64) (*types.Block, error)
 	GetBlockByHash(hash [32]byte) (*types.Block, error)
-	GetLatestBlock() (*types.Block, error)
+	HasBlock(hash [32]byte) bool
+	ForEachBlock(fn func(block *types.Block) error) error
+	GetBestBlock() ([32]byte, error)
+	SetBestBlock(hash [32]byte) error
+	ReadOnly() bool
+	Close() error
 }
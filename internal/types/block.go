@@ -1,21 +1,33 @@
 package types
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 	"time"
 
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
 	"github.com/fkapsahili/mini-blockchain/internal/crypto"
 )
 
+const (
+	// BlockHeaderSize is the length of an encoded block header
+	BlockHeaderSize = 4 + 32 + 32 + 32 + 8 + 4 + 4
+
+	// MaxBlockSize is the largest encoded block that is accepted or decoded
+	MaxBlockSize = 4 << 20
+
+	// MaxBlockSigOps bounds the signature checks of a block, keeping the
+	// time to validate it in line with its size
+	MaxBlockSigOps = 20_000
+)
+
 // BlockHeaders contains metadata about a block
 type BlockHeader struct {
 	Version       int32
 	PrevBlockHash [32]byte
-	MerkleRoot    [32]byte
+	MerkleRoot    [32]byte // Commits to the transaction IDs
+	WitnessRoot   [32]byte // Commits to the full transactions, signatures included
 	Timestamp     time.Time
-	Difficulty    uint32
+	Difficulty    uint32 // Compact-encoded target the block hash must not exceed
 	Nonce         uint32
 }
 
@@ -27,25 +39,74 @@ type Block struct {
 	Height       uint64
 }
 
-// getHeaderBytes serializes block header fields in bytes for hashing
+// GetHeaderBytes returns the encoded block header for hashing
 func (b *Block) GetHeaderBytes() []byte {
-	buf := new(bytes.Buffer)
+	return codec.Marshal(&b.Header)
+}
+
+// Encode writes the canonical encoding of the header. All fields have a
+// fixed size and the nonce goes last so miners can update it in place.
+func (h *BlockHeader) Encode(w *codec.Writer) {
+	w.WriteInt32(h.Version)
+	w.WriteHash(h.PrevBlockHash)
+	w.WriteHash(h.MerkleRoot)
+	w.WriteHash(h.WitnessRoot)
+	w.WriteInt64(h.Timestamp.UnixNano())
+	w.WriteUint32(h.Difficulty)
+	w.WriteUint32(h.Nonce)
+}
+
+// Decode reads a header written by Encode
+func (h *BlockHeader) Decode(r *codec.Reader) {
+	h.Version = r.ReadInt32()
+	h.PrevBlockHash = r.ReadHash()
+	h.MerkleRoot = r.ReadHash()
+	h.WitnessRoot = r.ReadHash()
+	h.Timestamp = time.Unix(0, r.ReadInt64()).UTC()
+	h.Difficulty = r.ReadUint32()
+	h.Nonce = r.ReadUint32()
+}
+
+// Encode writes the canonical encoding of the block: the header, the
+// height and the transactions. The hash is derived from the header.
+func (b *Block) Encode(w *codec.Writer) {
+	b.Header.Encode(w)
+	w.WriteUint64(b.Height)
+	w.WriteVarInt(uint64(len(b.Transactions)))
+	for i := range b.Transactions {
+		b.Transactions[i].Encode(w)
+	}
+}
 
-	// Write all header fields in order
-	binary.Write(buf, binary.LittleEndian, b.Header.Version)
-	buf.Write(b.Header.PrevBlockHash[:])
-	buf.Write(b.Header.MerkleRoot[:])
-	binary.Write(buf, binary.LittleEndian, b.Header.Timestamp.Unix())
-	binary.Write(buf, binary.LittleEndian, b.Header.Difficulty)
-	binary.Write(buf, binary.LittleEndian, b.Header.Nonce)
+// Decode reads a block written by Encode and computes its hash
+func (b *Block) Decode(r *codec.Reader) {
+	*b = Block{}
+	b.Header.Decode(r)
+	b.Height = r.ReadUint64()
+	if n := r.ReadCountOf(MaxBlockSize/minTransactionSize, minTransactionSize); n > 0 {
+		b.Transactions = make([]Transaction, n)
+	}
+	for i := range b.Transactions {
+		b.Transactions[i].Decode(r)
+	}
+	if r.Err() == nil {
+		b.Hash = b.ComputeHash()
+	}
+}
 
-	return buf.Bytes()
+// SerializeSize returns the length of the encoded block
+func (b *Block) SerializeSize() int {
+	return len(codec.Marshal(b))
 }
 
 // ComputeHash calculates the hash of the block
 func (b *Block) ComputeHash() [32]byte {
-	headerBytes := b.GetHeaderBytes()
-	return crypto.Hash(headerBytes)
+	return b.Header.ComputeHash()
+}
+
+// ComputeHash calculates the hash of the header, which identifies its block
+func (h *BlockHeader) ComputeHash() [32]byte {
+	return crypto.Hash(codec.Marshal(h))
 }
 
 // ComputeMerkleRoot calculates the Merkle root of transactions
@@ -56,11 +117,36 @@ func (b *Block) ComputeMerkleRoot() [32]byte {
 	}
 
 	hashes := make([][32]byte, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		hashes[i] = tx.Hash
+	}
 	return crypto.CalculateMerkleRoot(hashes)
 }
 
-// UpdateHash updates both Merkle root and block hash
-func (b *Block) UpdateHash() {
+// ComputeWitnessRoot calculates the Merkle root of the witness hashes of
+// the transactions. Transaction IDs leave out the signatures, this root
+// keeps a block hash from standing for more than one block.
+func (b *Block) ComputeWitnessRoot() [32]byte {
+	if len(b.Transactions) == 0 {
+		return sha256.Sum256([]byte{})
+	}
+
+	hashes := make([][32]byte, len(b.Transactions))
+	for i := range b.Transactions {
+		hashes[i] = b.Transactions[i].WitnessHash()
+	}
+	return crypto.CalculateMerkleRoot(hashes)
+}
+
+// UpdateRoots updates the Merkle and witness roots after the transactions
+// changed
+func (b *Block) UpdateRoots() {
 	b.Header.MerkleRoot = b.ComputeMerkleRoot()
+	b.Header.WitnessRoot = b.ComputeWitnessRoot()
+}
+
+// UpdateHash updates both roots and the block hash
+func (b *Block) UpdateHash() {
+	b.UpdateRoots()
 	b.Hash = b.ComputeHash()
 }
@@ -0,0 +1,159 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+)
+
+func testBlock(t *testing.T) *Block {
+	t.Helper()
+	block := &Block{
+		Header: BlockHeader{
+			Version:       1,
+			PrevBlockHash: [32]byte{0xaa},
+			Timestamp:     time.Date(2025, 3, 1, 12, 0, 0, 123456789, time.UTC),
+			Difficulty:    0x207fffff,
+			Nonce:         42,
+		},
+		Height:       7,
+		Transactions: []Transaction{NewCoinbaseTransaction(7, 1, []TransactionOutput{{Amount: 50, PublicKeyHash: make([]byte, 20)}})},
+	}
+	block.Transactions = append(block.Transactions, signedTransaction(t))
+	block.UpdateHash()
+	return block
+}
+
+func TestBlockEncodeRoundTrip(t *testing.T) {
+	block := testBlock(t)
+	data := codec.Marshal(block)
+
+	var decoded Block
+	if err := codec.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, block) {
+		t.Errorf("Unmarshal() = %+v, want %+v", decoded, *block)
+	}
+	if block.SerializeSize() != len(data) {
+		t.Errorf("SerializeSize() = %d, want %d", block.SerializeSize(), len(data))
+	}
+}
+
+func TestHeaderBytes(t *testing.T) {
+	block := testBlock(t)
+	header := block.GetHeaderBytes()
+	if len(header) != BlockHeaderSize {
+		t.Fatalf("len(GetHeaderBytes()) = %d, want %d", len(header), BlockHeaderSize)
+	}
+
+	// The nonce is the last field so miners can patch it in place
+	if got := header[len(header)-4:]; got[0] != 42 || got[1] != 0 {
+		t.Errorf("nonce bytes = %x, want 2a000000", got)
+	}
+
+	// Sub-second timestamps are part of the hash
+	other := *block
+	other.Header.Timestamp = block.Header.Timestamp.Add(time.Nanosecond)
+	if other.ComputeHash() == block.ComputeHash() {
+		t.Error("ComputeHash() should change with the timestamp nanoseconds")
+	}
+}
+
+func TestWitnessRoot(t *testing.T) {
+	block := testBlock(t)
+	if block.Header.WitnessRoot != block.ComputeWitnessRoot() {
+		t.Fatalf("WitnessRoot = %x, want %x", block.Header.WitnessRoot, block.ComputeWitnessRoot())
+	}
+
+	// Another signature keeps the txid but not the witness hash, so the
+	// block hash tells both blocks apart
+	malleated := *block
+	malleated.Transactions = append([]Transaction(nil), block.Transactions...)
+	tx := &malleated.Transactions[1]
+	tx.Inputs = append([]TransactionInput(nil), tx.Inputs...)
+	tx.Inputs[0].Signature = append([]byte{0}, tx.Inputs[0].Signature...)
+	if tx.ComputeHash() != block.Transactions[1].Hash {
+		t.Fatal("ComputeHash() should not commit to signatures")
+	}
+	if tx.WitnessHash() == block.Transactions[1].WitnessHash() {
+		t.Error("WitnessHash() should commit to signatures")
+	}
+	malleated.UpdateHash()
+	if malleated.Header.MerkleRoot != block.Header.MerkleRoot {
+		t.Error("Merkle root should only commit to txids")
+	}
+	if malleated.Hash == block.Hash {
+		t.Error("block hash should change with a signature")
+	}
+}
+
+func TestBlockDecodeLimits(t *testing.T) {
+	block := testBlock(t)
+	block.Transactions[1].Outputs[0].PublicKeyHash = make([]byte, MaxPublicKeyHashLen+1)
+	if err := block.Transactions[1].CheckLimits(); err == nil {
+		t.Error("CheckLimits() should fail for an oversized public key hash")
+	}
+
+	var decoded Block
+	if err := codec.Unmarshal(codec.Marshal(block), &decoded); err == nil {
+		t.Error("Unmarshal() should fail for an oversized public key hash")
+	}
+
+	// Truncated input
+	data := codec.Marshal(testBlock(t))
+	if err := codec.Unmarshal(data[:len(data)-1], &decoded); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Unmarshal() of truncated block error = %v", err)
+	}
+}
+
+func TestDecodeInflatedCounts(t *testing.T) {
+	// Each message claims more elements than its bytes can hold, which must
+	// fail before the elements are allocated
+	const size = 1 << 20
+	encode := func(write func(w *codec.Writer)) []byte {
+		var buf bytes.Buffer
+		write(codec.NewWriter(&buf))
+		return append(buf.Bytes(), make([]byte, size-buf.Len())...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		v    codec.Decoder
+	}{
+		{"transactions", encode(func(w *codec.Writer) {
+			testBlock(t).Header.Encode(w)
+			w.WriteUint64(7)
+			w.WriteVarInt(400_000)
+		}), new(Block)},
+		{"inputs", encode(func(w *codec.Writer) {
+			w.WriteUint32(1)
+			w.WriteVarInt(100_000)
+		}), new(Transaction)},
+		{"outputs", encode(func(w *codec.Writer) {
+			w.WriteUint32(1)
+			w.WriteVarInt(0)
+			w.WriteVarInt(400_000)
+		}), new(Transaction)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			err := codec.Unmarshal(tt.data, tt.v)
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Fatal("Unmarshal() of an inflated count error = nil")
+			}
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/16 {
+				t.Errorf("Unmarshal() allocated %d bytes before failing", alloc)
+			}
+		})
+	}
+}
@@ -1,11 +1,50 @@
 package types
 
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/fkapsahili/mini-blockchain/internal/codec"
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+)
+
+const (
+	// CoinbaseOutputIndex is the output index of a coinbase input
+	CoinbaseOutputIndex = math.MaxUint32
+
+	// MinCoinbaseDataLen and MaxCoinbaseDataLen bound the coinbase data,
+	// which starts with the committed block height
+	MinCoinbaseDataLen = 8
+	MaxCoinbaseDataLen = 100
+
+	// MaxPublicKeyLen, MaxSignatureLen and MaxPublicKeyHashLen bound the
+	// variable length transaction fields. A signature must also fit the
+	// coinbase data it doubles as.
+	MaxPublicKeyLen     = 65
+	MaxSignatureLen     = MaxCoinbaseDataLen
+	MaxPublicKeyHashLen = 32
+
+	// minInputSize, minOutputSize and minTransactionSize are the shortest
+	// encodings of an input, an output and a transaction, bounding the
+	// counts a decoder allocates for
+	minInputSize       = 32 + 4 + 1 + 1
+	minOutputSize      = 8 + 1
+	minTransactionSize = 4 + 1 + 1 + 4
+
+	// sigHashTag separates signature digests from transaction IDs
+	sigHashTag = "mini-blockchain/sighash"
+)
+
 // TransactionInput represents a reference to a previous transaction output
 type TransactionInput struct {
 	PrevTxHash  [32]byte // Hash of the previous transaction
 	OutputIndex uint32
 	PublicKey   []byte
-	Signature   []byte
+	Signature   []byte // Coinbase data for coinbase transactions
 }
 
 // TransactionOutput represents a new output created by a transaction
@@ -22,3 +61,188 @@ type Transaction struct {
 	LockTime uint32 // Earliest time when this transaction can be included
 	Hash     [32]byte
 }
+
+// NewCoinbaseTransaction creates the transaction minting new coins in the
+// block at height. The coinbase data commits to the height, which keeps
+// coinbase hashes unique, followed by an extra nonce for miners.
+func NewCoinbaseTransaction(height, extraNonce uint64, outputs []TransactionOutput) Transaction {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint64(data[:8], height)
+	binary.LittleEndian.PutUint64(data[8:], extraNonce)
+
+	tx := Transaction{
+		Version: 1,
+		Inputs: []TransactionInput{{
+			OutputIndex: CoinbaseOutputIndex,
+			Signature:   data,
+		}},
+		Outputs: outputs,
+	}
+	tx.Hash = tx.ComputeHash()
+	return tx
+}
+
+// ComputeHash calculates the transaction ID. It commits to everything but
+// the input signatures, so re-encoding a signature cannot change the ID.
+// The coinbase data is kept since it makes coinbase IDs unique.
+func (tx *Transaction) ComputeHash() [32]byte {
+	var buf bytes.Buffer
+	tx.encode(codec.NewWriter(&buf), false)
+	return crypto.Hash(buf.Bytes())
+}
+
+// WitnessHash calculates the hash of the full encoding, signatures
+// included, which blocks commit to in their witness root
+func (tx *Transaction) WitnessHash() [32]byte {
+	var buf bytes.Buffer
+	tx.encode(codec.NewWriter(&buf), true)
+	return crypto.Hash(buf.Bytes())
+}
+
+// SigHash calculates the digest the signature of input index signs. It
+// commits to all inputs and outputs and to the position of the input.
+func (tx *Transaction) SigHash(index int) [32]byte {
+	var buf bytes.Buffer
+	buf.WriteString(sigHashTag)
+	w := codec.NewWriter(&buf)
+	tx.encode(w, false)
+	w.WriteUint32(uint32(index))
+	return crypto.Hash(buf.Bytes())
+}
+
+// Sign sets the public key and signature of every input to spend the
+// outputs with key, then updates the transaction ID
+func (tx *Transaction) Sign(key *ecdsa.PrivateKey) error {
+	publicKey := crypto.PublicKeyToBytes(&key.PublicKey)
+	for i := range tx.Inputs {
+		tx.Inputs[i].PublicKey = publicKey
+	}
+
+	for i := range tx.Inputs {
+		sigHash := tx.SigHash(i)
+		signature, err := crypto.Sign(key, sigHash[:])
+		if err != nil {
+			return err
+		}
+		tx.Inputs[i].Signature = signature
+	}
+
+	tx.Hash = tx.ComputeHash()
+	return nil
+}
+
+// SerializeSize returns the length of the encoded transaction
+func (tx *Transaction) SerializeSize() int {
+	return len(codec.Marshal(tx))
+}
+
+// SigOpCount returns the number of signature checks validating the
+// transaction takes, one per input spending an output
+func (tx *Transaction) SigOpCount() int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+	return len(tx.Inputs)
+}
+
+// Encode writes the canonical encoding of the transaction. The hash is
+// not part of it, it is derived from the content.
+func (tx *Transaction) Encode(w *codec.Writer) {
+	tx.encode(w, true)
+}
+
+// encode writes the transaction, leaving out input signatures unless
+// withSignatures is set. The coinbase data is always written.
+func (tx *Transaction) encode(w *codec.Writer, withSignatures bool) {
+	withSignatures = withSignatures || tx.IsCoinbase()
+
+	w.WriteUint32(tx.Version)
+	w.WriteVarInt(uint64(len(tx.Inputs)))
+	for _, input := range tx.Inputs {
+		w.WriteHash(input.PrevTxHash)
+		w.WriteUint32(input.OutputIndex)
+		w.WriteBytes(input.PublicKey)
+		if withSignatures {
+			w.WriteBytes(input.Signature)
+		}
+	}
+
+	w.WriteVarInt(uint64(len(tx.Outputs)))
+	for _, output := range tx.Outputs {
+		w.WriteUint64(output.Amount)
+		w.WriteBytes(output.PublicKeyHash)
+	}
+
+	w.WriteUint32(tx.LockTime)
+}
+
+// Decode reads a transaction written by Encode and computes its hash
+func (tx *Transaction) Decode(r *codec.Reader) {
+	*tx = Transaction{Version: r.ReadUint32()}
+
+	if n := r.ReadCountOf(MaxBlockSize/minInputSize, minInputSize); n > 0 {
+		tx.Inputs = make([]TransactionInput, n)
+	}
+	for i := range tx.Inputs {
+		input := &tx.Inputs[i]
+		input.PrevTxHash = r.ReadHash()
+		input.OutputIndex = r.ReadUint32()
+		input.PublicKey = r.ReadBytes(MaxPublicKeyLen)
+		input.Signature = r.ReadBytes(MaxSignatureLen)
+	}
+
+	if n := r.ReadCountOf(MaxBlockSize/minOutputSize, minOutputSize); n > 0 {
+		tx.Outputs = make([]TransactionOutput, n)
+	}
+	for i := range tx.Outputs {
+		tx.Outputs[i].Amount = r.ReadUint64()
+		tx.Outputs[i].PublicKeyHash = r.ReadBytes(MaxPublicKeyHashLen)
+	}
+
+	tx.LockTime = r.ReadUint32()
+	if r.Err() == nil {
+		tx.Hash = tx.ComputeHash()
+	}
+}
+
+// CheckLimits verifies that the variable length fields fit the limits
+// enforced when decoding, so an accepted transaction can always be read back
+func (tx *Transaction) CheckLimits() error {
+	for _, input := range tx.Inputs {
+		if len(input.PublicKey) > MaxPublicKeyLen {
+			return fmt.Errorf("public key of %d bytes exceeds %d", len(input.PublicKey), MaxPublicKeyLen)
+		}
+		if len(input.Signature) > MaxSignatureLen {
+			return fmt.Errorf("signature of %d bytes exceeds %d", len(input.Signature), MaxSignatureLen)
+		}
+	}
+	for _, output := range tx.Outputs {
+		if len(output.PublicKeyHash) > MaxPublicKeyHashLen {
+			return fmt.Errorf("public key hash of %d bytes exceeds %d", len(output.PublicKeyHash), MaxPublicKeyHashLen)
+		}
+	}
+	return nil
+}
+
+// IsCoinbase reports whether the transaction mints new coins instead of
+// spending previous outputs
+func (tx *Transaction) IsCoinbase() bool {
+	if len(tx.Inputs) != 1 {
+		return false
+	}
+	input := tx.Inputs[0]
+	return input.PrevTxHash == [32]byte{} && input.OutputIndex == CoinbaseOutputIndex
+}
+
+// CoinbaseHeight returns the block height committed in a coinbase
+func (tx *Transaction) CoinbaseHeight() (uint64, error) {
+	if !tx.IsCoinbase() {
+		return 0, errors.New("not a coinbase transaction")
+	}
+
+	data := tx.Inputs[0].Signature
+	if len(data) < MinCoinbaseDataLen {
+		return 0, errors.New("coinbase data too short")
+	}
+	return binary.LittleEndian.Uint64(data[:8]), nil
+}
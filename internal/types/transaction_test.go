@@ -0,0 +1,100 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+)
+
+func signedTransaction(t *testing.T) Transaction {
+	t.Helper()
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	tx := Transaction{
+		Version: 1,
+		Inputs: []TransactionInput{
+			{PrevTxHash: [32]byte{0x01}},
+			{PrevTxHash: [32]byte{0x02}, OutputIndex: 1},
+		},
+		Outputs: []TransactionOutput{{Amount: 5, PublicKeyHash: crypto.HashToAddress(&key.PublicKey)}},
+	}
+	if err := tx.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	return tx
+}
+
+func TestComputeHash(t *testing.T) {
+	tx := signedTransaction(t)
+	if tx.Hash != tx.ComputeHash() {
+		t.Fatalf("Hash = %x, want %x", tx.Hash, tx.ComputeHash())
+	}
+
+	tests := []struct {
+		name     string
+		mutate   func(tx *Transaction)
+		wantSame bool
+	}{
+		{"signature changed", func(tx *Transaction) { tx.Inputs[0].Signature = []byte{0x30, 0x00} }, true},
+		{"signature removed", func(tx *Transaction) { tx.Inputs[1].Signature = nil }, true},
+		{"claimed hash changed", func(tx *Transaction) { tx.Hash = [32]byte{0xff} }, true},
+		{"output amount changed", func(tx *Transaction) { tx.Outputs[0].Amount++ }, false},
+		{"input outpoint changed", func(tx *Transaction) { tx.Inputs[1].OutputIndex = 2 }, false},
+		{"public key changed", func(tx *Transaction) { tx.Inputs[0].PublicKey = []byte{0x04} }, false},
+		{"lock time changed", func(tx *Transaction) { tx.LockTime = 1 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutated := tx
+			mutated.Inputs = append([]TransactionInput{}, tx.Inputs...)
+			mutated.Outputs = append([]TransactionOutput{}, tx.Outputs...)
+			tt.mutate(&mutated)
+			if got := mutated.ComputeHash() == tx.Hash; got != tt.wantSame {
+				t.Errorf("ComputeHash() unchanged = %v, want %v", got, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestSigHash(t *testing.T) {
+	tx := signedTransaction(t)
+
+	if tx.SigHash(0) == tx.SigHash(1) {
+		t.Error("SigHash() should differ between inputs")
+	}
+	if tx.SigHash(0) == tx.ComputeHash() {
+		t.Error("SigHash() should differ from the transaction ID")
+	}
+
+	for i, input := range tx.Inputs {
+		pub, err := crypto.BytesToPublicKey(input.PublicKey)
+		if err != nil {
+			t.Fatalf("BytesToPublicKey() error = %v", err)
+		}
+		sigHash := tx.SigHash(i)
+		if !crypto.Verify(pub, sigHash[:], input.Signature) {
+			t.Errorf("Verify() of input %d = false, want true", i)
+		}
+	}
+
+	// A signature for one input must not verify for another
+	pub, _ := crypto.BytesToPublicKey(tx.Inputs[0].PublicKey)
+	sigHash := tx.SigHash(1)
+	if crypto.Verify(pub, sigHash[:], tx.Inputs[0].Signature) {
+		t.Error("Verify() of a signature moved to another input = true, want false")
+	}
+}
+
+func TestCoinbaseHashCommitsToData(t *testing.T) {
+	a := NewCoinbaseTransaction(1, 0, nil)
+	b := NewCoinbaseTransaction(1, 1, nil)
+	if a.Hash == b.Hash {
+		t.Error("coinbase hashes should differ by extra nonce")
+	}
+	if a.Hash != a.ComputeHash() {
+		t.Errorf("Hash = %x, want %x", a.Hash, a.ComputeHash())
+	}
+}
@@ -0,0 +1,370 @@
+package utxo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// snapshotFile holds the persisted set inside the data directory
+const snapshotFile = "utxo.json"
+
+var (
+	// ErrMissingInput is returned when an input spends an output that does
+	// not exist or is already spent
+	ErrMissingInput = errors.New("input spends missing or spent output")
+
+	// ErrInsufficientInputs is returned when outputs exceed inputs
+	ErrInsufficientInputs = errors.New("outputs exceed inputs")
+
+	// ErrExcessiveCoinbase is returned when a coinbase claims more than the
+	// subsidy plus the fees of the block
+	ErrExcessiveCoinbase = errors.New("coinbase claims more than subsidy plus fees")
+)
+
+// Outpoint identifies a transaction output
+type Outpoint struct {
+	TxHash [32]byte
+	Index  uint32
+}
+
+// String returns the outpoint as txhash:index
+func (o Outpoint) String() string {
+	return fmt.Sprintf("%x:%d", o.TxHash, o.Index)
+}
+
+// Entry is an unspent transaction output
+type Entry struct {
+	Amount        uint64
+	PublicKeyHash []byte
+	Height        uint64 // Height of the block that created the output
+}
+
+// Set tracks the unspent outputs of the best chain as of BestHash
+type Set struct {
+	dataDir  string
+	entries  map[Outpoint]*Entry
+	bestHash [32]byte
+	mu       sync.RWMutex
+}
+
+// snapshot is the persisted form of a set
+type snapshot struct {
+	BestHash [32]byte
+	Entries  []snapshotEntry
+}
+
+type snapshotEntry struct {
+	Outpoint Outpoint
+	Entry    Entry
+}
+
+// Open loads the set persisted in dataDir, or returns an empty set if none
+// was saved yet
+func Open(dataDir string) (*Set, error) {
+	set := &Set{
+		dataDir: dataDir,
+		entries: make(map[Outpoint]*Entry),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dataDir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return set, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read utxo set: %w", err)
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal utxo set: %w", err)
+	}
+
+	set.bestHash = snap.BestHash
+	for _, e := range snap.Entries {
+		entry := e.Entry
+		set.entries[e.Outpoint] = &entry
+	}
+	return set, nil
+}
+
+// BestHash returns the hash of the block the set is current with
+func (s *Set) BestHash() [32]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.bestHash
+}
+
+// Get returns the unspent output at the outpoint, or nil
+func (s *Set) Get(op Outpoint) *Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.entries[op]
+}
+
+// Len returns the number of unspent outputs
+func (s *Set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.entries)
+}
+
+// Reset empties the set, for rebuilding it from the chain
+func (s *Set) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[Outpoint]*Entry)
+	s.bestHash = [32]byte{}
+}
+
+// CheckBlock validates the transactions of a block that would extend the
+// set without applying them. subsidy is the amount the block's coinbase may
+// mint in addition to the fees.
+func (s *Set) CheckBlock(block *types.Block, subsidy uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, _, err := s.connect(block, subsidy)
+	return err
+}
+
+// ConnectBlock validates and applies the transactions of a block that
+// extends the set. It returns the data needed to undo the block again.
+func (s *Set) ConnectBlock(block *types.Block, subsidy uint64) (*BlockUndo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, undo, err := s.connect(block, subsidy)
+	if err != nil {
+		return nil, err
+	}
+
+	for op, entry := range v.changes {
+		if entry == nil {
+			delete(s.entries, op)
+		} else {
+			s.entries[op] = entry
+		}
+	}
+	s.bestHash = block.Hash
+
+	return undo, nil
+}
+
+// connect runs the block's transactions against a view of the set
+func (s *Set) connect(block *types.Block, subsidy uint64) (*view, *BlockUndo, error) {
+	if block.Header.PrevBlockHash != s.bestHash {
+		return nil, nil, errors.New("block does not extend the best block of the utxo set")
+	}
+
+	v := newView(s.entries)
+	undo := &BlockUndo{}
+
+	var fees, minted uint64
+	for i := range block.Transactions {
+		tx := &block.Transactions[i]
+		if i == 0 && tx.IsCoinbase() {
+			sum, err := SumOutputs(tx)
+			if err != nil {
+				return nil, nil, fmt.Errorf("coinbase: %w", err)
+			}
+			minted = sum
+		} else {
+			fee, err := v.spend(tx, undo)
+			if err != nil {
+				return nil, nil, fmt.Errorf("transaction %x: %w", tx.Hash, err)
+			}
+			if fees > math.MaxUint64-fee {
+				return nil, nil, errors.New("block fees overflow")
+			}
+			fees += fee
+		}
+
+		if err := v.addOutputs(tx, block.Height); err != nil {
+			return nil, nil, fmt.Errorf("transaction %x: %w", tx.Hash, err)
+		}
+	}
+
+	if minted > subsidy && minted-subsidy > fees {
+		return nil, nil, fmt.Errorf("%w: %d > %d + %d", ErrExcessiveCoinbase, minted, subsidy, fees)
+	}
+
+	return v, undo, nil
+}
+
+// DisconnectBlock reverts a block that is the set's best block, removing
+// the outputs it created and restoring the ones it spent
+func (s *Set) DisconnectBlock(block *types.Block, undo *BlockUndo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if block.Hash != s.bestHash {
+		return errors.New("block is not the best block of the utxo set")
+	}
+
+	inputs := 0
+	for i := range block.Transactions {
+		inputs += len(spentInputs(block, i))
+	}
+	if inputs != len(undo.Spent) {
+		return fmt.Errorf("undo data has %d spent outputs, block has %d inputs", len(undo.Spent), inputs)
+	}
+
+	// Walk backwards so outputs created and spent within the block cancel out
+	next := len(undo.Spent)
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := &block.Transactions[i]
+		for j := range tx.Outputs {
+			delete(s.entries, Outpoint{TxHash: tx.Hash, Index: uint32(j)})
+		}
+		for range spentInputs(block, i) {
+			next--
+			spent := undo.Spent[next]
+			entry := spent.Entry
+			s.entries[spent.Outpoint] = &entry
+		}
+	}
+	s.bestHash = block.Header.PrevBlockHash
+
+	return nil
+}
+
+// spentInputs returns the inputs of the i-th transaction of the block that
+// spend previous outputs, which is none for the coinbase
+func spentInputs(block *types.Block, i int) []types.TransactionInput {
+	tx := &block.Transactions[i]
+	if i == 0 && tx.IsCoinbase() {
+		return nil
+	}
+	return tx.Inputs
+}
+
+// Flush persists the set to the data directory
+func (s *Set) Flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := snapshot{
+		BestHash: s.bestHash,
+		Entries:  make([]snapshotEntry, 0, len(s.entries)),
+	}
+	for op, entry := range s.entries {
+		snap.Entries = append(snap.Entries, snapshotEntry{Outpoint: op, Entry: *entry})
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal utxo set: %w", err)
+	}
+
+	return storage.WriteFileAtomic(filepath.Join(s.dataDir, snapshotFile), data)
+}
+
+// view stages changes to a set, nil entries mark spent outputs
+type view struct {
+	base    map[Outpoint]*Entry
+	changes map[Outpoint]*Entry
+}
+
+func newView(base map[Outpoint]*Entry) *view {
+	return &view{
+		base:    base,
+		changes: make(map[Outpoint]*Entry),
+	}
+}
+
+// get returns the output as seen through the view
+func (v *view) get(op Outpoint) *Entry {
+	if entry, ok := v.changes[op]; ok {
+		return entry
+	}
+	return v.base[op]
+}
+
+// spend checks the transaction's inputs and marks them spent, recording the
+// spent outputs in undo. It returns the fee the transaction pays.
+func (v *view) spend(tx *types.Transaction, undo *BlockUndo) (uint64, error) {
+	var inputSum uint64
+	for _, input := range tx.Inputs {
+		op := Outpoint{TxHash: input.PrevTxHash, Index: input.OutputIndex}
+		entry := v.get(op)
+		if entry == nil {
+			return 0, fmt.Errorf("%w: %s", ErrMissingInput, op)
+		}
+
+		if err := CheckOwner(input.PublicKey, entry.PublicKeyHash); err != nil {
+			return 0, fmt.Errorf("input %s: %w", op, err)
+		}
+
+		if inputSum > math.MaxUint64-entry.Amount {
+			return 0, errors.New("input amounts overflow")
+		}
+		inputSum += entry.Amount
+
+		undo.Spent = append(undo.Spent, SpentOutput{Outpoint: op, Entry: *entry})
+		v.changes[op] = nil
+	}
+
+	outputSum, err := SumOutputs(tx)
+	if err != nil {
+		return 0, err
+	}
+	if outputSum > inputSum {
+		return 0, fmt.Errorf("%w: %d > %d", ErrInsufficientInputs, outputSum, inputSum)
+	}
+
+	return inputSum - outputSum, nil
+}
+
+// addOutputs adds the transaction's outputs to the view
+func (v *view) addOutputs(tx *types.Transaction, height uint64) error {
+	for i, output := range tx.Outputs {
+		op := Outpoint{TxHash: tx.Hash, Index: uint32(i)}
+		if v.get(op) != nil {
+			return fmt.Errorf("output %s already exists", op)
+		}
+		v.changes[op] = &Entry{
+			Amount:        output.Amount,
+			PublicKeyHash: output.PublicKeyHash,
+			Height:        height,
+		}
+	}
+	return nil
+}
+
+// SumOutputs returns the total amount of the transaction's outputs
+func SumOutputs(tx *types.Transaction) (uint64, error) {
+	var sum uint64
+	for _, output := range tx.Outputs {
+		if sum > math.MaxUint64-output.Amount {
+			return 0, errors.New("output amounts overflow")
+		}
+		sum += output.Amount
+	}
+	return sum, nil
+}
+
+// CheckOwner verifies the spending public key hashes to the output's address
+func CheckOwner(publicKey, publicKeyHash []byte) error {
+	// Parsing rejects keys that aren't points on the curve
+	if _, err := crypto.BytesToPublicKey(publicKey); err != nil {
+		return err
+	}
+	if !bytes.Equal(crypto.BytesToAddress(publicKey), publicKeyHash) {
+		return errors.New("public key does not match output address")
+	}
+	return nil
+}
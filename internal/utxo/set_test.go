@@ -0,0 +1,219 @@
+package utxo
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"testing"
+
+	"github.com/fkapsahili/mini-blockchain/internal/crypto"
+	"github.com/fkapsahili/mini-blockchain/internal/types"
+)
+
+// testKey returns a fresh key and its address
+func testKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	return key, crypto.HashToAddress(&key.PublicKey)
+}
+
+// spend returns a transaction with the given hash spending the outpoints
+// with key and paying amounts to address
+func spend(key *ecdsa.PrivateKey, hash byte, address []byte, amounts []uint64, ops ...Outpoint) types.Transaction {
+	tx := types.Transaction{Version: 1, Hash: [32]byte{hash}}
+	for _, op := range ops {
+		tx.Inputs = append(tx.Inputs, types.TransactionInput{
+			PrevTxHash:  op.TxHash,
+			OutputIndex: op.Index,
+			PublicKey:   crypto.PublicKeyToBytes(&key.PublicKey),
+		})
+	}
+	for _, amount := range amounts {
+		tx.Outputs = append(tx.Outputs, types.TransactionOutput{Amount: amount, PublicKeyHash: address})
+	}
+	return tx
+}
+
+// fundedSet returns a set with one output of 100 paying to address
+func fundedSet(t *testing.T, address []byte) (*Set, Outpoint) {
+	t.Helper()
+
+	set, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	funding := Outpoint{TxHash: [32]byte{0xff}, Index: 0}
+	set.entries[funding] = &Entry{Amount: 100, PublicKeyHash: address, Height: 0}
+	return set, funding
+}
+
+func TestConnectAndDisconnectBlock(t *testing.T) {
+	key, address := testKey(t)
+	set, funding := fundedSet(t, address)
+
+	// The second transaction spends an output of the first within the block
+	first := spend(key, 1, address, []uint64{60, 30}, funding)
+	second := spend(key, 2, address, []uint64{50}, Outpoint{TxHash: first.Hash, Index: 0})
+	block := &types.Block{
+		Hash:         [32]byte{0xaa},
+		Height:       1,
+		Transactions: []types.Transaction{first, second},
+	}
+
+	undo, err := set.ConnectBlock(block, 0)
+	if err != nil {
+		t.Fatalf("ConnectBlock() error = %v", err)
+	}
+	if len(undo.Spent) != 2 {
+		t.Errorf("len(undo.Spent) = %d, want 2", len(undo.Spent))
+	}
+
+	if set.Get(funding) != nil {
+		t.Error("Funding output should be spent")
+	}
+	if set.Get(Outpoint{TxHash: first.Hash, Index: 0}) != nil {
+		t.Error("Output spent within the block should be gone")
+	}
+	if entry := set.Get(Outpoint{TxHash: first.Hash, Index: 1}); entry == nil || entry.Amount != 30 || entry.Height != 1 {
+		t.Errorf("Unspent output = %+v, want amount 30 at height 1", entry)
+	}
+	if set.BestHash() != block.Hash {
+		t.Errorf("BestHash() = %x, want %x", set.BestHash(), block.Hash)
+	}
+
+	if err := set.DisconnectBlock(block, undo); err != nil {
+		t.Fatalf("DisconnectBlock() error = %v", err)
+	}
+	if set.Len() != 1 || set.Get(funding) == nil {
+		t.Errorf("After disconnect the set holds %d outputs, want only the funding output", set.Len())
+	}
+	if set.BestHash() != block.Header.PrevBlockHash {
+		t.Errorf("BestHash() = %x, want %x", set.BestHash(), block.Header.PrevBlockHash)
+	}
+}
+
+func TestConnectBlockRejects(t *testing.T) {
+	key, address := testKey(t)
+	otherKey, _ := testKey(t)
+	missing := Outpoint{TxHash: [32]byte{0xee}, Index: 0}
+
+	tests := []struct {
+		name    string
+		txs     func(funding Outpoint) []types.Transaction
+		wantErr error
+	}{
+		{
+			name: "missing input",
+			txs: func(Outpoint) []types.Transaction {
+				return []types.Transaction{spend(key, 1, address, []uint64{1}, missing)}
+			},
+			wantErr: ErrMissingInput,
+		},
+		{
+			name: "double spend within block",
+			txs: func(funding Outpoint) []types.Transaction {
+				return []types.Transaction{
+					spend(key, 1, address, []uint64{1}, funding),
+					spend(key, 2, address, []uint64{1}, funding),
+				}
+			},
+			wantErr: ErrMissingInput,
+		},
+		{
+			name: "outputs exceed inputs",
+			txs: func(funding Outpoint) []types.Transaction {
+				return []types.Transaction{spend(key, 1, address, []uint64{101}, funding)}
+			},
+			wantErr: ErrInsufficientInputs,
+		},
+		{
+			name: "outputs without inputs",
+			txs: func(Outpoint) []types.Transaction {
+				return []types.Transaction{spend(key, 1, address, []uint64{1})}
+			},
+			wantErr: ErrInsufficientInputs,
+		},
+		{
+			name: "coinbase claims more than the fees",
+			txs: func(funding Outpoint) []types.Transaction {
+				return []types.Transaction{
+					types.NewCoinbaseTransaction(1, 0, []types.TransactionOutput{{Amount: 11, PublicKeyHash: address}}),
+					spend(key, 1, address, []uint64{90}, funding),
+				}
+			},
+			wantErr: ErrExcessiveCoinbase,
+		},
+		{
+			name: "wrong owner",
+			txs: func(funding Outpoint) []types.Transaction {
+				return []types.Transaction{spend(otherKey, 1, address, []uint64{1}, funding)}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, funding := fundedSet(t, address)
+			block := &types.Block{Hash: [32]byte{0xaa}, Height: 1, Transactions: tt.txs(funding)}
+
+			if err := set.CheckBlock(block, 0); err == nil {
+				t.Error("CheckBlock() should fail")
+			}
+
+			_, err := set.ConnectBlock(block, 0)
+			if err == nil {
+				t.Fatal("ConnectBlock() should fail")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("ConnectBlock() error = %v, want %v", err, tt.wantErr)
+			}
+			if set.Len() != 1 || set.Get(funding) == nil {
+				t.Error("A failed block must leave the set unchanged")
+			}
+		})
+	}
+}
+
+func TestFlushAndUndoPersistence(t *testing.T) {
+	key, address := testKey(t)
+	set, funding := fundedSet(t, address)
+
+	block := &types.Block{
+		Hash:         [32]byte{0xaa},
+		Height:       1,
+		Transactions: []types.Transaction{spend(key, 1, address, []uint64{40, 60}, funding)},
+	}
+	undo, err := set.ConnectBlock(block, 0)
+	if err != nil {
+		t.Fatalf("ConnectBlock() error = %v", err)
+	}
+	if err := set.SaveUndo(block.Hash, undo); err != nil {
+		t.Fatalf("SaveUndo() error = %v", err)
+	}
+	if err := set.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	reopened, err := Open(set.dataDir)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if reopened.Len() != 2 || reopened.BestHash() != block.Hash {
+		t.Fatalf("Reopened set has %d outputs at %x, want 2 at %x", reopened.Len(), reopened.BestHash(), block.Hash)
+	}
+
+	loaded, err := reopened.LoadUndo(block.Hash)
+	if err != nil {
+		t.Fatalf("LoadUndo() error = %v", err)
+	}
+	if err := reopened.DisconnectBlock(block, loaded); err != nil {
+		t.Fatalf("DisconnectBlock() error = %v", err)
+	}
+	if entry := reopened.Get(funding); entry == nil || entry.Amount != 100 {
+		t.Errorf("Restored funding output = %+v, want amount 100", entry)
+	}
+}
@@ -0,0 +1,52 @@
+package utxo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fkapsahili/mini-blockchain/internal/storage"
+)
+
+// SpentOutput records an output spent by a block
+type SpentOutput struct {
+	Outpoint Outpoint
+	Entry    Entry
+}
+
+// BlockUndo holds the outputs a block spent, in spending order, so the
+// block can be disconnected again
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+// undoPath returns the file path of the undo data for a block
+func (s *Set) undoPath(hash [32]byte) string {
+	return filepath.Join(s.dataDir, "undo_"+hex.EncodeToString(hash[:])+".json")
+}
+
+// SaveUndo persists the undo data of a block
+func (s *Set) SaveUndo(hash [32]byte, undo *BlockUndo) error {
+	data, err := json.Marshal(undo)
+	if err != nil {
+		return fmt.Errorf("failed to marshal undo data: %w", err)
+	}
+
+	return storage.WriteFileAtomic(s.undoPath(hash), data)
+}
+
+// LoadUndo reads the undo data of a block
+func (s *Set) LoadUndo(hash [32]byte) (*BlockUndo, error) {
+	data, err := os.ReadFile(s.undoPath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read undo data: %w", err)
+	}
+
+	var undo BlockUndo
+	if err := json.Unmarshal(data, &undo); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal undo data: %w", err)
+	}
+	return &undo, nil
+}